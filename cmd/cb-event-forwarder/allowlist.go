@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// fields an allowlist of each type is checked against unless fields= is configured
+var allowlistDefaultFields = map[string][]string{
+	"hash": {"md5"},
+	"path": {"process_path"},
+	"cidr": {"remote_ip"},
+}
+
+// Allowlist is one [allowlist:<name>] section: a file of trusted md5/sha256 hashes, process path globs or CIDR
+// ranges. Events of the matching types whose value in one of Fields is on the list are dropped.
+type Allowlist struct {
+	Name           string
+	Type           string
+	File           string
+	Fields         []string
+	EventTypes     []string
+	ReloadInterval time.Duration
+
+	sync.RWMutex
+	hashes   map[string]bool
+	paths    []*regexp.Regexp
+	networks []*net.IPNet
+	entries  int
+	modTime  time.Time
+	loadedAt time.Time
+	lastErr  string
+
+	suppressed int64
+	// suppressed events by the field that matched; built by load, so only read after the first load
+	suppressedByField map[string]*int64
+}
+
+type AllowlistStatistics struct {
+	Type              string           `json:"type"`
+	File              string           `json:"file"`
+	Entries           int              `json:"entries"`
+	Suppressed        int64            `json:"suppressed"`
+	SuppressedByField map[string]int64 `json:"suppressed_by_field"`
+	LastLoaded        time.Time        `json:"last_loaded"`
+	LastError         string           `json:"last_error"`
+}
+
+// load reads the list file and replaces the current entries. On error the previous entries are kept.
+func (a *Allowlist) load() error {
+	err := a.read()
+
+	a.Lock()
+	defer a.Unlock()
+	if a.suppressedByField == nil {
+		a.suppressedByField = make(map[string]*int64, len(a.Fields))
+		for _, field := range a.Fields {
+			a.suppressedByField[field] = new(int64)
+		}
+	}
+	if err != nil {
+		a.lastErr = err.Error()
+		// don't retry a broken file until it is modified again
+		if info, statErr := os.Stat(a.File); statErr == nil {
+			a.modTime = info.ModTime()
+		}
+	} else {
+		a.lastErr = ""
+	}
+	return err
+}
+
+func (a *Allowlist) read() error {
+	f, err := os.Open(a.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	hashes := make(map[string]bool)
+	var paths []*regexp.Regexp
+	var networks []*net.IPNet
+	entries := 0
+
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		switch a.Type {
+		case "hash":
+			// allow "<hash> <comment>" lines, as written by md5sum and sha256sum
+			line = strings.ToLower(strings.Fields(line)[0])
+			if !isHexHash(line) {
+				return fmt.Errorf("%s line %d: %q is not an md5 or sha256 hash", a.File, lineNumber, line)
+			}
+			hashes[line] = true
+		case "path":
+			re, err := compilePathGlob(line)
+			if err != nil {
+				return fmt.Errorf("%s line %d: %s", a.File, lineNumber, err)
+			}
+			paths = append(paths, re)
+		case "cidr":
+			network, err := parseCIDROrIP(line)
+			if err != nil {
+				return fmt.Errorf("%s line %d: %s", a.File, lineNumber, err)
+			}
+			networks = append(networks, network)
+		}
+		entries++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.Lock()
+	a.hashes, a.paths, a.networks, a.entries = hashes, paths, networks, entries
+	a.modTime = info.ModTime()
+	a.loadedAt = time.Now()
+	a.Unlock()
+	return nil
+}
+
+// changed reports whether the list file was modified since it was last loaded.
+func (a *Allowlist) changed() bool {
+	info, err := os.Stat(a.File)
+	if err != nil {
+		return false
+	}
+	a.RLock()
+	defer a.RUnlock()
+	return !info.ModTime().Equal(a.modTime)
+}
+
+// match returns the first of the list's fields whose value in msg is on the list.
+func (a *Allowlist) match(msg map[string]interface{}) (string, bool) {
+	a.RLock()
+	defer a.RUnlock()
+
+	for _, field := range a.Fields {
+		v, ok := getFieldPath(msg, field)
+		if !ok {
+			continue
+		}
+		s, ok := v.(string)
+		if !ok || s == "" {
+			continue
+		}
+
+		switch a.Type {
+		case "hash":
+			if a.hashes[strings.ToLower(s)] {
+				return field, true
+			}
+		case "path":
+			for _, re := range a.paths {
+				if re.MatchString(s) {
+					return field, true
+				}
+			}
+		case "cidr":
+			ip := net.ParseIP(s)
+			if ip == nil {
+				continue
+			}
+			for _, network := range a.networks {
+				if network.Contains(ip) {
+					return field, true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+func (a *Allowlist) statistics() AllowlistStatistics {
+	a.RLock()
+	defer a.RUnlock()
+
+	stats := AllowlistStatistics{
+		Type:              a.Type,
+		File:              a.File,
+		Entries:           a.entries,
+		Suppressed:        atomic.LoadInt64(&a.suppressed),
+		SuppressedByField: make(map[string]int64, len(a.suppressedByField)),
+		LastLoaded:        a.loadedAt,
+		LastError:         a.lastErr,
+	}
+	for field, n := range a.suppressedByField {
+		stats.SuppressedByField[field] = atomic.LoadInt64(n)
+	}
+	return stats
+}
+
+func isHexHash(s string) bool {
+	if len(s) != 32 && len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// compilePathGlob converts a process path glob to a case-insensitive regular expression. * matches any characters
+// within one directory, ** matches any characters including directory separators and ? matches one character. / and
+// \ are interchangeable, so c:\windows\system32\* and c:/windows/system32/* are the same pattern.
+func compilePathGlob(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("(?i)^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString(`[^\\/]*`)
+			}
+		case '?':
+			b.WriteString(`[^\\/]`)
+		case '\\', '/':
+			b.WriteString(`[\\/]`)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// parseCIDROrIP parses a CIDR range, or a single address as a range of one.
+func parseCIDROrIP(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		return network, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP address or CIDR range", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// Allowlister drops events matching any of the configured allowlists. It runs before enrichment, so suppressed
+// events never cost a Cb Response API call.
+type Allowlister struct {
+	lists []*Allowlist
+}
+
+// NewAllowlister loads every list; a list that cannot be loaded at startup is a fatal error.
+func NewAllowlister(lists []*Allowlist) (*Allowlister, error) {
+	for _, list := range lists {
+		if err := list.load(); err != nil {
+			return nil, fmt.Errorf("could not load allowlist %s: %s", list.Name, err)
+		}
+		log.Infof("Loaded %d entries from allowlist %s (%s)", list.statistics().Entries, list.Name, list.File)
+	}
+	return &Allowlister{lists: lists}, nil
+}
+
+func (a *Allowlister) Name() string {
+	return "allowlist"
+}
+
+func (a *Allowlister) Process(msg map[string]interface{}) bool {
+	for _, list := range a.lists {
+		if !matchAnyRoutingKey(list.EventTypes, msg) {
+			continue
+		}
+		if field, ok := list.match(msg); ok {
+			atomic.AddInt64(&list.suppressed, 1)
+			atomic.AddInt64(list.suppressedByField[field], 1)
+			return false
+		}
+	}
+	return true
+}
+
+func (a *Allowlister) Statistics() interface{} {
+	stats := make(map[string]AllowlistStatistics, len(a.lists))
+	for _, list := range a.lists {
+		stats[list.Name] = list.statistics()
+	}
+	return stats
+}
+
+// Start reloads each list when its file changes, checked every reload_interval, and every list on SIGHUP.
+func (a *Allowlister) Start() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for _, list := range a.lists {
+		if list.ReloadInterval <= 0 {
+			continue
+		}
+		go func(list *Allowlist) {
+			ticker := time.NewTicker(list.ReloadInterval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ticker.C:
+					if list.changed() {
+						a.reload(list)
+					}
+				case <-shutdownRequested:
+					return
+				}
+			}
+		}(list)
+	}
+
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+				log.Info("Received SIGHUP, reloading allowlists.")
+				for _, list := range a.lists {
+					a.reload(list)
+				}
+			case <-shutdownRequested:
+				return
+			}
+		}
+	}()
+}
+
+func (a *Allowlister) reload(list *Allowlist) {
+	if err := list.load(); err != nil {
+		log.Errorf("Could not reload allowlist %s; keeping the previous entries: %s", list.Name, err)
+		return
+	}
+	log.Infof("Reloaded %d entries from allowlist %s (%s)", list.statistics().Entries, list.Name, list.File)
+}
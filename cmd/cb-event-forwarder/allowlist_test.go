@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func writeAllowlistFile(t *testing.T, dir, name, contents string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAllowlister(t *testing.T) {
+	dir, err := ioutil.TempDir("", "allowlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hashes := &Allowlist{
+		Name: "signed",
+		Type: "hash",
+		File: writeAllowlistFile(t, dir, "hashes.txt", `# trusted binaries
+5746BD7E255DD6A8AFA06F7C42C1BA41  ntdll.dll
+e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855
+`),
+		Fields:     []string{"md5", "parent_md5"},
+		EventTypes: []string{"ingress.event.#"},
+	}
+	paths := &Allowlist{
+		Name: "system",
+		Type: "path",
+		File: writeAllowlistFile(t, dir, "paths.txt", `c:\windows\system32\*.exe
+c:/program files/**/updater?.exe
+`),
+		Fields:     []string{"process_path"},
+		EventTypes: []string{"ingress.event.moduleload", "ingress.event.filemod"},
+	}
+	networks := &Allowlist{
+		Name:       "internal",
+		Type:       "cidr",
+		File:       writeAllowlistFile(t, dir, "networks.txt", "10.0.0.0/8\n192.168.1.1\nfd00::/8\n"),
+		Fields:     []string{"remote_ip"},
+		EventTypes: []string{"ingress.event.netconn"},
+	}
+
+	a, err := NewAllowlister([]*Allowlist{hashes, paths, networks})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		msg      map[string]interface{}
+		expected bool
+	}{
+		{map[string]interface{}{"type": "ingress.event.moduleload", "md5": "5746bd7e255dd6a8afa06f7c42c1ba41"}, false},
+		{map[string]interface{}{"type": "ingress.event.procstart", "md5": "00000000000000000000000000000000",
+			"parent_md5": "5746BD7E255DD6A8AFA06F7C42C1BA41"}, false},
+		{map[string]interface{}{"type": "watchlist.hit.process", "md5": "5746BD7E255DD6A8AFA06F7C42C1BA41"}, true},
+		{map[string]interface{}{"type": "ingress.event.moduleload", "md5": "00000000000000000000000000000000",
+			"process_path": `C:\Windows\System32\svchost.exe`}, false},
+		{map[string]interface{}{"type": "ingress.event.moduleload",
+			"process_path": `c:\windows\system32\drivers\evil.exe`}, true},
+		{map[string]interface{}{"type": "ingress.event.filemod",
+			"process_path": `C:\Program Files\Vendor\bin\updater2.exe`}, false},
+		{map[string]interface{}{"type": "ingress.event.regmod",
+			"process_path": `C:\Windows\System32\svchost.exe`}, true},
+		{map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "10.1.2.3"}, false},
+		{map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "192.168.1.1"}, false},
+		{map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "192.168.1.2"}, true},
+		{map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "fd12::1"}, false},
+		{map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "not an ip"}, true},
+	} {
+		if got := a.Process(test.msg); got != test.expected {
+			t.Errorf("Process(%v) = %t, expected %t", test.msg, got, test.expected)
+		}
+	}
+
+	suppressed := func() map[string]map[string]int64 {
+		counts := make(map[string]map[string]int64)
+		for name, stats := range a.Statistics().(map[string]AllowlistStatistics) {
+			counts[name] = stats.SuppressedByField
+		}
+		return counts
+	}
+	expected := map[string]map[string]int64{
+		"signed":   {"md5": 1, "parent_md5": 1},
+		"system":   {"process_path": 2},
+		"internal": {"remote_ip": 3},
+	}
+	if diff := cmp.Diff(expected, suppressed()); diff != "" {
+		t.Errorf("suppression counts mismatch (-want +got):\n%s", diff)
+	}
+
+	// a modified file is reloaded; a broken one keeps the previous entries
+	later := time.Now().Add(time.Minute)
+	writeAllowlistFile(t, dir, "networks.txt", "172.16.0.0/12\n")
+	os.Chtimes(networks.File, later, later)
+	if !networks.changed() {
+		t.Fatal("expected the modified file to be detected")
+	}
+	a.reload(networks)
+	if a.Process(map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "10.1.2.3"}) != true ||
+		a.Process(map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "172.20.0.1"}) != false {
+		t.Error("reloaded list was not applied")
+	}
+
+	writeAllowlistFile(t, dir, "networks.txt", "300.0.0.0/8\n")
+	os.Chtimes(networks.File, later.Add(time.Minute), later.Add(time.Minute))
+	a.reload(networks)
+	stats := a.Statistics().(map[string]AllowlistStatistics)["internal"]
+	if stats.Entries != 1 || stats.LastError == "" {
+		t.Errorf("expected the previous entries and an error to be kept, got %+v", stats)
+	}
+	if networks.changed() {
+		t.Error("a broken file should not be retried until it is modified again")
+	}
+}
+
+func TestCompilePathGlob(t *testing.T) {
+	for _, test := range []struct {
+		glob     string
+		path     string
+		expected bool
+	}{
+		{`c:\windows\system32\*`, `C:\WINDOWS\System32\cmd.exe`, true},
+		{`c:\windows\system32\*`, `C:\Windows\System32\drivers\etc\hosts`, false},
+		{`c:\windows\**`, `C:\Windows\System32\drivers\etc\hosts`, true},
+		{`/usr/bin/?ython3`, `/usr/bin/python3`, true},
+		{`/usr/bin/?ython3`, `/usr/bin/cpython3`, false},
+		{`c:\program files (x86)\*.exe`, `c:\program files (x86)\app.exe`, true},
+	} {
+		re, err := compilePathGlob(test.glob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := re.MatchString(test.path); got != test.expected {
+			t.Errorf("%s matching %s: got %t, expected %t", test.glob, test.path, got, test.expected)
+		}
+	}
+}
+
+func TestNewAllowlisterErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "allowlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, list := range []*Allowlist{
+		{Name: "missing", Type: "hash", File: filepath.Join(dir, "missing.txt"), Fields: []string{"md5"}},
+		{Name: "hash", Type: "hash", File: writeAllowlistFile(t, dir, "bad_hash.txt", "notahash\n"),
+			Fields: []string{"md5"}},
+		{Name: "cidr", Type: "cidr", File: writeAllowlistFile(t, dir, "bad_cidr.txt", "10.0.0.0/33\n"),
+			Fields: []string{"remote_ip"}},
+	} {
+		if _, err := NewAllowlister([]*Allowlist{list}); err == nil {
+			t.Errorf("expected an error loading %s", list.Name)
+		}
+	}
+}
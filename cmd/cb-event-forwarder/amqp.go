@@ -107,6 +107,15 @@ func NewConsumer(amqpURI, queueName, ctag string, bindToRawExchange bool,
 	return c, deliveries, nil
 }
 
+// Cancel stops the broker from sending further deliveries to this consumer. Deliveries that have already been
+// received are still handed out, and the deliveries channel is closed once they have all been consumed.
+func (c *Consumer) Cancel() error {
+	if err := c.channel.Cancel(c.tag, false); err != nil {
+		return fmt.Errorf("Consumer cancel failed: %s", err)
+	}
+	return nil
+}
+
 func (c *Consumer) Shutdown() error {
 	if err := c.channel.Cancel(c.tag, true); err != nil {
 		return fmt.Errorf("Consumer cancel failed: %s", err)
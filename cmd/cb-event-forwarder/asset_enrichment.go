@@ -0,0 +1,474 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// An Asset is a row of the assets file: the owner, criticality and business unit of a host, identified by its
+// sensor id, its hostname, or both.
+type Asset struct {
+	Hostname     string
+	SensorID     int
+	Owner        string
+	Criticality  string
+	BusinessUnit string
+}
+
+type assetZone struct {
+	network *net.IPNet
+	zone    string
+}
+
+// assetFile is the state of one of the lookup files, guarded by the AssetEnricher's lock.
+type assetFile struct {
+	File     string
+	modTime  time.Time
+	loadedAt time.Time
+	entries  int
+	lastErr  string
+}
+
+type AssetFileStatistics struct {
+	File       string    `json:"file"`
+	Entries    int       `json:"entries"`
+	LastLoaded time.Time `json:"last_loaded"`
+	LastError  string    `json:"last_error"`
+}
+
+type AssetStatistics struct {
+	Evaluated     int64                          `json:"evaluated"`
+	ZoneMatches   int64                          `json:"zone_matches"`
+	AssetMatches  int64                          `json:"asset_matches"`
+	UnknownAssets int64                          `json:"unknown_assets"`
+	Files         map[string]AssetFileStatistics `json:"files"`
+}
+
+// The AssetEnricher adds the network zone of remote_ip and local_ip (remote_ip_zone, local_ip_zone), whether the
+// remote address is internal (is_internal), and the owner, criticality and business unit of the reporting host
+// (asset_owner, asset_criticality, asset_business_unit). Zones come from a CSV file of CIDR ranges, and assets from a
+// CSV file keyed by sensor id or hostname; both are reloaded when they change on disk.
+type AssetEnricher struct {
+	zonesFile      *assetFile
+	assetsFile     *assetFile
+	eventTypes     []string
+	reloadInterval time.Duration
+
+	sync.RWMutex
+	// most specific network first
+	zones    []assetZone
+	bySensor map[int]*Asset
+	byHost   map[string]*Asset
+
+	evaluated     int64
+	zoneMatches   int64
+	assetMatches  int64
+	unknownAssets int64
+}
+
+// NewAssetEnricher loads the zones and assets files; either may be empty, but not both. A file that cannot be loaded
+// at startup is an error.
+func NewAssetEnricher(zonesFile, assetsFile string, eventTypes []string,
+	reloadInterval time.Duration) (*AssetEnricher, error) {
+	e := &AssetEnricher{eventTypes: eventTypes, reloadInterval: reloadInterval}
+	if zonesFile != "" {
+		e.zonesFile = &assetFile{File: zonesFile}
+		if err := e.loadZones(); err != nil {
+			return nil, fmt.Errorf("could not load zones file %s: %s", zonesFile, err)
+		}
+		log.Infof("Loaded %d network zones from %s", e.zonesFile.entries, zonesFile)
+	}
+	if assetsFile != "" {
+		e.assetsFile = &assetFile{File: assetsFile}
+		if err := e.loadAssets(); err != nil {
+			return nil, fmt.Errorf("could not load assets file %s: %s", assetsFile, err)
+		}
+		log.Infof("Loaded %d assets from %s", e.assetsFile.entries, assetsFile)
+	}
+	return e, nil
+}
+
+// readAssetFile reads f if it can be stat'd, calling apply with its contents. On failure, the modification time is
+// still recorded, so a broken file is not retried until it changes again.
+func (e *AssetEnricher) readAssetFile(f *assetFile, apply func(data []byte) (int, error)) error {
+	info, err := os.Stat(f.File)
+	if err != nil {
+		e.Lock()
+		f.lastErr = err.Error()
+		e.Unlock()
+		return err
+	}
+
+	var entries int
+	data, err := ioutil.ReadFile(f.File)
+	if err == nil {
+		entries, err = apply(data)
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	f.modTime = info.ModTime()
+	if err != nil {
+		f.lastErr = err.Error()
+		return err
+	}
+	f.entries = entries
+	f.loadedAt = time.Now()
+	f.lastErr = ""
+	return nil
+}
+
+func (e *AssetEnricher) loadZones() error {
+	return e.readAssetFile(e.zonesFile, func(data []byte) (int, error) {
+		zones, err := parseZonesCSV(data)
+		if err != nil {
+			return 0, err
+		}
+		e.Lock()
+		e.zones = zones
+		e.Unlock()
+		return len(zones), nil
+	})
+}
+
+func (e *AssetEnricher) loadAssets() error {
+	return e.readAssetFile(e.assetsFile, func(data []byte) (int, error) {
+		assets, err := parseAssetsCSV(data)
+		if err != nil {
+			return 0, err
+		}
+		bySensor := make(map[int]*Asset)
+		byHost := make(map[string]*Asset)
+		for _, asset := range assets {
+			if asset.SensorID != 0 {
+				bySensor[asset.SensorID] = asset
+			}
+			if asset.Hostname != "" {
+				byHost[asset.Hostname] = asset
+			}
+		}
+		// short names match events from hosts listed by their fully qualified names, unless listed separately
+		for _, asset := range assets {
+			if short := shortHostname(asset.Hostname); short != asset.Hostname {
+				if _, ok := byHost[short]; !ok {
+					byHost[short] = asset
+				}
+			}
+		}
+
+		e.Lock()
+		e.bySensor = bySensor
+		e.byHost = byHost
+		e.Unlock()
+		return len(assets), nil
+	})
+}
+
+func shortHostname(hostname string) string {
+	if i := strings.Index(hostname, "."); i > 0 {
+		return hostname[:i]
+	}
+	return hostname
+}
+
+// csvColumns reads the header row of r and returns a function that gets the named column of a record.
+func csvColumns(r *csv.Reader) (map[string]int, func(record []string, names ...string) string, error) {
+	header, err := r.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read the header row: %s", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	column := func(record []string, names ...string) string {
+		for _, name := range names {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+		}
+		return ""
+	}
+	return columns, column, nil
+}
+
+func newAssetCSVReader(data []byte) *csv.Reader {
+	r := csv.NewReader(strings.NewReader(string(data)))
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	return r
+}
+
+// parseZonesCSV parses a zones file: a header row naming a cidr (or network) and a zone column, then one range per
+// row. The zones are returned most specific first, so that a host range can be carved out of a wider zone.
+func parseZonesCSV(data []byte) ([]assetZone, error) {
+	r := newAssetCSVReader(data)
+	columns, column, err := csvColumns(r)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := columns["zone"]; !ok {
+		return nil, errors.New("the header row has no zone column")
+	}
+	if _, ok := columns["cidr"]; !ok {
+		if _, ok := columns["network"]; !ok {
+			return nil, errors.New("the header row has no cidr or network column")
+		}
+	}
+
+	var zones []assetZone
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		cidr, zone := column(record, "cidr", "network"), column(record, "zone")
+		if cidr == "" {
+			continue
+		}
+		network, err := parseCIDROrIP(cidr)
+		if err != nil {
+			return nil, err
+		}
+		if zone == "" {
+			return nil, fmt.Errorf("%s has no zone", cidr)
+		}
+		zones = append(zones, assetZone{network: network, zone: zone})
+	}
+
+	sort.SliceStable(zones, func(i, j int) bool {
+		iOnes, iBits := zones[i].network.Mask.Size()
+		jOnes, jBits := zones[j].network.Mask.Size()
+		return iBits-iOnes < jBits-jOnes
+	})
+	return zones, nil
+}
+
+// parseAssetsCSV parses an assets file: a header row naming a hostname (or computer_name) column, a sensor_id column
+// or both, and optionally owner, criticality and business_unit columns.
+func parseAssetsCSV(data []byte) ([]*Asset, error) {
+	r := newAssetCSVReader(data)
+	columns, column, err := csvColumns(r)
+	if err != nil {
+		return nil, err
+	}
+	_, hasHostname := columns["hostname"]
+	_, hasComputerName := columns["computer_name"]
+	_, hasSensorID := columns["sensor_id"]
+	if !hasHostname && !hasComputerName && !hasSensorID {
+		return nil, errors.New("the header row has no hostname, computer_name or sensor_id column")
+	}
+
+	var assets []*Asset
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		asset := &Asset{
+			Hostname:     strings.ToLower(column(record, "hostname", "computer_name")),
+			Owner:        column(record, "owner"),
+			Criticality:  column(record, "criticality"),
+			BusinessUnit: column(record, "business_unit"),
+		}
+		if sensorID := column(record, "sensor_id"); sensorID != "" {
+			if asset.SensorID, err = strconv.Atoi(sensorID); err != nil || asset.SensorID <= 0 {
+				return nil, fmt.Errorf("invalid sensor_id %s", sensorID)
+			}
+		}
+		if asset.Hostname == "" && asset.SensorID == 0 {
+			continue
+		}
+		assets = append(assets, asset)
+	}
+	return assets, nil
+}
+
+func (e *AssetEnricher) Name() string {
+	return "assets"
+}
+
+func (e *AssetEnricher) Process(msg map[string]interface{}) bool {
+	if !matchAnyRoutingKey(e.eventTypes, msg) {
+		return true
+	}
+	atomic.AddInt64(&e.evaluated, 1)
+
+	e.RLock()
+	defer e.RUnlock()
+
+	zoned := false
+	if ip := ipFromEvent(msg, "remote_ip"); ip != nil {
+		zone := e.zoneOf(ip)
+		if zone != "" {
+			msg["remote_ip_zone"] = zone
+			zoned = true
+		}
+		msg["is_internal"] = zone != "" || isPrivateIP(ip)
+	}
+	if ip := ipFromEvent(msg, "local_ip"); ip != nil {
+		if zone := e.zoneOf(ip); zone != "" {
+			msg["local_ip_zone"] = zone
+			zoned = true
+		}
+	}
+	if zoned {
+		atomic.AddInt64(&e.zoneMatches, 1)
+	}
+
+	if e.assetsFile == nil {
+		return true
+	}
+	if asset := e.assetOf(msg); asset != nil {
+		atomic.AddInt64(&e.assetMatches, 1)
+		for field, value := range map[string]string{
+			"asset_owner":         asset.Owner,
+			"asset_criticality":   asset.Criticality,
+			"asset_business_unit": asset.BusinessUnit,
+		} {
+			if value != "" {
+				msg[field] = value
+			}
+		}
+	} else if _, ok := msg["sensor_id"]; ok {
+		atomic.AddInt64(&e.unknownAssets, 1)
+	}
+	return true
+}
+
+func ipFromEvent(msg map[string]interface{}, field string) net.IP {
+	s, ok := msg[field].(string)
+	if !ok {
+		return nil
+	}
+	return net.ParseIP(s)
+}
+
+func (e *AssetEnricher) zoneOf(ip net.IP) string {
+	for _, zone := range e.zones {
+		if zone.network.Contains(ip) {
+			return zone.zone
+		}
+	}
+	return ""
+}
+
+// assetOf looks up the host that reported msg, first by sensor id and then by hostname.
+func (e *AssetEnricher) assetOf(msg map[string]interface{}) *Asset {
+	if sensorID, ok := intFromEvent(msg["sensor_id"]); ok {
+		if asset, ok := e.bySensor[sensorID]; ok {
+			return asset
+		}
+	}
+	if hostname, ok := msg["computer_name"].(string); ok && hostname != "" {
+		hostname = strings.ToLower(hostname)
+		if asset, ok := e.byHost[hostname]; ok {
+			return asset
+		}
+		if asset, ok := e.byHost[shortHostname(hostname)]; ok {
+			return asset
+		}
+	}
+	return nil
+}
+
+func (e *AssetEnricher) Statistics() interface{} {
+	stats := AssetStatistics{
+		Evaluated:     atomic.LoadInt64(&e.evaluated),
+		ZoneMatches:   atomic.LoadInt64(&e.zoneMatches),
+		AssetMatches:  atomic.LoadInt64(&e.assetMatches),
+		UnknownAssets: atomic.LoadInt64(&e.unknownAssets),
+		Files:         make(map[string]AssetFileStatistics),
+	}
+
+	e.RLock()
+	defer e.RUnlock()
+	for name, f := range map[string]*assetFile{"zones": e.zonesFile, "assets": e.assetsFile} {
+		if f != nil {
+			stats.Files[name] = AssetFileStatistics{File: f.File, Entries: f.entries, LastLoaded: f.loadedAt,
+				LastError: f.lastErr}
+		}
+	}
+	return stats
+}
+
+// changed reports whether f has been modified since it was last loaded.
+func (e *AssetEnricher) changed(f *assetFile) bool {
+	info, err := os.Stat(f.File)
+	if err != nil {
+		return false
+	}
+	e.RLock()
+	defer e.RUnlock()
+	return !info.ModTime().Equal(f.modTime)
+}
+
+// Start checks the zones and assets files for changes every reload interval, and reloads them both on SIGHUP.
+func (e *AssetEnricher) Start() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		ticker := time.NewTicker(e.reloadInterval)
+		defer ticker.Stop()
+		defer signal.Stop(hup)
+
+		for {
+			select {
+			case <-ticker.C:
+				e.reload(false)
+			case <-hup:
+				log.Info("Received SIGHUP, reloading zones and assets.")
+				e.reload(true)
+			case <-shutdownRequested:
+				return
+			}
+		}
+	}()
+}
+
+// reload reloads the files that changed, or both if force is set. A file that cannot be reloaded keeps its previous
+// entries.
+func (e *AssetEnricher) reload(force bool) {
+	for _, f := range []struct {
+		file *assetFile
+		load func() error
+	}{
+		{e.zonesFile, e.loadZones},
+		{e.assetsFile, e.loadAssets},
+	} {
+		if f.file == nil || !(force || e.changed(f.file)) {
+			continue
+		}
+		if err := f.load(); err != nil {
+			log.Errorf("Could not reload %s; keeping the previous entries: %s", f.file.File, err)
+			continue
+		}
+		e.RLock()
+		entries := f.file.entries
+		e.RUnlock()
+		log.Infof("Reloaded %d entries from %s", entries, f.file.File)
+	}
+}
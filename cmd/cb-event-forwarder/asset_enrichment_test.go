@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAssetEnricher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	zonesFile := filepath.Join(dir, "zones.csv")
+	assetsFile := filepath.Join(dir, "assets.csv")
+	if err := ioutil.WriteFile(zonesFile, []byte(`cidr,zone
+10.0.0.0/8,datacenter
+10.20.0.0/16,vpn
+# the jump host is in the DMZ, inside the datacenter range
+10.1.1.5,dmz
+192.168.100.0/24,guest
+203.0.113.0/24,dmz
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(assetsFile, []byte(`hostname,sensor_id,owner,criticality,business_unit
+DC01.corp.example.com,,Identity Team,critical,IT
+,12,Payments Team,high,Finance
+WKS-0042,,,low,
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewAssetEnricher(zonesFile, assetsFile, nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		msg      map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			msg: map[string]interface{}{"type": "ingress.event.netconn", "sensor_id": int32(12),
+				"computer_name": "PAY-SRV-01", "remote_ip": "10.1.1.5", "local_ip": "10.20.3.4"},
+			expected: map[string]interface{}{"type": "ingress.event.netconn", "sensor_id": int32(12),
+				"computer_name": "PAY-SRV-01", "remote_ip": "10.1.1.5", "local_ip": "10.20.3.4",
+				"remote_ip_zone": "dmz", "local_ip_zone": "vpn", "is_internal": true,
+				"asset_owner": "Payments Team", "asset_criticality": "high", "asset_business_unit": "Finance"},
+		},
+		{
+			msg: map[string]interface{}{"type": "ingress.event.netconn", "sensor_id": int32(3),
+				"computer_name": "DC01", "remote_ip": "198.51.100.7", "local_ip": "10.0.0.10"},
+			expected: map[string]interface{}{"type": "ingress.event.netconn", "sensor_id": int32(3),
+				"computer_name": "DC01", "remote_ip": "198.51.100.7", "local_ip": "10.0.0.10",
+				"local_ip_zone": "datacenter", "is_internal": false, "asset_owner": "Identity Team",
+				"asset_criticality": "critical", "asset_business_unit": "IT"},
+		},
+		{
+			msg: map[string]interface{}{"type": "ingress.event.procstart", "sensor_id": json.Number("4"),
+				"computer_name": "wks-0042.corp.example.com"},
+			expected: map[string]interface{}{"type": "ingress.event.procstart", "sensor_id": json.Number("4"),
+				"computer_name": "wks-0042.corp.example.com", "asset_criticality": "low"},
+		},
+		{
+			msg: map[string]interface{}{"type": "ingress.event.netconn", "sensor_id": int32(5),
+				"computer_name": "LAPTOP-7", "remote_ip": "172.16.4.4"},
+			expected: map[string]interface{}{"type": "ingress.event.netconn", "sensor_id": int32(5),
+				"computer_name": "LAPTOP-7", "remote_ip": "172.16.4.4", "is_internal": true},
+		},
+	} {
+		e.Process(test.msg)
+		if diff := cmp.Diff(test.expected, test.msg); diff != "" {
+			t.Errorf("event mismatch (-want +got):\n%s", diff)
+		}
+	}
+
+	stats := e.Statistics().(AssetStatistics)
+	expected := AssetStatistics{Evaluated: 4, ZoneMatches: 2, AssetMatches: 3, UnknownAssets: 1,
+		Files: map[string]AssetFileStatistics{
+			"zones":  {File: zonesFile, Entries: 5, LastLoaded: stats.Files["zones"].LastLoaded},
+			"assets": {File: assetsFile, Entries: 3, LastLoaded: stats.Files["assets"].LastLoaded},
+		}}
+	if diff := cmp.Diff(expected, stats); diff != "" {
+		t.Errorf("statistics mismatch (-want +got):\n%s", diff)
+	}
+
+	// a modified file is reloaded; a broken one keeps the previous entries
+	later := time.Now().Add(time.Minute)
+	ioutil.WriteFile(zonesFile, []byte("network,zone\n10.0.0.0/8,corp\n"), 0644)
+	os.Chtimes(zonesFile, later, later)
+	ioutil.WriteFile(assetsFile, []byte("owner,criticality\nnobody,low\n"), 0644)
+	os.Chtimes(assetsFile, later, later)
+	e.reload(false)
+
+	msg := map[string]interface{}{"sensor_id": int32(12), "remote_ip": "10.1.1.5"}
+	e.Process(msg)
+	if msg["remote_ip_zone"] != "corp" || msg["asset_owner"] != "Payments Team" {
+		t.Errorf("expected the new zones and the previous assets, got %v", msg)
+	}
+	stats = e.Statistics().(AssetStatistics)
+	if stats.Files["zones"].LastError != "" || stats.Files["assets"].LastError == "" {
+		t.Errorf("unexpected file statistics %+v", stats.Files)
+	}
+	if e.changed(e.zonesFile) || e.changed(e.assetsFile) {
+		t.Error("files should not be reloaded again until they change")
+	}
+}
+
+func TestParseZonesErrors(t *testing.T) {
+	for _, data := range []string{
+		"zone\ndmz\n",
+		"cidr,owner\n10.0.0.0/8,x\n",
+		"cidr,zone\n10.0.0.0/33,dmz\n",
+		"cidr,zone\n10.0.0.0/8,\n",
+	} {
+		if _, err := parseZonesCSV([]byte(data)); err == nil {
+			t.Errorf("expected an error for %q", data)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// auditLogInput tails the Cb Response audit logs; nil unless audit_log is enabled
+var auditLogInput *FileInput
+
+// AuditLogFile is a tailed log file and the event type its lines are output as.
+type AuditLogFile struct {
+	Path      string
+	EventType string
+	// one of the keys of auditLogFormats, or "raw" to only output the line as message
+	Format string
+}
+
+var defaultAuditLogFiles = []AuditLogFile{
+	{Path: "/var/log/cb/audit/live-response.log", EventType: "audit.log.liveresponse", Format: "liveresponse"},
+	{Path: "/var/log/cb/audit/banning.log", EventType: "audit.log.banning", Format: "banning"},
+	{Path: "/var/log/cb/audit/isolation.log", EventType: "audit.log.isolation", Format: "isolation"},
+	{Path: "/var/log/cb/audit/useractivity.log", EventType: "audit.log.useractivity", Format: "useractivity"},
+}
+
+// auditLogPattern extracts fields from an audit log message through its named groups. action is used when the
+// pattern has no action group.
+type auditLogPattern struct {
+	re     *regexp.Regexp
+	action string
+}
+
+const (
+	auditUser    = `"(?P<user>[^"]+)"`
+	auditFrom    = `(?: from (?P<source_ip>[0-9a-fA-F.:]+))?`
+	auditSensor  = `sensor (?P<sensor_id>\d+)(?: \((?P<hostname>[^)]+)\))?`
+	auditSession = `live response session (?P<session_id>\d+)`
+)
+
+func auditPattern(action, expr string) auditLogPattern {
+	return auditLogPattern{re: regexp.MustCompile(`^` + expr), action: action}
+}
+
+// auditLogFormats holds the patterns tried, in order, on the message of each line of an audit log format. Each
+// pattern matches one kind of line of the Cb Response audit logs; test/raw_data/audit_log has examples of each.
+var auditLogFormats = map[string][]auditLogPattern{
+	"liveresponse": {
+		auditPattern("", auditUser+auditFrom+` (?P<action>started|closed) `+auditSession+` on `+auditSensor),
+		auditPattern("command", auditUser+auditFrom+` executed "(?P<command>[^"]*)" in `+auditSession+
+			` on `+auditSensor),
+		auditPattern("", auditSession+` on `+auditSensor+` (?P<action>timed out)`),
+	},
+	"banning": {
+		auditPattern("", auditUser+auditFrom+` (?P<action>banned|unbanned) hash (?P<md5>[0-9a-fA-F]{32})`),
+	},
+	"isolation": {
+		auditPattern("", auditUser+auditFrom+` (?P<action>isolated|unisolated) `+auditSensor),
+	},
+	"useractivity": {
+		auditPattern("", auditUser+` (?P<action>logged in|logged out)`+auditFrom),
+		auditPattern("", `(?P<action>failed login) for `+auditUser+auditFrom),
+	},
+}
+
+// auditLogPrefix matches the timestamp and log level that start each audit log line.
+var auditLogPrefix = regexp.MustCompile(`^\[?(?P<timestamp>\d{4}-\d{2}-\d{2}[ T]\d{2}:\d{2}:\d{2}(?:[.,]\d+)?)` +
+	`\]?(?:\s*[-:]?\s*\[?(?:DEBUG|INFO|WARNING|WARN|ERROR|CRITICAL)\]?)?\s*[-:]?\s*`)
+
+// auditLogKeyValue matches key=value pairs, which fill in fields the format patterns did not find.
+var auditLogKeyValue = regexp.MustCompile(`(\w+)=("[^"]*"|[^\s,;]+)`)
+
+var auditLogKeyAliases = map[string]string{
+	"username":  "user",
+	"ip":        "source_ip",
+	"remote_ip": "source_ip",
+	"src_ip":    "source_ip",
+	"sensor":    "sensor_id",
+	"session":   "session_id",
+}
+
+var auditLogIntegerFields = map[string]bool{"sensor_id": true, "session_id": true, "status_code": true}
+
+// parseAuditLogLine returns the fields of an audit log line in format. The line is always included as message;
+// parsed reports whether a format pattern matched it.
+func parseAuditLogLine(format, line string) (msg map[string]interface{}, parsed bool) {
+	msg = map[string]interface{}{"message": line}
+	if format == "raw" {
+		return msg, false
+	}
+
+	body := line
+	if m := auditLogPrefix.FindStringSubmatch(line); m != nil {
+		body = line[len(m[0]):]
+		stamp := strings.Replace(strings.Replace(m[1], ",", ".", 1), "T", " ", 1)
+		if t, err := time.ParseInLocation("2006-01-02 15:04:05.999999999", stamp, time.Local); err == nil {
+			msg["timestamp"] = unixSecondsFloat(t)
+		}
+	}
+
+	setField := func(name, value string) {
+		if value == "" {
+			return
+		}
+		if _, ok := msg[name]; ok {
+			return
+		}
+		if auditLogIntegerFields[name] {
+			if i, err := strconv.Atoi(value); err == nil {
+				msg[name] = i
+				return
+			}
+		}
+		msg[name] = value
+	}
+
+	for _, pattern := range auditLogFormats[format] {
+		m := pattern.re.FindStringSubmatch(body)
+		if m == nil {
+			continue
+		}
+		for i, name := range pattern.re.SubexpNames() {
+			if name == "action" {
+				m[i] = strings.Replace(strings.ToLower(m[i]), " ", "_", -1)
+			}
+			if name != "" {
+				setField(name, m[i])
+			}
+		}
+		setField("action", pattern.action)
+		parsed = true
+		break
+	}
+
+	for _, kv := range auditLogKeyValue.FindAllStringSubmatch(body, -1) {
+		key := strings.ToLower(kv[1])
+		if alias, ok := auditLogKeyAliases[key]; ok {
+			key = alias
+		}
+		setField(key, strings.Trim(kv[2], `"`))
+	}
+
+	return msg, parsed
+}
+
+// newAuditLogInput returns a FileInput that outputs each line of the audit log files as an event with the fields
+// parsed from it. Positions are saved to checkpointPath unless it is empty.
+func newAuditLogInput(files []AuditLogFile, checkpointPath string) (*FileInput, error) {
+	var configs []FileInputConfig
+	for _, f := range files {
+		format := f.Format
+		configs = append(configs, FileInputConfig{
+			Name:      f.EventType,
+			Paths:     []string{f.Path},
+			EventType: f.EventType,
+			parse: func(record string) (map[string]interface{}, bool) {
+				msg, parsed := parseAuditLogLine(format, record)
+				return msg, parsed || format == "raw"
+			},
+		})
+	}
+	return NewFileInput(configs, checkpointPath)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseAuditLogLine(t *testing.T) {
+	stamp, err := time.ParseInLocation("2006-01-02 15:04:05", "2018-03-05 14:07:53", time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := float64(stamp.Unix()) + 0.127
+
+	for _, test := range []struct {
+		desc     string
+		format   string
+		line     string
+		expected map[string]interface{}
+		parsed   bool
+	}{
+		{
+			desc:   "Live response session started",
+			format: "liveresponse",
+			line: `2018-03-05 14:07:53,127: "admin" from 172.22.10.7 started live response session 3 on sensor 12 ` +
+				`(WIN-ACME-01)`,
+			expected: map[string]interface{}{"timestamp": timestamp, "user": "admin", "source_ip": "172.22.10.7",
+				"action": "started", "session_id": 3, "sensor_id": 12, "hostname": "WIN-ACME-01"},
+			parsed: true,
+		},
+		{
+			desc:   "Live response command",
+			format: "liveresponse",
+			line: `2018-03-05 14:07:53,127: "jdoe" from 10.1.1.9 executed "get c:\windows\temp\a.exe" in live ` +
+				`response session 3 on sensor 12 (WIN-ACME-01)`,
+			expected: map[string]interface{}{"timestamp": timestamp, "user": "jdoe", "source_ip": "10.1.1.9",
+				"action": "command", "command": `get c:\windows\temp\a.exe`, "session_id": 3, "sensor_id": 12,
+				"hostname": "WIN-ACME-01"},
+			parsed: true,
+		},
+		{
+			desc:   "Live response session timed out",
+			format: "liveresponse",
+			line:   "2018-03-05 14:07:53,127: live response session 4 on sensor 31 timed out",
+			expected: map[string]interface{}{"timestamp": timestamp, "action": "timed_out", "session_id": 4,
+				"sensor_id": 31},
+			parsed: true,
+		},
+		{
+			desc:   "Hash banned",
+			format: "banning",
+			line:   `2018-03-05 14:07:53,127: "admin" from 10.1.1.5 banned hash 33AE1B209D9BE2FC6835B8A35A889CEC`,
+			expected: map[string]interface{}{"timestamp": timestamp, "user": "admin", "source_ip": "10.1.1.5",
+				"action": "banned", "md5": "33AE1B209D9BE2FC6835B8A35A889CEC"},
+			parsed: true,
+		},
+		{
+			desc:   "Sensor isolated",
+			format: "isolation",
+			line:   `2018-03-05 14:07:53,127: "admin" from 10.1.1.5 isolated sensor 12 (WIN-ACME-01)`,
+			expected: map[string]interface{}{"timestamp": timestamp, "user": "admin", "source_ip": "10.1.1.5",
+				"action": "isolated", "sensor_id": 12, "hostname": "WIN-ACME-01"},
+			parsed: true,
+		},
+		{
+			desc:   "Login",
+			format: "useractivity",
+			line:   `2018-03-05 14:07:53,127: "admin" logged in from 172.22.10.7`,
+			expected: map[string]interface{}{"timestamp": timestamp, "user": "admin", "action": "logged_in",
+				"source_ip": "172.22.10.7"},
+			parsed: true,
+		},
+		{
+			desc:   "Failed login with key=value fields",
+			format: "useractivity",
+			line:   `2018-03-05 14:07:53,127: failed login for "jdoe" from 172.22.10.9 reason=invalid_password`,
+			expected: map[string]interface{}{"timestamp": timestamp, "action": "failed_login", "user": "jdoe",
+				"source_ip": "172.22.10.9", "reason": "invalid_password"},
+			parsed: true,
+		},
+		{
+			desc:     "Line of another format",
+			format:   "banning",
+			line:     `2018-03-05 14:07:53,127: "admin" from 10.1.1.5 isolated sensor 12 (WIN-ACME-01)`,
+			expected: map[string]interface{}{"timestamp": timestamp},
+		},
+		{
+			desc:     "Unrecognized line",
+			format:   "banning",
+			line:     "2018-03-05 14:07:53,127: ban list reloaded",
+			expected: map[string]interface{}{"timestamp": timestamp},
+		},
+		{
+			desc:     "Raw format",
+			format:   "raw",
+			line:     "2018-03-05 14:07:53,127: user=admin",
+			expected: map[string]interface{}{},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			test.expected["message"] = test.line
+
+			msg, parsed := parseAuditLogLine(test.format, test.line)
+			if parsed != test.parsed {
+				t.Errorf("expected parsed to be %t", test.parsed)
+			}
+			if diff := cmp.Diff(test.expected, msg); diff != "" {
+				t.Errorf("fields mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseAuditLogFixtures(t *testing.T) {
+	for _, f := range defaultAuditLogFiles {
+		path := filepath.Join("../../test/raw_data/audit_log", filepath.Base(f.Path))
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			msg, parsed := parseAuditLogLine(f.Format, line)
+			if !parsed {
+				t.Errorf("%s: expected line to be parsed: %s", path, line)
+				continue
+			}
+			if _, ok := msg["timestamp"]; !ok || msg["action"] == "" {
+				t.Errorf("%s: expected a timestamp and an action, got %v", path, msg)
+			}
+		}
+	}
+}
+
+func TestAuditLogInputResumesFromCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logPath := filepath.Join(dir, "banning.log")
+	checkpointPath := filepath.Join(dir, "positions.json")
+	files := []AuditLogFile{{Path: logPath, EventType: "audit.log.banning", Format: "banning"}}
+
+	appendLines := func(lines ...string) {
+		f, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range lines {
+			f.WriteString(line + "\n")
+		}
+		f.Close()
+	}
+
+	var lock sync.Mutex
+	var messages []string
+	run := func() *FileInput {
+		input, err := newAuditLogInput(files, checkpointPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		input.output = func(msg map[string]interface{}) error {
+			if msg["type"] != "audit.log.banning" {
+				t.Errorf("unexpected event type %v", msg["type"])
+			}
+			lock.Lock()
+			messages = append(messages, msg["message"].(string))
+			lock.Unlock()
+			return nil
+		}
+		input.Start()
+		return input
+	}
+	waitFor := func(n int) {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+			lock.Lock()
+			got := len(messages)
+			lock.Unlock()
+			if got >= n {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("timed out waiting for %d lines, got %v", n, messages)
+	}
+
+	// without a checkpoint, tailing starts at the end of the file
+	appendLines("before the first start")
+	input := run()
+	time.Sleep(50 * time.Millisecond)
+	appendLines("line 1")
+	waitFor(1)
+	input.Stop()
+
+	// lines written while stopped are output after the restart
+	appendLines("line 2", "line 3")
+	input = run()
+	appendLines("line 4")
+	waitFor(4)
+	input.Stop()
+
+	if diff := cmp.Diff([]string{"line 1", "line 2", "line 3", "line 4"}, messages); diff != "" {
+		t.Errorf("lines mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"zvelo.io/ttlru"
+)
+
+// the hash fields that are looked up, and the prefix given to the fields added for each of them
+var binaryHashFields = []struct {
+	field  string
+	prefix string
+}{
+	{"md5", "binary_"},
+	{"process_md5", "process_binary_"},
+	{"parent_md5", "parent_binary_"},
+}
+
+// how long a failed lookup is remembered before the server is asked again, so that an unreachable or overloaded
+// server is not queried for every event
+const binaryLookupErrorTTL = 30 * time.Second
+
+// how long an event waits for a binary summary that is not cached before it is sent without it, and how many
+// lookups may be outstanding at once. Lookups that take longer keep running in the background and fill the cache
+// for later events.
+const (
+	binaryLookupTimeout = 250 * time.Millisecond
+	binaryLookupSlots   = 8
+)
+
+// returned for lookups that are not started because binaryLookupSlots queries are outstanding already
+var errTooManyBinaryLookups = errors.New("too many binary lookups in progress")
+
+// BinarySummary holds the fields of /api/v1/binary/<md5>/summary that are added to events.
+type BinarySummary struct {
+	DigsigResult         string `json:"digsig_result"`
+	CompanyName          string `json:"company_name"`
+	ProductName          string `json:"product_name"`
+	OriginalFilename     string `json:"original_filename"`
+	ServerAddedTimestamp string `json:"server_added_timestamp"`
+	HostCount            int    `json:"host_count"`
+}
+
+type BinaryEnrichmentStatistics struct {
+	CacheSize         int   `json:"cache_size"`
+	NegativeCacheSize int   `json:"negative_cache_size"`
+	CacheHits         int64 `json:"cache_hits"`
+	NegativeCacheHits int64 `json:"negative_cache_hits"`
+	Lookups           int64 `json:"lookups"`
+	UnknownBinaries   int64 `json:"unknown_binaries"`
+	LookupErrors      int64 `json:"lookup_errors"`
+	ErrorCacheHits    int64 `json:"error_cache_hits"`
+	Coalesced         int64 `json:"coalesced"`
+	Timeouts          int64 `json:"timeouts"`
+	SkippedLookups    int64 `json:"skipped_lookups"`
+}
+
+// binaryLookup is a single in-flight query for a binary summary. Events that need the same md5 while the query is
+// outstanding wait on done instead of issuing their own request.
+type binaryLookup struct {
+	done    chan struct{}
+	summary *BinarySummary
+	err     error
+}
+
+// BinaryEnricher adds file metadata from the Cb Response binary store to events carrying an md5, process_md5 or
+// parent_md5. Summaries are cached; hashes the server does not know about are remembered in a separate negative
+// cache, and failed lookups in an error cache for a short time, so that they are not queried for every event.
+//
+// Process never waits on the server for longer than the lookup timeout: events whose binary is not cached yet are
+// sent without the binary fields once it expires, or straight away if too many lookups are outstanding.
+type BinaryEnricher struct {
+	eventTypes []string
+	timeout    time.Duration
+
+	// retrieves a route from the Cb Response REST API; replaced in tests
+	get func(route string) ([]byte, error)
+
+	cache         ttlru.Cache
+	negativeCache ttlru.Cache
+	errorCache    ttlru.Cache
+
+	inflightLock sync.Mutex
+	inflight     map[string]*binaryLookup
+	// holds a token for each query to the Cb Response Server that has not returned yet
+	fetchSlots chan struct{}
+
+	cacheHits         int64
+	negativeCacheHits int64
+	errorCacheHits    int64
+	coalesced         int64
+	lookups           int64
+	unknownBinaries   int64
+	lookupErrors      int64
+	timeouts          int64
+	skippedLookups    int64
+}
+
+func NewBinaryEnricher(eventTypes []string, cacheSize int, cacheTTL, negativeTTL time.Duration) *BinaryEnricher {
+	return &BinaryEnricher{
+		eventTypes:    eventTypes,
+		timeout:       binaryLookupTimeout,
+		get:           GetCb,
+		cache:         ttlru.New(cacheSize, ttlru.WithTTL(cacheTTL)),
+		negativeCache: ttlru.New(cacheSize, ttlru.WithTTL(negativeTTL)),
+		errorCache:    ttlru.New(cacheSize, ttlru.WithTTL(binaryLookupErrorTTL)),
+		inflight:      make(map[string]*binaryLookup),
+		fetchSlots:    make(chan struct{}, binaryLookupSlots),
+	}
+}
+
+func (e *BinaryEnricher) Name() string {
+	return "binary_enrichment"
+}
+
+func isEmptyMd5(md5 string) bool {
+	return strings.Trim(md5, "0") == ""
+}
+
+// summary returns the binary summary for md5, or nil if the binary is not known to the server or cannot be
+// retrieved within the lookup timeout.
+func (e *BinaryEnricher) summary(md5 string) *BinarySummary {
+	if cached, ok := e.cache.Get(md5); ok {
+		atomic.AddInt64(&e.cacheHits, 1)
+		return cached.(*BinarySummary)
+	}
+	if _, ok := e.negativeCache.Get(md5); ok {
+		atomic.AddInt64(&e.negativeCacheHits, 1)
+		return nil
+	}
+	if _, ok := e.errorCache.Get(md5); ok {
+		atomic.AddInt64(&e.errorCacheHits, 1)
+		return nil
+	}
+
+	l := e.lookup(md5)
+
+	timer := time.NewTimer(e.timeout)
+	defer timer.Stop()
+
+	select {
+	case <-l.done:
+		if l.err != nil {
+			log.Debugf("Could not retrieve binary summary for %s: %s", md5, l.err)
+		}
+		return l.summary
+	case <-timer.C:
+		log.Debugf("Timed out after %s retrieving binary summary for %s; sending event without it", e.timeout, md5)
+		atomic.AddInt64(&e.timeouts, 1)
+		return nil
+	}
+}
+
+// lookup returns the in-flight query for md5, starting one if none is outstanding. If too many queries are
+// outstanding already, the lookup returned has failed with errTooManyBinaryLookups.
+func (e *BinaryEnricher) lookup(md5 string) *binaryLookup {
+	e.inflightLock.Lock()
+	defer e.inflightLock.Unlock()
+
+	if l, ok := e.inflight[md5]; ok {
+		atomic.AddInt64(&e.coalesced, 1)
+		return l
+	}
+
+	l := &binaryLookup{done: make(chan struct{})}
+	select {
+	case e.fetchSlots <- struct{}{}:
+	default:
+		atomic.AddInt64(&e.skippedLookups, 1)
+		l.err = errTooManyBinaryLookups
+		close(l.done)
+		return l
+	}
+	e.inflight[md5] = l
+
+	go func() {
+		defer func() { <-e.fetchSlots }()
+
+		l.summary = e.fetch(md5)
+
+		e.inflightLock.Lock()
+		delete(e.inflight, md5)
+		e.inflightLock.Unlock()
+
+		close(l.done)
+	}()
+
+	return l
+}
+
+// fetch queries the server for the summary of md5 and caches the outcome.
+func (e *BinaryEnricher) fetch(md5 string) *BinarySummary {
+	atomic.AddInt64(&e.lookups, 1)
+	body, err := e.get(fmt.Sprintf("api/v1/binary/%s/summary", md5))
+	if err != nil {
+		if apiErr, ok := err.(*CbAPIError); ok && apiErr.StatusCode == 404 {
+			atomic.AddInt64(&e.unknownBinaries, 1)
+			e.negativeCache.Set(md5, true)
+		} else {
+			atomic.AddInt64(&e.lookupErrors, 1)
+			e.errorCache.Set(md5, true)
+			log.Debugf("Could not retrieve binary summary for %s: %s", md5, err)
+		}
+		return nil
+	}
+
+	summary := &BinarySummary{}
+	if err := decodeAPIResponse(body, summary); err != nil {
+		atomic.AddInt64(&e.lookupErrors, 1)
+		e.errorCache.Set(md5, true)
+		log.Debugf("Could not parse binary summary for %s: %s", md5, err)
+		return nil
+	}
+
+	e.cache.Set(md5, summary)
+	return summary
+}
+
+func (e *BinaryEnricher) Process(msg map[string]interface{}) bool {
+	if !matchAnyRoutingKey(e.eventTypes, msg) {
+		return true
+	}
+
+	for _, hashField := range binaryHashFields {
+		md5, ok := msg[hashField.field].(string)
+		if !ok || isEmptyMd5(md5) {
+			continue
+		}
+
+		summary := e.summary(strings.ToUpper(md5))
+		if summary == nil {
+			continue
+		}
+
+		msg[hashField.prefix+"digsig_result"] = summary.DigsigResult
+		msg[hashField.prefix+"company_name"] = summary.CompanyName
+		msg[hashField.prefix+"product_name"] = summary.ProductName
+		msg[hashField.prefix+"original_filename"] = summary.OriginalFilename
+		msg[hashField.prefix+"first_seen"] = summary.ServerAddedTimestamp
+		msg[hashField.prefix+"host_count"] = summary.HostCount
+	}
+
+	return true
+}
+
+func (e *BinaryEnricher) Statistics() interface{} {
+	return BinaryEnrichmentStatistics{
+		CacheSize:         e.cache.Len(),
+		NegativeCacheSize: e.negativeCache.Len(),
+		CacheHits:         atomic.LoadInt64(&e.cacheHits),
+		NegativeCacheHits: atomic.LoadInt64(&e.negativeCacheHits),
+		Lookups:           atomic.LoadInt64(&e.lookups),
+		UnknownBinaries:   atomic.LoadInt64(&e.unknownBinaries),
+		LookupErrors:      atomic.LoadInt64(&e.lookupErrors),
+		ErrorCacheHits:    atomic.LoadInt64(&e.errorCacheHits),
+		Coalesced:         atomic.LoadInt64(&e.coalesced),
+		Timeouts:          atomic.LoadInt64(&e.timeouts),
+		SkippedLookups:    atomic.LoadInt64(&e.skippedLookups),
+	}
+}
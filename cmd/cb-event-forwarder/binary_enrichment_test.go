@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const testBinarySummary = `{"md5": "6A993F9B16B993AE0E9D838EFA3A1C72", "digsig_result": "Signed",
+	"company_name": "Microsoft Corporation", "product_name": "Microsoft Malware Protection",
+	"original_filename": "MpCmdRun.exe", "server_added_timestamp": "2015-11-16T19:01:07.325Z", "host_count": 12}`
+
+func TestBinaryEnricherProcess(t *testing.T) {
+	for _, test := range []struct {
+		desc            string
+		msg             map[string]interface{}
+		expected        map[string]interface{}
+		expectedLookups []string
+	}{
+		{
+			desc: "Process md5 is enriched",
+			msg: map[string]interface{}{
+				"type":        "ingress.event.procstart",
+				"process_md5": "6a993f9b16b993ae0e9d838efa3a1c72",
+				"parent_md5":  "000000000000000000000000000000",
+			},
+			expected: map[string]interface{}{
+				"type":                             "ingress.event.procstart",
+				"process_md5":                      "6a993f9b16b993ae0e9d838efa3a1c72",
+				"parent_md5":                       "000000000000000000000000000000",
+				"process_binary_digsig_result":     "Signed",
+				"process_binary_company_name":      "Microsoft Corporation",
+				"process_binary_product_name":      "Microsoft Malware Protection",
+				"process_binary_original_filename": "MpCmdRun.exe",
+				"process_binary_first_seen":        "2015-11-16T19:01:07.325Z",
+				"process_binary_host_count":        12,
+			},
+			expectedLookups: []string{"api/v1/binary/6A993F9B16B993AE0E9D838EFA3A1C72/summary"},
+		},
+		{
+			desc: "Unknown binaries are negatively cached",
+			msg: map[string]interface{}{
+				"type": "feed.ingress.hit.binary",
+				"md5":  "449571D58547F434FAF544F2BAF2FA4C",
+			},
+			expected: map[string]interface{}{
+				"type": "feed.ingress.hit.binary",
+				"md5":  "449571D58547F434FAF544F2BAF2FA4C",
+			},
+			expectedLookups: []string{"api/v1/binary/449571D58547F434FAF544F2BAF2FA4C/summary"},
+		},
+		{
+			desc: "Event types that are not configured are left alone",
+			msg: map[string]interface{}{
+				"type": "ingress.event.netconn",
+				"md5":  "6a993f9b16b993ae0e9d838efa3a1c72",
+			},
+			expected: map[string]interface{}{
+				"type": "ingress.event.netconn",
+				"md5":  "6a993f9b16b993ae0e9d838efa3a1c72",
+			},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			var lookups []string
+			e := NewBinaryEnricher([]string{"ingress.event.procstart", "feed.#"}, 10, time.Minute, time.Minute)
+			e.get = func(route string) ([]byte, error) {
+				lookups = append(lookups, route)
+				if route == "api/v1/binary/6A993F9B16B993AE0E9D838EFA3A1C72/summary" {
+					return []byte(testBinarySummary), nil
+				}
+				return nil, &CbAPIError{StatusCode: 404}
+			}
+
+			// process the same event twice; the second time must be answered from the cache
+			for i := 0; i < 2; i++ {
+				msg := make(map[string]interface{})
+				for k, v := range test.msg {
+					msg[k] = v
+				}
+				if !e.Process(msg) {
+					t.Errorf("expected event to be kept")
+				}
+				if diff := cmp.Diff(test.expected, msg); diff != "" {
+					t.Errorf("event mismatch (-want +got):\n%s", diff)
+				}
+			}
+
+			if diff := cmp.Diff(test.expectedLookups, lookups); diff != "" {
+				t.Errorf("API lookups mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestBinaryEnricherLookups(t *testing.T) {
+	e := NewBinaryEnricher([]string{"ingress.event.#"}, 10, time.Minute, time.Minute)
+	e.timeout = time.Minute
+	var lookups int64
+	release := make(chan struct{})
+	e.get = func(route string) ([]byte, error) {
+		atomic.AddInt64(&lookups, 1)
+		if route == "api/v1/binary/6A993F9B16B993AE0E9D838EFA3A1C72/summary" {
+			<-release
+			return []byte(testBinarySummary), nil
+		}
+		return nil, errors.New("connection refused")
+	}
+
+	// events waiting for the same binary share a single request
+	var wg sync.WaitGroup
+	msgs := make([]map[string]interface{}, 5)
+	for i := range msgs {
+		msgs[i] = map[string]interface{}{"type": "ingress.event.procstart", "md5": "6a993f9b16b993ae0e9d838efa3a1c72"}
+		wg.Add(1)
+		go func(msg map[string]interface{}) {
+			defer wg.Done()
+			e.Process(msg)
+		}(msgs[i])
+	}
+	for atomic.LoadInt64(&e.coalesced) < int64(len(msgs)-1) {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	for _, msg := range msgs {
+		if msg["binary_company_name"] != "Microsoft Corporation" {
+			t.Errorf("expected the event to be enriched, got %v", msg)
+		}
+	}
+
+	// failed lookups are not retried for every event
+	for i := 0; i < 3; i++ {
+		e.Process(map[string]interface{}{"type": "ingress.event.procstart", "md5": "449571D58547F434FAF544F2BAF2FA4C"})
+	}
+
+	stats := e.Statistics().(BinaryEnrichmentStatistics)
+	if atomic.LoadInt64(&lookups) != 2 || stats.LookupErrors != 1 || stats.ErrorCacheHits != 2 {
+		t.Errorf("expected 2 lookups, got %d; statistics %+v", lookups, stats)
+	}
+}
+
+func TestBinaryEnricherDoesNotWaitForSlowLookups(t *testing.T) {
+	e := NewBinaryEnricher([]string{"ingress.event.#"}, 20, time.Minute, time.Minute)
+	e.timeout = 10 * time.Millisecond
+	release := make(chan struct{})
+	e.get = func(route string) ([]byte, error) {
+		<-release
+		return []byte(testBinarySummary), nil
+	}
+
+	// events are sent without the binary fields while the lookup is outstanding
+	msg := map[string]interface{}{"type": "ingress.event.procstart", "md5": "6a993f9b16b993ae0e9d838efa3a1c72"}
+	e.Process(msg)
+	if _, ok := msg["binary_company_name"]; ok {
+		t.Errorf("expected the event to be sent unenriched, got %v", msg)
+	}
+
+	// and straight away once every lookup slot is taken
+	for i := 1; i < binaryLookupSlots; i++ {
+		e.Process(map[string]interface{}{"type": "ingress.event.procstart", "md5": fmt.Sprintf("%032X", i)})
+	}
+	start := time.Now()
+	e.Process(map[string]interface{}{"type": "ingress.event.procstart", "md5": "449571D58547F434FAF544F2BAF2FA4C"})
+	if elapsed := time.Since(start); elapsed >= e.timeout {
+		t.Errorf("expected the event not to wait for a lookup slot, took %s", elapsed)
+	}
+
+	stats := e.Statistics().(BinaryEnrichmentStatistics)
+	if stats.Timeouts != binaryLookupSlots || stats.SkippedLookups != 1 {
+		t.Errorf("expected %d timeouts and 1 skipped lookup, got %+v", binaryLookupSlots, stats)
+	}
+
+	// the lookups carry on in the background and fill the cache for later events
+	close(release)
+	for e.cache.Len() < binaryLookupSlots {
+		time.Sleep(time.Millisecond)
+	}
+	msg = map[string]interface{}{"type": "ingress.event.procstart", "md5": "6a993f9b16b993ae0e9d838efa3a1c72"}
+	e.Process(msg)
+	if msg["binary_company_name"] != "Microsoft Corporation" {
+		t.Errorf("expected the event to be enriched from the cache, got %v", msg)
+	}
+}
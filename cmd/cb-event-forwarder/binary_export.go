@@ -0,0 +1,450 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"zvelo.io/ttlru"
+)
+
+// md5s are used to build file names and object keys, so anything else is rejected before it reaches the store
+var binaryMd5Pattern = regexp.MustCompile(`^[0-9A-Fa-f]{32}$`)
+
+// permanentExportError is an export failure that would fail the same way if retried, such as a binary the server
+// does not have or one that turns out to be larger than the size limit.
+type permanentExportError struct {
+	err error
+}
+
+func (e *permanentExportError) Error() string {
+	return e.err.Error()
+}
+
+// BinaryStore is a destination for binaries exported from the Cb Response binary store. Binaries are stored as
+// the zip file returned by the Cb Response REST API, keyed by their upper case md5.
+type BinaryStore interface {
+	// TempDir is where binaries are downloaded before being stored
+	TempDir() string
+	// Exists returns the location of the binary if it has already been stored
+	Exists(md5 string) (location string, exists bool, err error)
+	// Put stores the downloaded binary in f and returns its location
+	Put(md5 string, f *os.File) (location string, err error)
+	String() string
+}
+
+// newBinaryStore creates a BinaryStore from a destination of the form file:<directory> or s3:<region>:<bucket>.
+func newBinaryStore(destination string) (BinaryStore, error) {
+	parts := strings.SplitN(destination, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid binary export destination '%s': should be file:<directory> or s3:<region>:<bucket>",
+			destination)
+	}
+
+	switch parts[0] {
+	case "file":
+		if err := os.MkdirAll(parts[1], 0700); err != nil {
+			return nil, err
+		}
+		return &localBinaryStore{directory: parts[1]}, nil
+	case "s3":
+		bucket := strings.SplitN(parts[1], ":", 2)
+		if len(bucket) != 2 {
+			return nil, fmt.Errorf("Invalid binary export destination '%s': should be s3:<region>:<bucket>", destination)
+		}
+		return newS3BinaryStore(bucket[0], bucket[1])
+	}
+
+	return nil, fmt.Errorf("Invalid binary export destination '%s': should be file:<directory> or s3:<region>:<bucket>",
+		destination)
+}
+
+type localBinaryStore struct {
+	directory string
+}
+
+func (s *localBinaryStore) path(md5 string) string {
+	return filepath.Join(s.directory, md5+".zip")
+}
+
+// TempDir downloads into the destination directory itself so that Put is a rename within the same filesystem.
+func (s *localBinaryStore) TempDir() string {
+	return s.directory
+}
+
+func (s *localBinaryStore) Exists(md5 string) (string, bool, error) {
+	_, err := os.Stat(s.path(md5))
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return s.path(md5), true, nil
+}
+
+func (s *localBinaryStore) Put(md5 string, f *os.File) (string, error) {
+	if err := os.Rename(f.Name(), s.path(md5)); err != nil {
+		return "", err
+	}
+	return s.path(md5), nil
+}
+
+func (s *localBinaryStore) String() string {
+	return "file:" + s.directory
+}
+
+type s3BinaryStore struct {
+	region string
+	bucket string
+	prefix string
+	out    *s3.S3
+}
+
+func newS3BinaryStore(region, bucket string) (*s3BinaryStore, error) {
+	awsConfig := &aws.Config{Region: aws.String(region)}
+	if config.BinaryExportS3Endpoint != "" {
+		// S3 compatible object stores generally need path style bucket addressing
+		awsConfig.WithEndpoint(config.BinaryExportS3Endpoint).WithS3ForcePathStyle(true)
+	}
+
+	if config.BinaryExportS3CredentialProfile != "" {
+		parts := strings.SplitN(config.BinaryExportS3CredentialProfile, ":", 2)
+		credentialProvider := credentials.SharedCredentialsProvider{}
+
+		if len(parts) == 2 {
+			credentialProvider.Filename = parts[0]
+			credentialProvider.Profile = parts[1]
+		} else {
+			credentialProvider.Profile = parts[0]
+		}
+
+		awsConfig.Credentials = credentials.NewCredentials(&credentialProvider)
+	}
+
+	s := &s3BinaryStore{
+		region: region,
+		bucket: bucket,
+		prefix: config.BinaryExportS3ObjectPrefix,
+		out:    s3.New(session.New(awsConfig)),
+	}
+
+	_, err := s.out.HeadBucket(&s3.HeadBucketInput{Bucket: &s.bucket})
+	if err != nil {
+		// as with the S3 output, PutObject rights may be granted without ListBucket
+		log.Infof("Could not open bucket %s: %s", s.bucket, err)
+	}
+
+	return s, nil
+}
+
+func (s *s3BinaryStore) key(md5 string) string {
+	if s.prefix != "" {
+		return s.prefix + "/" + md5 + ".zip"
+	}
+	return md5 + ".zip"
+}
+
+func (s *s3BinaryStore) location(md5 string) string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, s.key(md5))
+}
+
+func (s *s3BinaryStore) TempDir() string {
+	return os.TempDir()
+}
+
+func (s *s3BinaryStore) Exists(md5 string) (string, bool, error) {
+	key := s.key(md5)
+	_, err := s.out.HeadObject(&s3.HeadObjectInput{Bucket: &s.bucket, Key: &key})
+	if err != nil {
+		if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 404 {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return s.location(md5), true, nil
+}
+
+func (s *s3BinaryStore) Put(md5 string, f *os.File) (string, error) {
+	key := s.key(md5)
+	_, err := s.out.PutObject(&s3.PutObjectInput{
+		Body:        f,
+		Bucket:      &s.bucket,
+		Key:         &key,
+		ContentType: aws.String("application/zip"),
+	})
+	if err != nil {
+		return "", err
+	}
+	return s.location(md5), nil
+}
+
+func (s *s3BinaryStore) String() string {
+	return fmt.Sprintf("s3:%s:%s", s.region, s.bucket)
+}
+
+// binaryExport is an export in progress. Workers that receive the same md5 while it is running wait on done and
+// share its result.
+type binaryExport struct {
+	done     chan struct{}
+	location string
+	err      error
+}
+
+type BinaryExportStatistics struct {
+	Destination  string `json:"destination"`
+	QueueDepth   int    `json:"queue_depth"`
+	QueueSize    int    `json:"queue_size"`
+	Exported     int64  `json:"exported"`
+	ExportedSize int64  `json:"exported_bytes"`
+	Duplicates   int64  `json:"duplicates"`
+	TooLarge     int64  `json:"too_large"`
+	Failed       int64  `json:"failed"`
+	Retries      int64  `json:"retries"`
+}
+
+// BinaryExporter downloads binaries announced by binarystore.file.added events and stores them in a BinaryStore.
+// The event is output once the export has finished, annotated with binary_location, or with binary_export_error if
+// the binary could not be exported.
+type BinaryExporter struct {
+	store        BinaryStore
+	maxSize      int64
+	retries      int
+	retryBackoff time.Duration
+	timeout      time.Duration
+	workers      int
+	queue        chan map[string]interface{}
+	wg           sync.WaitGroup
+
+	// downloads a binary from the Cb Response Server; replaced in tests
+	download func(md5 string, w io.Writer, maxBytes int64, timeout time.Duration) (int64, error)
+	// hands the annotated event on to the output; replaced in tests
+	output func(msg map[string]interface{}) error
+
+	// locations of recently exported binaries, so that repeated events do not query the store
+	exported ttlru.Cache
+
+	inflightLock sync.Mutex
+	inflight     map[string]*binaryExport
+
+	exportedCount int64
+	exportedSize  int64
+	duplicates    int64
+	tooLarge      int64
+	failed        int64
+	retryCount    int64
+}
+
+func downloadBinary(md5 string, w io.Writer, maxBytes int64, timeout time.Duration) (int64, error) {
+	if cbAPI == nil {
+		return 0, fmt.Errorf("Cb Response API client is not configured; set cb_server_url and api_token")
+	}
+	return cbAPI.Download(fmt.Sprintf("api/v1/binary/%s", md5), w, maxBytes, timeout)
+}
+
+func NewBinaryExporter(store BinaryStore, workers, queueSize int, maxSize int64, retries int,
+	timeout time.Duration) *BinaryExporter {
+	return &BinaryExporter{
+		store:        store,
+		maxSize:      maxSize,
+		retries:      retries,
+		retryBackoff: 5 * time.Second,
+		timeout:      timeout,
+		workers:      workers,
+		queue:        make(chan map[string]interface{}, queueSize),
+		download:     downloadBinary,
+		output:       outputMessage,
+		exported:     ttlru.New(10000, ttlru.WithTTL(24*time.Hour)),
+		inflight:     make(map[string]*binaryExport),
+	}
+}
+
+func isBinaryStoreFileAdded(msg map[string]interface{}) bool {
+	eventType, _ := msg["type"].(string)
+	return eventType == "binarystore.file.added"
+}
+
+func (e *BinaryExporter) Start() {
+	log.Infof("Exporting binaries to %s with %d workers", e.store, e.workers)
+
+	e.wg.Add(e.workers)
+	for i := 0; i < e.workers; i++ {
+		go e.worker()
+	}
+}
+
+// Submit queues a binarystore.file.added event for export, blocking while the queue is full so that consumption
+// from the message bus slows down rather than binaries going unexported.
+func (e *BinaryExporter) Submit(msg map[string]interface{}) {
+	e.queue <- msg
+}
+
+// Stop waits for all queued exports to finish. No events may be submitted after Stop is called.
+func (e *BinaryExporter) Stop() {
+	close(e.queue)
+	e.wg.Wait()
+}
+
+func (e *BinaryExporter) worker() {
+	defer e.wg.Done()
+
+	for msg := range e.queue {
+		location, err := e.export(msg)
+		if err != nil {
+			log.Errorf("Could not export binary %v: %s", msg["md5"], err)
+			msg["binary_export_error"] = err.Error()
+		} else {
+			msg["binary_location"] = location
+		}
+
+		if err := e.output(msg); err != nil {
+			log.Errorf("Error outputting binarystore.file.added event: %s", err)
+		}
+	}
+}
+
+func (e *BinaryExporter) export(msg map[string]interface{}) (string, error) {
+	md5, ok := msg["md5"].(string)
+	if !ok || md5 == "" {
+		return "", fmt.Errorf("event has no md5")
+	}
+	if !binaryMd5Pattern.MatchString(md5) {
+		return "", fmt.Errorf("invalid md5 %q", md5)
+	}
+	md5 = strings.ToUpper(md5)
+
+	// the binary is downloaded as a zip, so compare the compressed size where the event provides it
+	size, ok := intFromEvent(msg["compressed_size"])
+	if !ok {
+		size, ok = intFromEvent(msg["size"])
+	}
+	if ok && int64(size) > e.maxSize {
+		atomic.AddInt64(&e.tooLarge, 1)
+		return "", fmt.Errorf("binary is %d bytes, larger than the %d byte limit", size, e.maxSize)
+	}
+
+	if location, ok := e.exported.Get(md5); ok {
+		atomic.AddInt64(&e.duplicates, 1)
+		return location.(string), nil
+	}
+
+	e.inflightLock.Lock()
+	if export, ok := e.inflight[md5]; ok {
+		e.inflightLock.Unlock()
+		atomic.AddInt64(&e.duplicates, 1)
+		<-export.done
+		return export.location, export.err
+	}
+	export := &binaryExport{done: make(chan struct{})}
+	e.inflight[md5] = export
+	e.inflightLock.Unlock()
+
+	export.location, export.err = e.exportWithRetry(md5)
+	if export.err == nil {
+		e.exported.Set(md5, export.location)
+	} else {
+		atomic.AddInt64(&e.failed, 1)
+	}
+
+	e.inflightLock.Lock()
+	delete(e.inflight, md5)
+	e.inflightLock.Unlock()
+	close(export.done)
+
+	return export.location, export.err
+}
+
+func (e *BinaryExporter) exportWithRetry(md5 string) (string, error) {
+	if location, exists, err := e.store.Exists(md5); err == nil && exists {
+		atomic.AddInt64(&e.duplicates, 1)
+		return location, nil
+	}
+
+	backoff := e.retryBackoff
+	for attempt := 0; ; attempt++ {
+		location, err := e.exportOnce(md5)
+		if err == nil {
+			return location, nil
+		}
+		if permanent, ok := err.(*permanentExportError); ok {
+			return "", permanent.err
+		}
+		if attempt >= e.retries {
+			return "", err
+		}
+
+		log.Debugf("Retrying export of binary %s in %s after error: %s", md5, backoff, err)
+		atomic.AddInt64(&e.retryCount, 1)
+
+		// give up rather than hold up shutdown; the event is output with the last error
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-shutdownRequested:
+			timer.Stop()
+			return "", err
+		}
+		backoff *= 2
+	}
+}
+
+func (e *BinaryExporter) exportOnce(md5 string) (string, error) {
+	f, err := ioutil.TempFile(e.store.TempDir(), ".download-"+md5+"-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	n, err := e.download(md5, f, e.maxSize, e.timeout)
+	if n > e.maxSize {
+		atomic.AddInt64(&e.tooLarge, 1)
+		return "", &permanentExportError{fmt.Errorf("binary is larger than the %d byte limit", e.maxSize)}
+	}
+	if err != nil {
+		if apiErr, ok := err.(*CbAPIError); ok && !apiErr.retryable() {
+			return "", &permanentExportError{err}
+		}
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	location, err := e.store.Put(md5, f)
+	if err != nil {
+		return "", err
+	}
+
+	atomic.AddInt64(&e.exportedCount, 1)
+	atomic.AddInt64(&e.exportedSize, n)
+	log.Debugf("Exported binary %s (%d bytes) to %s", md5, n, location)
+
+	return location, nil
+}
+
+func (e *BinaryExporter) Statistics() interface{} {
+	return BinaryExportStatistics{
+		Destination:  e.store.String(),
+		QueueDepth:   len(e.queue),
+		QueueSize:    cap(e.queue),
+		Exported:     atomic.LoadInt64(&e.exportedCount),
+		ExportedSize: atomic.LoadInt64(&e.exportedSize),
+		Duplicates:   atomic.LoadInt64(&e.duplicates),
+		TooLarge:     atomic.LoadInt64(&e.tooLarge),
+		Failed:       atomic.LoadInt64(&e.failed),
+		Retries:      atomic.LoadInt64(&e.retryCount),
+	}
+}
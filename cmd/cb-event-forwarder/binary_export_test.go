@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBinaryExporter(t *testing.T) {
+	for _, test := range []struct {
+		desc              string
+		events            []map[string]interface{}
+		downloadFailures  int
+		downloadError     error
+		downloadSize      int
+		expectedDownloads int
+		expectedFiles     []string
+		expectedErrors    int
+	}{
+		{
+			desc: "Binary is stored under its md5",
+			events: []map[string]interface{}{
+				{"type": "binarystore.file.added", "md5": "33ae1b209d9be2fc6835b8a35a889cec",
+					"compressed_size": json.Number("57682")},
+			},
+			expectedDownloads: 1,
+			expectedFiles:     []string{"33AE1B209D9BE2FC6835B8A35A889CEC.zip"},
+		},
+		{
+			desc: "Duplicate events download the binary once",
+			events: []map[string]interface{}{
+				{"type": "binarystore.file.added", "md5": "33F50BFD715A530B9ED683C6BE108A74"},
+				{"type": "binarystore.file.added", "md5": "33F50BFD715A530B9ED683C6BE108A74"},
+				{"type": "binarystore.file.added", "md5": "33F50BFD715A530B9ED683C6BE108A74"},
+			},
+			expectedDownloads: 1,
+			expectedFiles:     []string{"33F50BFD715A530B9ED683C6BE108A74.zip"},
+		},
+		{
+			desc: "Failed downloads are retried",
+			events: []map[string]interface{}{
+				{"type": "binarystore.file.added", "md5": "5A1F895338418DF8C1D31E590DC1BAA5"},
+			},
+			downloadFailures:  2,
+			expectedDownloads: 3,
+			expectedFiles:     []string{"5A1F895338418DF8C1D31E590DC1BAA5.zip"},
+		},
+		{
+			desc: "Binaries over the size limit are not downloaded",
+			events: []map[string]interface{}{
+				{"type": "binarystore.file.added", "md5": "D5496CF5DF8921CFC1EF1770F98C2192",
+					"compressed_size": json.Number("361314")},
+			},
+			expectedErrors: 1,
+		},
+		{
+			desc: "Binaries the server does not have are not retried",
+			events: []map[string]interface{}{
+				{"type": "binarystore.file.added", "md5": "D5496CF5DF8921CFC1EF1770F98C2192"},
+			},
+			downloadFailures:  1,
+			downloadError:     &CbAPIError{StatusCode: 404},
+			expectedDownloads: 1,
+			expectedErrors:    1,
+		},
+		{
+			desc: "Downloads over the size limit are not retried",
+			events: []map[string]interface{}{
+				{"type": "binarystore.file.added", "md5": "D5496CF5DF8921CFC1EF1770F98C2192"},
+			},
+			downloadSize:      100001,
+			expectedDownloads: 1,
+			expectedErrors:    1,
+		},
+		{
+			desc: "Invalid md5s are rejected",
+			events: []map[string]interface{}{
+				{"type": "binarystore.file.added", "md5": "../../etc/cron.d/D5496CF5DF8921CF"},
+				{"type": "binarystore.file.added", "md5": "D5496CF5DF8921CFC1EF1770F98C21"},
+			},
+			expectedErrors: 2,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "binary-export")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			store, err := newBinaryStore("file:" + dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var lock sync.Mutex
+			var downloads int
+			var output []map[string]interface{}
+
+			e := NewBinaryExporter(store, 2, len(test.events), 100000, 3, time.Second)
+			e.retryBackoff = time.Millisecond
+			e.download = func(md5 string, w io.Writer, maxBytes int64, timeout time.Duration) (int64, error) {
+				lock.Lock()
+				downloads++
+				fail := downloads <= test.downloadFailures
+				lock.Unlock()
+
+				// give duplicate events time to arrive while the first download is in progress
+				time.Sleep(20 * time.Millisecond)
+				if fail && test.downloadError != nil {
+					return 0, test.downloadError
+				}
+				if fail {
+					return 0, &CbAPIError{StatusCode: 503}
+				}
+				if test.downloadSize > 0 {
+					return io.Copy(w, io.LimitReader(strings.NewReader(strings.Repeat("x", test.downloadSize)), maxBytes+1))
+				}
+				n, err := io.Copy(w, strings.NewReader("PK zip of "+md5))
+				return n, err
+			}
+			e.output = func(msg map[string]interface{}) error {
+				lock.Lock()
+				output = append(output, msg)
+				lock.Unlock()
+				return nil
+			}
+
+			e.Start()
+			for _, event := range test.events {
+				e.Submit(event)
+			}
+			e.Stop()
+
+			if downloads != test.expectedDownloads {
+				t.Errorf("expected %d downloads, got %d", test.expectedDownloads, downloads)
+			}
+			if len(output) != len(test.events) {
+				t.Fatalf("expected %d events to be output, got %d", len(test.events), len(output))
+			}
+
+			var errs int
+			for _, msg := range output {
+				if _, ok := msg["binary_export_error"]; ok {
+					errs++
+					continue
+				}
+				location, _ := msg["binary_location"].(string)
+				if filepath.Dir(location) != dir {
+					t.Errorf("expected binary_location in %s, got %v", dir, msg["binary_location"])
+				}
+			}
+			if errs != test.expectedErrors {
+				t.Errorf("expected %d events with binary_export_error, got %d", test.expectedErrors, errs)
+			}
+
+			files, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, f := range files {
+				names = append(names, f.Name())
+			}
+			if strings.Join(names, ",") != strings.Join(test.expectedFiles, ",") {
+				t.Errorf("expected files %v in the destination, got %v", test.expectedFiles, names)
+			}
+		})
+	}
+}
+
+func TestNewBinaryStoreErrors(t *testing.T) {
+	for _, destination := range []string{"", "/var/cb/binaries", "s3:my-bucket", "ftp:host"} {
+		if _, err := newBinaryStore(destination); err == nil {
+			t.Errorf("expected an error for destination %q", destination)
+		}
+	}
+
+	if _, err := newBinaryStore("file:/dev/null/binaries"); err == nil {
+		t.Errorf("expected an error for a destination that cannot be created")
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"filippo.io/age"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// the shortest HMAC key accepted in a bundle signing key file
+const minBundleHMACKeyLength = 32
+
+// detached signatures are written next to the file they sign, with this suffix
+const signatureFileSuffix = ".sig"
+
+// loadBundleRecipients reads the age recipients that output files are encrypted to, one age1... X25519 public key per
+// line. Blank lines and lines starting with # are skipped.
+func loadBundleRecipients(fileName string) ([]age.Recipient, error) {
+	fp, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	return age.ParseRecipients(fp)
+}
+
+// encryptedFile is an output file written through an age encryption stream. Closing it writes the final chunk of
+// the stream before closing the file, without which the file cannot be decrypted.
+type encryptedFile struct {
+	io.WriteCloser
+	file *os.File
+}
+
+func newEncryptedFile(fp *os.File, recipients []age.Recipient) (*encryptedFile, error) {
+	w, err := age.Encrypt(fp, recipients...)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedFile{WriteCloser: w, file: fp}, nil
+}
+
+func (f *encryptedFile) Close() error {
+	err := f.WriteCloser.Close()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// A BundleSigner writes a detached signature file for each rolled over output file. The hmac method signs the file
+// with HMAC-SHA256 using a shared secret; the ed25519 method signs the SHA-256 digest of the file with an Ed25519
+// private key, so that consumers only need the public key to verify it.
+type BundleSigner struct {
+	Method string
+
+	hmacKey    []byte
+	privateKey ed25519.PrivateKey
+}
+
+// BundleSignature is the content of a .sig file.
+type BundleSignature struct {
+	File      string `json:"file"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+	Algorithm string `json:"algorithm"`
+	Signature string `json:"signature"`
+}
+
+// NewBundleSigner loads the signing key for method from keyFile. For hmac, the file holds the secret (at least 32
+// characters, surrounding whitespace is ignored); for ed25519, it holds a PEM encoded PKCS #8 private key, such as
+// the one written by openssl genpkey -algorithm ed25519.
+func NewBundleSigner(method, keyFile string) (*BundleSigner, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &BundleSigner{Method: method}
+	switch method {
+	case "hmac":
+		s.hmacKey = []byte(strings.TrimSpace(string(data)))
+		if len(s.hmacKey) < minBundleHMACKeyLength {
+			return nil, fmt.Errorf("the HMAC key is shorter than %d characters", minBundleHMACKeyLength)
+		}
+	case "ed25519":
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "PRIVATE KEY" {
+			return nil, errors.New("expected a PEM encoded PRIVATE KEY")
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		privateKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("the private key is not an Ed25519 key")
+		}
+		s.privateKey = privateKey
+	default:
+		return nil, fmt.Errorf("unknown signing method %s", method)
+	}
+	return s, nil
+}
+
+// signatureFileName returns the name of the detached signature file for fileName.
+func signatureFileName(fileName string) string {
+	return fileName + signatureFileSuffix
+}
+
+// signFile computes the signature of fileName and writes it to its signature file, returning the signature file name.
+func (s *BundleSigner) signFile(fileName string) (string, error) {
+	fp, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+
+	digest := sha256.New()
+	var mac hash.Hash
+	w := io.Writer(digest)
+	if s.Method == "hmac" {
+		mac = hmac.New(sha256.New, s.hmacKey)
+		w = io.MultiWriter(digest, mac)
+	}
+	size, err := io.Copy(w, fp)
+	if err != nil {
+		return "", err
+	}
+
+	sig := BundleSignature{
+		File:   filepath.Base(fileName),
+		Size:   size,
+		SHA256: hex.EncodeToString(digest.Sum(nil)),
+	}
+	if s.Method == "hmac" {
+		sig.Algorithm = "hmac-sha256"
+		sig.Signature = hex.EncodeToString(mac.Sum(nil))
+	} else {
+		sig.Algorithm = "ed25519-sha256"
+		sig.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(s.privateKey, digest.Sum(nil)))
+	}
+
+	data, err := json.Marshal(sig)
+	if err != nil {
+		return "", err
+	}
+
+	// write the signature under a temporary name first, so a partial signature file is never picked up
+	sigName := signatureFileName(fileName)
+	if err := ioutil.WriteFile(sigName+".tmp", append(data, '\n'), 0644); err != nil {
+		return "", err
+	}
+	return sigName, os.Rename(sigName+".tmp", sigName)
+}
+
+// ensureSignature returns the signature file for fileName, signing it first if the file has not been signed yet, as
+// for files left behind by an unclean shutdown.
+func (s *BundleSigner) ensureSignature(fileName string) (string, error) {
+	sigName := signatureFileName(fileName)
+	if _, err := os.Stat(sigName); err == nil {
+		return sigName, nil
+	}
+	return s.signFile(fileName)
+}
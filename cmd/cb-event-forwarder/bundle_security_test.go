@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/google/go-cmp/cmp"
+	"github.com/vaughan0/go-ini"
+)
+
+type fakeBundleBehavior struct {
+	uploaded map[string][]byte
+	sync.Mutex
+}
+
+func (b *fakeBundleBehavior) Upload(fileName string, fp *os.File) UploadStatus {
+	data, err := ioutil.ReadAll(fp)
+	if err == nil {
+		b.Lock()
+		b.uploaded[filepath.Base(fileName)] = data
+		b.Unlock()
+	}
+	return UploadStatus{fileName: fileName, result: err}
+}
+
+func (b *fakeBundleBehavior) Initialize(connString string) error { return nil }
+func (b *fakeBundleBehavior) Statistics() interface{}            { return nil }
+func (b *fakeBundleBehavior) Key() string                        { return "fake" }
+func (b *fakeBundleBehavior) String() string                     { return "fake" }
+
+func readSignature(t *testing.T, sigName string) BundleSignature {
+	data, err := ioutil.ReadFile(sigName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sig BundleSignature
+	if err := json.Unmarshal(data, &sig); err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func TestEncryptedSignedFileOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipientsFile := filepath.Join(dir, "recipients.txt")
+	keyFile := filepath.Join(dir, "signing.key")
+	secret := "0123456789abcdef0123456789abcdef"
+	ioutil.WriteFile(recipientsFile, []byte("# downstream SIEM\n"+identity.Recipient().String()+"\n"), 0644)
+	ioutil.WriteFile(keyFile, []byte(secret+"\n"), 0600)
+
+	input := ini.File{"bundle_security": {"recipients_file": recipientsFile, "signing_method": "hmac",
+		"signing_key_file": keyFile}}
+	parsed := Configuration{OutputType: FileOutputType}
+	errs := &ConfigurationError{Empty: true}
+	parseBundleSecurityConfiguration(&input, &parsed, errs)
+	if !errs.Empty {
+		t.Fatal(errs)
+	}
+
+	saved := config
+	defer func() { config = saved }()
+	config.FileHandlerCompressData = true
+	config.BundleRecipients = parsed.BundleRecipients
+	config.BundleSigner = parsed.BundleSigner
+
+	o := &FileOutput{}
+	if err := o.Initialize(filepath.Join(dir, "events.json")); err != nil {
+		t.Fatal(err)
+	}
+	o.output(`{"type":"ingress.event.procstart"}`)
+	o.output(`{"type":"ingress.event.netconn"}`)
+	rolled, err := o.rollOverFile("20060102")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.closeFile()
+	if !strings.HasSuffix(rolled, ".gz.age") {
+		t.Errorf("expected the rolled over file to be named *.gz.age, got %s", rolled)
+	}
+
+	ciphertext, err := ioutil.ReadFile(rolled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(ciphertext, []byte("ingress.event")) {
+		t.Error("expected the rolled over file to be encrypted")
+	}
+	r, err := age.Decrypt(bytes.NewReader(ciphertext), identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := "{\"type\":\"ingress.event.procstart\"}\n{\"type\":\"ingress.event.netconn\"}\n"
+	if string(plaintext) != lines {
+		t.Errorf("expected %q, got %q", lines, plaintext)
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(ciphertext)
+	digest := sha256.Sum256(ciphertext)
+	expected := BundleSignature{File: filepath.Base(rolled), Size: int64(len(ciphertext)),
+		SHA256: hex.EncodeToString(digest[:]), Algorithm: "hmac-sha256", Signature: hex.EncodeToString(mac.Sum(nil))}
+	if diff := cmp.Diff(expected, readSignature(t, signatureFileName(rolled))); diff != "" {
+		t.Errorf("signature mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestBundledOutputUploadsSignatures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "signing.pem")
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	signer, err := NewBundleSigner("ed25519", keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := config
+	defer func() { config = saved }()
+	config.BundleSigner = signer
+	config.BundleRecipients = nil
+	config.FileHandlerCompressData = false
+
+	// a straggler left behind without a signature, and one that was signed at rollover
+	holding := filepath.Join(dir, "holding")
+	os.Mkdir(holding, 0700)
+	unsigned := filepath.Join(holding, "event-forwarder.2024-05-01T10:00:00.000.restart")
+	signed := filepath.Join(holding, "event-forwarder.2024-05-01T10:05:00.000")
+	ioutil.WriteFile(unsigned, []byte("first\n"), 0644)
+	ioutil.WriteFile(signed, []byte("second\n"), 0644)
+	if _, err := signer.signFile(signed); err != nil {
+		t.Fatal(err)
+	}
+
+	behavior := &fakeBundleBehavior{uploaded: make(map[string][]byte)}
+	o := &BundledOutput{behavior: behavior}
+	if err := o.Initialize(holding + ":bucket"); err != nil {
+		t.Fatal(err)
+	}
+	defer o.tempFileOutput.closeFile()
+
+	queued := append([]string(nil), o.filesToUpload...)
+	sort.Strings(queued)
+	if diff := cmp.Diff([]string{unsigned, signed}, queued); diff != "" {
+		t.Fatalf("queued files mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, fn := range queued {
+		go o.uploadOne(fn)
+		if result := <-o.fileResultChan; result.result != nil || result.fileName != fn {
+			t.Errorf("unexpected upload result %+v", result)
+		}
+	}
+
+	for _, fn := range queued {
+		name := filepath.Base(fn)
+		var sig BundleSignature
+		if err := json.Unmarshal(behavior.uploaded[name+".sig"], &sig); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		digest := sha256.Sum256(behavior.uploaded[name])
+		signature, _ := base64.StdEncoding.DecodeString(sig.Signature)
+		if sig.Algorithm != "ed25519-sha256" ||
+			!ed25519.Verify(privateKey.Public().(ed25519.PublicKey), digest[:], signature) {
+			t.Errorf("%s: signature does not verify: %+v", name, sig)
+		}
+		if _, err := os.Stat(fn); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed after the upload", fn)
+		}
+		if _, err := os.Stat(signatureFileName(fn)); !os.IsNotExist(err) {
+			t.Errorf("expected the signature of %s to be removed after the upload", fn)
+		}
+	}
+}
+
+func TestParseBundleSecurityConfigurationErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	shortKey := filepath.Join(dir, "short.key")
+	ioutil.WriteFile(shortKey, []byte("too short"), 0600)
+	badRecipients := filepath.Join(dir, "recipients.txt")
+	ioutil.WriteFile(badRecipients, []byte("not-a-recipient\n"), 0644)
+
+	for _, test := range []struct {
+		outputType int
+		section    ini.Section
+	}{
+		{HTTPOutputType, ini.Section{"signing_key_file": shortKey, "signing_method": "hmac"}},
+		{FileOutputType, ini.Section{"recipients_file": badRecipients}},
+		{FileOutputType, ini.Section{"recipients_file": filepath.Join(dir, "missing")}},
+		{S3OutputType, ini.Section{"signing_key_file": shortKey, "signing_method": "hmac"}},
+		{S3OutputType, ini.Section{"signing_key_file": shortKey, "signing_method": "rsa"}},
+		{S3OutputType, ini.Section{"signing_key_file": shortKey}},
+	} {
+		parsed := &Configuration{OutputType: test.outputType}
+		errs := &ConfigurationError{Empty: true}
+		parseBundleSecurityConfiguration(&ini.File{"bundle_security": test.section}, parsed, errs)
+		if errs.Empty {
+			t.Errorf("expected an error for %v with output type %d", test.section, test.outputType)
+		}
+	}
+}
@@ -16,6 +16,8 @@ type UploadStatus struct {
 	fileName string
 	result   error
 	status   int
+	// the file was empty and removed without being uploaded
+	skipped bool
 }
 
 type BundledOutput struct {
@@ -36,6 +38,8 @@ type BundledOutput struct {
 	fileResultChan    chan UploadStatus
 
 	filesToUpload []string
+	// uploads started but whose result has not been received yet
+	uploadsInFlight int
 
 	// TODO: make this thread-safe from the status page
 	sync.RWMutex
@@ -65,6 +69,10 @@ type BundleBehavior interface {
 }
 
 func (o *BundledOutput) uploadOne(fileName string) {
+	// read the signer once; the result must only be reported once the files are gone, as the receiver may move on
+	// (and, at shutdown, exit) as soon as it has the result
+	signer := config.BundleSigner
+
 	fp, err := os.OpenFile(fileName, os.O_RDONLY, 0644)
 	if err != nil {
 		o.fileResultChan <- UploadStatus{fileName: fileName, result: err}
@@ -73,15 +81,19 @@ func (o *BundledOutput) uploadOne(fileName string) {
 
 	fileInfo, err := fp.Stat()
 	if err != nil {
-		o.fileResultChan <- UploadStatus{fileName: fileName, result: err}
 		fp.Close()
+		o.fileResultChan <- UploadStatus{fileName: fileName, result: err}
 		return
 	}
+
+	uploadStatus := UploadStatus{fileName: fileName, skipped: true}
 	if fileInfo.Size() > 0 || config.UploadEmptyFiles {
 		// only upload if the file size is greater than zero
-		uploadStatus := o.behavior.Upload(fileName, fp)
+		uploadStatus = o.behavior.Upload(fileName, fp)
+		if uploadStatus.result == nil && signer != nil {
+			uploadStatus = o.uploadSignature(signer, fileName)
+		}
 		err = uploadStatus.result
-		o.fileResultChan <- uploadStatus
 	}
 
 	fp.Close()
@@ -92,7 +104,40 @@ func (o *BundledOutput) uploadOne(fileName string) {
 		if err != nil {
 			log.Infof("error removing %s: %s", fileName, err.Error())
 		}
+		if signer != nil {
+			os.Remove(signatureFileName(fileName))
+		}
 	}
+
+	o.fileResultChan <- uploadStatus
+}
+
+// startUpload uploads fileName in the background. Every upload started reports exactly one result on fileResultChan.
+func (o *BundledOutput) startUpload(fileName string) {
+	o.Lock()
+	o.uploadsInFlight++
+	o.Unlock()
+
+	go o.uploadOne(fileName)
+}
+
+// uploadSignature uploads the detached signature of a bundle after the bundle itself. If the signature cannot be
+// uploaded, the result is reported for the bundle, so that both are uploaded again.
+func (o *BundledOutput) uploadSignature(signer *BundleSigner, fileName string) UploadStatus {
+	sigName, err := signer.ensureSignature(fileName)
+	if err != nil {
+		return UploadStatus{fileName: fileName, result: err}
+	}
+
+	fp, err := os.Open(sigName)
+	if err != nil {
+		return UploadStatus{fileName: fileName, result: err}
+	}
+	defer fp.Close()
+
+	uploadStatus := o.behavior.Upload(sigName, fp)
+	uploadStatus.fileName = fileName
+	return uploadStatus
 }
 
 func (o *BundledOutput) queueStragglers() {
@@ -116,6 +161,11 @@ func (o *BundledOutput) queueStragglers() {
 			continue
 		}
 
+		// signature files are uploaded along with the bundle they sign
+		if strings.HasSuffix(fn, signatureFileSuffix) || strings.HasSuffix(fn, signatureFileSuffix+".tmp") {
+			continue
+		}
+
 		if len(strings.TrimPrefix(fn, "event-forwarder")) > 0 {
 			o.filesToUpload = append(o.filesToUpload, filepath.Join(o.tempFileDirectory, fn))
 		}
@@ -190,7 +240,7 @@ func (o *BundledOutput) rollOver() error {
 		return err
 	}
 
-	go o.uploadOne(fn)
+	o.startUpload(fn)
 	o.currentFileSize = 0
 
 	return nil
@@ -219,26 +269,43 @@ func (o *BundledOutput) Statistics() interface{} {
 	}
 }
 
-func (o *BundledOutput) Go(messages <-chan string, errorChan chan<- error) error {
+// Connected reports false when the most recent upload attempt failed.
+func (o *BundledOutput) Connected() bool {
+	o.RLock()
+	defer o.RUnlock()
+
+	return !o.lastUploadErrorTime.After(o.lastSuccessfulUpload)
+}
+
+// Backlog returns the number of rolled-over files waiting to be uploaded, including those being uploaded.
+func (o *BundledOutput) Backlog() int {
+	o.RLock()
+	defer o.RUnlock()
+
+	return len(o.filesToUpload) + o.uploadsInFlight
+}
+
+func (o *BundledOutput) Go(messages <-chan string, errorChan chan<- error, done chan<- struct{}) error {
 	go func() {
 		refreshTicker := time.NewTicker(1 * time.Second)
 
 		hup := make(chan os.Signal, 1)
 		signal.Notify(hup, syscall.SIGHUP)
 
-		term := make(chan os.Signal, 1)
-		signal.Notify(term, syscall.SIGTERM)
-		signal.Notify(term, syscall.SIGINT)
-
+		defer close(done)
 		defer refreshTicker.Stop()
 		defer o.tempFileOutput.closeFile()
 		defer o.tempFileOutput.flushOutput(true)
 		defer signal.Stop(hup)
-		defer signal.Stop(term)
 
 		for {
 			select {
-			case message := <-messages:
+			case message, ok := <-messages:
+				if !ok {
+					log.Infof("Output channel closed; sending remaining data to %s", o.behavior.String())
+					o.drain()
+					return
+				}
 				if err := o.output(message); err != nil {
 					errorChan <- err
 					return
@@ -252,35 +319,20 @@ func (o *BundledOutput) Go(messages <-chan string, errorChan chan<- error) error
 					}
 				}
 
+				o.Lock()
+				var fn string
 				if len(o.filesToUpload) > 0 {
-					var fn string
 					fn, o.filesToUpload = o.filesToUpload[0], o.filesToUpload[1:]
-					go o.uploadOne(fn)
+				}
+				o.Unlock()
+				if fn != "" {
+					o.startUpload(fn)
 				}
 
 			case fileResult := <-o.fileResultChan:
-				if fileResult.result != nil {
-					o.uploadErrors++
-					o.lastUploadError = fileResult.result.Error()
-					o.lastUploadErrorTime = time.Now()
-					//Handle 400s - lets stop processing the file and move it to debug zone
-					if fileResult.status != 400 {
-						// our default behavior is to try and upload the file next time around...
-						o.filesToUpload = append(o.filesToUpload, fileResult.fileName)
-					} else {
-						// if we receive HTTP 400 error code (Bad Request), we assume the error is "permanent" and
-						//  due not to some transient issue on the server side (overloading, service not available, etc)
-						//  and instead an issue with the data we've sent. So move the file to the debug area and
-						//  don't try to upload it again.
-						MoveFileToDebug(fileResult.fileName)
-					}
-
-					log.Infof("Error uploading file %s: %s", fileResult.fileName, fileResult.result)
-				} else {
-					o.successfulUploads++
-					o.lastSuccessfulUpload = time.Now()
-					log.Infof("Successfully uploaded file %s to %s.", fileResult.fileName, o.behavior.String())
-				}
+				o.Lock()
+				o.recordUploadResult(fileResult)
+				o.Unlock()
 
 			case <-hup:
 				// flush to S3 immediately
@@ -289,15 +341,79 @@ func (o *BundledOutput) Go(messages <-chan string, errorChan chan<- error) error
 					errorChan <- err
 					return
 				}
-			case <-term:
-				// handle exit gracefully
-				errorChan <- errors.New("SIGTERM received")
-				refreshTicker.Stop()
-				log.Info("Received SIGTERM. Exiting")
-				return
 			}
 		}
 	}()
 
 	return nil
 }
+
+func (o *BundledOutput) recordUploadResult(fileResult UploadStatus) {
+	o.uploadsInFlight--
+
+	if fileResult.skipped {
+		log.Debugf("Removed empty file %s without uploading it", fileResult.fileName)
+	} else if fileResult.result != nil {
+		o.uploadErrors++
+		o.lastUploadError = fileResult.result.Error()
+		o.lastUploadErrorTime = time.Now()
+		//Handle 400s - lets stop processing the file and move it to debug zone
+		if fileResult.status != 400 {
+			// our default behavior is to try and upload the file next time around...
+			o.filesToUpload = append(o.filesToUpload, fileResult.fileName)
+		} else {
+			// if we receive HTTP 400 error code (Bad Request), we assume the error is "permanent" and
+			//  due not to some transient issue on the server side (overloading, service not available, etc)
+			//  and instead an issue with the data we've sent. So move the file to the debug area and
+			//  don't try to upload it again.
+			MoveFileToDebug(fileResult.fileName)
+		}
+
+		log.Infof("Error uploading file %s: %s", fileResult.fileName, fileResult.result)
+	} else {
+		o.successfulUploads++
+		o.lastSuccessfulUpload = time.Now()
+		log.Infof("Successfully uploaded file %s to %s.", fileResult.fileName, o.behavior.String())
+	}
+}
+
+// drain is called when the output channel has been closed during shutdown. The current bundle is rolled over and
+// every outstanding bundle is uploaded; files that still fail to upload are left in the temporary directory and
+// picked up again on the next start.
+func (o *BundledOutput) drain() {
+	if o.currentFileSize > 0 {
+		if err := o.rollOver(); err != nil {
+			log.Errorf("Could not roll over final bundle: %s", err)
+		}
+	}
+
+	o.Lock()
+	pending := o.filesToUpload
+	o.filesToUpload = make([]string, 0)
+	o.Unlock()
+
+	// upload the queued files one at a time, after the uploads already started by rollOver and the ticker
+	for _, fn := range pending {
+		o.waitForUploads()
+		o.startUpload(fn)
+	}
+	o.waitForUploads()
+}
+
+// waitForUploads records the results of the uploads in flight until none are left. Results are not necessarily
+// received in the order the uploads were started.
+func (o *BundledOutput) waitForUploads() {
+	for {
+		o.RLock()
+		inFlight := o.uploadsInFlight
+		o.RUnlock()
+		if inFlight == 0 {
+			return
+		}
+
+		result := <-o.fileResultChan
+		o.Lock()
+		o.recordUploadResult(result)
+		o.Unlock()
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBundledOutputDrain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := config
+	defer func() { config = saved }()
+	config.BundleSigner = nil
+	config.BundleRecipients = nil
+	config.FileHashChain = false
+	config.FileHandlerCompressData = false
+	config.UploadEmptyFiles = false
+	config.BundleSizeMax = 1024 * 1024
+
+	ioutil.WriteFile(filepath.Join(dir, "event-forwarder.2024-05-01T10:00:00.000"), []byte("first\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "event-forwarder.2024-05-01T10:05:00.000"), nil, 0644)
+
+	behavior := &fakeBundleBehavior{uploaded: make(map[string][]byte)}
+	o := &BundledOutput{behavior: behavior}
+	if err := o.Initialize(dir + ":bucket"); err != nil {
+		t.Fatal(err)
+	}
+	defer o.tempFileOutput.closeFile()
+
+	// an upload started by the ticker is still in flight when the output channel is closed
+	sort.Strings(o.filesToUpload)
+	fn := o.filesToUpload[0]
+	o.filesToUpload = o.filesToUpload[1:]
+	o.startUpload(fn)
+	if backlog := o.Backlog(); backlog != 2 {
+		t.Errorf("expected the queued and the in-flight upload in the backlog, got %d", backlog)
+	}
+	if err := o.output("second"); err != nil {
+		t.Fatal(err)
+	}
+	o.drain()
+
+	if o.Backlog() != 0 || o.successfulUploads != 2 || o.uploadErrors != 0 {
+		t.Errorf("expected two uploads and no backlog, got %d uploads, %d errors, backlog %d",
+			o.successfulUploads, o.uploadErrors, o.Backlog())
+	}
+	contents := make([]string, 0)
+	for _, data := range behavior.uploaded {
+		contents = append(contents, string(data))
+	}
+	sort.Strings(contents)
+	if diff := cmp.Diff([]string{"first\n", "second\n"}, contents); diff != "" {
+		t.Errorf("uploaded files mismatch (-want +got):\n%s", diff)
+	}
+	if remaining, _ := filepath.Glob(filepath.Join(dir, "event-forwarder.*")); len(remaining) != 0 {
+		t.Errorf("expected every rolled over file to be removed, found %v", remaining)
+	}
+}
@@ -1,15 +1,11 @@
 package main
 
 import (
-	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
-	"net/url"
 	"strconv"
 	"time"
-	"github.com/gregjones/httpcache"
 	"zvelo.io/ttlru"
 )
 
@@ -53,55 +49,12 @@ type APIInfo struct {
  */
 var FeedCache = ttlru.New(128, ttlru.WithTTL(5*time.Minute))
 
+// GetCb retrieves route from the Cb Response REST API through the shared client.
 func GetCb(route string) ([]byte, error) {
-
-	var proxyRequest func(*http.Request) (*url.URL, error)
-
-	if config.CbAPIProxyURL == "" {
-		/*
-		 * No Proxy was specified
-		 */
-		proxyRequest = nil
-	} else {
-		proxyURL, err := url.Parse(config.CbAPIProxyURL)
-		if err != nil {
-			return nil, err
-		}
-		proxyRequest = http.ProxyURL(proxyURL)
-	}
-
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: !config.CbAPIVerifySSL, MinVersion: tls.VersionTLS12},
-		Proxy:           proxyRequest,
-	}
-
-
-	c := httpcache.NewMemoryCache()
-	httpcachetr := &httpcache.Transport{Cache: c, MarkCachedResponses: true, Transport: tr}
-
-	httpClient := &http.Client{
-		Transport: httpcachetr,
-		Timeout:   5 * time.Second,
+	if cbAPI == nil {
+		return nil, errors.New("Cb Response API client is not configured; set cb_server_url and api_token")
 	}
-
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s%s", config.CbServerURL, route), nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Add("X-Auth-Token", config.CbAPIToken)
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("Cb Response Server returned a %d status code", resp.StatusCode)
-	}
-
-	body, err := ioutil.ReadAll(resp.Body)
-	return body, err
+	return cbAPI.Get(route)
 }
 
 func GetCbVersion() (version string, err error) {
@@ -122,67 +75,55 @@ func GetCbVersion() (version string, err error) {
 }
 
 func GetReportTitle(FeedID int, ReportID string) (string, error) {
-	threatReport := ThreatReport{}
-
-	key := strconv.Itoa(FeedID) + "|" + ReportID
-
-	reportTitle, cachePresent := FeedCache.Get(key)
-
-	if cachePresent && reportTitle != nil {
-		return reportTitle.(string), nil
-	}
-	body, err := GetCb(fmt.Sprintf("api/v1/feed/%d/report/%s", FeedID, ReportID))
-	if err != nil {
-		return "", err
-	}
-
-	err = json.Unmarshal(body, &threatReport)
-
+	threatReport, err := getThreatReport(FeedID, ReportID)
 	if err != nil {
 		return "", err
 	}
-
-	FeedCache.Set(key, threatReport.Title)
-
 	return threatReport.Title, nil
 }
 
-func GetReport(FeedID int, ReportID string) (string, int, string, error) {
-
-	threatReport := ThreatReport{}
-
-	key := strconv.Itoa(FeedID) + "|" + ReportID
+func reportCacheKey(FeedID int, ReportID string) string {
+	return strconv.Itoa(FeedID) + "|" + ReportID
+}
 
+// GetCachedReport returns the threat report for a "<feed_id>|<report_id>" key if it is in the FeedCache, without
+// querying the Cb Response Server.
+func GetCachedReport(key string) (*ThreatReport, bool) {
 	rawThreatReportP, cachePresent := FeedCache.Get(key)
+	if !cachePresent || rawThreatReportP == nil {
+		return nil, false
+	}
+	threatReportP, ok := rawThreatReportP.(*ThreatReport)
+	return threatReportP, ok
+}
 
-	if cachePresent {
-		if rawThreatReportP != nil {
-			threatReportP := (rawThreatReportP).(*ThreatReport)
-			threatReport := *threatReportP
-			reportTitle := threatReport.Title
-			reportScore := threatReport.Score
-			reportLink := threatReport.Link
-			return reportTitle, reportScore, reportLink, nil
-		}
+func getThreatReport(FeedID int, ReportID string) (*ThreatReport, error) {
+	key := reportCacheKey(FeedID, ReportID)
 
+	if cachedReport, ok := GetCachedReport(key); ok {
+		return cachedReport, nil
 	}
-	//implicit ELSE
+
 	body, err := GetCb(fmt.Sprintf("api/v1/feed/%d/report/%s", FeedID, ReportID))
+	if err != nil {
+		return nil, err
+	}
 
+	threatReport := &ThreatReport{}
+	err = json.Unmarshal(body, threatReport)
 	if err != nil {
-		return "", 0, "", err
+		return nil, err
 	}
 
-	err = json.Unmarshal(body, &threatReport)
+	FeedCache.Set(key, threatReport)
+
+	return threatReport, nil
+}
 
+func GetReport(FeedID int, ReportID string) (string, int, string, error) {
+	threatReport, err := getThreatReport(FeedID, ReportID)
 	if err != nil {
 		return "", 0, "", err
 	}
-
-	FeedCache.Set(key, &threatReport)
-
 	return threatReport.Title, threatReport.Score, threatReport.Link, nil
-
 }
-
-
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the shared client for the Cb Response REST API; nil unless api_token is set
+var cbAPI *CbAPIClient
+
+// CbAPIError is returned when the Cb Response Server answers with a non-200 status code.
+type CbAPIError struct {
+	StatusCode int
+}
+
+func (e *CbAPIError) Error() string {
+	return fmt.Sprintf("Cb Response Server returned a %d status code", e.StatusCode)
+}
+
+func (e *CbAPIError) retryable() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// rateLimiter spaces requests evenly so that no more than the configured number are started per second.
+type rateLimiter struct {
+	sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// Wait blocks until the caller may issue a request, or until ctx is done.
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	l.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type CbAPIStatistics struct {
+	Requests      int64            `json:"requests"`
+	Errors        int64            `json:"errors"`
+	Retries       int64            `json:"retries"`
+	StatusCodes   map[string]int64 `json:"status_codes"`
+	LatencyAvg    float64          `json:"latency_avg_ms"`
+	LatencyMax    float64          `json:"latency_max_ms"`
+	RateLimitWait float64          `json:"rate_limit_wait_ms"`
+}
+
+// CbAPIClient is shared by everything that queries the Cb Response REST API. It reuses connections across calls,
+// limits the rate of requests to the server and retries transient failures. Responses are not cached here; each
+// caller keeps a bounded cache of what it looked up.
+type CbAPIClient struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+	limiter    *rateLimiter
+
+	timeout      time.Duration
+	maxRetries   int
+	retryBackoff time.Duration
+
+	requests      int64
+	errors        int64
+	retries       int64
+	latencySum    int64
+	latencyMax    int64
+	rateLimitWait int64
+
+	statusLock  sync.Mutex
+	statusCodes map[int]int64
+}
+
+func NewCbAPIClient(baseURL, token string, verifySSL bool, proxyURL string) (*CbAPIClient, error) {
+	var proxyRequest func(*http.Request) (*url.URL, error)
+
+	if proxyURL != "" {
+		parsedProxyURL, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, err
+		}
+		proxyRequest = http.ProxyURL(parsedProxyURL)
+	}
+
+	tr := &http.Transport{
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: !verifySSL, MinVersion: tls.VersionTLS12},
+		Proxy:               proxyRequest,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+
+	return &CbAPIClient{
+		baseURL:      baseURL,
+		token:        token,
+		httpClient:   &http.Client{Transport: tr},
+		timeout:      5 * time.Second,
+		maxRetries:   3,
+		retryBackoff: 500 * time.Millisecond,
+		statusCodes:  make(map[int]int64),
+	}, nil
+}
+
+// newCbAPIClientFromConfig builds the shared client from the [bridge] api_* options.
+func newCbAPIClientFromConfig() (*CbAPIClient, error) {
+	c, err := NewCbAPIClient(config.CbServerURL, config.CbAPIToken, config.CbAPIVerifySSL, config.CbAPIProxyURL)
+	if err != nil {
+		return nil, err
+	}
+	c.timeout = config.CbAPITimeout
+	c.maxRetries = config.CbAPIMaxRetries
+	c.limiter = newRateLimiter(config.CbAPIRateLimit)
+	return c, nil
+}
+
+// Get retrieves route relative to the Cb Response Server URL. Each attempt is bounded by the client timeout;
+// network errors, 5xx and 429 responses are retried with exponential backoff.
+func (c *CbAPIClient) Get(route string) ([]byte, error) {
+	backoff := c.retryBackoff
+
+	for attempt := 0; ; attempt++ {
+		body, err := c.get(route)
+		if err == nil {
+			return body, nil
+		}
+
+		atomic.AddInt64(&c.errors, 1)
+
+		if apiErr, ok := err.(*CbAPIError); ok && !apiErr.retryable() {
+			return nil, err
+		}
+		if attempt >= c.maxRetries {
+			return nil, err
+		}
+
+		log.Debugf("Retrying %s in %s after error: %s", route, backoff, err)
+		atomic.AddInt64(&c.retries, 1)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// do issues a single rate limited GET request for route. The caller must close the response body.
+func (c *CbAPIClient) do(ctx context.Context, route string) (*http.Response, time.Time, error) {
+	if c.limiter != nil {
+		start := time.Now()
+		if err := c.limiter.Wait(ctx); err != nil {
+			return nil, start, err
+		}
+		atomic.AddInt64(&c.rateLimitWait, int64(time.Since(start)))
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s%s", c.baseURL, route), nil)
+	if err != nil {
+		return nil, time.Now(), err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Add("X-Auth-Token", c.token)
+
+	start := time.Now()
+	atomic.AddInt64(&c.requests, 1)
+
+	resp, err := c.httpClient.Do(req)
+	return resp, start, err
+}
+
+func (c *CbAPIClient) get(route string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	resp, start, err := c.do(ctx, route)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	c.recordResponse(resp, time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, &CbAPIError{StatusCode: resp.StatusCode}
+	}
+
+	return body, nil
+}
+
+// Download streams the body of route to w, failing if it is larger than maxBytes. Unlike Get, it makes a single
+// attempt bounded by timeout, since a partially written body cannot be retried.
+func (c *CbAPIClient) Download(route string, w io.Writer, maxBytes int64, timeout time.Duration) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resp, start, err := c.do(ctx, route)
+	if err != nil {
+		atomic.AddInt64(&c.errors, 1)
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		c.recordResponse(resp, time.Since(start))
+		atomic.AddInt64(&c.errors, 1)
+		return 0, &CbAPIError{StatusCode: resp.StatusCode}
+	}
+
+	n, err := io.Copy(w, io.LimitReader(resp.Body, maxBytes+1))
+	c.recordResponse(resp, time.Since(start))
+	if err != nil {
+		atomic.AddInt64(&c.errors, 1)
+		return n, err
+	}
+	if n > maxBytes {
+		return n, fmt.Errorf("%s is larger than the %d byte limit", route, maxBytes)
+	}
+
+	return n, nil
+}
+
+func (c *CbAPIClient) recordResponse(resp *http.Response, latency time.Duration) {
+	atomic.AddInt64(&c.latencySum, int64(latency))
+	for {
+		max := atomic.LoadInt64(&c.latencyMax)
+		if int64(latency) <= max || atomic.CompareAndSwapInt64(&c.latencyMax, max, int64(latency)) {
+			break
+		}
+	}
+
+	c.statusLock.Lock()
+	c.statusCodes[resp.StatusCode]++
+	c.statusLock.Unlock()
+}
+
+func (c *CbAPIClient) Statistics() interface{} {
+	toMillis := func(ns int64) float64 {
+		return float64(ns) / float64(time.Millisecond)
+	}
+
+	stats := CbAPIStatistics{
+		Requests:      atomic.LoadInt64(&c.requests),
+		Errors:        atomic.LoadInt64(&c.errors),
+		Retries:       atomic.LoadInt64(&c.retries),
+		StatusCodes:   make(map[string]int64),
+		LatencyMax:    toMillis(atomic.LoadInt64(&c.latencyMax)),
+		RateLimitWait: toMillis(atomic.LoadInt64(&c.rateLimitWait)),
+	}
+
+	c.statusLock.Lock()
+	var responses int64
+	for code, count := range c.statusCodes {
+		stats.StatusCodes[strconv.Itoa(code)] = count
+		responses += count
+	}
+	c.statusLock.Unlock()
+
+	if responses > 0 {
+		stats.LatencyAvg = toMillis(atomic.LoadInt64(&c.latencySum)) / float64(responses)
+	}
+
+	return stats
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCbAPIClientRetries(t *testing.T) {
+	for _, test := range []struct {
+		desc             string
+		statusCodes      []int
+		maxRetries       int
+		expectedRequests int64
+		expectError      bool
+	}{
+		{
+			desc:             "Success on first attempt",
+			statusCodes:      []int{200},
+			maxRetries:       3,
+			expectedRequests: 1,
+		},
+		{
+			desc:             "5xx is retried until success",
+			statusCodes:      []int{502, 503, 200},
+			maxRetries:       3,
+			expectedRequests: 3,
+		},
+		{
+			desc:             "5xx gives up after max retries",
+			statusCodes:      []int{500, 500, 500},
+			maxRetries:       2,
+			expectedRequests: 3,
+			expectError:      true,
+		},
+		{
+			desc:             "4xx is not retried",
+			statusCodes:      []int{404, 200},
+			maxRetries:       3,
+			expectedRequests: 1,
+			expectError:      true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			var requests int64
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt64(&requests, 1)
+				if r.Header.Get("X-Auth-Token") != "token" {
+					t.Errorf("expected X-Auth-Token header to be set")
+				}
+				w.WriteHeader(test.statusCodes[n-1])
+				w.Write([]byte(`{"version": "6.3.0"}`))
+			}))
+			defer server.Close()
+
+			c, err := NewCbAPIClient(server.URL+"/", "token", false, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.maxRetries = test.maxRetries
+			c.retryBackoff = time.Millisecond
+
+			body, err := c.Get("api/info")
+			if test.expectError && err == nil {
+				t.Errorf("expected an error, got body %s", body)
+			}
+			if !test.expectError && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if requests != test.expectedRequests {
+				t.Errorf("expected %d requests, got %d", test.expectedRequests, requests)
+			}
+		})
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(100)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := limiter.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first request goes immediately, the following four are spaced 10ms apart
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("expected 5 requests at 100/s to take at least 40ms, took %s", elapsed)
+	}
+
+	if newRateLimiter(0) != nil {
+		t.Errorf("expected a rate limit of 0 to disable the limiter")
+	}
+}
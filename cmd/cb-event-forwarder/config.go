@@ -5,11 +5,15 @@ import (
 	"crypto/x509"
 	"errors"
 	_ "expvar"
+	"filippo.io/age"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/vaughan0/go-ini"
 	"io/ioutil"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"text/template"
@@ -27,6 +31,18 @@ const (
 	KafkaOutputType
 )
 
+// names of the output types, as given in output_type
+var outputTypeNames = map[int]string{
+	FileOutputType:   "file",
+	S3OutputType:     "s3",
+	TCPOutputType:    "tcp",
+	UDPOutputType:    "udp",
+	SyslogOutputType: "syslog",
+	HTTPOutputType:   "http",
+	SplunkOutputType: "splunk",
+	KafkaOutputType:  "kafka",
+}
+
 const (
 	LEEFOutputFormat = iota
 	JSONOutputFormat
@@ -91,6 +107,16 @@ type Configuration struct {
 	// Compress data on S3 or file output types
 	FileHandlerCompressData bool
 
+	// Link the lines written by the file output in a hash chain
+	FileHashChain bool
+
+	// [bundle_security] encryption and signing of file output and S3 bundles, with keys read from files
+	BundleRecipientsFile string
+	BundleRecipients     []age.Recipient
+	BundleSigningMethod  string
+	BundleSigningKeyFile string
+	BundleSigner         *BundleSigner
+
 	TLSConfig *tls.Config
 
 	// optional post processing of feed hits to retrieve titles
@@ -98,6 +124,12 @@ type Configuration struct {
 	CbAPIToken                string
 	CbAPIVerifySSL            bool
 	CbAPIProxyURL             string
+	CbAPITimeout              time.Duration
+	CbAPIMaxRetries           int
+	CbAPIRateLimit            float64
+	PostprocessWorkers        int
+	PostprocessQueueSize      int
+	PostprocessTimeout        time.Duration
 
 	// Kafka-specific configuration
 	KafkaBrokers        *string
@@ -115,6 +147,118 @@ type Configuration struct {
 	RemoveFromOutput []string
 	AuditLog         bool
 	NumProcessors    int
+
+	// readiness checks reported through the /readyz endpoint
+	ReadinessStallTimeout     time.Duration
+	ReadinessMaxBundleBacklog int
+
+	// how long to wait for in-flight events to be output on SIGTERM before giving up
+	ShutdownTimeout time.Duration
+
+	// sensor details from the Cb Response REST API added to every event
+	SensorEnrichment        bool
+	SensorEnrichmentFields  []string
+	SensorEnrichmentRefresh time.Duration
+
+	// binary metadata from the Cb Response REST API added to events carrying an md5
+	BinaryEnrichment            bool
+	BinaryEnrichmentEventTypes  []string
+	BinaryEnrichmentCacheSize   int
+	BinaryEnrichmentCacheTTL    time.Duration
+	BinaryEnrichmentNegativeTTL time.Duration
+
+	// watchlist details from the Cb Response REST API added to watchlist hits and alerts
+	WatchlistEnrichment        bool
+	WatchlistEnrichmentRefresh time.Duration
+
+	// export of binaries announced by binarystore.file.added events
+	BinaryExport                    bool
+	BinaryExportDestination         string
+	BinaryExportWorkers             int
+	BinaryExportQueueSize           int
+	BinaryExportMaxSize             int64
+	BinaryExportRetries             int
+	BinaryExportTimeout             time.Duration
+	BinaryExportS3Endpoint          string
+	BinaryExportS3CredentialProfile string
+	BinaryExportS3ObjectPrefix      string
+
+	// audit log files tailed when AuditLog is set, and where their positions are saved
+	AuditLogFiles          []AuditLogFile
+	AuditLogCheckpointFile string
+
+	// additional files read by [file_input:<name>] sections
+	FileInputs []FileInputConfig
+
+	// [path_normalization] options
+	PathNormalization             bool
+	PathNormalizationFields       []string
+	PathNormalizationEventTypes   []string
+	PathNormalizationVolumes      map[string]string
+	PathNormalizationLearnVolumes bool
+	PathNormalizationSystemRoot   string
+
+	// [allowlist:<name>] sections
+	Allowlists []*Allowlist
+
+	// [domain_enrichment] options
+	DomainEnrichment               bool
+	DomainEnrichmentFields         []string
+	DomainEnrichmentEventTypes     []string
+	DomainTopSitesFile             string
+	DomainTopSitesLimit            int
+	DomainEnrichmentReloadInterval time.Duration
+
+	// Sigma rules evaluated when SigmaRulesDir is set
+	SigmaRulesDir  string
+	SigmaMinLevel  string
+	SigmaTagEvents bool
+
+	// [intel:<name>] files of indicators, and the [intel] options for matching them
+	IntelFiles          []*IntelFile
+	IntelFields         []IntelField
+	IntelEventTypes     []string
+	IntelEmitEvents     bool
+	IntelReloadInterval time.Duration
+
+	// GeoIP enrichment from the [geoip] MaxMind databases, enabled if either database is set
+	GeoIPCityDatabase   string
+	GeoIPASNDatabase    string
+	GeoIPFields         []string
+	GeoIPEventTypes     []string
+	GeoIPReloadInterval time.Duration
+
+	// [assets] zones and assets files, enabled if either is set
+	AssetZonesFile      string
+	AssetsFile          string
+	AssetEventTypes     []string
+	AssetReloadInterval time.Duration
+
+	// [netconn_aggregation] options
+	NetconnAggregation              bool
+	NetconnAggregationWindow        time.Duration
+	NetconnAggregationMaxFlows      int
+	NetconnAggregationRareThreshold int
+	NetconnAggregationRareWindow    time.Duration
+
+	// [dedup:<name>] sections, in order of name
+	Dedups []*DedupRule
+
+	// [filter:<name>] sections
+	Filters []*FilterRule
+
+	// [mask:<name>] sections, and the [masking] key file used by hmac rules
+	MaskRules          []*MaskRule
+	MaskKeyFile        string
+	MaskActiveKey      string
+	MaskReloadInterval time.Duration
+
+	// [transform:<n>] sections, in the order they are applied
+	Transforms []*TransformStep
+
+	// inventory.<kind> events polled from the Cb Response REST API, keyed by kind
+	InventoryIntervals   map[string]time.Duration
+	InventoryChangesOnly bool
 }
 
 type ConfigurationError struct {
@@ -732,6 +876,74 @@ func ParseConfig(fn string) (Configuration, error) {
 		config.CbAPIProxyURL = val
 	}
 
+	config.CbAPITimeout = 5 * time.Second
+	val, ok = input.Get("bridge", "api_timeout")
+	if ok {
+		timeout, err := strconv.ParseInt(val, 10, 64)
+		if err == nil && timeout > 0 {
+			config.CbAPITimeout = time.Duration(timeout) * time.Second
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid api_timeout: %s", val))
+		}
+	}
+
+	config.CbAPIMaxRetries = 3
+	val, ok = input.Get("bridge", "api_max_retries")
+	if ok {
+		maxRetries, err := strconv.Atoi(val)
+		if err == nil && maxRetries >= 0 {
+			config.CbAPIMaxRetries = maxRetries
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid api_max_retries: %s", val))
+		}
+	}
+
+	// default to no more than 20 requests per second to the Cb Response Server
+	config.CbAPIRateLimit = 20
+	val, ok = input.Get("bridge", "api_rate_limit")
+	if ok {
+		rateLimit, err := strconv.ParseFloat(val, 64)
+		if err == nil && rateLimit >= 0 {
+			config.CbAPIRateLimit = rateLimit
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid api_rate_limit: %s", val))
+		}
+	}
+
+	config.PostprocessWorkers = 4
+	val, ok = input.Get("bridge", "api_postprocess_workers")
+	if ok {
+		workers, err := strconv.Atoi(val)
+		if err == nil && workers > 0 {
+			config.PostprocessWorkers = workers
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid api_postprocess_workers: %s", val))
+		}
+	}
+
+	config.PostprocessQueueSize = 1000
+	val, ok = input.Get("bridge", "api_postprocess_queue_size")
+	if ok {
+		queueSize, err := strconv.Atoi(val)
+		if err == nil && queueSize >= 0 {
+			config.PostprocessQueueSize = queueSize
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid api_postprocess_queue_size: %s", val))
+		}
+	}
+
+	// default to sending the event without report details if the Cb server has not answered within five seconds
+	config.PostprocessTimeout = 5 * time.Second
+	val, ok = input.Get("bridge", "api_postprocess_timeout")
+	if ok {
+		timeout, err := strconv.ParseInt(val, 10, 64)
+		if err == nil && timeout > 0 {
+			config.PostprocessTimeout = time.Duration(timeout) * time.Second
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid api_postprocess_timeout: %s", val))
+		}
+	}
+
 	val, ok = input.Get("bridge", "message_processor_count")
 	if ok {
 		if numprocessors, err := strconv.ParseInt(val, 10, 32); err == nil {
@@ -741,6 +953,62 @@ func ParseConfig(fn string) (Configuration, error) {
 		}
 	}
 
+	// default to reporting not ready after five minutes without output while events are arriving
+	config.ReadinessStallTimeout = 5 * time.Minute
+	val, ok = input.Get("bridge", "readiness_stall_timeout")
+	if ok {
+		stallTimeout, err := strconv.ParseInt(val, 10, 64)
+		if err == nil && stallTimeout >= 0 {
+			config.ReadinessStallTimeout = time.Duration(stallTimeout) * time.Second
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid readiness_stall_timeout: %s", val))
+		}
+	}
+
+	config.ReadinessMaxBundleBacklog = 10
+	val, ok = input.Get("bridge", "readiness_max_bundle_backlog")
+	if ok {
+		maxBacklog, err := strconv.Atoi(val)
+		if err == nil && maxBacklog >= 0 {
+			config.ReadinessMaxBundleBacklog = maxBacklog
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid readiness_max_bundle_backlog: %s", val))
+		}
+	}
+
+	config.ShutdownTimeout = 30 * time.Second
+	val, ok = input.Get("bridge", "shutdown_timeout")
+	if ok {
+		shutdownTimeout, err := strconv.ParseInt(val, 10, 64)
+		if err == nil && shutdownTimeout > 0 {
+			config.ShutdownTimeout = time.Duration(shutdownTimeout) * time.Second
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid shutdown_timeout: %s", val))
+		}
+	}
+
+	parseSensorEnrichmentConfiguration(&input, &config, &errs)
+	parseBinaryEnrichmentConfiguration(&input, &config, &errs)
+	parseWatchlistEnrichmentConfiguration(&input, &config, &errs)
+	parseBinaryExportConfiguration(&input, &config, &errs)
+	parseInventoryConfiguration(&input, &config, &errs)
+	parseAuditLogConfiguration(&input, &config, &errs)
+	parseFileInputConfiguration(&input, &config, &errs)
+	parsePathNormalizationConfiguration(&input, &config, &errs)
+	parseAllowlistConfiguration(&input, &config, &errs)
+	parseDedupConfiguration(&input, &config, &errs)
+	parseDomainEnrichmentConfiguration(&input, &config, &errs)
+	parseSigmaConfiguration(&input, &config, &errs)
+	parseIntelConfiguration(&input, &config, &errs)
+	parseNetconnAggregationConfiguration(&input, &config, &errs)
+	parseGeoIPConfiguration(&input, &config, &errs)
+	parseAssetConfiguration(&input, &config, &errs)
+	parseFilterConfiguration(&input, &config, &errs)
+	parseMaskConfiguration(&input, &config, &errs)
+	parseTransformConfiguration(&input, &config, &errs)
+	parseBundleSecurityConfiguration(&input, &config, &errs)
+	parseHashChainConfiguration(&input, &config, &errs)
+
 	config.parseEventTypes(input)
 
 	if !errs.Empty {
@@ -878,3 +1146,998 @@ func parseOAuthConfiguration(input *ini.File, config *Configuration, errs *Confi
 		}
 	}
 }
+
+// splitConfigList splits a comma separated option into its trimmed, non-empty elements.
+func splitConfigList(val string) []string {
+	var elements []string
+	for _, element := range strings.Split(val, ",") {
+		element = strings.TrimSpace(element)
+		if element != "" {
+			elements = append(elements, element)
+		}
+	}
+	return elements
+}
+
+// parseSensorEnrichmentConfiguration parses the sensor_enrichment options. Sensor enrichment queries the Cb Response
+// REST API, so api_token must also be configured.
+func parseSensorEnrichmentConfiguration(input *ini.File, config *Configuration, errs *ConfigurationError) {
+	val, ok := input.Get("bridge", "sensor_enrichment")
+	if !ok {
+		return
+	}
+	enabled, err := strconv.ParseBool(val)
+	if err != nil {
+		errs.addErrorString("Unknown value for 'sensor_enrichment': valid values are true, false, 1, 0. Default is 'false'")
+		return
+	}
+	if !enabled {
+		return
+	}
+	if !config.PerformFeedPostprocessing {
+		errs.addErrorString("sensor_enrichment requires cb_server_url and api_token to be configured")
+		return
+	}
+	config.SensorEnrichment = true
+
+	config.SensorEnrichmentFields = []string{"sensor_group", "os_environment_display_string", "build_version_string",
+		"network_adapters"}
+	if val, ok := input.Get("bridge", "sensor_enrichment_fields"); ok {
+		config.SensorEnrichmentFields = splitConfigList(val)
+	}
+
+	// default to refreshing the sensor list every five minutes
+	config.SensorEnrichmentRefresh = parseSecondsOption(input, "bridge", "sensor_enrichment_refresh", 5*time.Minute,
+		errs)
+}
+
+// parseSecondsOption parses an option given in seconds. The default is returned if the option is not set; an
+// error is recorded if it is not a positive number of seconds.
+func parseSecondsOption(input *ini.File, section, key string, defaultValue time.Duration,
+	errs *ConfigurationError) time.Duration {
+	val, ok := input.Get(section, key)
+	if !ok {
+		return defaultValue
+	}
+	seconds, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || seconds <= 0 {
+		errs.addErrorString(fmt.Sprintf("Invalid %s: %s", key, val))
+		return defaultValue
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// parseBinaryEnrichmentConfiguration parses the binary_enrichment options. Binary enrichment queries the Cb Response
+// REST API, so api_token must also be configured.
+func parseBinaryEnrichmentConfiguration(input *ini.File, config *Configuration, errs *ConfigurationError) {
+	val, ok := input.Get("bridge", "binary_enrichment")
+	if !ok {
+		return
+	}
+	enabled, err := strconv.ParseBool(val)
+	if err != nil {
+		errs.addErrorString("Unknown value for 'binary_enrichment': valid values are true, false, 1, 0. Default is 'false'")
+		return
+	}
+	if !enabled {
+		return
+	}
+	if !config.PerformFeedPostprocessing {
+		errs.addErrorString("binary_enrichment requires cb_server_url and api_token to be configured")
+		return
+	}
+	config.BinaryEnrichment = true
+
+	config.BinaryEnrichmentEventTypes = []string{"ingress.event.procstart", "ingress.event.moduleload", "feed.#",
+		"alert.#", "watchlist.#"}
+	if val, ok := input.Get("bridge", "binary_enrichment_event_types"); ok {
+		config.BinaryEnrichmentEventTypes = splitConfigList(val)
+	}
+
+	config.BinaryEnrichmentCacheSize = 10000
+	if val, ok := input.Get("bridge", "binary_enrichment_cache_size"); ok {
+		cacheSize, err := strconv.Atoi(val)
+		if err == nil && cacheSize > 0 {
+			config.BinaryEnrichmentCacheSize = cacheSize
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid binary_enrichment_cache_size: %s", val))
+		}
+	}
+
+	config.BinaryEnrichmentCacheTTL = parseSecondsOption(input, "bridge", "binary_enrichment_cache_ttl",
+		time.Hour, errs)
+	config.BinaryEnrichmentNegativeTTL = parseSecondsOption(input, "bridge", "binary_enrichment_negative_ttl",
+		10*time.Minute, errs)
+}
+
+// parseWatchlistEnrichmentConfiguration parses the watchlist_enrichment options. Watchlist enrichment queries the
+// Cb Response REST API, so api_token must also be configured.
+func parseWatchlistEnrichmentConfiguration(input *ini.File, config *Configuration, errs *ConfigurationError) {
+	val, ok := input.Get("bridge", "watchlist_enrichment")
+	if !ok {
+		return
+	}
+	enabled, err := strconv.ParseBool(val)
+	if err != nil {
+		errs.addErrorString("Unknown value for 'watchlist_enrichment': valid values are true, false, 1, 0. Default is 'false'")
+		return
+	}
+	if !enabled {
+		return
+	}
+	if !config.PerformFeedPostprocessing {
+		errs.addErrorString("watchlist_enrichment requires cb_server_url and api_token to be configured")
+		return
+	}
+	config.WatchlistEnrichment = true
+
+	config.WatchlistEnrichmentRefresh = parseSecondsOption(input, "bridge", "watchlist_enrichment_refresh",
+		5*time.Minute, errs)
+}
+
+// parsePositiveIntOption parses an integer option that must be greater than zero, returning defaultValue if it is
+// not set.
+func parsePositiveIntOption(input *ini.File, section, key string, defaultValue int, errs *ConfigurationError) int {
+	val, ok := input.Get(section, key)
+	if !ok {
+		return defaultValue
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil || i <= 0 {
+		errs.addErrorString(fmt.Sprintf("Invalid %s: %s", key, val))
+		return defaultValue
+	}
+	return i
+}
+
+// parseBinaryExportConfiguration parses the [binary_export] section. Binaries are downloaded through the Cb
+// Response REST API, so api_token must also be configured.
+func parseBinaryExportConfiguration(input *ini.File, config *Configuration, errs *ConfigurationError) {
+	destination, ok := input.Get("binary_export", "destination")
+	if !ok || destination == "" {
+		return
+	}
+	if !config.PerformFeedPostprocessing {
+		errs.addErrorString("[binary_export] requires cb_server_url and api_token to be configured")
+		return
+	}
+	config.BinaryExport = true
+	config.BinaryExportDestination = destination
+
+	config.BinaryExportWorkers = parsePositiveIntOption(input, "binary_export", "workers", 2, errs)
+	config.BinaryExportQueueSize = parsePositiveIntOption(input, "binary_export", "queue_size", 100, errs)
+	config.BinaryExportRetries = 3
+	if val, ok := input.Get("binary_export", "retries"); ok {
+		retries, err := strconv.Atoi(val)
+		if err == nil && retries >= 0 {
+			config.BinaryExportRetries = retries
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid retries: %s", val))
+		}
+	}
+
+	// default 50MB limit on the size of an exported binary
+	config.BinaryExportMaxSize = 50 * 1024 * 1024
+	if val, ok := input.Get("binary_export", "max_size"); ok {
+		maxSize, err := strconv.ParseInt(val, 10, 64)
+		if err == nil && maxSize > 0 {
+			config.BinaryExportMaxSize = maxSize
+		} else {
+			errs.addErrorString(fmt.Sprintf("Invalid max_size: %s", val))
+		}
+	}
+
+	config.BinaryExportTimeout = parseSecondsOption(input, "binary_export", "timeout", 2*time.Minute, errs)
+
+	config.BinaryExportS3Endpoint, _ = input.Get("binary_export", "s3_endpoint")
+	config.BinaryExportS3CredentialProfile, _ = input.Get("binary_export", "credential_profile")
+	config.BinaryExportS3ObjectPrefix, _ = input.Get("binary_export", "object_prefix")
+}
+
+// parseInventoryConfiguration parses the [inventory] section. Each <kind>_interval option enables polling of that
+// inventory kind from the Cb Response REST API, so api_token must also be configured.
+func parseInventoryConfiguration(input *ini.File, config *Configuration, errs *ConfigurationError) {
+	config.InventoryIntervals = make(map[string]time.Duration)
+	for _, source := range inventorySources {
+		key := source.Kind + "_interval"
+		if _, ok := input.Get("inventory", key); !ok {
+			continue
+		}
+		config.InventoryIntervals[source.Kind] = parseSecondsOption(input, "inventory", key, time.Hour, errs)
+	}
+	if len(config.InventoryIntervals) == 0 {
+		return
+	}
+	if !config.PerformFeedPostprocessing {
+		errs.addErrorString("[inventory] requires cb_server_url and api_token to be configured")
+		return
+	}
+
+	if val, ok := input.Get("inventory", "changes_only"); ok {
+		changesOnly, err := strconv.ParseBool(val)
+		if err != nil {
+			errs.addErrorString("Unknown value for 'changes_only': valid values are true, false, 1, 0. Default is 'false'")
+		}
+		config.InventoryChangesOnly = changesOnly
+	}
+}
+
+// parseAuditLogConfiguration parses the [audit_log] section, used when audit_log is enabled. Each option other than
+// checkpoint_file maps an event type to the file tailed for it, as <event type>=<format>:<path>. Without any, the
+// four Cb Response audit logs under /var/log/cb/audit are tailed.
+func parseAuditLogConfiguration(input *ini.File, config *Configuration, errs *ConfigurationError) {
+	if !config.AuditLog {
+		return
+	}
+
+	config.AuditLogCheckpointFile = "/var/cb/data/event-forwarder/audit_log_positions.json"
+	if val, ok := input.Get("audit_log", "checkpoint_file"); ok {
+		config.AuditLogCheckpointFile = val
+	}
+
+	var eventTypes []string
+	for key := range input.Section("audit_log") {
+		if key != "checkpoint_file" {
+			eventTypes = append(eventTypes, key)
+		}
+	}
+	sort.Strings(eventTypes)
+
+	for _, eventType := range eventTypes {
+		val, _ := input.Get("audit_log", eventType)
+		parts := strings.SplitN(val, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			errs.addErrorString(fmt.Sprintf("Invalid audit log file for %s: %s; expected <format>:<path>", eventType, val))
+			continue
+		}
+		if _, ok := auditLogFormats[parts[0]]; !ok && parts[0] != "raw" {
+			errs.addErrorString(fmt.Sprintf("Unknown audit log format for %s: %s", eventType, parts[0]))
+			continue
+		}
+		config.AuditLogFiles = append(config.AuditLogFiles,
+			AuditLogFile{Path: parts[1], EventType: eventType, Format: parts[0]})
+	}
+
+	if len(eventTypes) == 0 {
+		config.AuditLogFiles = defaultAuditLogFiles
+	}
+}
+
+// parseFileInputConfiguration parses the [file_input:<name>] sections, each of which describes a set of files whose
+// records are output as events of one type.
+func parseFileInputConfiguration(input *ini.File, config *Configuration, errs *ConfigurationError) {
+	var sections []string
+	for section := range *input {
+		if strings.HasPrefix(section, "file_input:") {
+			sections = append(sections, section)
+		}
+	}
+	sort.Strings(sections)
+
+	for _, section := range sections {
+		c := FileInputConfig{Name: strings.TrimPrefix(section, "file_input:")}
+
+		val, _ := input.Get(section, "paths")
+		c.Paths = splitConfigList(val)
+		if len(c.Paths) == 0 {
+			errs.addErrorString(fmt.Sprintf("[%s] requires paths", section))
+			continue
+		}
+		for _, pattern := range c.Paths {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				errs.addErrorString(fmt.Sprintf("Invalid path in [%s]: %s", section, pattern))
+			}
+		}
+
+		c.EventType, _ = input.Get(section, "type")
+		if c.EventType == "" {
+			errs.addErrorString(fmt.Sprintf("[%s] requires type", section))
+			continue
+		}
+
+		c.Format = "text"
+		if val, ok := input.Get(section, "format"); ok {
+			c.Format = strings.ToLower(val)
+			if c.Format != "text" && c.Format != "json" {
+				errs.addErrorString(fmt.Sprintf("Unknown format in [%s]: %s; valid values are text, json", section, val))
+			}
+		}
+
+		if val, ok := input.Get(section, "pattern"); ok && val != "" {
+			re, err := regexp.Compile(val)
+			if err != nil {
+				errs.addErrorString(fmt.Sprintf("Invalid pattern in [%s]: %s", section, err))
+			}
+			c.Pattern = re
+		}
+
+		if val, ok := input.Get(section, "multiline_start"); ok && val != "" {
+			re, err := regexp.Compile(val)
+			if err != nil {
+				errs.addErrorString(fmt.Sprintf("Invalid multiline_start in [%s]: %s", section, err))
+			}
+			c.MultilineStart = re
+		}
+		c.MultilineMaxLines = parsePositiveIntOption(input, section, "multiline_max_lines", 500, errs)
+		c.MultilineTimeout = parseSecondsOption(input, section, "multiline_timeout", 2*time.Second, errs)
+
+		if val, ok := input.Get(section, "start_at"); ok {
+			switch strings.ToLower(val) {
+			case "beginning":
+				c.FromBeginning = true
+			case "end":
+			default:
+				errs.addErrorString(fmt.Sprintf("Unknown start_at in [%s]: %s; valid values are beginning, end",
+					section, val))
+			}
+		}
+
+		c.CheckpointFile = fmt.Sprintf("/var/cb/data/event-forwarder/file_input_%s.json", c.Name)
+		if val, ok := input.Get(section, "checkpoint_file"); ok {
+			c.CheckpointFile = val
+		}
+
+		config.FileInputs = append(config.FileInputs, c)
+	}
+}
+
+// parseTransformConfiguration parses the [transform:<n>] sections. Each section is one step, and steps are applied
+// in increasing order of n.
+func parseTransformConfiguration(input *ini.File, config *Configuration, errs *ConfigurationError) {
+	type numberedSection struct {
+		name   string
+		number int
+	}
+	var sections []numberedSection
+	for section := range *input {
+		if !strings.HasPrefix(section, "transform:") {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(section, "transform:"))
+		if err != nil {
+			errs.addErrorString(fmt.Sprintf("Invalid section [%s]: transform sections are numbered, as [transform:1]",
+				section))
+			continue
+		}
+		sections = append(sections, numberedSection{name: section, number: n})
+	}
+	sort.Slice(sections, func(i, j int) bool { return sections[i].number < sections[j].number })
+
+	for _, section := range sections {
+		step := &TransformStep{Name: section.name}
+
+		step.Action, _ = input.Get(section.name, "action")
+		step.Action = strings.ToLower(step.Action)
+		if !transformActions[step.Action] {
+			errs.addErrorString(fmt.Sprintf("Unknown action in [%s]: %q; valid actions are rename, copy, drop, add, "+
+				"convert, flatten", section.name, step.Action))
+			continue
+		}
+
+		if val, ok := input.Get(section.name, "event_types"); ok {
+			step.EventTypes = splitConfigList(val)
+		}
+		step.Separator, _ = input.Get(section.name, "separator")
+
+		val, _ := input.Get(section.name, "fields")
+		for _, field := range splitConfigList(val) {
+			parts := strings.SplitN(field, ":", 2)
+			f := TransformField{Field: strings.TrimSpace(parts[0])}
+			if len(parts) == 2 {
+				f.Arg = strings.TrimSpace(parts[1])
+			}
+
+			switch step.Action {
+			case "rename", "copy":
+				if f.Arg == "" {
+					errs.addErrorString(fmt.Sprintf("Invalid field in [%s]: %s; expected <field>:<new field>",
+						section.name, field))
+				}
+			case "add":
+				if len(parts) != 2 {
+					errs.addErrorString(fmt.Sprintf("Invalid field in [%s]: %s; expected <field>:<value>",
+						section.name, field))
+				}
+			case "convert":
+				if !transformTypes[f.Arg] {
+					errs.addErrorString(fmt.Sprintf("Invalid field in [%s]: %s; expected <field>:<type> with type "+
+						"string, int, float or bool", section.name, field))
+				}
+			}
+			step.Fields = append(step.Fields, f)
+		}
+		if len(step.Fields) == 0 && step.Action != "flatten" {
+			errs.addErrorString(fmt.Sprintf("[%s] requires fields", section.name))
+		}
+
+		config.Transforms = append(config.Transforms, step)
+	}
+}
+
+// parseFilterConfiguration parses the [filter:<name>] sections, each of which is an include or exclude rule with a
+// filter expression.
+func parseFilterConfiguration(input *ini.File, config *Configuration, errs *ConfigurationError) {
+	var sections []string
+	for section := range *input {
+		if strings.HasPrefix(section, "filter:") {
+			sections = append(sections, section)
+		}
+	}
+	sort.Strings(sections)
+
+	knownOutputs := make(map[string]bool)
+	for _, name := range outputTypeNames {
+		knownOutputs[name] = true
+	}
+
+	for _, section := range sections {
+		rule := &FilterRule{Name: strings.TrimPrefix(section, "filter:"), Action: "exclude"}
+
+		if val, ok := input.Get(section, "action"); ok {
+			rule.Action = strings.ToLower(val)
+			if rule.Action != "include" && rule.Action != "exclude" {
+				errs.addErrorString(fmt.Sprintf("Unknown action in [%s]: %s; valid values are include, exclude",
+					section, val))
+				continue
+			}
+		}
+
+		rule.Expression, _ = input.Get(section, "expression")
+		if rule.Expression == "" {
+			errs.addErrorString(fmt.Sprintf("[%s] requires an expression", section))
+			continue
+		}
+		expr, err := CompileFilterExpression(rule.Expression)
+		if err != nil {
+			errs.addErrorString(fmt.Sprintf("Invalid expression in [%s]: %s", section, err))
+			continue
+		}
+		rule.expr = expr
+
+		if val, ok := input.Get(section, "outputs"); ok {
+			for _, output := range splitConfigList(strings.ToLower(val)) {
+				if !knownOutputs[output] {
+					errs.addErrorString(fmt.Sprintf("Unknown output in [%s]: %s", section, output))
+				}
+				rule.Outputs = append(rule.Outputs, output)
+			}
+		}
+
+		config.Filters = append(config.Filters, rule)
+	}
+}
+
+// parseAllowlistConfiguration parses the [allowlist:<name>] sections, each of which is a file of hashes, process
+// path globs or CIDR ranges whose events are dropped.
+func parseAllowlistConfiguration(input *ini.File, config *Configuration, errs *ConfigurationError) {
+	var sections []string
+	for section := range *input {
+		if strings.HasPrefix(section, "allowlist:") {
+			sections = append(sections, section)
+		}
+	}
+	sort.Strings(sections)
+
+	for _, section := range sections {
+		list := &Allowlist{
+			Name:       strings.TrimPrefix(section, "allowlist:"),
+			EventTypes: []string{"ingress.event.#"},
+		}
+
+		list.Type, _ = input.Get(section, "type")
+		list.Type = strings.ToLower(list.Type)
+		if _, ok := allowlistDefaultFields[list.Type]; !ok {
+			errs.addErrorString(fmt.Sprintf("Unknown type in [%s]: %q; valid types are hash, path, cidr", section,
+				list.Type))
+			continue
+		}
+
+		list.File, _ = input.Get(section, "file")
+		if list.File == "" {
+			errs.addErrorString(fmt.Sprintf("[%s] requires a file", section))
+			continue
+		}
+
+		list.Fields = allowlistDefaultFields[list.Type]
+		if val, ok := input.Get(section, "fields"); ok {
+			list.Fields = splitConfigList(val)
+		}
+		if val, ok := input.Get(section, "event_types"); ok {
+			list.EventTypes = splitConfigList(val)
+		}
+		list.ReloadInterval = parseSecondsOption(input, section, "reload_interval", 60*time.Second, errs)
+
+		config.Allowlists = append(config.Allowlists, list)
+	}
+}
+
+// parseDedupConfiguration parses the [dedup:<name>] sections. Each event is deduplicated by the first rule, in order
+// of name, whose event types it matches.
+func parseDedupConfiguration(input *ini.File, config *Configuration, errs *ConfigurationError) {
+	var sections []string
+	for section := range *input {
+		if strings.HasPrefix(section, "dedup:") {
+			sections = append(sections, section)
+		}
+	}
+	sort.Strings(sections)
+
+	for _, section := range sections {
+		rule := &DedupRule{Name: strings.TrimPrefix(section, "dedup:")}
+
+		val, _ := input.Get(section, "key")
+		rule.Key = splitConfigList(val)
+		if len(rule.Key) == 0 {
+			errs.addErrorString(fmt.Sprintf("[%s] requires a key, such as key=type,watchlist_id,process_guid",
+				section))
+			continue
+		}
+
+		if val, ok := input.Get(section, "event_types"); ok {
+			rule.EventTypes = splitConfigList(val)
+		}
+		rule.Window = parseSecondsOption(input, section, "window", 300*time.Second, errs)
+		rule.MaxKeys = parsePositiveIntOption(input, section, "max_keys", 100000, errs)
+
+		if val, ok := input.Get(section, "rollup"); ok {
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				errs.addErrorString(fmt.Sprintf("Invalid rollup in [%s]: %s", section, val))
+			}
+			rule.Rollup = b
+		}
+
+		config.Dedups = append(config.Dedups, rule)
+	}
+}
+
+// parseNetconnAggregationConfiguration parses the [netconn_aggregation] section.
+func parseNetconnAggregationConfiguration(input *ini.File, config *Configuration, errs *ConfigurationError) {
+	val, ok := input.Get("netconn_aggregation", "enabled")
+	if !ok {
+		return
+	}
+	enabled, err := strconv.ParseBool(val)
+	if err != nil {
+		errs.addErrorString("Unknown value for 'enabled' in [netconn_aggregation]: valid values are true, false, 1, 0")
+		return
+	}
+	config.NetconnAggregation = enabled
+	if !enabled {
+		return
+	}
+
+	config.NetconnAggregationWindow = parseSecondsOption(input, "netconn_aggregation", "window", time.Minute, errs)
+	config.NetconnAggregationMaxFlows = parsePositiveIntOption(input, "netconn_aggregation", "max_flows", 100000, errs)
+	config.NetconnAggregationRareWindow = parseSecondsOption(input, "netconn_aggregation", "rare_destination_window",
+		24*time.Hour, errs)
+
+	if val, ok := input.Get("netconn_aggregation", "rare_destination_threshold"); ok {
+		threshold, err := strconv.Atoi(val)
+		if err != nil || threshold < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid rare_destination_threshold: %s", val))
+		} else {
+			config.NetconnAggregationRareThreshold = threshold
+		}
+	}
+}
+
+// parseSigmaConfiguration parses the [sigma] section. Sigma rules are evaluated if rules_dir is set.
+func parseSigmaConfiguration(input *ini.File, config *Configuration, errs *ConfigurationError) {
+	val, ok := input.Get("sigma", "rules_dir")
+	if !ok || val == "" {
+		return
+	}
+	config.SigmaRulesDir = val
+
+	config.SigmaMinLevel = "informational"
+	if val, ok := input.Get("sigma", "min_level"); ok {
+		level := strings.ToLower(val)
+		if _, ok := sigmaLevels[level]; !ok {
+			errs.addErrorString(fmt.Sprintf("Unknown min_level in [sigma]: %s; valid values are informational, low, "+
+				"medium, high, critical", val))
+		}
+		config.SigmaMinLevel = level
+	}
+
+	if val, ok := input.Get("sigma", "tag_events"); ok {
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			errs.addErrorString("Unknown value for 'tag_events' in [sigma]: valid values are true, false, 1, 0")
+		}
+		config.SigmaTagEvents = b
+	}
+}
+
+// parseIntelConfiguration parses the [intel:<name>] sections, each of which is a file of indicators, and the [intel]
+// section with the options for matching events against them.
+func parseIntelConfiguration(input *ini.File, config *Configuration, errs *ConfigurationError) {
+	var sections []string
+	for section := range *input {
+		if strings.HasPrefix(section, "intel:") {
+			sections = append(sections, section)
+		}
+	}
+	if len(sections) == 0 {
+		return
+	}
+	sort.Strings(sections)
+
+	for _, section := range sections {
+		f := &IntelFile{Name: strings.TrimPrefix(section, "intel:")}
+
+		f.File, _ = input.Get(section, "file")
+		if f.File == "" {
+			errs.addErrorString(fmt.Sprintf("[%s] requires a file", section))
+			continue
+		}
+
+		if val, ok := input.Get(section, "format"); ok {
+			f.Format = strings.ToLower(val)
+			if f.Format != "csv" && f.Format != "json" && f.Format != "stix" {
+				errs.addErrorString(fmt.Sprintf("Unknown format in [%s]: %s; valid formats are csv, json, stix",
+					section, val))
+			}
+		}
+		if val, ok := input.Get(section, "confidence"); ok {
+			confidence, err := strconv.Atoi(val)
+			if err != nil || confidence < 0 || confidence > 100 {
+				errs.addErrorString(fmt.Sprintf("Invalid confidence in [%s]: %s; expected 0 to 100", section, val))
+			}
+			f.Confidence = confidence
+		}
+		if val, ok := input.Get(section, "tags"); ok {
+			f.Tags = splitConfigList(val)
+		}
+
+		config.IntelFiles = append(config.IntelFiles, f)
+	}
+
+	config.IntelFields = defaultIntelFields
+	if val, ok := input.Get("intel", "fields"); ok {
+		config.IntelFields = nil
+		for _, field := range splitConfigList(val) {
+			parts := strings.SplitN(field, ":", 2)
+			if len(parts) != 2 || !intelIndicatorTypes[strings.TrimSpace(parts[1])] {
+				errs.addErrorString(fmt.Sprintf("Invalid field in [intel]: %s; expected <field>:<type> with type "+
+					"ip, domain, md5, sha256 or path", field))
+				continue
+			}
+			config.IntelFields = append(config.IntelFields,
+				IntelField{Field: strings.TrimSpace(parts[0]), Type: strings.TrimSpace(parts[1])})
+		}
+	}
+
+	config.IntelEventTypes = []string{"ingress.event.#"}
+	if val, ok := input.Get("intel", "event_types"); ok {
+		config.IntelEventTypes = splitConfigList(val)
+	}
+
+	if val, ok := input.Get("intel", "emit_events"); ok {
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			errs.addErrorString("Unknown value for 'emit_events' in [intel]: valid values are true, false, 1, 0")
+		}
+		config.IntelEmitEvents = b
+	}
+	config.IntelReloadInterval = parseSecondsOption(input, "intel", "reload_interval", time.Minute, errs)
+}
+
+// parseGeoIPConfiguration parses the [geoip] section. GeoIP enrichment is enabled if city_database or asn_database
+// is set.
+func parseGeoIPConfiguration(input *ini.File, config *Configuration, errs *ConfigurationError) {
+	if val, ok := input.Get("geoip", "city_database"); ok {
+		config.GeoIPCityDatabase = val
+	}
+	if val, ok := input.Get("geoip", "asn_database"); ok {
+		config.GeoIPASNDatabase = val
+	}
+	if config.GeoIPCityDatabase == "" && config.GeoIPASNDatabase == "" {
+		return
+	}
+
+	config.GeoIPFields = []string{"remote_ip"}
+	if val, ok := input.Get("geoip", "fields"); ok {
+		config.GeoIPFields = splitConfigList(val)
+		if len(config.GeoIPFields) == 0 {
+			errs.addErrorString("No fields specified in [geoip]")
+		}
+	}
+
+	if val, ok := input.Get("geoip", "event_types"); ok {
+		config.GeoIPEventTypes = splitConfigList(val)
+	}
+
+	config.GeoIPReloadInterval = parseSecondsOption(input, "geoip", "reload_interval", time.Minute, errs)
+}
+
+// parseAssetConfiguration parses the [assets] section. Zone and asset enrichment is enabled if zones_file or
+// assets_file is set.
+func parseAssetConfiguration(input *ini.File, config *Configuration, errs *ConfigurationError) {
+	if val, ok := input.Get("assets", "zones_file"); ok {
+		config.AssetZonesFile = val
+	}
+	if val, ok := input.Get("assets", "assets_file"); ok {
+		config.AssetsFile = val
+	}
+	if config.AssetZonesFile == "" && config.AssetsFile == "" {
+		return
+	}
+
+	if val, ok := input.Get("assets", "event_types"); ok {
+		config.AssetEventTypes = splitConfigList(val)
+	}
+
+	config.AssetReloadInterval = parseSecondsOption(input, "assets", "reload_interval", time.Minute, errs)
+}
+
+// parsePathNormalizationConfiguration parses the [path_normalization] section.
+func parsePathNormalizationConfiguration(input *ini.File, config *Configuration, errs *ConfigurationError) {
+	val, ok := input.Get("path_normalization", "enabled")
+	if !ok {
+		return
+	}
+	enabled, err := strconv.ParseBool(val)
+	if err != nil {
+		errs.addErrorString("Unknown value for 'enabled' in [path_normalization]: valid values are true, false, 1, 0")
+		return
+	}
+	config.PathNormalization = enabled
+	if !enabled {
+		return
+	}
+
+	config.PathNormalizationFields = []string{"path", "process_path", "parent_path"}
+	if val, ok := input.Get("path_normalization", "fields"); ok {
+		config.PathNormalizationFields = splitConfigList(val)
+	}
+
+	config.PathNormalizationEventTypes = []string{"ingress.event.#"}
+	if val, ok := input.Get("path_normalization", "event_types"); ok {
+		config.PathNormalizationEventTypes = splitConfigList(val)
+	}
+
+	config.PathNormalizationVolumes = make(map[string]string)
+	if val, ok := input.Get("path_normalization", "volumes"); ok {
+		for _, volume := range splitConfigList(val) {
+			parts := strings.SplitN(volume, "=", 2)
+			device, drive := strings.TrimSpace(parts[0]), ""
+			if len(parts) == 2 {
+				drive = strings.TrimSpace(parts[1])
+			}
+			if !strings.HasPrefix(strings.ToLower(device), `\device\`) || len(drive) != 2 || drive[1] != ':' {
+				errs.addErrorString(fmt.Sprintf("Invalid volume in [path_normalization]: %s; expected "+
+					`\Device\<volume>=<drive letter>:`, volume))
+				continue
+			}
+			config.PathNormalizationVolumes[device] = drive
+		}
+	}
+
+	config.PathNormalizationLearnVolumes = true
+	if val, ok := input.Get("path_normalization", "learn_volumes"); ok {
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			errs.addErrorString("Unknown value for 'learn_volumes' in [path_normalization]: valid values are true, " +
+				"false, 1, 0")
+		}
+		config.PathNormalizationLearnVolumes = b
+	}
+
+	config.PathNormalizationSystemRoot = `C:\Windows`
+	if val, ok := input.Get("path_normalization", "system_root"); ok {
+		config.PathNormalizationSystemRoot = val
+	}
+}
+
+// parseDomainEnrichmentConfiguration parses the [domain_enrichment] section.
+func parseDomainEnrichmentConfiguration(input *ini.File, config *Configuration, errs *ConfigurationError) {
+	val, ok := input.Get("domain_enrichment", "enabled")
+	if !ok {
+		return
+	}
+	enabled, err := strconv.ParseBool(val)
+	if err != nil {
+		errs.addErrorString("Unknown value for 'enabled' in [domain_enrichment]: valid values are true, false, 1, 0")
+		return
+	}
+	config.DomainEnrichment = enabled
+	if !enabled {
+		return
+	}
+
+	config.DomainEnrichmentFields = []string{"domain"}
+	if val, ok := input.Get("domain_enrichment", "fields"); ok {
+		config.DomainEnrichmentFields = splitConfigList(val)
+		if len(config.DomainEnrichmentFields) == 0 {
+			errs.addErrorString("No fields specified in [domain_enrichment]")
+		}
+	}
+
+	if val, ok := input.Get("domain_enrichment", "event_types"); ok {
+		config.DomainEnrichmentEventTypes = splitConfigList(val)
+	}
+
+	if val, ok := input.Get("domain_enrichment", "top_sites_file"); ok {
+		config.DomainTopSitesFile = val
+	}
+
+	if val, ok := input.Get("domain_enrichment", "top_sites_limit"); ok {
+		limit, err := strconv.Atoi(val)
+		if err != nil || limit < 0 {
+			errs.addErrorString(fmt.Sprintf("Invalid top_sites_limit: %s", val))
+		} else {
+			config.DomainTopSitesLimit = limit
+		}
+	}
+
+	config.DomainEnrichmentReloadInterval = parseSecondsOption(input, "domain_enrichment", "reload_interval",
+		time.Minute, errs)
+}
+
+// parseMaskConfiguration parses the [mask:<name>] sections, each of which masks a list of fields, and the [masking]
+// section with the keys used for pseudonymization.
+func parseMaskConfiguration(input *ini.File, config *Configuration, errs *ConfigurationError) {
+	var sections []string
+	for section := range *input {
+		if strings.HasPrefix(section, "mask:") {
+			sections = append(sections, section)
+		}
+	}
+	sort.Strings(sections)
+
+	knownOutputs := make(map[string]bool)
+	for _, name := range outputTypeNames {
+		knownOutputs[name] = true
+	}
+
+	usesKeys := false
+	for _, section := range sections {
+		rule := &MaskRule{Name: strings.TrimPrefix(section, "mask:")}
+
+		val, _ := input.Get(section, "fields")
+		rule.Fields = splitConfigList(val)
+		if len(rule.Fields) == 0 {
+			errs.addErrorString(fmt.Sprintf("[%s] requires fields", section))
+			continue
+		}
+
+		val, _ = input.Get(section, "method")
+		rule.Method = strings.ToLower(val)
+		if !maskMethods[rule.Method] {
+			errs.addErrorString(fmt.Sprintf("Unknown method in [%s]: %s; valid values are hmac, redact, regex, "+
+				"truncate", section, val))
+			continue
+		}
+
+		switch rule.Method {
+		case "hmac":
+			usesKeys = true
+		case "redact":
+			rule.Replacement = "[REDACTED]"
+		case "regex":
+			rule.Replacement = "****"
+			rule.Pattern, _ = input.Get(section, "pattern")
+			re, err := regexp.Compile(rule.Pattern)
+			if rule.Pattern == "" || err != nil {
+				errs.addErrorString(fmt.Sprintf("[%s] requires a valid pattern for the regex method", section))
+				continue
+			}
+			rule.re = re
+		case "truncate":
+			val, _ := input.Get(section, "length")
+			length, err := strconv.Atoi(val)
+			if err != nil || length <= 0 {
+				errs.addErrorString(fmt.Sprintf("[%s] requires a positive length for the truncate method", section))
+				continue
+			}
+			rule.Length = length
+		}
+
+		if val, ok := input.Get(section, "replacement"); ok {
+			rule.Replacement = val
+		}
+
+		if val, ok := input.Get(section, "ignore_case"); ok {
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				errs.addErrorString(fmt.Sprintf("Unknown value for 'ignore_case' in [%s]: valid values are true, "+
+					"false, 1, 0", section))
+			}
+			rule.IgnoreCase = b
+		}
+
+		if val, ok := input.Get(section, "event_types"); ok {
+			rule.EventTypes = splitConfigList(val)
+		}
+
+		if val, ok := input.Get(section, "outputs"); ok {
+			for _, output := range splitConfigList(strings.ToLower(val)) {
+				if !knownOutputs[output] {
+					errs.addErrorString(fmt.Sprintf("Unknown output in [%s]: %s", section, output))
+				}
+				rule.Outputs = append(rule.Outputs, output)
+			}
+		}
+
+		config.MaskRules = append(config.MaskRules, rule)
+	}
+
+	if val, ok := input.Get("masking", "key_file"); ok {
+		config.MaskKeyFile = val
+	}
+	if val, ok := input.Get("masking", "active_key"); ok {
+		config.MaskActiveKey = val
+	}
+	if usesKeys && config.MaskKeyFile == "" {
+		errs.addErrorString("The hmac masking method requires key_file in [masking]")
+	}
+	config.MaskReloadInterval = parseSecondsOption(input, "masking", "reload_interval", time.Minute, errs)
+}
+
+// parseBundleSecurityConfiguration parses the [bundle_security] section and loads the keys it refers to. Encryption
+// is enabled if recipients_file is set, and signing if signing_key_file is set.
+func parseBundleSecurityConfiguration(input *ini.File, config *Configuration, errs *ConfigurationError) {
+	if val, ok := input.Get("bundle_security", "recipients_file"); ok {
+		config.BundleRecipientsFile = val
+	}
+	if val, ok := input.Get("bundle_security", "signing_key_file"); ok {
+		config.BundleSigningKeyFile = val
+	}
+	if config.BundleRecipientsFile == "" && config.BundleSigningKeyFile == "" {
+		return
+	}
+
+	if config.OutputType != FileOutputType && config.OutputType != S3OutputType {
+		errs.addErrorString("Bundle encryption and signing in [bundle_security] are only supported with the file " +
+			"and s3 outputs")
+		return
+	}
+
+	if config.BundleRecipientsFile != "" {
+		recipients, err := loadBundleRecipients(config.BundleRecipientsFile)
+		if err != nil {
+			errs.addErrorString(fmt.Sprintf("Could not load recipients from %s: %s", config.BundleRecipientsFile,
+				err))
+		}
+		config.BundleRecipients = recipients
+	}
+
+	if config.BundleSigningKeyFile == "" {
+		return
+	}
+	config.BundleSigningMethod = "ed25519"
+	if val, ok := input.Get("bundle_security", "signing_method"); ok {
+		config.BundleSigningMethod = strings.ToLower(val)
+		if config.BundleSigningMethod != "hmac" && config.BundleSigningMethod != "ed25519" {
+			errs.addErrorString(fmt.Sprintf("Unknown signing_method in [bundle_security]: %s; valid values are "+
+				"hmac, ed25519", val))
+			return
+		}
+	}
+	signer, err := NewBundleSigner(config.BundleSigningMethod, config.BundleSigningKeyFile)
+	if err != nil {
+		errs.addErrorString(fmt.Sprintf("Could not load the signing key from %s: %s", config.BundleSigningKeyFile,
+			err))
+		return
+	}
+	config.BundleSigner = signer
+}
+
+// parseHashChainConfiguration parses the hash_chain option in [bridge], which is only supported with the file output.
+func parseHashChainConfiguration(input *ini.File, config *Configuration, errs *ConfigurationError) {
+	val, ok := input.Get("bridge", "hash_chain")
+	if !ok {
+		return
+	}
+	enabled, err := strconv.ParseBool(val)
+	if err != nil {
+		errs.addErrorString("Unknown value for 'hash_chain' in [bridge]: valid values are true, false, 1, 0")
+		return
+	}
+	if enabled && config.OutputType != FileOutputType {
+		errs.addErrorString("hash_chain in [bridge] is only supported with the file output")
+		return
+	}
+	config.FileHashChain = enabled
+}
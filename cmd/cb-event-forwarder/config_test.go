@@ -340,3 +340,51 @@ func TestParseOAuthConfigurationErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestParseTransformConfiguration(t *testing.T) {
+	input := &ini.File{
+		"transform:10": {
+			"action": "flatten",
+		},
+		"transform:2": {
+			"action":      "rename",
+			"event_types": "watchlist.#, feed.#",
+			"fields":      "process_name:process.name, md5:file_hash",
+		},
+		"transform:3": {
+			"action": "add",
+			"fields": "environment:production, url:https://cb.example.com",
+		},
+	}
+	config := &Configuration{}
+	errs := &ConfigurationError{Empty: true}
+
+	parseTransformConfiguration(input, config, errs)
+
+	expected := []*TransformStep{
+		{Name: "transform:2", Action: "rename", EventTypes: []string{"watchlist.#", "feed.#"},
+			Fields: []TransformField{{"process_name", "process.name"}, {"md5", "file_hash"}}},
+		{Name: "transform:3", Action: "add",
+			Fields: []TransformField{{"environment", "production"}, {"url", "https://cb.example.com"}}},
+		{Name: "transform:10", Action: "flatten"},
+	}
+	if diff := cmp.Diff(expected, config.Transforms, cmp.AllowUnexported(TransformStep{})); diff != "" {
+		t.Errorf("transform steps mismatch (-want +got):\n%s", diff)
+	}
+	if !errs.Empty {
+		t.Errorf("unexpected errors: %v", errs.Errors)
+	}
+
+	for _, section := range []ini.Section{
+		{"action": "uppercase", "fields": "process_name"},
+		{"action": "rename", "fields": "process_name"},
+		{"action": "convert", "fields": "sensor_id:integer"},
+		{"action": "drop"},
+	} {
+		errs := &ConfigurationError{Empty: true}
+		parseTransformConfiguration(&ini.File{"transform:1": section}, &Configuration{}, errs)
+		if errs.Empty {
+			t.Errorf("expected an error for %v", section)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// type of the summary events emitted for suppressed duplicates
+const dedupRollupType = "dedup.rollup"
+
+// DedupRule is one [dedup:<name>] section. Events of the matching types with the same values for the Key fields
+// are duplicates: only the first one in each Window is output, and the rest are counted.
+type DedupRule struct {
+	Name       string
+	EventTypes []string
+	Key        []string
+	Window     time.Duration
+	// emit a dedup.rollup event for each key that had duplicates when its window closes
+	Rollup bool
+	// keys tracked at once; events with new keys beyond this are output without deduplication
+	MaxKeys int
+
+	sync.Mutex
+	entries map[string]*dedupEntry
+
+	suppressed int64
+	rollups    int64
+	overflow   int64
+}
+
+type dedupEntry struct {
+	eventType string
+	key       map[string]interface{}
+	firstSeen time.Time
+	lastSeen  time.Time
+	count     int64
+}
+
+type DedupRuleStatistics struct {
+	Window     float64 `json:"window"`
+	Keys       int     `json:"keys"`
+	Suppressed int64   `json:"suppressed"`
+	Rollups    int64   `json:"rollups"`
+	Overflow   int64   `json:"overflow"`
+}
+
+// Deduplicator drops repeated events, such as a watchlist firing again for the same process, according to the
+// first dedup rule that matches each event.
+type Deduplicator struct {
+	rules []*DedupRule
+
+	// current time; replaced in tests
+	now func() time.Time
+	// outputs a rollup event; replaced in tests
+	output func(msg map[string]interface{}) error
+}
+
+func NewDeduplicator(rules []*DedupRule) *Deduplicator {
+	for _, rule := range rules {
+		rule.entries = make(map[string]*dedupEntry)
+	}
+	return &Deduplicator{rules: rules, now: time.Now, output: outputMessage}
+}
+
+func (d *Deduplicator) Name() string {
+	return "dedup"
+}
+
+func (d *Deduplicator) Process(msg map[string]interface{}) bool {
+	if msg["type"] == dedupRollupType {
+		return true
+	}
+
+	for _, rule := range d.rules {
+		if !matchAnyRoutingKey(rule.EventTypes, msg) {
+			continue
+		}
+		return d.process(rule, msg)
+	}
+	return true
+}
+
+func (d *Deduplicator) process(rule *DedupRule, msg map[string]interface{}) bool {
+	now := d.now()
+	key, values := dedupKey(rule.Key, msg)
+
+	rule.Lock()
+	entry, ok := rule.entries[key]
+	if ok && now.Sub(entry.firstSeen) < rule.Window {
+		entry.count++
+		entry.lastSeen = now
+		rule.Unlock()
+		atomic.AddInt64(&rule.suppressed, 1)
+		return false
+	}
+
+	var expired *dedupEntry
+	if ok {
+		expired = entry
+	} else if len(rule.entries) >= rule.MaxKeys {
+		rule.Unlock()
+		atomic.AddInt64(&rule.overflow, 1)
+		return true
+	}
+
+	eventType, _ := msg["type"].(string)
+	rule.entries[key] = &dedupEntry{eventType: eventType, key: values, firstSeen: now, lastSeen: now, count: 1}
+	rule.Unlock()
+
+	if expired != nil {
+		d.emitRollup(rule, expired)
+	}
+	return true
+}
+
+// dedupKey returns the values of the key fields in msg, joined into a map key. A missing field has an empty value.
+func dedupKey(fields []string, msg map[string]interface{}) (string, map[string]interface{}) {
+	values := make(map[string]interface{}, len(fields))
+	parts := make([]string, len(fields))
+	for i, field := range fields {
+		v, ok := getFieldPath(msg, field)
+		if ok {
+			values[field] = v
+			parts[i] = fmt.Sprint(v)
+		}
+	}
+	return strings.Join(parts, "\x00"), values
+}
+
+// Start closes expired windows periodically until shutdown is requested.
+func (d *Deduplicator) Start() {
+	interval := time.Second
+	for _, rule := range d.rules {
+		if rule.Window/10 > interval {
+			interval = rule.Window / 10
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				d.sweep(false)
+			case <-shutdownRequested:
+				return
+			}
+		}
+	}()
+}
+
+// Stop closes every open window, emitting any pending rollup events. It is called during shutdown, once no more
+// events are being processed.
+func (d *Deduplicator) Stop() {
+	d.sweep(true)
+}
+
+// sweep forgets the keys whose window has closed, or every key if all is set, and emits their rollup events.
+func (d *Deduplicator) sweep(all bool) {
+	now := d.now()
+	for _, rule := range d.rules {
+		var expired []*dedupEntry
+
+		rule.Lock()
+		for key, entry := range rule.entries {
+			if all || now.Sub(entry.firstSeen) >= rule.Window {
+				expired = append(expired, entry)
+				delete(rule.entries, key)
+			}
+		}
+		rule.Unlock()
+
+		for _, entry := range expired {
+			d.emitRollup(rule, entry)
+		}
+	}
+}
+
+func (d *Deduplicator) emitRollup(rule *DedupRule, entry *dedupEntry) {
+	if !rule.Rollup || entry.count < 2 {
+		return
+	}
+
+	msg := map[string]interface{}{
+		"type":        dedupRollupType,
+		"dedup_rule":  rule.Name,
+		"dedup_key":   entry.key,
+		"event_type":  entry.eventType,
+		"first_seen":  unixSecondsFloat(entry.firstSeen),
+		"last_seen":   unixSecondsFloat(entry.lastSeen),
+		"count":       entry.count,
+		"suppressed":  entry.count - 1,
+		"window":      rule.Window.Seconds(),
+		"rollup_time": d.now().Unix(),
+	}
+	if err := d.output(msg); err != nil {
+		log.Errorf("Could not output the dedup rollup for %s: %s", rule.Name, err)
+		return
+	}
+	atomic.AddInt64(&rule.rollups, 1)
+}
+
+func (d *Deduplicator) Statistics() interface{} {
+	stats := make(map[string]DedupRuleStatistics, len(d.rules))
+	for _, rule := range d.rules {
+		rule.Lock()
+		keys := len(rule.entries)
+		rule.Unlock()
+
+		stats[rule.Name] = DedupRuleStatistics{
+			Window:     rule.Window.Seconds(),
+			Keys:       keys,
+			Suppressed: atomic.LoadInt64(&rule.suppressed),
+			Rollups:    atomic.LoadInt64(&rule.rollups),
+			Overflow:   atomic.LoadInt64(&rule.overflow),
+		}
+	}
+	return stats
+}
+
+// unixSecondsFloat returns t as fractional seconds since the epoch, with millisecond precision, the same form as the
+// timestamp field of sensor events.
+func unixSecondsFloat(t time.Time) float64 {
+	return float64(t.UnixNano()/int64(time.Millisecond)) / 1000
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDeduplicator(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	var rollups []map[string]interface{}
+
+	rules := []*DedupRule{
+		{Name: "watchlist-hits", EventTypes: []string{"watchlist.hit.#"},
+			Key: []string{"type", "watchlist_id", "process_guid"}, Window: time.Minute, Rollup: true, MaxKeys: 2},
+		{Name: "feed-hits", EventTypes: []string{"feed.#"}, Key: []string{"feed_id", "md5"}, Window: time.Minute,
+			MaxKeys: 10},
+	}
+	d := NewDeduplicator(rules)
+	d.now = func() time.Time { return now }
+	d.output = func(msg map[string]interface{}) error {
+		rollups = append(rollups, msg)
+		return nil
+	}
+
+	hit := func(watchlistID int, processGUID string) map[string]interface{} {
+		return map[string]interface{}{"type": "watchlist.hit.process",
+			"watchlist_id": json.Number(strconv.Itoa(watchlistID)), "process_guid": processGUID}
+	}
+
+	steps := []struct {
+		advance  time.Duration
+		msg      map[string]interface{}
+		expected bool
+	}{
+		{0, hit(1, "a"), true},
+		{10 * time.Second, hit(1, "a"), false},
+		{10 * time.Second, hit(1, "a"), false},
+		{0, hit(2, "a"), true},
+		// too many keys: output without deduplication
+		{0, hit(3, "a"), true},
+		{0, hit(3, "a"), true},
+		{0, map[string]interface{}{"type": "feed.storage.hit.process", "feed_id": json.Number("7"), "md5": "A"}, true},
+		{0, map[string]interface{}{"type": "feed.storage.hit.process", "feed_id": json.Number("7"), "md5": "A"}, false},
+		{0, map[string]interface{}{"type": "ingress.event.procstart"}, true},
+		{0, map[string]interface{}{"type": "ingress.event.procstart"}, true},
+		{0, map[string]interface{}{"type": dedupRollupType}, true},
+		// the window for watchlist 1 closed 60s after its first hit; this starts a new one and rolls up the old
+		{45 * time.Second, hit(1, "a"), true},
+	}
+	for i, step := range steps {
+		now = now.Add(step.advance)
+		if got := d.Process(step.msg); got != step.expected {
+			t.Errorf("step %d: Process(%v) = %t, expected %t", i, step.msg, got, step.expected)
+		}
+	}
+
+	expected := []map[string]interface{}{
+		{
+			"type":       dedupRollupType,
+			"dedup_rule": "watchlist-hits",
+			"dedup_key": map[string]interface{}{"type": "watchlist.hit.process", "watchlist_id": json.Number("1"),
+				"process_guid": "a"},
+			"event_type":  "watchlist.hit.process",
+			"first_seen":  float64(1500000000),
+			"last_seen":   float64(1500000020),
+			"count":       int64(3),
+			"suppressed":  int64(2),
+			"window":      float64(60),
+			"rollup_time": int64(1500000065),
+		},
+	}
+	if diff := cmp.Diff(expected, rollups); diff != "" {
+		t.Errorf("rollups mismatch (-want +got):\n%s", diff)
+	}
+
+	expectedStats := map[string]DedupRuleStatistics{
+		"watchlist-hits": {Window: 60, Keys: 2, Suppressed: 2, Rollups: 1, Overflow: 2},
+		"feed-hits":      {Window: 60, Keys: 1, Suppressed: 1},
+	}
+	if diff := cmp.Diff(expectedStats, d.Statistics()); diff != "" {
+		t.Errorf("statistics mismatch (-want +got):\n%s", diff)
+	}
+
+	// closing every window forgets all keys; only keys with duplicates are rolled up, and only for rollup rules
+	rollups = nil
+	d.Stop()
+	if len(rollups) != 0 {
+		t.Errorf("expected no rollups, got %v", rollups)
+	}
+	for name, stats := range d.Statistics().(map[string]DedupRuleStatistics) {
+		if stats.Keys != 0 {
+			t.Errorf("%s: expected no keys after Stop, got %d", name, stats.Keys)
+		}
+	}
+}
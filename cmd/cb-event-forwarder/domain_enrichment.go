@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/publicsuffix"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type DomainStatistics struct {
+	Evaluated      int64     `json:"evaluated"`
+	Parsed         int64     `json:"parsed"`
+	Unparsed       int64     `json:"unparsed"`
+	TopSiteMatches int64     `json:"top_site_matches"`
+	TopSites       int       `json:"top_sites"`
+	TopSitesFile   string    `json:"top_sites_file,omitempty"`
+	LastLoaded     time.Time `json:"last_loaded,omitempty"`
+	LastError      string    `json:"last_error,omitempty"`
+}
+
+// The DomainEnricher splits domain names in events into their parts using the public suffix list embedded in
+// golang.org/x/net/publicsuffix. For a field such as domain with the value mail.corp.example.co.uk, it adds
+// domain_registered (example.co.uk), domain_tld (co.uk), domain_subdomain (mail.corp), domain_length (the length of
+// the whole name) and domain_entropy (the Shannon entropy, in bits per character, of the registered label, example),
+// which is high for the random looking names generated by DGAs. With a top sites list, it also adds domain_top_site,
+// which is true if the registered domain is on the list.
+type DomainEnricher struct {
+	fields         []string
+	eventTypes     []string
+	topSitesFile   string
+	topSitesLimit  int
+	reloadInterval time.Duration
+
+	sync.RWMutex
+	topSites map[string]bool
+	modTime  time.Time
+	loadedAt time.Time
+	lastErr  string
+
+	evaluated      int64
+	parsed         int64
+	unparsed       int64
+	topSiteMatches int64
+}
+
+// NewDomainEnricher returns a DomainEnricher for the given fields. If topSitesFile is set, the first topSitesLimit
+// domains in it (all of them if topSitesLimit is 0) are loaded; a file that cannot be loaded is an error.
+func NewDomainEnricher(fields, eventTypes []string, topSitesFile string, topSitesLimit int,
+	reloadInterval time.Duration) (*DomainEnricher, error) {
+	e := &DomainEnricher{
+		fields:         fields,
+		eventTypes:     eventTypes,
+		topSitesFile:   topSitesFile,
+		topSitesLimit:  topSitesLimit,
+		reloadInterval: reloadInterval,
+	}
+	if topSitesFile != "" {
+		if err := e.loadTopSites(); err != nil {
+			return nil, fmt.Errorf("could not load top sites file %s: %s", topSitesFile, err)
+		}
+		log.Infof("Loaded %d top sites from %s", len(e.topSites), topSitesFile)
+	}
+	return e, nil
+}
+
+// parseTopSites parses a list of domains, one per line, or a ranked list of rank,domain lines such as the Tranco or
+// Umbrella top sites lists. Blank lines and lines starting with # are skipped.
+func parseTopSites(data []byte, limit int) (map[string]bool, error) {
+	sites := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if i := strings.LastIndex(text, ","); i >= 0 {
+			text = strings.TrimSpace(text[i+1:])
+		}
+		domain := strings.TrimSuffix(strings.ToLower(text), ".")
+		if domain == "" || strings.ContainsAny(domain, " \t/") {
+			return nil, fmt.Errorf("line %d: %q is not a domain", line, scanner.Text())
+		}
+		sites[domain] = true
+		if limit > 0 && len(sites) >= limit {
+			break
+		}
+	}
+	return sites, scanner.Err()
+}
+
+// loadTopSites loads the top sites file. If it cannot be loaded, the previous list stays in use.
+func (e *DomainEnricher) loadTopSites() error {
+	info, err := os.Stat(e.topSitesFile)
+	if err != nil {
+		e.Lock()
+		e.lastErr = err.Error()
+		e.Unlock()
+		return err
+	}
+
+	var sites map[string]bool
+	data, err := ioutil.ReadFile(e.topSitesFile)
+	if err == nil {
+		sites, err = parseTopSites(data, e.topSitesLimit)
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	e.modTime = info.ModTime()
+	if err != nil {
+		e.lastErr = err.Error()
+		return err
+	}
+	e.topSites = sites
+	e.loadedAt = time.Now()
+	e.lastErr = ""
+	return nil
+}
+
+func (e *DomainEnricher) Name() string {
+	return "domain_enrichment"
+}
+
+func (e *DomainEnricher) Process(msg map[string]interface{}) bool {
+	if !matchAnyRoutingKey(e.eventTypes, msg) {
+		return true
+	}
+
+	for _, field := range e.fields {
+		name, ok := msg[field].(string)
+		if !ok || name == "" {
+			continue
+		}
+		atomic.AddInt64(&e.evaluated, 1)
+
+		parts, ok := parseDomain(name)
+		if !ok {
+			atomic.AddInt64(&e.unparsed, 1)
+			continue
+		}
+		atomic.AddInt64(&e.parsed, 1)
+
+		msg[field+"_registered"] = parts.registered
+		msg[field+"_tld"] = parts.tld
+		if parts.subdomain != "" {
+			msg[field+"_subdomain"] = parts.subdomain
+		}
+		msg[field+"_length"] = parts.length
+		msg[field+"_entropy"] = parts.entropy
+
+		if e.topSitesFile != "" {
+			e.RLock()
+			topSite := e.topSites[parts.registered] || e.topSites[parts.name]
+			e.RUnlock()
+			msg[field+"_top_site"] = topSite
+			if topSite {
+				atomic.AddInt64(&e.topSiteMatches, 1)
+			}
+		}
+	}
+	return true
+}
+
+type domainParts struct {
+	name       string
+	registered string
+	tld        string
+	subdomain  string
+	length     int
+	entropy    float64
+}
+
+// parseDomain splits a domain name into its registered domain, public suffix and subdomain. Addresses, single label
+// names such as wpad and names that are themselves public suffixes cannot be split.
+func parseDomain(name string) (domainParts, bool) {
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	if name == "" || net.ParseIP(name) != nil || !strings.Contains(name, ".") {
+		return domainParts{}, false
+	}
+
+	registered, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return domainParts{}, false
+	}
+	tld, _ := publicsuffix.PublicSuffix(name)
+	label := strings.TrimSuffix(registered, "."+tld)
+
+	return domainParts{
+		name:       name,
+		registered: registered,
+		tld:        tld,
+		subdomain:  strings.TrimSuffix(strings.TrimSuffix(name, registered), "."),
+		length:     len(name),
+		entropy:    shannonEntropy(label),
+	}, true
+}
+
+// shannonEntropy returns the entropy of s in bits per character, rounded to three decimal places.
+func shannonEntropy(s string) float64 {
+	if s == "" {
+		return 0
+	}
+	counts := make(map[rune]int)
+	for _, r := range s {
+		counts[r]++
+	}
+	total := float64(len([]rune(s)))
+	entropy := 0.0
+	for _, count := range counts {
+		p := float64(count) / total
+		entropy -= p * math.Log2(p)
+	}
+	return math.Round(entropy*1000) / 1000
+}
+
+func (e *DomainEnricher) Statistics() interface{} {
+	e.RLock()
+	defer e.RUnlock()
+	return DomainStatistics{
+		Evaluated:      atomic.LoadInt64(&e.evaluated),
+		Parsed:         atomic.LoadInt64(&e.parsed),
+		Unparsed:       atomic.LoadInt64(&e.unparsed),
+		TopSiteMatches: atomic.LoadInt64(&e.topSiteMatches),
+		TopSites:       len(e.topSites),
+		TopSitesFile:   e.topSitesFile,
+		LastLoaded:     e.loadedAt,
+		LastError:      e.lastErr,
+	}
+}
+
+// topSitesChanged reports whether the top sites file has been modified since it was last loaded.
+func (e *DomainEnricher) topSitesChanged() bool {
+	info, err := os.Stat(e.topSitesFile)
+	if err != nil {
+		return false
+	}
+	e.RLock()
+	defer e.RUnlock()
+	return !info.ModTime().Equal(e.modTime)
+}
+
+// Start checks the top sites file for changes every reload interval, and reloads it on SIGHUP.
+func (e *DomainEnricher) Start() {
+	if e.topSitesFile == "" {
+		return
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		ticker := time.NewTicker(e.reloadInterval)
+		defer ticker.Stop()
+		defer signal.Stop(hup)
+
+		for {
+			select {
+			case <-ticker.C:
+				if e.topSitesChanged() {
+					e.reload()
+				}
+			case <-hup:
+				log.Info("Received SIGHUP, reloading the top sites list.")
+				e.reload()
+			case <-shutdownRequested:
+				return
+			}
+		}
+	}()
+}
+
+func (e *DomainEnricher) reload() {
+	if err := e.loadTopSites(); err != nil {
+		log.Errorf("Could not reload top sites file %s; keeping the previous list: %s", e.topSitesFile, err)
+		return
+	}
+	log.Infof("Reloaded %d top sites from %s", e.Statistics().(DomainStatistics).TopSites, e.topSitesFile)
+}
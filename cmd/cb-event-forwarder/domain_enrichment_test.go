@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseDomain(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		expected domainParts
+		ok       bool
+	}{
+		{"mail.corp.example.co.uk", domainParts{name: "mail.corp.example.co.uk", registered: "example.co.uk",
+			tld: "co.uk", subdomain: "mail.corp", length: 23, entropy: 2.522}, true},
+		{"WWW.Google.com.", domainParts{name: "www.google.com", registered: "google.com", tld: "com",
+			subdomain: "www", length: 14, entropy: 1.918}, true},
+		{"xkqjzvbtwp.ru", domainParts{name: "xkqjzvbtwp.ru", registered: "xkqjzvbtwp.ru", tld: "ru", length: 13,
+			entropy: 3.322}, true},
+		{"customer.appspot.com", domainParts{name: "customer.appspot.com", registered: "customer.appspot.com",
+			tld: "appspot.com", length: 20, entropy: 3}, true},
+		{"co.uk", domainParts{}, false},
+		{"wpad", domainParts{}, false},
+		{"10.1.2.3", domainParts{}, false},
+		{"", domainParts{}, false},
+	} {
+		parts, ok := parseDomain(test.name)
+		if ok != test.ok {
+			t.Errorf("%s: got ok %t, expected %t", test.name, ok, test.ok)
+			continue
+		}
+		if diff := cmp.Diff(test.expected, parts, cmp.AllowUnexported(domainParts{})); diff != "" {
+			t.Errorf("%s: mismatch (-want +got):\n%s", test.name, diff)
+		}
+	}
+}
+
+func TestDomainEnricher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "domains")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	topSites := filepath.Join(dir, "top-1m.csv")
+	if err := ioutil.WriteFile(topSites, []byte("1,google.com\n2,microsoft.com\n3,example.co.uk\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewDomainEnricher([]string{"domain"}, nil, topSites, 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		msg      map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			msg: map[string]interface{}{"type": "ingress.event.netconn", "domain": "login.microsoft.com"},
+			expected: map[string]interface{}{"type": "ingress.event.netconn", "domain": "login.microsoft.com",
+				"domain_registered": "microsoft.com", "domain_tld": "com", "domain_subdomain": "login",
+				"domain_length": 19, "domain_entropy": 2.948, "domain_top_site": true},
+		},
+		{
+			// beyond the top_sites_limit
+			msg: map[string]interface{}{"type": "ingress.event.netconn", "domain": "example.co.uk"},
+			expected: map[string]interface{}{"type": "ingress.event.netconn", "domain": "example.co.uk",
+				"domain_registered": "example.co.uk", "domain_tld": "co.uk", "domain_length": 13,
+				"domain_entropy": 2.522, "domain_top_site": false},
+		},
+		{
+			msg:      map[string]interface{}{"type": "ingress.event.netconn", "domain": "localhost"},
+			expected: map[string]interface{}{"type": "ingress.event.netconn", "domain": "localhost"},
+		},
+		{
+			msg:      map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "203.0.113.7"},
+			expected: map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "203.0.113.7"},
+		},
+	} {
+		e.Process(test.msg)
+		if diff := cmp.Diff(test.expected, test.msg); diff != "" {
+			t.Errorf("event mismatch (-want +got):\n%s", diff)
+		}
+	}
+
+	// a broken top sites file keeps the previous list
+	ioutil.WriteFile(topSites, []byte("rank,domain\n1,not a domain\n"), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(topSites, later, later)
+	if !e.topSitesChanged() {
+		t.Fatal("expected the modified file to be detected")
+	}
+	e.reload()
+
+	stats := e.Statistics().(DomainStatistics)
+	if stats.Evaluated != 3 || stats.Parsed != 2 || stats.Unparsed != 1 || stats.TopSiteMatches != 1 ||
+		stats.TopSites != 2 || stats.LastError == "" || e.topSitesChanged() {
+		t.Errorf("unexpected statistics %+v", stats)
+	}
+}
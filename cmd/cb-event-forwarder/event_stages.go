@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An EventStage is applied to every event in outputMessage before it is encoded. Process may modify msg in place;
+// returning false drops the event.
+type EventStage interface {
+	Name() string
+	Process(msg map[string]interface{}) bool
+}
+
+// stages applied to outgoing events, in order; built once at startup by startEventStages
+var eventStages []EventStage
+
+func applyEventStages(stages []EventStage, msg map[string]interface{}) bool {
+	for _, stage := range stages {
+		if !stage.Process(msg) {
+			return false
+		}
+	}
+	return true
+}
+
+// stagesAfter returns the stages that follow stage in eventStages, or all of them if stage is not one of them.
+func stagesAfter(stage EventStage) []EventStage {
+	for i, s := range eventStages {
+		if s == stage {
+			return eventStages[i+1:]
+		}
+	}
+	return eventStages
+}
+
+// startEventStages builds the configured stages and starts any background work they need. Enrichment stages run
+// first so that later stages can act on the fields they add.
+func startEventStages() error {
+	var stages []EventStage
+
+	// paths are normalized first, so allowlists, Sigma rules and intel see drive letters and registry hive names
+	if config.PathNormalization {
+		normalizer := NewPathNormalizer(config.PathNormalizationFields, config.PathNormalizationEventTypes,
+			config.PathNormalizationVolumes, config.PathNormalizationLearnVolumes, config.PathNormalizationSystemRoot)
+		expvar.Publish(normalizer.Name(), expvar.Func(normalizer.Statistics))
+		stages = append(stages, normalizer)
+	}
+
+	// allowlists run before enrichment, so suppressed events are never enriched
+	if len(config.Allowlists) > 0 {
+		allowlister, err := NewAllowlister(config.Allowlists)
+		if err != nil {
+			return err
+		}
+		allowlister.Start()
+		expvar.Publish(allowlister.Name(), expvar.Func(allowlister.Statistics))
+		stages = append(stages, allowlister)
+	}
+
+	// dedup also runs before the sensor, watchlist and binary enrichers, so duplicates are not looked up in the Cb
+	// Response API by them. Feed post-processing happens before any stage and is not affected.
+	if len(config.Dedups) > 0 {
+		deduplicator = NewDeduplicator(config.Dedups)
+		deduplicator.Start()
+		expvar.Publish(deduplicator.Name(), expvar.Func(deduplicator.Statistics))
+		stages = append(stages, deduplicator)
+	}
+
+	// domains are split before Sigma rules and intel see them
+	if config.DomainEnrichment {
+		domains, err := NewDomainEnricher(config.DomainEnrichmentFields, config.DomainEnrichmentEventTypes,
+			config.DomainTopSitesFile, config.DomainTopSitesLimit, config.DomainEnrichmentReloadInterval)
+		if err != nil {
+			return err
+		}
+		domains.Start()
+		expvar.Publish(domains.Name(), expvar.Func(domains.Statistics))
+		stages = append(stages, domains)
+	}
+
+	// Sigma rules and intel indicators see each netconn event before it is aggregated into a flow
+	if config.SigmaRulesDir != "" {
+		sigma := NewSigmaEngine(config.SigmaRulesDir, config.SigmaMinLevel, config.SigmaTagEvents)
+		if err := sigma.Load(); err != nil {
+			return fmt.Errorf("could not load Sigma rules from %s: %s", config.SigmaRulesDir, err)
+		}
+		sigma.Start()
+		expvar.Publish(sigma.Name(), expvar.Func(sigma.Statistics))
+		stages = append(stages, sigma)
+	}
+
+	if len(config.IntelFiles) > 0 {
+		intel, err := NewIntelMatcher(config.IntelFiles, config.IntelFields, config.IntelEventTypes,
+			config.IntelEmitEvents, config.IntelReloadInterval)
+		if err != nil {
+			return err
+		}
+		intel.Start()
+		expvar.Publish(intel.Name(), expvar.Func(intel.Statistics))
+		stages = append(stages, intel)
+	}
+
+	if config.NetconnAggregation {
+		netconnAggregator = NewNetconnAggregator(config.NetconnAggregationWindow, config.NetconnAggregationMaxFlows,
+			config.NetconnAggregationRareThreshold, config.NetconnAggregationRareWindow)
+		netconnAggregator.Start()
+		expvar.Publish(netconnAggregator.Name(), expvar.Func(netconnAggregator.Statistics))
+		stages = append(stages, netconnAggregator)
+	}
+
+	if config.SensorEnrichment {
+		sensors := NewSensorEnricher(config.SensorEnrichmentFields, config.SensorEnrichmentRefresh)
+		sensors.Start()
+		expvar.Publish(sensors.Name(), expvar.Func(sensors.Statistics))
+		stages = append(stages, sensors)
+	}
+
+	if config.WatchlistEnrichment {
+		watchlists := NewWatchlistEnricher(config.WatchlistEnrichmentRefresh)
+		watchlists.Start()
+		expvar.Publish(watchlists.Name(), expvar.Func(watchlists.Statistics))
+		stages = append(stages, watchlists)
+	}
+
+	if config.BinaryEnrichment {
+		binaries := NewBinaryEnricher(config.BinaryEnrichmentEventTypes, config.BinaryEnrichmentCacheSize,
+			config.BinaryEnrichmentCacheTTL, config.BinaryEnrichmentNegativeTTL)
+		expvar.Publish(binaries.Name(), expvar.Func(binaries.Statistics))
+		stages = append(stages, binaries)
+	}
+
+	if config.GeoIPCityDatabase != "" || config.GeoIPASNDatabase != "" {
+		geoip, err := NewGeoIPEnricher(config.GeoIPCityDatabase, config.GeoIPASNDatabase, config.GeoIPFields,
+			config.GeoIPEventTypes, config.GeoIPReloadInterval)
+		if err != nil {
+			return err
+		}
+		geoip.Start()
+		expvar.Publish(geoip.Name(), expvar.Func(geoip.Statistics))
+		stages = append(stages, geoip)
+	}
+
+	if config.AssetZonesFile != "" || config.AssetsFile != "" {
+		assets, err := NewAssetEnricher(config.AssetZonesFile, config.AssetsFile, config.AssetEventTypes,
+			config.AssetReloadInterval)
+		if err != nil {
+			return err
+		}
+		assets.Start()
+		expvar.Publish(assets.Name(), expvar.Func(assets.Statistics))
+		stages = append(stages, assets)
+	}
+
+	// filters see events as enriched, but before transforms rename their fields
+	if len(config.Filters) > 0 {
+		filter := NewFilter(config.Filters, outputTypeNames[config.OutputType])
+		expvar.Publish(filter.Name(), expvar.Func(filter.Statistics))
+		stages = append(stages, filter)
+	}
+
+	// masking runs after filters, which can still match the original values, and before transforms rename fields
+	if len(config.MaskRules) > 0 {
+		var keys *MaskKeys
+		if config.MaskKeyFile != "" {
+			keys = &MaskKeys{File: config.MaskKeyFile, Active: config.MaskActiveKey}
+		}
+		masker, err := NewMasker(config.MaskRules, outputTypeNames[config.OutputType], keys, config.MaskReloadInterval)
+		if err != nil {
+			return err
+		}
+		masker.Start()
+		expvar.Publish(masker.Name(), expvar.Func(masker.Statistics))
+		stages = append(stages, masker)
+	}
+
+	// transforms run last, so they see the fields added by enrichment
+	if len(config.Transforms) > 0 {
+		transformer := NewTransformer(config.Transforms)
+		expvar.Publish(transformer.Name(), expvar.Func(transformer.Statistics))
+		stages = append(stages, transformer)
+	}
+
+	eventStages = stages
+	return nil
+}
+
+// startPeriodicRefresh loads a snapshot used by an enrichment stage and then refreshes it every interval. A failed
+// load is logged but not fatal; the stage keeps using its previous snapshot, or none, until a refresh succeeds.
+func startPeriodicRefresh(what string, interval time.Duration, refresh func() error, lastRefresh func() time.Time) {
+	if err := refresh(); err != nil {
+		log.Errorf("Could not load %s from the Cb Response Server: %s", what, err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := refresh(); err != nil {
+				log.Errorf("Could not refresh %s from the Cb Response Server; using the snapshot from %s: %s",
+					what, lastRefresh().Format(time.RFC3339), err)
+			}
+		}
+	}()
+}
+
+// intFromEvent converts a numeric field from either a JSON event (json.Number) or a protobuf event (native integer
+// types) to an int.
+func intFromEvent(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		i, err := n.Int64()
+		return int(i), err == nil
+	case int:
+		return n, true
+	case int32:
+		return int(n), true
+	case int64:
+		return int(n), true
+	case uint16:
+		return int(n), true
+	case uint32:
+		return int(n), true
+	case uint64:
+		return int(n), true
+	case float64:
+		return int(n), true
+	case string:
+		i, err := strconv.Atoi(n)
+		return i, err == nil
+	}
+	return 0, false
+}
+
+// matchRoutingKey reports whether key matches an AMQP topic pattern, where * matches exactly one dot-separated word
+// and # matches zero or more words. For example, watchlist.# matches every watchlist event.
+func matchRoutingKey(pattern, key string) bool {
+	return matchRoutingKeyWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchRoutingKeyWords(pattern, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(key); i++ {
+			if matchRoutingKeyWords(pattern[1:], key[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(key) > 0 && matchRoutingKeyWords(pattern[1:], key[1:])
+	default:
+		return len(key) > 0 && pattern[0] == key[0] && matchRoutingKeyWords(pattern[1:], key[1:])
+	}
+}
+
+// matchAnyRoutingKey reports whether the type of msg matches one of patterns. An empty list matches every event.
+func matchAnyRoutingKey(patterns []string, msg map[string]interface{}) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	eventType, _ := msg["type"].(string)
+	for _, pattern := range patterns {
+		if matchRoutingKey(pattern, eventType) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,36 +1,694 @@
 package main
 
 import (
-	"github.com/hpcloud/tail"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-type FileConsumer struct {
-	fileName string
+// number of bytes at the start of a file used to recognize it after a restart
+const fingerprintSize = 256
+
+// FilePosition records how far a file has been read. The fingerprint of the first FingerprintSize bytes identifies
+// the file, so that a position is only reused for the same file and not for one that replaced it on rotation.
+type FilePosition struct {
+	Offset          int64  `json:"offset"`
+	Fingerprint     string `json:"fingerprint"`
+	FingerprintSize int64  `json:"fingerprint_size"`
+}
+
+func fileFingerprint(f *os.File, size int64) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, size)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fileTailerHandler receives what a FileTailer reads.
+type fileTailerHandler interface {
+	// Line is called for each complete line, without its line ending, with the position just after it. If it
+	// returns an error, the line is read again later.
+	Line(line string, position FilePosition) error
+	// Idle is called when the end of the file has been reached. finished is set when the file has been rotated,
+	// truncated or removed and will not be read any further.
+	Idle(finished bool) error
+	Error(err error)
+}
+
+// FileTailer follows a file by polling it, like tail -F. It tracks the offset of the last complete line it has
+// handed out so reading can resume there after a restart, and it detects rotation by comparing the open file with
+// the one currently at its path.
+type FileTailer struct {
+	path          string
+	pollInterval  time.Duration
+	fromBeginning bool
+
+	file     *os.File
+	info     os.FileInfo
+	reader   *bufio.Reader
+	partial  string
+	position FilePosition
+}
+
+// NewFileTailer returns a tailer for path. Reading resumes at start if it was recorded for the file currently at
+// path, and begins at the start of the file if a different file has replaced it since. Without a recorded position,
+// reading begins at the end of the file unless fromBeginning is set.
+func NewFileTailer(path string, start *FilePosition, fromBeginning bool) *FileTailer {
+	t := &FileTailer{path: path, pollInterval: time.Second, fromBeginning: fromBeginning}
+	if start != nil {
+		t.position = *start
+	} else {
+		t.position.Offset = -1
+	}
+	return t
+}
+
+// open opens the file at path and seeks to where reading should begin. fromStart is set after a rotation, when the
+// whole of the new file is unread.
+func (t *FileTailer) open(fromStart bool) error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	offset := int64(0)
+	if !fromStart {
+		if t.position.Offset < 0 {
+			if !t.fromBeginning {
+				offset = info.Size()
+			}
+		} else if t.position.Offset <= info.Size() && t.position.FingerprintSize <= info.Size() {
+			fingerprint, err := fileFingerprint(f, t.position.FingerprintSize)
+			if err == nil && fingerprint == t.position.Fingerprint {
+				offset = t.position.Offset
+			}
+		}
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	t.file = f
+	t.info = info
+	t.reader = bufio.NewReader(f)
+	t.partial = ""
+	t.position = FilePosition{Offset: offset}
+	return t.updateFingerprint()
+}
+
+// updateFingerprint extends the fingerprint while the file is still shorter than fingerprintSize.
+func (t *FileTailer) updateFingerprint() error {
+	size := t.position.Offset
+	if size > fingerprintSize {
+		size = fingerprintSize
+	}
+	if size == t.position.FingerprintSize && t.position.Fingerprint != "" {
+		return nil
+	}
+	fingerprint, err := fileFingerprint(t.file, size)
+	if err != nil {
+		return err
+	}
+	t.position.Fingerprint = fingerprint
+	t.position.FingerprintSize = size
+	return nil
+}
+
+func (t *FileTailer) close() {
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+}
+
+// readLines hands each complete line read from the open file to h until the end of the file. If h returns an
+// error, reading stops and the line will be read again.
+func (t *FileTailer) readLines(h fileTailerHandler) error {
+	for {
+		data, err := t.reader.ReadString('\n')
+		if err == io.EOF {
+			t.partial += data
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		line := strings.TrimRight(t.partial+data, "\r\n")
+		next := t.position
+		next.Offset += int64(len(t.partial) + len(data))
+
+		if err := h.Line(line, next); err != nil {
+			// rewind so the line is read again
+			if _, seekErr := t.file.Seek(t.position.Offset, io.SeekStart); seekErr != nil {
+				return seekErr
+			}
+			t.reader.Reset(t.file)
+			t.partial = ""
+			return err
+		}
+
+		t.partial = ""
+		t.position = next
+		if err := t.updateFingerprint(); err != nil {
+			return err
+		}
+	}
+}
+
+// finish reads the rest of a file that will not be written to any more, including a final line without a newline.
+func (t *FileTailer) finish(h fileTailerHandler) error {
+	if err := t.readLines(h); err != nil {
+		return err
+	}
+	if t.partial != "" {
+		next := t.position
+		next.Offset += int64(len(t.partial))
+		if err := h.Line(t.partial, next); err != nil {
+			return err
+		}
+		t.partial = ""
+		t.position = next
+	}
+	return h.Idle(true)
+}
+
+type fileState int
+
+const (
+	fileUnchanged fileState = iota
+	fileRotated
+	fileTruncated
+	fileRemoved
+)
+
+// checkRotation reports whether the file at path has been replaced, truncated or removed since it was opened.
+func (t *FileTailer) checkRotation() fileState {
+	info, err := os.Stat(t.path)
+	if os.IsNotExist(err) {
+		return fileRemoved
+	}
+	if err != nil {
+		return fileUnchanged
+	}
+	if !os.SameFile(t.info, info) {
+		return fileRotated
+	}
+	if info.Size() < t.position.Offset+int64(len(t.partial)) {
+		return fileTruncated
+	}
+	return fileUnchanged
+}
+
+// Run follows the file until stop is closed or the file is removed. A file that cannot be read is retried every
+// poll interval.
+func (t *FileTailer) Run(stop <-chan struct{}, h fileTailerHandler) {
+	defer t.close()
+
+	fromStart := false
+	for {
+		if t.file == nil {
+			err := t.open(fromStart)
+			if os.IsNotExist(err) {
+				return
+			}
+			if err != nil {
+				h.Error(err)
+			}
+		}
+
+		if t.file != nil {
+			if err := t.readLines(h); err != nil {
+				h.Error(err)
+			} else {
+				switch t.checkRotation() {
+				case fileRotated:
+					// finish the old file, then start the new one from the beginning
+					if err := t.finish(h); err != nil {
+						h.Error(err)
+					}
+					t.close()
+					fromStart = true
+					continue
+				case fileTruncated:
+					if err := h.Idle(true); err != nil {
+						h.Error(err)
+					}
+					t.close()
+					fromStart = true
+					continue
+				case fileRemoved:
+					if err := t.finish(h); err != nil {
+						h.Error(err)
+					}
+					return
+				default:
+					if err := h.Idle(false); err != nil {
+						h.Error(err)
+					}
+				}
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(t.pollInterval):
+		}
+	}
+}
+
+// CheckpointFile persists the positions of tailed files, keyed by path, so tailing resumes where it stopped after a
+// restart. Positions are written to disk by Save, atomically by renaming a temporary file into place.
+type CheckpointFile struct {
+	path string
+
+	sync.Mutex
+	positions map[string]FilePosition
+	dirty     bool
+}
+
+// LoadCheckpointFile reads the positions stored at path. A missing file is not an error; it holds no positions, and
+// its directory is created so that it can be saved. If path is empty, positions are only kept in memory.
+func LoadCheckpointFile(path string) (*CheckpointFile, error) {
+	c := &CheckpointFile{path: path, positions: make(map[string]FilePosition)}
+	if path == "" {
+		return c, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.positions); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *CheckpointFile) Get(key string) *FilePosition {
+	c.Lock()
+	defer c.Unlock()
+
+	position, ok := c.positions[key]
+	if !ok {
+		return nil
+	}
+	return &position
+}
+
+func (c *CheckpointFile) Set(key string, position FilePosition) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.positions[key] = position
+	c.dirty = true
+}
+
+func (c *CheckpointFile) Delete(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.positions[key]; ok {
+		delete(c.positions, key)
+		c.dirty = true
+	}
+}
+
+// Save writes the positions to disk if they have changed since the last save.
+func (c *CheckpointFile) Save() error {
+	c.Lock()
+	defer c.Unlock()
+
+	if !c.dirty || c.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(c.positions)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	c.dirty = false
+	return nil
+}
+
+// FileInputConfig describes a set of files whose records are output as events of one type.
+type FileInputConfig struct {
+	Name string
+	// glob patterns; they should not match rotated copies of the files, which would be read again
+	Paths     []string
+	EventType string
+	// text or json
+	Format string
+	// optional regular expression whose named groups are added as fields of text records
+	Pattern *regexp.Regexp
+	// if set, lines that do not match are appended to the record started by the last line that did
+	MultilineStart    *regexp.Regexp
+	MultilineMaxLines int
+	// a record is output once no line has been added to it for this long
+	MultilineTimeout time.Duration
+	// read files that exist at startup and have no saved position from the beginning rather than the end
+	FromBeginning  bool
+	CheckpointFile string
+
+	// returns the fields of a record and whether it could be parsed; defaults to parseFileInputRecord
+	parse func(record string) (map[string]interface{}, bool)
+}
+
+// parseFileInputRecord returns the fields of a record according to the Format and Pattern of c. JSON records are
+// decoded into top-level fields; text records are output as message, with the groups of Pattern if it matches.
+func (c *FileInputConfig) parseFileInputRecord(record string) (map[string]interface{}, bool) {
+	if c.Format == "json" {
+		var msg map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewBufferString(record))
+		decoder.UseNumber()
+		if err := decoder.Decode(&msg); err != nil || msg == nil {
+			return map[string]interface{}{"message": record}, false
+		}
+		return msg, true
+	}
+
+	msg := map[string]interface{}{"message": record}
+	if c.Pattern == nil {
+		return msg, true
+	}
+	m := c.Pattern.FindStringSubmatch(record)
+	if m == nil {
+		return msg, false
+	}
+	for i, name := range c.Pattern.SubexpNames() {
+		if name != "" && m[i] != "" {
+			msg[name] = m[i]
+		}
+	}
+	return msg, true
+}
+
+type FileInputFileStatistics struct {
+	Path          string       `json:"path"`
+	EventType     string       `json:"event_type"`
+	Position      FilePosition `json:"position"`
+	Records       int64        `json:"records"`
+	Unparsed      int64        `json:"unparsed"`
+	LastError     string       `json:"last_error"`
+	LastErrorTime time.Time    `json:"last_error_time"`
+}
+
+// fileInputFile groups the lines of one tailed file into records and outputs them.
+type fileInputFile struct {
+	input  *FileInput
+	config *FileInputConfig
+	path   string
+
+	// lines of the record being grouped, and the position after the last of them
+	pending         []string
+	pendingPosition FilePosition
+	lastLine        time.Time
+
+	records  int64
+	unparsed int64
+
+	sync.Mutex
+	position      FilePosition
+	lastError     string
+	lastErrorTime time.Time
 }
 
-func (f FileConsumer) tailFile(fName string, c chan<- string) error {
-	seekInfo := tail.SeekInfo{Offset: 0, Whence: io.SeekEnd}
-	t, err := tail.TailFile(fName, tail.Config{Follow: true, ReOpen: true, Poll: true, Location: &seekInfo})
-	if err == nil {
-		for line := range t.Lines {
-			log.Debug(line.Text)
-			c <- line.Text
+func (f *fileInputFile) Line(line string, position FilePosition) error {
+	if f.config.MultilineStart == nil {
+		return f.emit([]string{line}, position)
+	}
+
+	if len(f.pending) > 0 &&
+		(f.config.MultilineStart.MatchString(line) || len(f.pending) >= f.config.MultilineMaxLines) {
+		if err := f.emit(f.pending, f.pendingPosition); err != nil {
+			return err
 		}
+	}
+	f.pending = append(f.pending, line)
+	f.pendingPosition = position
+	f.lastLine = time.Now()
+	return nil
+}
+
+func (f *fileInputFile) Idle(finished bool) error {
+	if len(f.pending) == 0 {
 		return nil
 	}
-	log.Debugf("Error tailing file %s : %v", fName, err)
-	return err
+	if finished || time.Since(f.lastLine) >= f.config.MultilineTimeout {
+		return f.emit(f.pending, f.pendingPosition)
+	}
+	return nil
 }
 
-func NewFileConsumer(fName string) (*FileConsumer, <-chan string, error) {
+// Error records an error reading the file. It is logged when it first occurs rather than on every retry.
+func (f *fileInputFile) Error(err error) {
+	if err == errShutdown {
+		return
+	}
 
-	consumer := &FileConsumer{fileName: fName}
+	f.Lock()
+	repeated := f.lastError == err.Error()
+	f.lastError = err.Error()
+	f.lastErrorTime = time.Now()
+	f.Unlock()
 
-	c := make(chan string)
+	if !repeated {
+		log.Errorf("Error reading %s: %s", f.path, err)
+	}
+}
 
-	go consumer.tailFile(fName, c)
+func (f *fileInputFile) emit(lines []string, position FilePosition) error {
+	record := strings.Join(lines, "\n")
+	msg, parsed := f.config.parse(record)
+	msg["type"] = f.config.EventType
+	msg["source_path"] = f.path
+
+	if err := f.input.output(msg); err != nil {
+		return err
+	}
+
+	f.pending = nil
+	atomic.AddInt64(&f.records, 1)
+	if !parsed {
+		atomic.AddInt64(&f.unparsed, 1)
+		log.Debugf("Could not parse record from %s: %s", f.path, record)
+	}
+
+	f.Lock()
+	f.position = position
+	f.Unlock()
+	f.input.checkpoints.Set(f.path, position)
+	return nil
+}
+
+// FileInput tails the files matching the patterns of one or more FileInputConfigs and outputs their records as
+// events. Patterns are matched again every scan interval to pick up new files, which are read from the beginning.
+// The position after the last record output from each file is saved to a checkpoint file, so after a restart
+// reading resumes with the first record that was not output.
+type FileInput struct {
+	configs     []*FileInputConfig
+	checkpoints *CheckpointFile
+
+	pollInterval time.Duration
+	scanInterval time.Duration
+	saveInterval time.Duration
+
+	// outputs an event; replaced in tests
+	output func(msg map[string]interface{}) error
+
+	sync.Mutex
+	files map[string]*fileInputFile
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewFileInput returns an input for configs. Positions are not persisted if checkpointPath is empty.
+func NewFileInput(configs []FileInputConfig, checkpointPath string) (*FileInput, error) {
+	checkpoints, err := LoadCheckpointFile(checkpointPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read checkpoint file %s: %s", checkpointPath, err)
+	}
+
+	input := &FileInput{
+		checkpoints:  checkpoints,
+		pollInterval: time.Second,
+		scanInterval: 10 * time.Second,
+		saveInterval: 5 * time.Second,
+		output:       outputMessage,
+		files:        make(map[string]*fileInputFile),
+		stop:         make(chan struct{}),
+	}
+	for i := range configs {
+		c := configs[i]
+		if c.parse == nil {
+			c.parse = c.parseFileInputRecord
+		}
+		input.configs = append(input.configs, &c)
+	}
+	return input, nil
+}
+
+func (i *FileInput) Start() {
+	i.scan(true)
+
+	i.wg.Add(1)
+	go func() {
+		defer i.wg.Done()
+
+		scanTicker := time.NewTicker(i.scanInterval)
+		defer scanTicker.Stop()
+		saveTicker := time.NewTicker(i.saveInterval)
+		defer saveTicker.Stop()
+
+		for {
+			select {
+			case <-scanTicker.C:
+				i.scan(false)
+			case <-saveTicker.C:
+				if err := i.checkpoints.Save(); err != nil {
+					log.Errorf("Could not save file positions: %s", err)
+				}
+			case <-i.stop:
+				return
+			}
+		}
+	}()
+}
+
+// scan starts tailing files that match a pattern and are not already being tailed. Files found by the initial scan
+// that have no saved position are read from the end, unless FromBeginning is set.
+func (i *FileInput) scan(initial bool) {
+	for _, c := range i.configs {
+		for _, pattern := range c.Paths {
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				log.Errorf("Invalid file pattern %s: %s", pattern, err)
+				continue
+			}
+			for _, path := range matches {
+				i.tail(c, path, !initial || c.FromBeginning)
+			}
+		}
+	}
+}
+
+func (i *FileInput) tail(c *FileInputConfig, path string, fromBeginning bool) {
+	i.Lock()
+	if _, ok := i.files[path]; ok {
+		i.Unlock()
+		return
+	}
+	f := &fileInputFile{input: i, config: c, path: path}
+	i.files[path] = f
+	i.Unlock()
+
+	log.Infof("Reading %s as %s events", path, c.EventType)
+
+	tailer := NewFileTailer(path, i.checkpoints.Get(path), fromBeginning)
+	tailer.pollInterval = i.pollInterval
+
+	i.wg.Add(1)
+	go func() {
+		defer i.wg.Done()
+		tailer.Run(i.stop, f)
+
+		select {
+		case <-i.stop:
+		default:
+			// the file was removed; if it is created again it is a new file
+			log.Infof("Stopped reading %s, which has been removed", path)
+			i.Lock()
+			delete(i.files, path)
+			i.Unlock()
+			i.checkpoints.Delete(path)
+		}
+	}()
+}
+
+// Stop stops reading and saves the position of each file.
+func (i *FileInput) Stop() {
+	close(i.stop)
+	i.wg.Wait()
+
+	if err := i.checkpoints.Save(); err != nil {
+		log.Errorf("Could not save file positions: %s", err)
+	}
+}
+
+func (i *FileInput) Statistics() interface{} {
+	i.Lock()
+	paths := make([]string, 0, len(i.files))
+	for path := range i.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	stats := make([]FileInputFileStatistics, 0, len(paths))
+	for _, path := range paths {
+		f := i.files[path]
+		f.Lock()
+		stats = append(stats, FileInputFileStatistics{
+			Path:          f.path,
+			EventType:     f.config.EventType,
+			Position:      f.position,
+			Records:       atomic.LoadInt64(&f.records),
+			Unparsed:      atomic.LoadInt64(&f.unparsed),
+			LastError:     f.lastError,
+			LastErrorTime: f.lastErrorTime,
+		})
+		f.Unlock()
+	}
+	i.Unlock()
 
-	return consumer, c, nil
+	return stats
 }
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFileInput(t *testing.T) {
+	for _, test := range []struct {
+		desc     string
+		config   FileInputConfig
+		steps    []func(dir string) error
+		expected []map[string]interface{}
+	}{
+		{
+			desc:   "Partial lines wait for their newline",
+			config: FileInputConfig{Paths: []string{"app.log"}},
+			steps: []func(dir string) error{
+				appendToFile("app.log", "one\ntw"),
+				appendToFile("app.log", "o\r\nthree\n"),
+			},
+			expected: []map[string]interface{}{
+				{"message": "one", "source_path": "app.log"},
+				{"message": "two", "source_path": "app.log"},
+				{"message": "three", "source_path": "app.log"},
+			},
+		},
+		{
+			desc:   "Rotated file is finished before the new one is read",
+			config: FileInputConfig{Paths: []string{"app.log"}},
+			steps: []func(dir string) error{
+				appendToFile("app.log", "one\n"),
+				func(dir string) error {
+					if err := appendToFile("app.log", "two\nlast without newline")(dir); err != nil {
+						return err
+					}
+					path := filepath.Join(dir, "app.log")
+					return os.Rename(path, path+".1")
+				},
+				appendToFile("app.log", "three\n"),
+			},
+			expected: []map[string]interface{}{
+				{"message": "one", "source_path": "app.log"},
+				{"message": "two", "source_path": "app.log"},
+				{"message": "last without newline", "source_path": "app.log"},
+				{"message": "three", "source_path": "app.log"},
+			},
+		},
+		{
+			desc:   "Truncated file is read from the start",
+			config: FileInputConfig{Paths: []string{"app.log"}},
+			steps: []func(dir string) error{
+				appendToFile("app.log", "one\ntwo\n"),
+				func(dir string) error {
+					return ioutil.WriteFile(filepath.Join(dir, "app.log"), []byte("x\n"), 0644)
+				},
+			},
+			expected: []map[string]interface{}{
+				{"message": "one", "source_path": "app.log"},
+				{"message": "two", "source_path": "app.log"},
+				{"message": "x", "source_path": "app.log"},
+			},
+		},
+		{
+			desc:   "New files matching a glob are read from the beginning",
+			config: FileInputConfig{Paths: []string{"*.json"}, Format: "json"},
+			steps: []func(dir string) error{
+				appendToFile("a.json", `{"tool": "scanner", "count": 3}`+"\n"),
+				appendToFile("b.json", "not json\n"),
+				appendToFile("a.txt", "not matched\n"),
+			},
+			expected: []map[string]interface{}{
+				{"tool": "scanner", "count": json.Number("3"), "source_path": "a.json"},
+				{"message": "not json", "source_path": "b.json"},
+			},
+		},
+		{
+			desc: "Multiline records with fields from a pattern",
+			config: FileInputConfig{
+				Paths:             []string{"app.log"},
+				Pattern:           regexp.MustCompile(`^(?P<time>\S+ \S+) (?P<level>[A-Z]+) `),
+				MultilineStart:    regexp.MustCompile(`^\d{4}-`),
+				MultilineMaxLines: 3,
+				MultilineTimeout:  100 * time.Millisecond,
+			},
+			steps: []func(dir string) error{
+				appendToFile("app.log", "2018-03-05 14:07:53 ERROR failed\nTraceback:\n  line 1\n"),
+				appendToFile("app.log", "2018-03-05 14:07:54 INFO ok\n"+
+					"2018-03-05 14:07:55 WARNING long\n a\n b\n c\n"),
+			},
+			expected: []map[string]interface{}{
+				{"message": "2018-03-05 14:07:53 ERROR failed\nTraceback:\n  line 1", "time": "2018-03-05 14:07:53",
+					"level": "ERROR", "source_path": "app.log"},
+				{"message": "2018-03-05 14:07:54 INFO ok", "time": "2018-03-05 14:07:54", "level": "INFO",
+					"source_path": "app.log"},
+				{"message": "2018-03-05 14:07:55 WARNING long\n a\n b", "time": "2018-03-05 14:07:55",
+					"level": "WARNING", "source_path": "app.log"},
+				{"message": " c", "source_path": "app.log"},
+			},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "file-input")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			// files that exist before the input starts are read from their end
+			if err := ioutil.WriteFile(filepath.Join(dir, "app.log"), []byte("old\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			c := test.config
+			c.EventType = "test.log"
+			for i, pattern := range c.Paths {
+				c.Paths[i] = filepath.Join(dir, pattern)
+			}
+
+			input, err := NewFileInput([]FileInputConfig{c}, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			input.pollInterval = 10 * time.Millisecond
+			input.scanInterval = 10 * time.Millisecond
+
+			var lock sync.Mutex
+			var output []map[string]interface{}
+			input.output = func(msg map[string]interface{}) error {
+				if msg["type"] != "test.log" {
+					t.Errorf("unexpected event type %v", msg["type"])
+				}
+				delete(msg, "type")
+				msg["source_path"], _ = filepath.Rel(dir, msg["source_path"].(string))
+				lock.Lock()
+				output = append(output, msg)
+				lock.Unlock()
+				return nil
+			}
+
+			input.Start()
+			for _, step := range test.steps {
+				time.Sleep(50 * time.Millisecond)
+				if err := step(dir); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+				lock.Lock()
+				n := len(output)
+				lock.Unlock()
+				if n >= len(test.expected) {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			input.Stop()
+
+			if diff := cmp.Diff(test.expected, output); diff != "" {
+				t.Errorf("events mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFileInputSavesCheckpointInNewDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-input")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// like the default checkpoint path, the directory does not exist yet
+	checkpointPath := filepath.Join(dir, "event-forwarder", "file_input_app.json")
+	c := FileInputConfig{Name: "app", EventType: "test.log", Paths: []string{filepath.Join(dir, "app.log")},
+		FromBeginning: true}
+	if err := appendToFile("app.log", "one\n")(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	input, err := NewFileInput([]FileInputConfig{c}, checkpointPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input.pollInterval = 10 * time.Millisecond
+	output := make(chan map[string]interface{}, 1)
+	input.output = func(msg map[string]interface{}) error {
+		output <- msg
+		return nil
+	}
+	input.Start()
+	select {
+	case <-output:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the line to be output")
+	}
+	input.Stop()
+
+	data, err := ioutil.ReadFile(checkpointPath)
+	if err != nil {
+		t.Fatalf("expected the checkpoint to be saved, got %s", err)
+	}
+	var positions map[string]FilePosition
+	if err := json.Unmarshal(data, &positions); err != nil {
+		t.Fatal(err)
+	}
+	if position, ok := positions[c.Paths[0]]; !ok || position.Offset != 4 {
+		t.Errorf("expected the position after the first line, got %v", positions)
+	}
+}
+
+func appendToFile(name, data string) func(dir string) error {
+	return func(dir string) error {
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = f.WriteString(data)
+		return err
+	}
+}
+
+func TestCheckpointFileCreatesDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "data", "event-forwarder", "positions.json")
+	checkpoints, err := LoadCheckpointFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoints.Set("/var/log/example.log", FilePosition{Offset: 42})
+	if err := checkpoints.Save(); err != nil {
+		t.Fatalf("expected the checkpoint to be saved, got %s", err)
+	}
+
+	checkpoints, err = LoadCheckpointFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position := checkpoints.Get("/var/log/example.log"); position == nil || position.Offset != 42 {
+		t.Errorf("expected the saved position to be loaded, got %+v", position)
+	}
+}
@@ -29,18 +29,27 @@ type FileOutput struct {
 	lastRolledOver      time.Time
 	sync.RWMutex
 	bufferOutput BufferOutput
+	// links the lines of the file when hash_chain is enabled
+	chain *hashChain
 }
 
 type FileStatistics struct {
-	LastOpenTime time.Time `json:"last_open_time"`
-	FileName     string    `json:"file_name"`
+	LastOpenTime  time.Time `json:"last_open_time"`
+	FileName      string    `json:"file_name"`
+	Encrypted     bool      `json:"encrypted"`
+	SigningMethod string    `json:"signing_method,omitempty"`
 }
 
 func (o *FileOutput) Statistics() interface{} {
 	o.RLock()
 	defer o.RUnlock()
 
-	return FileStatistics{LastOpenTime: o.fileOpenedAt, FileName: o.outputFileName}
+	stats := FileStatistics{LastOpenTime: o.fileOpenedAt, FileName: o.outputFileName,
+		Encrypted: len(config.BundleRecipients) > 0}
+	if config.BundleSigner != nil {
+		stats.SigningMethod = config.BundleSigner.Method
+	}
+	return stats
 }
 
 func (o *FileOutput) Key() string {
@@ -60,12 +69,30 @@ func (o *FileOutput) Initialize(fileName string) error {
 	o.lastRolledOver = time.Now()
 	o.closeFile()
 
+	if config.FileHashChain && o.chain == nil {
+		o.chain = newHashChain()
+	}
+
 	// if the output file already exists, let's roll it over to start from scratch
 	fp, err := os.OpenFile(o.outputFileName, os.O_RDWR|os.O_EXCL|os.O_CREATE, 0644)
 	if err != nil {
 		if os.IsExist(err) {
+			// continue the hash chain from the file left behind by the previous run
+			recovered := false
+			if o.chain != nil {
+				recovered, err = o.chain.recover(o.outputFileName)
+				if err != nil {
+					return fmt.Errorf("Could not continue the hash chain from %s: %s", o.outputFileName, err)
+				}
+			}
+
 			// the output file already exists, try to roll it over
-			o.rollOverRename("2006-01-02T15:04:05.000.restart")
+			if newName, err := o.rollOverRename("2006-01-02T15:04:05.000.restart"); err == nil {
+				if recovered {
+					o.finishChainFile(newName)
+				}
+				o.signFile(newName)
+			}
 
 			// try again
 			fp, err = os.OpenFile(o.outputFileName, os.O_RDWR|os.O_EXCL|os.O_CREATE, 0644)
@@ -79,11 +106,26 @@ func (o *FileOutput) Initialize(fileName string) error {
 		}
 	}
 
+	// data is compressed before it is encrypted, as encrypted data does not compress
+	o.outputFile = fp
+	if len(config.BundleRecipients) > 0 {
+		encrypted, err := newEncryptedFile(fp, config.BundleRecipients)
+		if err != nil {
+			fp.Close()
+			o.outputFile = nil
+			return err
+		}
+		o.outputFile = encrypted
+	}
+
 	if config.FileHandlerCompressData != false {
 		log.Info("File handler configured to compress data")
-		o.outputGzWriter = gzip.NewWriter(fp)
+		o.outputGzWriter = gzip.NewWriter(o.outputFile)
+	}
+
+	if o.chain != nil {
+		o.chain.startFile()
 	}
-	o.outputFile = fp
 
 	o.fileOpenedAt = time.Now()
 	o.lastRolledOver = time.Now()
@@ -92,7 +134,7 @@ func (o *FileOutput) Initialize(fileName string) error {
 	return nil
 }
 
-func (o *FileOutput) Go(messages <-chan string, errorChan chan<- error) error {
+func (o *FileOutput) Go(messages <-chan string, errorChan chan<- error, done chan<- struct{}) error {
 	if o.outputFile == nil {
 		return errors.New("No output file specified")
 	}
@@ -104,19 +146,19 @@ func (o *FileOutput) Go(messages <-chan string, errorChan chan<- error) error {
 		hup := make(chan os.Signal, 1)
 		signal.Notify(hup, syscall.SIGHUP)
 
-		term := make(chan os.Signal, 1)
-		signal.Notify(term, syscall.SIGTERM)
-		signal.Notify(term, syscall.SIGINT)
-
+		defer close(done)
 		defer o.closeFile()
 		defer o.flushOutput(true)
 		defer signal.Stop(hup)
-		defer signal.Stop(term)
 
 		for {
 
 			select {
-			case message := <-messages:
+			case message, ok := <-messages:
+				if !ok {
+					log.Info("Output channel closed; flushing and closing file")
+					return
+				}
 				if err := o.output(message); err != nil {
 					errorChan <- err
 					return
@@ -138,12 +180,6 @@ func (o *FileOutput) Go(messages <-chan string, errorChan chan<- error) error {
 					errorChan <- err
 					return
 				}
-
-			case <-term:
-				// handle exit gracefully
-				log.Info("Received SIGTERM. Exiting")
-				errorChan <- errors.New("SIGTERM received")
-				return
 			}
 		}
 	}()
@@ -196,8 +232,14 @@ func (o *FileOutput) output(s string) error {
 	/*
 	 * Write to our buffer first
 	 */
+	if o.chain != nil {
+		s = o.chain.link(s)
+	}
 	o.bufferOutput.buffer.WriteString(s + "\n")
 	err := o.flushOutput(false)
+	if err == nil {
+		recordOutput()
+	}
 	return err
 }
 
@@ -209,16 +251,31 @@ func (o *FileOutput) rollOverFile(tf string) (string, error) {
 		return "", err
 	}
 
-	return newName, o.Initialize(o.outputFileName)
+	chainErr := o.finishChainFile(newName)
+
+	if err := o.Initialize(o.outputFileName); err != nil {
+		return newName, err
+	}
+	if chainErr != nil {
+		return newName, chainErr
+	}
+	return newName, o.signFile(newName)
 }
 
 func (o *FileOutput) rollOverRename(tf string) (string, error) {
-	var newName string
+	encrypted := len(config.BundleRecipients) > 0
+
+	newName := o.outputFileName
+	if encrypted {
+		newName = strings.TrimSuffix(newName, ".age")
+	}
 	if config.FileHandlerCompressData == true {
-		fileNameWithoutExtension := strings.TrimSuffix(o.outputFileName, ".gz")
-		newName = fileNameWithoutExtension + "." + o.lastRolledOver.Format(tf) + ".gz"
+		newName = strings.TrimSuffix(newName, ".gz") + "." + o.lastRolledOver.Format(tf) + ".gz"
 	} else {
-		newName = o.outputFileName + "." + o.lastRolledOver.Format(tf)
+		newName = newName + "." + o.lastRolledOver.Format(tf)
+	}
+	if encrypted {
+		newName += ".age"
 	}
 
 	log.Infof("Rolling file %s to %s", o.outputFileName, newName)
@@ -230,6 +287,35 @@ func (o *FileOutput) rollOverRename(tf string) (string, error) {
 
 }
 
+// finishChainFile writes the manifest of a file that has been rolled over to fileName, when hash_chain is enabled,
+// and removes the manifest written when the file was closed. The manifest is signed along with the file.
+func (o *FileOutput) finishChainFile(fileName string) error {
+	if o.chain == nil {
+		return nil
+	}
+	manifestName := fileName + chainManifestSuffix
+	if err := writeChainManifest(manifestName, o.chain.manifest(fileName)); err != nil {
+		log.Errorf("Could not write the hash chain manifest %s: %s", manifestName, err)
+		return err
+	}
+	os.Remove(o.outputFileName + chainManifestSuffix)
+	return o.signFile(manifestName)
+}
+
+// signFile writes the detached signature of a rolled over file, if signing is configured.
+func (o *FileOutput) signFile(fileName string) error {
+	if config.BundleSigner == nil {
+		return nil
+	}
+	sigName, err := config.BundleSigner.signFile(fileName)
+	if err != nil {
+		log.Errorf("Could not sign %s: %s", fileName, err)
+		return err
+	}
+	log.Debugf("Wrote signature %s", sigName)
+	return nil
+}
+
 func (o *FileOutput) closeFile() {
 	if o.outputGzWriter != nil {
 		o.flushOutput(true)
@@ -241,6 +327,14 @@ func (o *FileOutput) closeFile() {
 		log.Debugf("Closing file %s", o.outputFileName)
 		o.outputFile.Close()
 		o.outputFile = nil
+
+		// record where the chain stands, so that it can be continued from this file after a restart
+		if o.chain != nil {
+			manifestName := o.outputFileName + chainManifestSuffix
+			if err := writeChainManifest(manifestName, o.chain.manifest(o.outputFileName)); err != nil {
+				log.Errorf("Could not write the hash chain manifest %s: %s", manifestName, err)
+			}
+		}
 	}
 
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// FilterRule is one [filter:<name>] section. Exclude rules drop the events they match; if there are include rules,
+// only events matching at least one of them are kept.
+type FilterRule struct {
+	Name       string
+	Action     string
+	Expression string
+	// output types the rule applies to; every output if empty
+	Outputs []string
+
+	expr    FilterExpression
+	matches int64
+}
+
+// appliesTo reports whether the rule is used with the given output type.
+func (r *FilterRule) appliesTo(outputType string) bool {
+	if len(r.Outputs) == 0 {
+		return true
+	}
+	for _, o := range r.Outputs {
+		if o == outputType {
+			return true
+		}
+	}
+	return false
+}
+
+type FilterRuleStatistics struct {
+	Action  string `json:"action"`
+	Matches int64  `json:"matches"`
+}
+
+type FilterStatistics struct {
+	Evaluated int64                           `json:"evaluated"`
+	Dropped   int64                           `json:"dropped"`
+	Rules     map[string]FilterRuleStatistics `json:"rules"`
+}
+
+// Filter drops events according to the include and exclude rules that apply to the configured output.
+type Filter struct {
+	includes []*FilterRule
+	excludes []*FilterRule
+
+	evaluated int64
+	dropped   int64
+}
+
+// NewFilter returns a filter with the rules in rules that apply to outputType.
+func NewFilter(rules []*FilterRule, outputType string) *Filter {
+	f := &Filter{}
+	for _, rule := range rules {
+		if !rule.appliesTo(outputType) {
+			continue
+		}
+		if rule.Action == "include" {
+			f.includes = append(f.includes, rule)
+		} else {
+			f.excludes = append(f.excludes, rule)
+		}
+	}
+	return f
+}
+
+func (f *Filter) Name() string {
+	return "filter"
+}
+
+func (f *Filter) Process(msg map[string]interface{}) bool {
+	atomic.AddInt64(&f.evaluated, 1)
+
+	for _, rule := range f.excludes {
+		if EvalFilterExpression(rule.expr, msg) {
+			atomic.AddInt64(&rule.matches, 1)
+			atomic.AddInt64(&f.dropped, 1)
+			return false
+		}
+	}
+
+	if len(f.includes) == 0 {
+		return true
+	}
+	for _, rule := range f.includes {
+		if EvalFilterExpression(rule.expr, msg) {
+			atomic.AddInt64(&rule.matches, 1)
+			return true
+		}
+	}
+	atomic.AddInt64(&f.dropped, 1)
+	return false
+}
+
+func (f *Filter) Statistics() interface{} {
+	stats := FilterStatistics{
+		Evaluated: atomic.LoadInt64(&f.evaluated),
+		Dropped:   atomic.LoadInt64(&f.dropped),
+		Rules:     make(map[string]FilterRuleStatistics),
+	}
+	for _, rules := range [][]*FilterRule{f.includes, f.excludes} {
+		for _, rule := range rules {
+			stats.Rules[rule.Name] = FilterRuleStatistics{Action: rule.Action, Matches: atomic.LoadInt64(&rule.matches)}
+		}
+	}
+	return stats
+}
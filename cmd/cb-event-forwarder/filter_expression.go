@@ -0,0 +1,605 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A FilterExpression is a compiled filter expression, evaluated against an event. The language has
+//
+//   - literals: "strings" or 'strings' with backslash escapes, numbers, true, false, null and [lists]
+//   - fields, named by a dotted path such as remote_port or docs.0.md5; a missing field is null
+//   - comparisons: == != < <= > >=, in and not in (a list, or a substring of a string), contains, startsWith,
+//     endsWith and matches (a regular expression)
+//   - the functions lower(x), upper(x) and len(x)
+//   - boolean operators && (and), || (or) and ! (not), and parentheses
+//
+// A field on its own is true if it is present and not false, zero or empty. Numbers are compared numerically, also
+// against strings that hold a number.
+type FilterExpression interface {
+	eval(msg map[string]interface{}) interface{}
+}
+
+// EvalFilterExpression reports whether expr is true for msg.
+func EvalFilterExpression(expr FilterExpression, msg map[string]interface{}) bool {
+	return filterTruthy(expr.eval(msg))
+}
+
+type filterToken struct {
+	kind  string // "string", "number", "ident", "op", or "eof"
+	text  string
+	value interface{}
+	pos   int
+}
+
+type filterLexer struct {
+	input  string
+	pos    int
+	tokens []filterToken
+}
+
+var filterOperators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ","}
+
+func (l *filterLexer) lex() error {
+	for {
+		for l.pos < len(l.input) && unicode.IsSpace(rune(l.input[l.pos])) {
+			l.pos++
+		}
+		if l.pos >= len(l.input) {
+			l.tokens = append(l.tokens, filterToken{kind: "eof", pos: l.pos})
+			return nil
+		}
+
+		start := l.pos
+		c := l.input[l.pos]
+		switch {
+		case c == '"' || c == '\'':
+			s, err := l.lexString(c)
+			if err != nil {
+				return err
+			}
+			l.tokens = append(l.tokens, filterToken{kind: "string", text: l.input[start:l.pos], value: s, pos: start})
+		case c >= '0' && c <= '9' || c == '-' && l.pos+1 < len(l.input) && l.input[l.pos+1] >= '0' &&
+			l.input[l.pos+1] <= '9':
+			l.pos++
+			for l.pos < len(l.input) && strings.IndexByte("0123456789.eE+-", l.input[l.pos]) >= 0 {
+				if (l.input[l.pos] == '+' || l.input[l.pos] == '-') && !strings.ContainsAny(l.input[l.pos-1:l.pos], "eE") {
+					break
+				}
+				l.pos++
+			}
+			f, err := strconv.ParseFloat(l.input[start:l.pos], 64)
+			if err != nil {
+				return fmt.Errorf("invalid number %q at position %d", l.input[start:l.pos], start)
+			}
+			l.tokens = append(l.tokens, filterToken{kind: "number", text: l.input[start:l.pos], value: f, pos: start})
+		case c == '_' || unicode.IsLetter(rune(c)):
+			for l.pos < len(l.input) && (l.input[l.pos] == '_' || l.input[l.pos] == '.' ||
+				unicode.IsLetter(rune(l.input[l.pos])) || unicode.IsDigit(rune(l.input[l.pos]))) {
+				l.pos++
+			}
+			l.tokens = append(l.tokens, filterToken{kind: "ident", text: l.input[start:l.pos], pos: start})
+		default:
+			matched := false
+			for _, op := range filterOperators {
+				if strings.HasPrefix(l.input[l.pos:], op) {
+					l.pos += len(op)
+					l.tokens = append(l.tokens, filterToken{kind: "op", text: op, pos: start})
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return fmt.Errorf("unexpected %q at position %d", c, start)
+			}
+		}
+	}
+}
+
+func (l *filterLexer) lexString(quote byte) (string, error) {
+	start := l.pos
+	l.pos++
+
+	var b strings.Builder
+	for l.pos < len(l.input) {
+		c := l.input[l.pos]
+		switch {
+		case c == quote:
+			l.pos++
+			return b.String(), nil
+		case c == '\\' && l.pos+1 < len(l.input):
+			l.pos++
+			switch e := l.input[l.pos]; e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				b.WriteByte(e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+		l.pos++
+	}
+	return "", fmt.Errorf("unterminated string starting at position %d", start)
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+// CompileFilterExpression parses an expression in the filter language described by FilterExpression.
+func CompileFilterExpression(input string) (FilterExpression, error) {
+	l := &filterLexer{input: input}
+	if err := l.lex(); err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: l.tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != "eof" {
+		return nil, fmt.Errorf("unexpected %q at position %d", t.text, t.pos)
+	}
+	return expr, nil
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	t := p.tokens[p.pos]
+	if t.kind != "eof" {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is one of the given operators or keywords.
+func (p *filterParser) accept(texts ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != "op" && t.kind != "ident" {
+		return "", false
+	}
+	for _, text := range texts {
+		if t.text == text {
+			p.pos++
+			return text, true
+		}
+	}
+	return "", false
+}
+
+func (p *filterParser) expect(text string) error {
+	if _, ok := p.accept(text); !ok {
+		t := p.peek()
+		if t.kind == "eof" {
+			return fmt.Errorf("expected %q at the end of the expression", text)
+		}
+		return fmt.Errorf("expected %q at position %d, found %q", text, t.pos, t.text)
+	}
+	return nil
+}
+
+func (p *filterParser) parseOr() (FilterExpression, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("||", "or"); !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = filterOr{left, right}
+	}
+}
+
+func (p *filterParser) parseAnd() (FilterExpression, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("&&", "and"); !ok {
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = filterAnd{left, right}
+	}
+}
+
+func (p *filterParser) parseNot() (FilterExpression, error) {
+	if _, ok := p.accept("!", "not"); ok {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (FilterExpression, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	op, ok := p.accept("==", "!=", "<", "<=", ">", ">=", "in", "contains", "startsWith", "endsWith", "matches")
+	if !ok {
+		// "not in" is the only comparison made of two words
+		if t := p.peek(); t.kind == "ident" && t.text == "not" && p.tokens[p.pos+1].text == "in" {
+			p.pos += 2
+			op = "not in"
+		} else {
+			return left, nil
+		}
+	}
+
+	right, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	if op == "matches" {
+		lit, ok := right.(filterLiteral)
+		pattern, isString := lit.value.(string)
+		if !ok || !isString {
+			return nil, fmt.Errorf("matches requires a string literal regular expression")
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %s", pattern, err)
+		}
+		return filterMatches{left, re}, nil
+	}
+	return filterComparison{op, left, right}, nil
+}
+
+func (p *filterParser) parsePrimary() (FilterExpression, error) {
+	t := p.next()
+	switch t.kind {
+	case "string", "number":
+		return filterLiteral{t.value}, nil
+	case "ident":
+		switch t.text {
+		case "true":
+			return filterLiteral{true}, nil
+		case "false":
+			return filterLiteral{false}, nil
+		case "null":
+			return filterLiteral{nil}, nil
+		case "lower", "upper", "len":
+			if p.peek().text == "(" {
+				p.next()
+				arg, err := p.parseOr()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(")"); err != nil {
+					return nil, err
+				}
+				return filterFunction{t.text, arg}, nil
+			}
+		}
+		return filterField{t.text}, nil
+	case "op":
+		switch t.text {
+		case "(":
+			expr, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return expr, nil
+		case "[":
+			var list filterList
+			if _, ok := p.accept("]"); ok {
+				return list, nil
+			}
+			for {
+				element, err := p.parsePrimary()
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, element)
+				if _, ok := p.accept("]"); ok {
+					return list, nil
+				}
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+		}
+	case "eof":
+		return nil, fmt.Errorf("unexpected end of the expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", t.text, t.pos)
+}
+
+type filterLiteral struct {
+	value interface{}
+}
+
+func (e filterLiteral) eval(msg map[string]interface{}) interface{} {
+	return e.value
+}
+
+type filterList []FilterExpression
+
+func (e filterList) eval(msg map[string]interface{}) interface{} {
+	values := make([]interface{}, len(e))
+	for i, element := range e {
+		values[i] = element.eval(msg)
+	}
+	return values
+}
+
+type filterField struct {
+	path string
+}
+
+func (e filterField) eval(msg map[string]interface{}) interface{} {
+	v, ok := getFieldPath(msg, e.path)
+	if !ok {
+		return nil
+	}
+	return normalizeFilterValue(v)
+}
+
+// normalizeFilterValue converts the numeric types found in events to float64 and arrays to []interface{}.
+func normalizeFilterValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case json.Number:
+		if f, err := value.Float64(); err == nil {
+			return f
+		}
+		return value.String()
+	case float32:
+		return float64(value)
+	case int, int32, int64, uint16, uint32, uint64:
+		i, _ := intFromEvent(value)
+		return float64(i)
+	case []map[string]interface{}:
+		values := make([]interface{}, len(value))
+		for i, element := range value {
+			values[i] = element
+		}
+		return values
+	case []string:
+		values := make([]interface{}, len(value))
+		for i, element := range value {
+			values[i] = element
+		}
+		return values
+	}
+	return v
+}
+
+type filterFunction struct {
+	name string
+	arg  FilterExpression
+}
+
+func (e filterFunction) eval(msg map[string]interface{}) interface{} {
+	v := e.arg.eval(msg)
+	switch e.name {
+	case "lower":
+		if s, ok := v.(string); ok {
+			return strings.ToLower(s)
+		}
+	case "upper":
+		if s, ok := v.(string); ok {
+			return strings.ToUpper(s)
+		}
+	case "len":
+		switch value := v.(type) {
+		case string:
+			return float64(len(value))
+		case []interface{}:
+			return float64(len(value))
+		case map[string]interface{}:
+			return float64(len(value))
+		}
+		return float64(0)
+	}
+	return v
+}
+
+type filterOr struct {
+	left, right FilterExpression
+}
+
+func (e filterOr) eval(msg map[string]interface{}) interface{} {
+	return filterTruthy(e.left.eval(msg)) || filterTruthy(e.right.eval(msg))
+}
+
+type filterAnd struct {
+	left, right FilterExpression
+}
+
+func (e filterAnd) eval(msg map[string]interface{}) interface{} {
+	return filterTruthy(e.left.eval(msg)) && filterTruthy(e.right.eval(msg))
+}
+
+type filterNot struct {
+	operand FilterExpression
+}
+
+func (e filterNot) eval(msg map[string]interface{}) interface{} {
+	return !filterTruthy(e.operand.eval(msg))
+}
+
+type filterMatches struct {
+	operand FilterExpression
+	re      *regexp.Regexp
+}
+
+func (e filterMatches) eval(msg map[string]interface{}) interface{} {
+	s, ok := filterString(e.operand.eval(msg))
+	return ok && e.re.MatchString(s)
+}
+
+type filterComparison struct {
+	op          string
+	left, right FilterExpression
+}
+
+func (e filterComparison) eval(msg map[string]interface{}) interface{} {
+	left, right := e.left.eval(msg), e.right.eval(msg)
+
+	switch e.op {
+	case "==":
+		return filterEqual(left, right)
+	case "!=":
+		return !filterEqual(left, right)
+	case "<", "<=", ">", ">=":
+		c, ok := filterCompare(left, right)
+		if !ok {
+			return false
+		}
+		switch e.op {
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		default:
+			return c >= 0
+		}
+	case "in", "not in":
+		return filterContains(right, left) == (e.op == "in")
+	case "contains":
+		return filterContains(left, right)
+	case "startsWith", "endsWith":
+		s, ok := left.(string)
+		prefix, isString := right.(string)
+		if !ok || !isString {
+			return false
+		}
+		if e.op == "startsWith" {
+			return strings.HasPrefix(s, prefix)
+		}
+		return strings.HasSuffix(s, prefix)
+	}
+	return false
+}
+
+func filterTruthy(v interface{}) bool {
+	switch value := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return value
+	case float64:
+		return value != 0
+	case string:
+		return value != ""
+	case []interface{}:
+		return len(value) > 0
+	case map[string]interface{}:
+		return len(value) > 0
+	}
+	return true
+}
+
+func filterNumber(v interface{}) (float64, bool) {
+	switch value := v.(type) {
+	case float64:
+		return value, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func filterString(v interface{}) (string, bool) {
+	switch value := v.(type) {
+	case string:
+		return value, true
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(value), true
+	}
+	return "", false
+}
+
+func filterEqual(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	_, aIsNumber := a.(float64)
+	_, bIsNumber := b.(float64)
+	if aIsNumber || bIsNumber {
+		x, ok1 := filterNumber(a)
+		y, ok2 := filterNumber(b)
+		return ok1 && ok2 && x == y
+	}
+	switch x := a.(type) {
+	case string:
+		y, ok := b.(string)
+		return ok && x == y
+	case bool:
+		y, ok := b.(bool)
+		return ok && x == y
+	}
+	return false
+}
+
+// filterCompare orders a and b numerically if both are numbers, and as strings otherwise.
+func filterCompare(a, b interface{}) (int, bool) {
+	if x, ok := filterNumber(a); ok {
+		if y, ok := filterNumber(b); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	x, ok1 := a.(string)
+	y, ok2 := b.(string)
+	if !ok1 || !ok2 {
+		return 0, false
+	}
+	return strings.Compare(x, y), true
+}
+
+// filterContains reports whether collection, a list or a string, contains element.
+func filterContains(collection, element interface{}) bool {
+	switch value := collection.(type) {
+	case []interface{}:
+		for _, v := range value {
+			if filterEqual(normalizeFilterValue(v), element) {
+				return true
+			}
+		}
+	case string:
+		s, ok := filterString(element)
+		return ok && strings.Contains(value, s)
+	}
+	return false
+}
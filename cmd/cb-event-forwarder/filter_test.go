@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func testFilterEvent() map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "ingress.event.netconn",
+		"remote_port": uint16(443),
+		"local_port":  json.Number("49152"),
+		"domain":      "proxy.corp.local",
+		"path":        `C:\Windows\System32\svchost.exe`,
+		"direction":   "outbound",
+		"tags":        []interface{}{"dns", "proxy"},
+		"process":     map[string]interface{}{"pid": json.Number("2140")},
+		"blocked":     false,
+	}
+}
+
+func TestFilterExpression(t *testing.T) {
+	for _, test := range []struct {
+		expression string
+		expected   bool
+	}{
+		{`type == "ingress.event.netconn" && remote_port in [80,443] && domain endsWith ".corp.local"`, true},
+		{`type == "ingress.event.netconn" and remote_port in [80, 8080]`, false},
+		{`remote_port not in [80, 8080]`, true},
+		{`remote_port == "443"`, true},
+		{`local_port >= 49152 && local_port < 65536`, true},
+		{`process.pid == 2140`, true},
+		{`lower(path) startsWith "c:\\windows\\system32\\"`, true},
+		{`path startsWith "c:\\windows"`, false},
+		{`path matches "(?i)\\\\system32\\\\[^\\\\]+\\.exe$"`, true},
+		{`domain contains "corp" || missing_field`, true},
+		{`!(direction == 'inbound') && !blocked`, true},
+		{`not tags contains "dns"`, false},
+		{`"proxy" in tags`, true},
+		{`missing_field == null && missing_field != ""`, true},
+		{`missing_field > 0 || missing_field < 0`, false},
+		{`len(tags) == 2 && upper(direction) == "OUTBOUND"`, true},
+		{`domain > "a" && domain < "q"`, true},
+		{`remote_port == -443.0 || remote_port == 4.43e2`, true},
+	} {
+		expr, err := CompileFilterExpression(test.expression)
+		if err != nil {
+			t.Errorf("%s: %s", test.expression, err)
+			continue
+		}
+		if got := EvalFilterExpression(expr, testFilterEvent()); got != test.expected {
+			t.Errorf("%s: got %t, expected %t", test.expression, got, test.expected)
+		}
+	}
+}
+
+func TestFilterExpressionErrors(t *testing.T) {
+	for _, expression := range []string{
+		`type ==`,
+		`type == "netconn`,
+		`(type == "netconn"`,
+		`remote_port in [80, 443`,
+		`type = "netconn"`,
+		`path matches "("`,
+		`path matches domain`,
+		`type == "netconn" "extra"`,
+	} {
+		if _, err := CompileFilterExpression(expression); err == nil {
+			t.Errorf("expected an error for %s", expression)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	compile := func(name, action, expression string, outputs ...string) *FilterRule {
+		expr, err := CompileFilterExpression(expression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &FilterRule{Name: name, Action: action, Expression: expression, Outputs: outputs, expr: expr}
+	}
+
+	rules := []*FilterRule{
+		compile("system32-modloads", "exclude",
+			`type == "ingress.event.moduleload" && lower(path) startsWith "c:\\windows\\system32\\"`),
+		compile("proxy", "exclude", `type == "ingress.event.netconn" && domain == "proxy.corp.local"`, "s3"),
+		compile("raw-events", "include", `type startsWith "ingress.event."`),
+		compile("alerts", "include", `type startsWith "alert."`),
+	}
+
+	events := []map[string]interface{}{
+		{"type": "ingress.event.moduleload", "path": `C:\Windows\System32\ntdll.dll`},
+		{"type": "ingress.event.moduleload", "path": `C:\Users\jdoe\AppData\evil.dll`},
+		{"type": "ingress.event.netconn", "domain": "proxy.corp.local"},
+		{"type": "alert.watchlist.hit.query.process"},
+		{"type": "feed.storage.hit.process"},
+	}
+
+	for _, test := range []struct {
+		outputType string
+		kept       []int
+		stats      FilterStatistics
+	}{
+		{
+			outputType: "file",
+			kept:       []int{1, 2, 3},
+			stats: FilterStatistics{Evaluated: 5, Dropped: 2, Rules: map[string]FilterRuleStatistics{
+				"system32-modloads": {Action: "exclude", Matches: 1},
+				"raw-events":        {Action: "include", Matches: 2},
+				"alerts":            {Action: "include", Matches: 1},
+			}},
+		},
+		{
+			outputType: "s3",
+			kept:       []int{1, 3},
+			stats: FilterStatistics{Evaluated: 5, Dropped: 3, Rules: map[string]FilterRuleStatistics{
+				"system32-modloads": {Action: "exclude", Matches: 1},
+				"proxy":             {Action: "exclude", Matches: 1},
+				"raw-events":        {Action: "include", Matches: 1},
+				"alerts":            {Action: "include", Matches: 1},
+			}},
+		},
+	} {
+		t.Run(test.outputType, func(t *testing.T) {
+			for _, rule := range rules {
+				rule.matches = 0
+			}
+			f := NewFilter(rules, test.outputType)
+
+			var kept []int
+			for i, event := range events {
+				if f.Process(event) {
+					kept = append(kept, i)
+				}
+			}
+
+			if diff := cmp.Diff(test.kept, kept); diff != "" {
+				t.Errorf("kept events mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(test.stats, f.Statistics()); diff != "" {
+				t.Errorf("statistics mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"fmt"
+	"github.com/oschwald/maxminddb-golang"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// privateNetworks are the address ranges that are never looked up: RFC 1918 and unique local addresses, loopback,
+// link local, carrier-grade NAT, multicast and unspecified addresses have no meaningful location or owner.
+var privateNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"224.0.0.0/4",
+	"255.255.255.255/32",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+func isPrivateIP(ip net.IP) bool {
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// A GeoIPDatabase is a MaxMind DB file, such as GeoLite2-City or GeoLite2-ASN, that is reloaded when it changes on
+// disk.
+type GeoIPDatabase struct {
+	File string
+
+	sync.RWMutex
+	reader   *maxminddb.Reader
+	modTime  time.Time
+	loadedAt time.Time
+	lastErr  string
+	lookups  int64
+	found    int64
+}
+
+type GeoIPDatabaseStatistics struct {
+	File         string    `json:"file"`
+	DatabaseType string    `json:"database_type"`
+	BuildTime    time.Time `json:"build_time"`
+	Lookups      int64     `json:"lookups"`
+	Found        int64     `json:"found"`
+	LastLoaded   time.Time `json:"last_loaded"`
+	LastError    string    `json:"last_error"`
+}
+
+type GeoIPStatistics struct {
+	Evaluated int64                              `json:"evaluated"`
+	Enriched  int64                              `json:"enriched"`
+	Private   int64                              `json:"private"`
+	Invalid   int64                              `json:"invalid"`
+	Databases map[string]GeoIPDatabaseStatistics `json:"databases"`
+}
+
+// load reads the database into memory. The file is read rather than memory mapped so that it can be overwritten in
+// place while the forwarder is running. If it cannot be loaded, the previous database stays in use.
+func (d *GeoIPDatabase) load() error {
+	info, err := os.Stat(d.File)
+	if err != nil {
+		d.setError(err)
+		return err
+	}
+	data, err := ioutil.ReadFile(d.File)
+	if err == nil {
+		var reader *maxminddb.Reader
+		reader, err = maxminddb.FromBytes(data)
+		if err == nil {
+			d.Lock()
+			d.reader = reader
+			d.modTime = info.ModTime()
+			d.loadedAt = time.Now()
+			d.lastErr = ""
+			d.Unlock()
+			return nil
+		}
+	}
+
+	d.Lock()
+	d.modTime = info.ModTime()
+	d.lastErr = err.Error()
+	d.Unlock()
+	return err
+}
+
+func (d *GeoIPDatabase) setError(err error) {
+	d.Lock()
+	d.lastErr = err.Error()
+	d.Unlock()
+}
+
+// changed reports whether the file has been modified since it was last loaded.
+func (d *GeoIPDatabase) changed() bool {
+	info, err := os.Stat(d.File)
+	if err != nil {
+		return false
+	}
+	d.RLock()
+	defer d.RUnlock()
+	return !info.ModTime().Equal(d.modTime)
+}
+
+// lookup decodes the record for ip into result, reporting whether the database has one.
+func (d *GeoIPDatabase) lookup(ip net.IP, result interface{}) bool {
+	d.RLock()
+	reader := d.reader
+	d.RUnlock()
+	if reader == nil {
+		return false
+	}
+
+	atomic.AddInt64(&d.lookups, 1)
+	_, ok, err := reader.LookupNetwork(ip, result)
+	if err != nil {
+		// an IPv6 address in an IPv4 only database, or a corrupt record
+		log.Debugf("Could not look up %s in %s: %s", ip, d.File, err)
+		return false
+	}
+	if ok {
+		atomic.AddInt64(&d.found, 1)
+	}
+	return ok
+}
+
+func (d *GeoIPDatabase) statistics() GeoIPDatabaseStatistics {
+	d.RLock()
+	defer d.RUnlock()
+	stats := GeoIPDatabaseStatistics{
+		File:       d.File,
+		Lookups:    atomic.LoadInt64(&d.lookups),
+		Found:      atomic.LoadInt64(&d.found),
+		LastLoaded: d.loadedAt,
+		LastError:  d.lastErr,
+	}
+	if d.reader != nil {
+		stats.DatabaseType = d.reader.Metadata.DatabaseType
+		stats.BuildTime = time.Unix(int64(d.reader.Metadata.BuildEpoch), 0).UTC()
+	}
+	return stats
+}
+
+// the parts of a GeoIP2 or GeoLite2 City record that are added to events
+type geoIPCityRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Country struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Location struct {
+		Latitude  *float64 `maxminddb:"latitude"`
+		Longitude *float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+}
+
+type geoIPASNRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// The GeoIPEnricher adds the location and autonomous system of public IP addresses in events, from local copies of
+// the MaxMind City and ASN databases. For each configured field, such as remote_ip, it adds <field>_country (the ISO
+// code), <field>_country_name, <field>_city, <field>_latitude, <field>_longitude, <field>_asn and <field>_as_org,
+// leaving out any that the databases have no value for.
+type GeoIPEnricher struct {
+	city           *GeoIPDatabase
+	asn            *GeoIPDatabase
+	fields         []string
+	eventTypes     []string
+	reloadInterval time.Duration
+
+	evaluated int64
+	enriched  int64
+	private   int64
+	invalid   int64
+}
+
+// NewGeoIPEnricher loads the City and ASN databases; either may be empty, but not both. A database that cannot be
+// loaded at startup is an error.
+func NewGeoIPEnricher(cityFile, asnFile string, fields, eventTypes []string,
+	reloadInterval time.Duration) (*GeoIPEnricher, error) {
+	e := &GeoIPEnricher{fields: fields, eventTypes: eventTypes, reloadInterval: reloadInterval}
+	if cityFile != "" {
+		e.city = &GeoIPDatabase{File: cityFile}
+	}
+	if asnFile != "" {
+		e.asn = &GeoIPDatabase{File: asnFile}
+	}
+
+	for _, d := range e.databases() {
+		if err := d.load(); err != nil {
+			return nil, fmt.Errorf("could not load GeoIP database %s: %s", d.File, err)
+		}
+		stats := d.statistics()
+		log.Infof("Loaded GeoIP database %s (%s, built %s)", d.File, stats.DatabaseType,
+			stats.BuildTime.Format("2006-01-02"))
+	}
+	return e, nil
+}
+
+func (e *GeoIPEnricher) databases() []*GeoIPDatabase {
+	var databases []*GeoIPDatabase
+	if e.city != nil {
+		databases = append(databases, e.city)
+	}
+	if e.asn != nil {
+		databases = append(databases, e.asn)
+	}
+	return databases
+}
+
+func (e *GeoIPEnricher) Name() string {
+	return "geoip"
+}
+
+func (e *GeoIPEnricher) Process(msg map[string]interface{}) bool {
+	if !matchAnyRoutingKey(e.eventTypes, msg) {
+		return true
+	}
+	atomic.AddInt64(&e.evaluated, 1)
+
+	enriched := false
+	for _, field := range e.fields {
+		value, ok := msg[field].(string)
+		if !ok || value == "" {
+			continue
+		}
+		ip := net.ParseIP(value)
+		if ip == nil {
+			atomic.AddInt64(&e.invalid, 1)
+			continue
+		}
+		if isPrivateIP(ip) {
+			atomic.AddInt64(&e.private, 1)
+			continue
+		}
+		if e.enrichAddress(msg, field, ip) {
+			enriched = true
+		}
+	}
+
+	if enriched {
+		atomic.AddInt64(&e.enriched, 1)
+	}
+	return true
+}
+
+func (e *GeoIPEnricher) enrichAddress(msg map[string]interface{}, field string, ip net.IP) bool {
+	enriched := false
+	set := func(suffix string, value interface{}) {
+		msg[field+"_"+suffix] = value
+		enriched = true
+	}
+
+	var city geoIPCityRecord
+	if e.city != nil && e.city.lookup(ip, &city) {
+		if city.Country.ISOCode != "" {
+			set("country", city.Country.ISOCode)
+		}
+		if name := city.Country.Names["en"]; name != "" {
+			set("country_name", name)
+		}
+		if name := city.City.Names["en"]; name != "" {
+			set("city", name)
+		}
+		if city.Location.Latitude != nil && city.Location.Longitude != nil {
+			set("latitude", *city.Location.Latitude)
+			set("longitude", *city.Location.Longitude)
+		}
+	}
+
+	var asn geoIPASNRecord
+	if e.asn != nil && e.asn.lookup(ip, &asn) {
+		if asn.Number != 0 {
+			set("asn", int(asn.Number))
+		}
+		if asn.Organization != "" {
+			set("as_org", asn.Organization)
+		}
+	}
+	return enriched
+}
+
+func (e *GeoIPEnricher) Statistics() interface{} {
+	stats := GeoIPStatistics{
+		Evaluated: atomic.LoadInt64(&e.evaluated),
+		Enriched:  atomic.LoadInt64(&e.enriched),
+		Private:   atomic.LoadInt64(&e.private),
+		Invalid:   atomic.LoadInt64(&e.invalid),
+		Databases: make(map[string]GeoIPDatabaseStatistics),
+	}
+	if e.city != nil {
+		stats.Databases["city"] = e.city.statistics()
+	}
+	if e.asn != nil {
+		stats.Databases["asn"] = e.asn.statistics()
+	}
+	return stats
+}
+
+// Start checks the database files for changes every reload interval, and reloads them all on SIGHUP.
+func (e *GeoIPEnricher) Start() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		ticker := time.NewTicker(e.reloadInterval)
+		defer ticker.Stop()
+		defer signal.Stop(hup)
+
+		for {
+			select {
+			case <-ticker.C:
+				for _, d := range e.databases() {
+					if d.changed() {
+						e.reload(d)
+					}
+				}
+			case <-hup:
+				log.Info("Received SIGHUP, reloading GeoIP databases.")
+				for _, d := range e.databases() {
+					e.reload(d)
+				}
+			case <-shutdownRequested:
+				return
+			}
+		}
+	}()
+}
+
+func (e *GeoIPEnricher) reload(d *GeoIPDatabase) {
+	if err := d.load(); err != nil {
+		log.Errorf("Could not reload GeoIP database %s; keeping the previous database: %s", d.File, err)
+		return
+	}
+	log.Infof("Reloaded GeoIP database %s (%s)", d.File, d.statistics().DatabaseType)
+}
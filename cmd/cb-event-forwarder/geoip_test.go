@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// writeTestMMDB writes a minimal IPv6 MaxMind DB with 24 bit records, mapping each network to a record. IPv4
+// networks are stored in ::/96, where the reader looks them up.
+func writeTestMMDB(t *testing.T, file, databaseType string, records map[string]map[string]interface{}) {
+	var data bytes.Buffer
+	// each node is a pair of records: a node index, -1 for no data, or -2-offset for data at offset
+	nodes := [][2]int{{-1, -1}}
+
+	for cidr, record := range records {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := network.Mask.Size()
+		ip := network.IP.To16()
+		if ip4 := network.IP.To4(); ip4 != nil {
+			ip = append(make(net.IP, 12), ip4...)
+			ones += 96
+		}
+		offset := data.Len()
+		data.Write(encodeTestMMDBValue(record))
+
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+			if i == ones-1 {
+				nodes[node][bit] = -2 - offset
+				break
+			}
+			if nodes[node][bit] < 0 {
+				nodes = append(nodes, [2]int{-1, -1})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	var db bytes.Buffer
+	for _, node := range nodes {
+		for _, record := range node {
+			value := record
+			if record == -1 {
+				value = len(nodes)
+			} else if record < -1 {
+				value = len(nodes) + 16 + (-2 - record)
+			}
+			db.Write([]byte{byte(value >> 16), byte(value >> 8), byte(value)})
+		}
+	}
+	db.Write(make([]byte, 16))
+	db.Write(data.Bytes())
+	db.WriteString("\xab\xcd\xefMaxMind.com")
+	db.Write(encodeTestMMDBValue(map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(1700000000),
+		"database_type":               databaseType,
+		"description":                 map[string]interface{}{"en": "test database"},
+		"ip_version":                  uint16(6),
+		"languages":                   []interface{}{"en"},
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 uint16(24),
+	}))
+
+	if err := ioutil.WriteFile(file, db.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func encodeTestMMDBValue(v interface{}) []byte {
+	control := func(typ, size int) []byte {
+		var b []byte
+		if typ <= 7 {
+			b = []byte{byte(typ << 5)}
+		} else {
+			b = []byte{0, byte(typ - 7)}
+		}
+		if size < 29 {
+			b[0] |= byte(size)
+			return b
+		}
+		b[0] |= 29
+		return append(b, byte(size-29))
+	}
+	unsigned := func(typ int, n uint64) []byte {
+		var buf []byte
+		for ; n > 0; n >>= 8 {
+			buf = append([]byte{byte(n)}, buf...)
+		}
+		return append(control(typ, len(buf)), buf...)
+	}
+
+	switch v := v.(type) {
+	case string:
+		return append(control(2, len(v)), v...)
+	case float64:
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, math.Float64bits(v))
+		return append(control(3, 8), buf...)
+	case uint16:
+		return unsigned(5, uint64(v))
+	case uint32:
+		return unsigned(6, uint64(v))
+	case uint64:
+		return unsigned(9, v)
+	case []interface{}:
+		b := control(11, len(v))
+		for _, element := range v {
+			b = append(b, encodeTestMMDBValue(element)...)
+		}
+		return b
+	case map[string]interface{}:
+		var keys []string
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b := control(7, len(v))
+		for _, key := range keys {
+			b = append(b, encodeTestMMDBValue(key)...)
+			b = append(b, encodeTestMMDBValue(v[key])...)
+		}
+		return b
+	}
+	panic("unsupported type")
+}
+
+func TestGeoIPEnricher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cityFile := filepath.Join(dir, "GeoLite2-City.mmdb")
+	asnFile := filepath.Join(dir, "GeoLite2-ASN.mmdb")
+	writeTestMMDB(t, cityFile, "GeoLite2-City", map[string]map[string]interface{}{
+		"81.2.69.0/24": {
+			"city":    map[string]interface{}{"names": map[string]interface{}{"en": "London"}},
+			"country": map[string]interface{}{"iso_code": "GB", "names": map[string]interface{}{"en": "United Kingdom"}},
+			"location": map[string]interface{}{"latitude": 51.5142, "longitude": -0.0931,
+				"accuracy_radius": uint16(10)},
+		},
+		"2001:db8::/32": {
+			"country": map[string]interface{}{"iso_code": "SE", "names": map[string]interface{}{"en": "Sweden"}},
+		},
+	})
+	writeTestMMDB(t, asnFile, "GeoLite2-ASN", map[string]map[string]interface{}{
+		"81.2.69.0/24": {"autonomous_system_number": uint32(20712),
+			"autonomous_system_organization": "Andrews & Arnold Ltd"},
+	})
+
+	e, err := NewGeoIPEnricher(cityFile, asnFile, []string{"remote_ip", "local_ip"}, nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		msg      map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			msg: map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "81.2.69.160",
+				"local_ip": "10.0.0.5"},
+			expected: map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "81.2.69.160",
+				"local_ip": "10.0.0.5", "remote_ip_country": "GB", "remote_ip_country_name": "United Kingdom",
+				"remote_ip_city": "London", "remote_ip_latitude": 51.5142, "remote_ip_longitude": -0.0931,
+				"remote_ip_asn": 20712, "remote_ip_as_org": "Andrews & Arnold Ltd"},
+		},
+		{
+			msg: map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "2001:db8::1"},
+			expected: map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "2001:db8::1",
+				"remote_ip_country": "SE", "remote_ip_country_name": "Sweden"},
+		},
+		{
+			msg:      map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "192.0.2.1"},
+			expected: map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "192.0.2.1"},
+		},
+		{
+			msg:      map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "fe80::1"},
+			expected: map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "fe80::1"},
+		},
+		{
+			msg:      map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "<unknown>"},
+			expected: map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "<unknown>"},
+		},
+	} {
+		if !e.Process(test.msg) {
+			t.Errorf("%v: events should never be dropped", test.msg)
+		}
+		if diff := cmp.Diff(test.expected, test.msg); diff != "" {
+			t.Errorf("event mismatch (-want +got):\n%s", diff)
+		}
+	}
+
+	stats := e.Statistics().(GeoIPStatistics)
+	if stats.Evaluated != 5 || stats.Enriched != 2 || stats.Private != 2 || stats.Invalid != 1 ||
+		stats.Databases["city"].DatabaseType != "GeoLite2-City" || stats.Databases["city"].Found != 2 ||
+		stats.Databases["asn"].Lookups != 3 || stats.Databases["asn"].Found != 1 {
+		t.Errorf("unexpected statistics %+v", stats)
+	}
+
+	// a modified database is reloaded; a broken one keeps the previous database
+	writeTestMMDB(t, asnFile, "GeoLite2-ASN", map[string]map[string]interface{}{
+		"81.2.69.0/24": {"autonomous_system_number": uint32(64500), "autonomous_system_organization": "Example"},
+	})
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(asnFile, later, later)
+	if !e.asn.changed() {
+		t.Fatal("expected the modified database to be detected")
+	}
+	e.reload(e.asn)
+
+	msg := map[string]interface{}{"remote_ip": "81.2.69.1"}
+	e.Process(msg)
+	if msg["remote_ip_asn"] != 64500 || msg["remote_ip_as_org"] != "Example" {
+		t.Errorf("reloaded database was not applied: %v", msg)
+	}
+
+	ioutil.WriteFile(asnFile, []byte("not a database"), 0644)
+	os.Chtimes(asnFile, later.Add(time.Minute), later.Add(time.Minute))
+	e.reload(e.asn)
+
+	msg = map[string]interface{}{"remote_ip": "81.2.69.1"}
+	e.Process(msg)
+	if msg["remote_ip_asn"] != 64500 || e.asn.statistics().LastError == "" || e.asn.changed() {
+		t.Errorf("expected the previous database and an error to be kept: %v %+v", msg, e.asn.statistics())
+	}
+
+	if _, err := NewGeoIPEnricher(filepath.Join(dir, "missing.mmdb"), "", []string{"remote_ip"}, nil,
+		time.Minute); err == nil {
+		t.Error("expected an error for a missing database")
+	}
+}
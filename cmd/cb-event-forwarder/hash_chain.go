@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// manifests are written next to the file they describe, with this suffix
+const chainManifestSuffix = ".manifest"
+
+// the longest line read back from a chained file
+const maxChainLineLength = 64 * 1024 * 1024
+
+// the previous line hash carried by the first line of a chain
+var genesisChainHash = strings.Repeat("0", sha256.Size*2)
+
+var errNoChainLines = errors.New("the file has no lines")
+
+// ChainManifest describes the lines of one hash-chained file. It is written when the file is rolled over, and for
+// the current file when it is closed.
+type ChainManifest struct {
+	File string `json:"file"`
+	// the number of lines in the file, and the sequence numbers of the first and last of them. An empty file has a
+	// first_seq one greater than its last_seq.
+	Lines    int64  `json:"lines"`
+	FirstSeq uint64 `json:"first_seq"`
+	LastSeq  uint64 `json:"last_seq"`
+	// the hash of the line before the first line of the file, and of the last line of the file
+	PrevHash  string    `json:"prev_hash"`
+	FinalHash string    `json:"final_hash"`
+	ClosedAt  time.Time `json:"closed_at"`
+}
+
+// A hashChain links each line written by a FileOutput to the line before it. Every line carries a sequence number
+// and the SHA-256 hash of the previous line as written, including its own sequence number and hash, so removing,
+// inserting, reordering or altering a line breaks the chain. The chain continues across rollovers and restarts.
+type hashChain struct {
+	seq      uint64
+	lastHash string
+
+	// the state of the chain when the current file was opened, and the number of lines written to it
+	fileFirstSeq uint64
+	filePrevHash string
+	fileLines    int64
+}
+
+func newHashChain() *hashChain {
+	c := &hashChain{lastHash: genesisChainHash}
+	c.startFile()
+	return c
+}
+
+// startFile starts counting the lines of a new file.
+func (c *hashChain) startFile() {
+	c.fileFirstSeq = c.seq + 1
+	c.filePrevHash = c.lastHash
+	c.fileLines = 0
+}
+
+// link returns line with the next sequence number and the hash of the previous line added to it.
+func (c *hashChain) link(line string) string {
+	c.seq++
+	linked := addChainFields(line, c.seq, c.lastHash)
+	c.lastHash = chainLineHash(linked)
+	c.fileLines++
+	return linked
+}
+
+// manifest returns the manifest of the current file.
+func (c *hashChain) manifest(fileName string) ChainManifest {
+	return ChainManifest{
+		File:      filepath.Base(fileName),
+		Lines:     c.fileLines,
+		FirstSeq:  c.fileFirstSeq,
+		LastSeq:   c.seq,
+		PrevHash:  c.filePrevHash,
+		FinalHash: c.lastHash,
+		ClosedAt:  time.Now(),
+	}
+}
+
+// recover continues the chain from a file left behind by a previous run, using the manifest written when it was
+// closed or, if it was not closed cleanly, by reading the file. If the file can be neither read nor trusted to be
+// empty, as for an encrypted file, the chain continues from the newest manifest of a file rolled over next to it,
+// and recover reports that the lines of fileName itself are not accounted for. The chain only starts anew if no
+// file has been rolled over with a manifest; otherwise, rather than fork the chain, recover returns an error.
+func (c *hashChain) recover(fileName string) (bool, error) {
+	m, err := readChainManifest(fileName + chainManifestSuffix)
+	if err == nil {
+		c.resume(m)
+		return true, nil
+	}
+	m, scanErr := scanChainFile(fileName)
+	if scanErr == nil {
+		c.resume(m)
+		return true, nil
+	}
+
+	rolled, err := newestRolledChainManifest(fileName)
+	if err != nil {
+		return false, fmt.Errorf("%s, and no rolled over manifest could be read: %s", scanErr, err)
+	}
+	if rolled == nil {
+		if scanErr != errNoChainLines {
+			log.Warnf("Could not read the hash chain from %s and no file has been rolled over with a manifest; "+
+				"starting a new chain: %s", fileName, scanErr)
+		}
+		return scanErr == errNoChainLines, nil
+	}
+
+	c.seq, c.lastHash = rolled.LastSeq, rolled.FinalHash
+	c.startFile()
+	if scanErr != errNoChainLines {
+		log.Warnf("Could not read the hash chain from %s; continuing from %s, without accounting for its lines: %s",
+			fileName, rolled.File, scanErr)
+		return false, nil
+	}
+	return true, nil
+}
+
+// resume sets the state of the chain to the end of the file described by m, which is still the current file.
+func (c *hashChain) resume(m ChainManifest) {
+	c.seq, c.lastHash = m.LastSeq, m.FinalHash
+	c.fileFirstSeq, c.filePrevHash, c.fileLines = m.FirstSeq, m.PrevHash, m.Lines
+}
+
+// newestRolledChainManifest returns the manifest with the highest sequence number among the files rolled over from
+// fileName, or nil if there are none. It fails if manifests exist but none of them can be read.
+func newestRolledChainManifest(fileName string) (*ChainManifest, error) {
+	names, err := filepath.Glob(fileName + ".*" + chainManifestSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	var newest *ChainManifest
+	var lastErr error
+	for _, name := range names {
+		if name == fileName+chainManifestSuffix {
+			continue
+		}
+		m, err := readChainManifest(name)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %s", name, err)
+			continue
+		}
+		if newest == nil || m.LastSeq > newest.LastSeq ||
+			(m.LastSeq == newest.LastSeq && m.ClosedAt.After(newest.ClosedAt)) {
+			newest = &m
+		}
+	}
+	if newest == nil && lastErr != nil {
+		return nil, lastErr
+	}
+	return newest, nil
+}
+
+func chainLineHash(line string) string {
+	sum := sha256.Sum256([]byte(line))
+	return hex.EncodeToString(sum[:])
+}
+
+// addChainFields adds chain_seq and chain_prev_hash to a line: as the first fields of a JSON object, or as
+// attributes at the end of a LEEF line, whose values cannot contain tabs.
+func addChainFields(line string, seq uint64, prevHash string) string {
+	if strings.HasPrefix(line, "{") && strings.HasSuffix(line, "}") {
+		fields := fmt.Sprintf(`{"chain_seq":%d,"chain_prev_hash":"%s"`, seq, prevHash)
+		if strings.TrimSpace(line[1:len(line)-1]) == "" {
+			return fields + "}"
+		}
+		return fields + "," + line[1:]
+	}
+	return fmt.Sprintf("%s\tchain_seq=%d\tchain_prev_hash=%s", line, seq, prevHash)
+}
+
+// parseChainFields returns the sequence number and previous line hash carried by a line.
+func parseChainFields(line string) (uint64, string, error) {
+	if strings.HasPrefix(line, "{") {
+		var fields struct {
+			Seq      *uint64 `json:"chain_seq"`
+			PrevHash *string `json:"chain_prev_hash"`
+		}
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			return 0, "", fmt.Errorf("could not parse the line: %s", err)
+		}
+		if fields.Seq == nil || fields.PrevHash == nil {
+			return 0, "", errors.New("the line has no chain_seq and chain_prev_hash fields")
+		}
+		return *fields.Seq, *fields.PrevHash, nil
+	}
+
+	i := strings.LastIndex(line, "\tchain_seq=")
+	if i < 0 {
+		return 0, "", errors.New("the line has no chain_seq and chain_prev_hash attributes")
+	}
+	parts := strings.SplitN(line[i+len("\tchain_seq="):], "\tchain_prev_hash=", 2)
+	if len(parts) != 2 {
+		return 0, "", errors.New("the line has no chain_prev_hash attribute")
+	}
+	seq, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid chain_seq %q", parts[0])
+	}
+	return seq, parts[1], nil
+}
+
+func readChainManifest(fileName string) (ChainManifest, error) {
+	var m ChainManifest
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("could not parse manifest %s: %s", fileName, err)
+	}
+	return m, nil
+}
+
+func writeChainManifest(fileName string, m ChainManifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(fileName+".tmp", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(fileName+".tmp", fileName)
+}
+
+// chainFileReader reads the lines of a chained file, decompressing it if it was written with compress_data.
+type chainFileReader struct {
+	*bufio.Scanner
+	file *os.File
+}
+
+func openChainFile(fileName string) (*chainFileReader, error) {
+	fp, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader = bufio.NewReader(fp)
+	magic, _ := r.(*bufio.Reader).Peek(len("age-encryption.org/"))
+	switch {
+	case bytes.HasPrefix(magic, []byte("age-encryption.org/")):
+		fp.Close()
+		return nil, fmt.Errorf("%s is encrypted; decrypt it with age -d first", fileName)
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		if r, err = gzip.NewReader(r); err != nil {
+			fp.Close()
+			return nil, err
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxChainLineLength)
+	return &chainFileReader{Scanner: scanner, file: fp}, nil
+}
+
+func (r *chainFileReader) Close() error {
+	return r.file.Close()
+}
+
+// scanChainFile returns the manifest of a chained file by reading it, without verifying the chain.
+func scanChainFile(fileName string) (ChainManifest, error) {
+	m := ChainManifest{File: filepath.Base(fileName)}
+	r, err := openChainFile(fileName)
+	if err != nil {
+		return m, err
+	}
+	defer r.Close()
+
+	for r.Scan() {
+		seq, prevHash, err := parseChainFields(r.Text())
+		if err != nil {
+			return m, fmt.Errorf("line %d: %s", m.Lines+1, err)
+		}
+		if m.Lines == 0 {
+			m.FirstSeq, m.PrevHash = seq, prevHash
+		}
+		m.Lines++
+		m.LastSeq, m.FinalHash = seq, chainLineHash(r.Text())
+	}
+	if err := r.Err(); err != nil && err != io.ErrUnexpectedEOF {
+		return m, err
+	}
+	if m.Lines == 0 {
+		return m, errNoChainLines
+	}
+	return m, nil
+}
+
+// chainFile is one of the files given to verifyChainFiles.
+type chainFile struct {
+	name     string
+	firstSeq uint64
+	lines    int64
+	manifest *ChainManifest
+}
+
+// verifyChainFiles verifies the hash chain through a set of chained files, in order of their sequence numbers. It
+// reports each file that verifies to out, and returns an error describing the first broken link: a line that was
+// altered, removed or inserted, a file missing between two others, or a file whose manifest does not match it.
+func verifyChainFiles(fileNames []string, out io.Writer) error {
+	var files []chainFile
+	for _, name := range fileNames {
+		f := chainFile{name: name}
+		if m, err := readChainManifest(name + chainManifestSuffix); err == nil {
+			f.manifest = &m
+			f.firstSeq, f.lines = m.FirstSeq, m.Lines
+		} else if !os.IsNotExist(err) {
+			return err
+		} else if m, err := scanChainFile(name); err == nil {
+			f.firstSeq, f.lines = m.FirstSeq, m.Lines
+		} else if err == errNoChainLines {
+			// such as a current file that nothing has been written to yet
+			fmt.Fprintf(out, "%s: skipped, no lines and no manifest\n", name)
+			continue
+		} else {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		files = append(files, f)
+	}
+	// an empty file comes before the file that follows it, which starts with the same sequence number
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].firstSeq != files[j].firstSeq {
+			return files[i].firstSeq < files[j].firstSeq
+		}
+		return files[i].lines < files[j].lines
+	})
+
+	var expectedSeq uint64
+	var prevHash, prevFile string
+	for _, f := range files {
+		r, err := openChainFile(f.name)
+		if err != nil {
+			return err
+		}
+
+		var lines int64
+		var firstSeq uint64
+		fileHash := prevHash
+		if prevFile == "" && f.manifest != nil {
+			expectedSeq, fileHash = f.manifest.FirstSeq, f.manifest.PrevHash
+		}
+		for r.Scan() {
+			lines++
+			line := r.Text()
+			seq, linkedHash, err := parseChainFields(line)
+			if err != nil {
+				r.Close()
+				return fmt.Errorf("%s:%d: %s", f.name, lines, err)
+			}
+			if prevFile == "" && f.manifest == nil && lines == 1 {
+				// without a manifest, the chain is verified from wherever the first file starts
+				expectedSeq, fileHash = seq, linkedHash
+			}
+			if lines == 1 {
+				firstSeq = seq
+			}
+
+			if seq != expectedSeq {
+				r.Close()
+				if lines == 1 && prevFile != "" {
+					return fmt.Errorf("gap between %s and %s: expected sequence number %d, found %d", prevFile,
+						f.name, expectedSeq, seq)
+				}
+				return fmt.Errorf("%s:%d: expected sequence number %d, found %d", f.name, lines, expectedSeq, seq)
+			}
+			if linkedHash != fileHash {
+				r.Close()
+				return fmt.Errorf("%s:%d: broken link at sequence number %d: the hash of the previous line does "+
+					"not match", f.name, lines, seq)
+			}
+			fileHash = chainLineHash(line)
+			expectedSeq++
+		}
+		// a compressed file that has not been closed ends without a gzip trailer; any lines missing from it are
+		// found by its manifest, or by the next file
+		err = r.Err()
+		r.Close()
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("%s:%d: %s", f.name, lines+1, err)
+		}
+
+		if m := f.manifest; m != nil {
+			if lines == 0 && (m.FirstSeq != expectedSeq || m.PrevHash != fileHash) {
+				return fmt.Errorf("gap between %s and %s: the manifest of the empty file does not continue the "+
+					"chain", prevFile, f.name)
+			}
+			if m.Lines != lines || m.LastSeq != expectedSeq-1 || m.FinalHash != fileHash {
+				return fmt.Errorf("%s: the file does not match its manifest (%d lines through sequence number %d in "+
+					"the manifest, %d lines through %d in the file); lines were removed from the end of the file or "+
+					"the file was altered", f.name, m.Lines, m.LastSeq, lines, expectedSeq-1)
+			}
+		}
+
+		switch {
+		case lines == 0:
+			fmt.Fprintf(out, "%s: OK, no lines\n", f.name)
+		case f.manifest == nil:
+			fmt.Fprintf(out, "%s: OK, sequence numbers %d to %d (no manifest)\n", f.name, firstSeq, expectedSeq-1)
+		default:
+			fmt.Fprintf(out, "%s: OK, sequence numbers %d to %d\n", f.name, firstSeq, expectedSeq-1)
+		}
+		prevHash, prevFile = fileHash, f.name
+	}
+	return nil
+}
+
+// runVerifyChain implements the verify-chain subcommand, returning the exit status.
+func runVerifyChain(args []string, out io.Writer) int {
+	var fileNames []string
+	for _, name := range args {
+		// skip the manifests and signatures matched by a pattern such as /var/log/events.json*
+		if strings.HasSuffix(name, chainManifestSuffix) || strings.HasSuffix(name, signatureFileSuffix) {
+			continue
+		}
+		fileNames = append(fileNames, name)
+	}
+	if len(fileNames) == 0 {
+		fmt.Fprintln(out, "usage: cb-event-forwarder verify-chain <file>...")
+		return 2
+	}
+
+	if err := verifyChainFiles(fileNames, out); err != nil {
+		fmt.Fprintf(out, "FAILED: %s\n", err)
+		return 1
+	}
+	fmt.Fprintln(out, "The hash chain is intact")
+	return 0
+}
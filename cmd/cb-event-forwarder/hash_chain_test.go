@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vaughan0/go-ini"
+)
+
+func TestChainFields(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	for _, test := range []struct {
+		line     string
+		expected string
+	}{
+		{`{"type":"ingress.event.procstart","pid":4}`,
+			`{"chain_seq":7,"chain_prev_hash":"` + hash + `","type":"ingress.event.procstart","pid":4}`},
+		{`{}`, `{"chain_seq":7,"chain_prev_hash":"` + hash + `"}`},
+		{"LEEF:1.0|CB|CB|5.1|ingress.event.netconn|cat=ingress.event.netconn\tdomain=example.com",
+			"LEEF:1.0|CB|CB|5.1|ingress.event.netconn|cat=ingress.event.netconn\tdomain=example.com\tchain_seq=7" +
+				"\tchain_prev_hash=" + hash},
+	} {
+		linked := addChainFields(test.line, 7, hash)
+		if linked != test.expected {
+			t.Errorf("expected %s, got %s", test.expected, linked)
+		}
+		seq, prevHash, err := parseChainFields(linked)
+		if err != nil || seq != 7 || prevHash != hash {
+			t.Errorf("%s: got %d, %s, %v", linked, seq, prevHash, err)
+		}
+	}
+
+	if _, _, err := parseChainFields(`{"type":"ingress.event.procstart"}`); err == nil {
+		t.Error("expected an error for a line without chain fields")
+	}
+}
+
+// rollOver rolls o over with a distinct timestamp, as the rolled over file names are only unique to the millisecond
+func rollOver(t *testing.T, o *FileOutput, at time.Time) string {
+	o.lastRolledOver = at
+	name, err := o.rollOverFile("2006-01-02T15:04:05.000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func verifyChainDir(dir string) (int, string) {
+	names, _ := filepath.Glob(filepath.Join(dir, "events.json*"))
+	var out bytes.Buffer
+	status := runVerifyChain(names, &out)
+	return status, out.String()
+}
+
+func TestHashChainFileOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := config
+	defer func() { config = saved }()
+	config.FileHashChain = true
+	config.FileHandlerCompressData = false
+	config.BundleRecipients = nil
+	config.BundleSigner = nil
+
+	fileName := filepath.Join(dir, "events.json")
+	o := &FileOutput{}
+	if err := o.Initialize(fileName); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	o.output(`{"type":"ingress.event.procstart","pid":1}`)
+	o.output(`{"type":"ingress.event.procstart","pid":2}`)
+	first := rollOver(t, o, start)
+	empty := rollOver(t, o, start.Add(time.Minute))
+	o.output(`{"type":"ingress.event.netconn","pid":3}`)
+	third := rollOver(t, o, start.Add(2*time.Minute))
+	o.output(`{"type":"ingress.event.netconn","pid":4}`)
+	o.closeFile()
+
+	m, err := readChainManifest(first + chainManifestSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.File != filepath.Base(first) || m.Lines != 2 || m.FirstSeq != 1 || m.LastSeq != 2 ||
+		m.PrevHash != genesisChainHash {
+		t.Errorf("unexpected manifest %+v", m)
+	}
+
+	// after a restart, the chain continues from the manifest written when the file was closed
+	o = &FileOutput{}
+	if err := o.Initialize(fileName); err != nil {
+		t.Fatal(err)
+	}
+	o.output(`{"type":"ingress.event.netconn","pid":5}`)
+	o.closeFile()
+
+	// and after a crash, from the lines in the file. The file left behind is rolled over with a name that is only
+	// unique to the millisecond.
+	os.Remove(fileName + chainManifestSuffix)
+	time.Sleep(2 * time.Millisecond)
+	o = &FileOutput{}
+	if err := o.Initialize(fileName); err != nil {
+		t.Fatal(err)
+	}
+	o.output(`{"type":"ingress.event.netconn","pid":6}`)
+	o.closeFile()
+
+	if status, out := verifyChainDir(dir); status != 0 || strings.Count(out, ": OK") != 6 {
+		t.Fatalf("expected the chain to verify, got status %d:\n%s", status, out)
+	}
+	current, _ := ioutil.ReadFile(fileName)
+	if !strings.HasPrefix(string(current), `{"chain_seq":6,"chain_prev_hash":"`) {
+		t.Errorf("expected the chain to continue at sequence number 6, got %s", current)
+	}
+
+	data, _ := ioutil.ReadFile(first)
+	thirdData, _ := ioutil.ReadFile(third)
+	for _, test := range []struct {
+		desc     string
+		tamper   func()
+		expected string
+	}{
+		{
+			desc: "an altered line",
+			tamper: func() {
+				ioutil.WriteFile(first, bytes.Replace(data, []byte(`"pid":1`), []byte(`"pid":9`), 1), 0644)
+			},
+			expected: "FAILED: " + first + ":2: broken link at sequence number 2",
+		},
+		{
+			desc: "a removed line",
+			tamper: func() {
+				lines := strings.SplitAfter(string(data), "\n")
+				ioutil.WriteFile(first, []byte(lines[1]), 0644)
+			},
+			expected: "FAILED: " + first + ":1: expected sequence number 1, found 2",
+		},
+		{
+			desc: "a truncated file",
+			tamper: func() {
+				lines := strings.SplitAfter(string(data), "\n")
+				ioutil.WriteFile(first, []byte(lines[0]), 0644)
+			},
+			expected: "FAILED: " + first + ": the file does not match its manifest",
+		},
+		{
+			desc:     "a missing file",
+			tamper:   func() { os.Rename(third, filepath.Join(dir, "removed")) },
+			expected: "FAILED: gap between " + empty + " and ",
+		},
+	} {
+		test.tamper()
+		status, out := verifyChainDir(dir)
+		if status != 1 || !strings.Contains(out, test.expected) {
+			t.Errorf("%s: expected status 1 and %q, got %d:\n%s", test.desc, test.expected, status, out)
+		}
+		ioutil.WriteFile(first, data, 0644)
+		ioutil.WriteFile(third, thirdData, 0644)
+	}
+}
+
+func TestHashChainRecoversFromRolledManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := config
+	defer func() { config = saved }()
+	config.FileHashChain = true
+	config.FileHandlerCompressData = false
+	config.BundleRecipients = nil
+	config.BundleSigner = nil
+
+	fileName := filepath.Join(dir, "events.json")
+	// restart simulates a crash that leaves fileName behind with the given content and without its manifest
+	restart := func(content string) (*FileOutput, error) {
+		os.Remove(fileName + chainManifestSuffix)
+		ioutil.WriteFile(fileName, []byte(content), 0644)
+		time.Sleep(2 * time.Millisecond)
+		o := &FileOutput{}
+		return o, o.Initialize(fileName)
+	}
+	expectSeq := func(name, seq string) {
+		data, _ := ioutil.ReadFile(name)
+		if !strings.HasPrefix(string(data), `{"chain_seq":`+seq+`,`) {
+			t.Errorf("expected the chain to continue at sequence number %s, got %s", seq, data)
+		}
+	}
+
+	// without any rolled over manifest, there is no chain to continue
+	o, err := restart(`{"type":"ingress.event.procstart","pid":0}` + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.output(`{"type":"ingress.event.procstart","pid":1}`)
+	o.output(`{"type":"ingress.event.procstart","pid":2}`)
+	rolled := rollOver(t, o, time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC))
+	o.output(`{"type":"ingress.event.procstart","pid":3}`)
+	o.closeFile()
+	expectSeq(rolled, "1")
+
+	// a file left behind empty, here having lost the line with sequence number 3, continues the chain from the
+	// rolled over file
+	o, err = restart("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.output(`{"type":"ingress.event.procstart","pid":4}`)
+	o.closeFile()
+	expectSeq(fileName, "3")
+
+	// as does one that cannot be read, although its lines are not accounted for
+	o, err = restart("garbled\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.output(`{"type":"ingress.event.procstart","pid":5}`)
+	o.closeFile()
+	expectSeq(fileName, "3")
+	restarted, _ := filepath.Glob(filepath.Join(dir, "events.json.*.restart"))
+	manifests, _ := filepath.Glob(filepath.Join(dir, "events.json.*.restart"+chainManifestSuffix))
+	if len(restarted) != 3 || len(manifests) != 1 {
+		t.Errorf("expected 3 restarted files, only the empty one with a manifest, got %v and %v", restarted, manifests)
+	}
+
+	// if no rolled over manifest can be read, the output refuses to start rather than fork the chain
+	for _, name := range append(manifests, rolled+chainManifestSuffix) {
+		ioutil.WriteFile(name, []byte("{"), 0644)
+	}
+	if _, err := restart(""); err == nil {
+		t.Error("expected an error when the chain cannot be continued")
+	}
+}
+
+func TestParseHashChainConfiguration(t *testing.T) {
+	for _, test := range []struct {
+		outputType int
+		value      string
+		expected   bool
+		ok         bool
+	}{
+		{FileOutputType, "true", true, true},
+		{FileOutputType, "0", false, true},
+		{FileOutputType, "sometimes", false, false},
+		{S3OutputType, "true", false, false},
+		{S3OutputType, "false", false, true},
+	} {
+		parsed := &Configuration{OutputType: test.outputType}
+		errs := &ConfigurationError{Empty: true}
+		parseHashChainConfiguration(&ini.File{"bridge": {"hash_chain": test.value}}, parsed, errs)
+		if errs.Empty != test.ok || parsed.FileHashChain != test.expected {
+			t.Errorf("hash_chain=%s with output type %d: got %t, errors %v", test.value, test.outputType,
+				parsed.FileHashChain, errs)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+type ReadinessCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+type ReadinessReport struct {
+	Ready  bool                      `json:"ready"`
+	Checks map[string]ReadinessCheck `json:"checks"`
+}
+
+func checkAMQPReadiness() ReadinessCheck {
+	status.RLock()
+	defer status.RUnlock()
+
+	if !status.IsConnected {
+		detail := "not connected to the message bus"
+		if status.LastConnectError != "" {
+			detail = fmt.Sprintf("%s: %s", detail, status.LastConnectError)
+		}
+		return ReadinessCheck{OK: false, Detail: detail}
+	}
+	return ReadinessCheck{OK: true, Detail: fmt.Sprintf("connected since %s", status.LastConnectTime.Format(time.RFC3339))}
+}
+
+func checkOutputReadiness() ReadinessCheck {
+	if outputHandler == nil {
+		return ReadinessCheck{OK: false, Detail: "output has not been started"}
+	}
+
+	health, ok := outputHandler.(OutputHealth)
+	if !ok {
+		return ReadinessCheck{OK: true, Detail: fmt.Sprintf("%s does not report connection state", outputHandler.String())}
+	}
+
+	if !health.Connected() {
+		return ReadinessCheck{OK: false, Detail: fmt.Sprintf("%s is disconnected", outputHandler.String())}
+	}
+
+	backlog := health.Backlog()
+	if config.ReadinessMaxBundleBacklog > 0 && backlog > config.ReadinessMaxBundleBacklog {
+		return ReadinessCheck{OK: false, Detail: fmt.Sprintf("%d bundles waiting to be sent to %s (threshold %d)",
+			backlog, outputHandler.String(), config.ReadinessMaxBundleBacklog)}
+	}
+
+	return ReadinessCheck{OK: true, Detail: fmt.Sprintf("%s connected, %d bundles waiting", outputHandler.String(), backlog)}
+}
+
+// checkEventFlowReadiness fails when events are still arriving but nothing has been output for longer than the
+// configured stall timeout.
+func checkEventFlowReadiness(now time.Time) ReadinessCheck {
+	if config.ReadinessStallTimeout <= 0 {
+		return ReadinessCheck{OK: true, Detail: "stall detection disabled"}
+	}
+
+	lastInput := atomic.LoadInt64(&status.lastInputTime)
+	if lastInput == 0 || now.Sub(time.Unix(0, lastInput)) > config.ReadinessStallTimeout {
+		return ReadinessCheck{OK: true, Detail: "no recent input"}
+	}
+
+	lastOutput := status.StartTime
+	if t := atomic.LoadInt64(&status.lastOutputTime); t != 0 {
+		lastOutput = time.Unix(0, t)
+	}
+
+	if since := now.Sub(lastOutput); since > config.ReadinessStallTimeout {
+		return ReadinessCheck{OK: false, Detail: fmt.Sprintf("no events output for %s while input is arriving",
+			since.Truncate(time.Second))}
+	}
+
+	return ReadinessCheck{OK: true, Detail: fmt.Sprintf("last event output at %s", lastOutput.Format(time.RFC3339))}
+}
+
+func checkReadiness(now time.Time) ReadinessReport {
+	report := ReadinessReport{
+		Ready: true,
+		Checks: map[string]ReadinessCheck{
+			"amqp":       checkAMQPReadiness(),
+			"output":     checkOutputReadiness(),
+			"event_flow": checkEventFlowReadiness(now),
+		},
+	}
+
+	for _, check := range report.Checks {
+		if !check.OK {
+			report.Ready = false
+		}
+	}
+
+	return report
+}
+
+func writeJSONStatus(w http.ResponseWriter, statusCode int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_, _ = w.Write(b)
+}
+
+// healthzHandler reports that the process is alive and serving HTTP.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSONStatus(w, http.StatusOK, map[string]interface{}{
+		"status": "ok",
+		"uptime": time.Now().Sub(status.StartTime).Seconds(),
+	})
+}
+
+// readyzHandler reports whether events are flowing from the message bus to the output. It returns 503 along with
+// the failing checks when the forwarder is not ready.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	report := checkReadiness(time.Now())
+	if report.Ready {
+		writeJSONStatus(w, http.StatusOK, report)
+	} else {
+		writeJSONStatus(w, http.StatusServiceUnavailable, report)
+	}
+}
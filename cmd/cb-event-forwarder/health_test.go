@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeHealthOutput struct {
+	connected bool
+	backlog   int
+}
+
+func (o *fakeHealthOutput) Initialize(string) error { return nil }
+func (o *fakeHealthOutput) Go(messages <-chan string, errs chan<- error, done chan<- struct{}) error {
+	return nil
+}
+func (o *fakeHealthOutput) String() string          { return "fake output" }
+func (o *fakeHealthOutput) Statistics() interface{} { return nil }
+func (o *fakeHealthOutput) Key() string             { return "fake" }
+func (o *fakeHealthOutput) Connected() bool         { return o.connected }
+func (o *fakeHealthOutput) Backlog() int            { return o.backlog }
+
+func TestCheckReadiness(t *testing.T) {
+	now := time.Now()
+
+	for _, test := range []struct {
+		desc          string
+		connected     bool
+		output        OutputHandler
+		lastInput     time.Time
+		lastOutput    time.Time
+		expectedReady bool
+		failingCheck  string
+	}{
+		{
+			desc:          "Everything healthy",
+			connected:     true,
+			output:        &fakeHealthOutput{connected: true},
+			lastInput:     now.Add(-time.Second),
+			lastOutput:    now.Add(-time.Second),
+			expectedReady: true,
+		},
+		{
+			desc:          "AMQP disconnected",
+			connected:     false,
+			output:        &fakeHealthOutput{connected: true},
+			expectedReady: false,
+			failingCheck:  "amqp",
+		},
+		{
+			desc:          "Output disconnected",
+			connected:     true,
+			output:        &fakeHealthOutput{connected: false},
+			expectedReady: false,
+			failingCheck:  "output",
+		},
+		{
+			desc:          "Bundle backlog over threshold",
+			connected:     true,
+			output:        &fakeHealthOutput{connected: true, backlog: 11},
+			expectedReady: false,
+			failingCheck:  "output",
+		},
+		{
+			desc:          "Input arriving but output stalled",
+			connected:     true,
+			output:        &fakeHealthOutput{connected: true},
+			lastInput:     now.Add(-time.Second),
+			lastOutput:    now.Add(-10 * time.Minute),
+			expectedReady: false,
+			failingCheck:  "event_flow",
+		},
+		{
+			desc:          "No input and no output is not a stall",
+			connected:     true,
+			output:        &fakeHealthOutput{connected: true},
+			lastInput:     now.Add(-10 * time.Minute),
+			lastOutput:    now.Add(-20 * time.Minute),
+			expectedReady: true,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			config.ReadinessStallTimeout = 5 * time.Minute
+			config.ReadinessMaxBundleBacklog = 10
+			status.IsConnected = test.connected
+			status.StartTime = now.Add(-time.Hour)
+			status.lastInputTime = 0
+			status.lastOutputTime = 0
+			if !test.lastInput.IsZero() {
+				status.lastInputTime = test.lastInput.UnixNano()
+			}
+			if !test.lastOutput.IsZero() {
+				status.lastOutputTime = test.lastOutput.UnixNano()
+			}
+			outputHandler = test.output
+			defer func() { outputHandler = nil }()
+
+			report := checkReadiness(now)
+			if report.Ready != test.expectedReady {
+				t.Errorf("expected ready=%t, got %t: %v", test.expectedReady, report.Ready, report.Checks)
+			}
+			if test.failingCheck != "" && report.Checks[test.failingCheck].OK {
+				t.Errorf("expected check %s to fail: %v", test.failingCheck, report.Checks)
+			}
+		})
+	}
+}
+
+func TestOutputRecordsEventFlow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := config
+	defer func() { config = saved }()
+	config.FileHashChain = false
+	config.FileHandlerCompressData = false
+	config.BundleRecipients = nil
+
+	o := &FileOutput{}
+	if err := o.Initialize(filepath.Join(dir, "events.json")); err != nil {
+		t.Fatal(err)
+	}
+	defer o.closeFile()
+
+	atomic.StoreInt64(&status.lastOutputTime, 0)
+	if err := o.output(`{"type":"ingress.event.procstart"}`); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt64(&status.lastOutputTime) == 0 {
+		t.Error("expected writing an event to record the time of the last output")
+	}
+}
@@ -0,0 +1,654 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/carbonblack/cb-event-forwarder/internal/deepcopy"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// type of the events emitted for indicator matches when IntelEmitEvents is set
+const intelMatchType = "intel.match"
+
+var intelIndicatorTypes = map[string]bool{"ip": true, "domain": true, "md5": true, "sha256": true, "path": true}
+
+// IntelField is an event field checked against the indicators of one type.
+type IntelField struct {
+	Field string
+	Type  string
+}
+
+// event fields checked when [intel] does not configure fields=
+var defaultIntelFields = []IntelField{
+	{"remote_ip", "ip"},
+	{"domain", "domain"},
+	{"md5", "md5"},
+	{"sha256", "sha256"},
+	{"path", "path"},
+}
+
+// Indicator is one indicator of compromise loaded from an intel file.
+type Indicator struct {
+	Value       string
+	Type        string
+	Source      string
+	Confidence  int
+	Tags        []string
+	Description string
+}
+
+// IntelFile is one [intel:<name>] section: a CSV, JSON or STIX 2 file of indicators. Confidence and Tags are used for
+// indicators that do not have their own.
+type IntelFile struct {
+	Name       string
+	File       string
+	Format     string
+	Confidence int
+	Tags       []string
+
+	sync.RWMutex
+	// indicators by type, then by lowercased value
+	indicators map[string]map[string]*Indicator
+	networks   []intelNetwork
+	count      int
+	modTime    time.Time
+	loadedAt   time.Time
+	lastErr    string
+
+	matches int64
+}
+
+type intelNetwork struct {
+	network   *net.IPNet
+	indicator *Indicator
+}
+
+type IntelFileStatistics struct {
+	File       string    `json:"file"`
+	Format     string    `json:"format"`
+	Indicators int       `json:"indicators"`
+	Matches    int64     `json:"matches"`
+	LastLoaded time.Time `json:"last_loaded"`
+	LastError  string    `json:"last_error"`
+}
+
+type IntelStatistics struct {
+	Evaluated     int64                          `json:"evaluated"`
+	MatchedEvents int64                          `json:"matched_events"`
+	Files         map[string]IntelFileStatistics `json:"files"`
+}
+
+// load reads the file and replaces the current indicators. On error the previous indicators are kept, and the file
+// is not retried until it is modified again.
+func (f *IntelFile) load() error {
+	info, err := os.Stat(f.File)
+	if err != nil {
+		f.setError(err)
+		return err
+	}
+	data, err := ioutil.ReadFile(f.File)
+	if err == nil {
+		var indicators []*Indicator
+		indicators, err = parseIntelIndicators(data, f.format())
+		if err == nil {
+			f.replace(indicators, info.ModTime())
+			return nil
+		}
+	}
+
+	f.Lock()
+	f.modTime = info.ModTime()
+	f.Unlock()
+	f.setError(err)
+	return err
+}
+
+func (f *IntelFile) setError(err error) {
+	f.Lock()
+	f.lastErr = err.Error()
+	f.Unlock()
+}
+
+// format returns the configured format, or guesses it from the file extension.
+func (f *IntelFile) format() string {
+	if f.Format != "" {
+		return f.Format
+	}
+	switch strings.ToLower(filepath.Ext(f.File)) {
+	case ".json", ".jsonl":
+		return "json"
+	case ".stix":
+		return "stix"
+	}
+	return "csv"
+}
+
+func (f *IntelFile) replace(indicators []*Indicator, modTime time.Time) {
+	byType := make(map[string]map[string]*Indicator)
+	var networks []intelNetwork
+	for _, indicator := range indicators {
+		if indicator.Source == "" {
+			indicator.Source = f.Name
+		}
+		if indicator.Confidence == 0 {
+			indicator.Confidence = f.Confidence
+		}
+		if len(indicator.Tags) == 0 {
+			indicator.Tags = f.Tags
+		}
+
+		if indicator.Type == "ip" && strings.Contains(indicator.Value, "/") {
+			if network, err := parseCIDROrIP(indicator.Value); err == nil {
+				networks = append(networks, intelNetwork{network: network, indicator: indicator})
+			}
+			continue
+		}
+		if byType[indicator.Type] == nil {
+			byType[indicator.Type] = make(map[string]*Indicator)
+		}
+		byType[indicator.Type][strings.ToLower(indicator.Value)] = indicator
+	}
+
+	f.Lock()
+	f.indicators, f.networks, f.count = byType, networks, len(indicators)
+	f.modTime, f.loadedAt, f.lastErr = modTime, time.Now(), ""
+	f.Unlock()
+}
+
+// changed reports whether the file was modified since it was last loaded.
+func (f *IntelFile) changed() bool {
+	info, err := os.Stat(f.File)
+	if err != nil {
+		return false
+	}
+	f.RLock()
+	defer f.RUnlock()
+	return !info.ModTime().Equal(f.modTime)
+}
+
+// lookup returns the indicator of type indicatorType matching value, if any.
+func (f *IntelFile) lookup(indicatorType, value string) *Indicator {
+	f.RLock()
+	defer f.RUnlock()
+
+	exact := f.indicators[indicatorType]
+	value = strings.ToLower(value)
+
+	switch indicatorType {
+	case "domain":
+		// an indicator for a domain also matches its subdomains
+		for domain := strings.TrimSuffix(value, "."); domain != ""; {
+			if indicator, ok := exact[domain]; ok {
+				return indicator
+			}
+			i := strings.Index(domain, ".")
+			if i < 0 {
+				break
+			}
+			domain = domain[i+1:]
+		}
+		return nil
+	case "path":
+		// an indicator without a directory matches the file name in any directory
+		if indicator, ok := exact[value]; ok {
+			return indicator
+		}
+		if i := strings.LastIndexAny(value, `\/`); i >= 0 {
+			return exact[value[i+1:]]
+		}
+		return nil
+	case "ip":
+		if indicator, ok := exact[value]; ok {
+			return indicator
+		}
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil
+		}
+		for _, n := range f.networks {
+			if n.network.Contains(ip) {
+				return n.indicator
+			}
+		}
+		return nil
+	}
+	return exact[value]
+}
+
+func (f *IntelFile) statistics() IntelFileStatistics {
+	f.RLock()
+	defer f.RUnlock()
+	return IntelFileStatistics{
+		File:       f.File,
+		Format:     f.format(),
+		Indicators: f.count,
+		Matches:    atomic.LoadInt64(&f.matches),
+		LastLoaded: f.loadedAt,
+		LastError:  f.lastErr,
+	}
+}
+
+// parseIntelIndicators parses indicators in one of the supported formats.
+func parseIntelIndicators(data []byte, format string) ([]*Indicator, error) {
+	var indicators []*Indicator
+	var err error
+	switch format {
+	case "csv":
+		indicators, err = parseIntelCSV(data)
+	case "json":
+		indicators, err = parseIntelJSON(data)
+	case "stix":
+		indicators, err = parseIntelSTIX(data)
+	default:
+		return nil, fmt.Errorf("unknown format %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, indicator := range indicators {
+		indicator.Value = strings.TrimSpace(indicator.Value)
+		indicator.Type = strings.ToLower(strings.TrimSpace(indicator.Type))
+		if indicator.Type == "" {
+			indicator.Type = guessIndicatorType(indicator.Value)
+		}
+		if !intelIndicatorTypes[indicator.Type] {
+			return nil, fmt.Errorf("indicator %s has unknown type %s", indicator.Value, indicator.Type)
+		}
+	}
+	return indicators, nil
+}
+
+// guessIndicatorType returns the type of an indicator given without one.
+func guessIndicatorType(value string) string {
+	switch {
+	case net.ParseIP(value) != nil:
+		return "ip"
+	case strings.Contains(value, "/"):
+		if _, _, err := net.ParseCIDR(value); err == nil {
+			return "ip"
+		}
+		return "path"
+	case strings.Contains(value, `\`):
+		return "path"
+	case isHexHash(strings.ToLower(value)) && len(value) == 32:
+		return "md5"
+	case isHexHash(strings.ToLower(value)):
+		return "sha256"
+	}
+	return "domain"
+}
+
+// parseIntelCSV parses a CSV file with a header row. The indicator is in the indicator or value column; the
+// optional type, source, confidence, tags and description columns describe it. Tags are separated by semicolons.
+func parseIntelCSV(data []byte) ([]*Indicator, error) {
+	r := csv.NewReader(strings.NewReader(string(data)))
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read the header row: %s", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	valueColumn, ok := columns["indicator"]
+	if !ok {
+		if valueColumn, ok = columns["value"]; !ok {
+			return nil, errors.New("the header row has no indicator or value column")
+		}
+	}
+	column := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var indicators []*Indicator
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if valueColumn >= len(record) || strings.TrimSpace(record[valueColumn]) == "" {
+			continue
+		}
+
+		indicator := &Indicator{
+			Value:       record[valueColumn],
+			Type:        column(record, "type"),
+			Source:      column(record, "source"),
+			Description: column(record, "description"),
+		}
+		if confidence := column(record, "confidence"); confidence != "" {
+			if indicator.Confidence, err = strconv.Atoi(confidence); err != nil {
+				return nil, fmt.Errorf("indicator %s has invalid confidence %s", indicator.Value, confidence)
+			}
+		}
+		for _, tag := range strings.Split(column(record, "tags"), ";") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				indicator.Tags = append(indicator.Tags, tag)
+			}
+		}
+		indicators = append(indicators, indicator)
+	}
+	return indicators, nil
+}
+
+type intelJSONIndicator struct {
+	Indicator   string      `json:"indicator"`
+	Value       string      `json:"value"`
+	Type        string      `json:"type"`
+	Source      string      `json:"source"`
+	Confidence  int         `json:"confidence"`
+	Tags        interface{} `json:"tags"`
+	Description string      `json:"description"`
+}
+
+// parseIntelJSON parses a JSON array of indicator objects, an object with an indicators array, or one indicator
+// object per line. The objects have the same fields as the CSV columns; tags may be a list or a string.
+func parseIntelJSON(data []byte) ([]*Indicator, error) {
+	var records []intelJSONIndicator
+	var wrapper struct {
+		Indicators []intelJSONIndicator `json:"indicators"`
+	}
+	trimmed := strings.TrimSpace(string(data))
+	switch {
+	case strings.HasPrefix(trimmed, "["):
+		if err := json.Unmarshal(data, &records); err != nil {
+			return nil, err
+		}
+	case json.Unmarshal(data, &wrapper) == nil && wrapper.Indicators != nil:
+		records = wrapper.Indicators
+	default:
+		decoder := json.NewDecoder(strings.NewReader(trimmed))
+		for {
+			var record intelJSONIndicator
+			err := decoder.Decode(&record)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, record)
+		}
+	}
+
+	indicators := make([]*Indicator, 0, len(records))
+	for _, record := range records {
+		indicator := &Indicator{
+			Value:       record.Indicator,
+			Type:        record.Type,
+			Source:      record.Source,
+			Confidence:  record.Confidence,
+			Description: record.Description,
+		}
+		if indicator.Value == "" {
+			indicator.Value = record.Value
+		}
+		switch tags := record.Tags.(type) {
+		case string:
+			indicator.Tags = splitConfigList(strings.Replace(tags, ";", ",", -1))
+		case []interface{}:
+			for _, tag := range tags {
+				indicator.Tags = append(indicator.Tags, fmt.Sprint(tag))
+			}
+		}
+		if indicator.Value != "" {
+			indicators = append(indicators, indicator)
+		}
+	}
+	return indicators, nil
+}
+
+// stixComparison matches one comparison in a STIX 2 pattern, such as [file:hashes.'SHA-256' = '...']
+var stixComparison = regexp.MustCompile(`([a-z0-9-]+):([A-Za-z0-9_.'-]+)\s*=\s*'((?:[^'\\]|\\.)*)'`)
+
+// parseIntelSTIX parses the indicator objects of a STIX 2 bundle. Each equality comparison on an IPv4 or IPv6
+// address, domain name, file hash or file name in an indicator's pattern is loaded as an indicator, described by the
+// indicator's name, confidence and labels.
+func parseIntelSTIX(data []byte) ([]*Indicator, error) {
+	var bundle struct {
+		Type    string `json:"type"`
+		Objects []struct {
+			Type        string   `json:"type"`
+			Name        string   `json:"name"`
+			Description string   `json:"description"`
+			Pattern     string   `json:"pattern"`
+			Confidence  int      `json:"confidence"`
+			Labels      []string `json:"labels"`
+		} `json:"objects"`
+	}
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, err
+	}
+	if bundle.Type != "bundle" {
+		return nil, errors.New("not a STIX bundle")
+	}
+
+	var indicators []*Indicator
+	for _, object := range bundle.Objects {
+		if object.Type != "indicator" {
+			continue
+		}
+		description := object.Name
+		if description == "" {
+			description = object.Description
+		}
+
+		for _, comparison := range stixComparison.FindAllStringSubmatch(object.Pattern, -1) {
+			indicatorType := stixIndicatorType(comparison[1], comparison[2])
+			if indicatorType == "" {
+				continue
+			}
+			indicators = append(indicators, &Indicator{
+				Value:       strings.Replace(comparison[3], `\'`, `'`, -1),
+				Type:        indicatorType,
+				Confidence:  object.Confidence,
+				Tags:        object.Labels,
+				Description: description,
+			})
+		}
+	}
+	return indicators, nil
+}
+
+func stixIndicatorType(objectType, property string) string {
+	property = strings.Replace(strings.ToLower(property), "'", "", -1)
+	switch {
+	case (objectType == "ipv4-addr" || objectType == "ipv6-addr") && property == "value":
+		return "ip"
+	case objectType == "domain-name" && property == "value":
+		return "domain"
+	case objectType == "file" && property == "hashes.md5":
+		return "md5"
+	case objectType == "file" && (property == "hashes.sha-256" || property == "hashes.sha256"):
+		return "sha256"
+	case objectType == "file" && property == "name":
+		return "path"
+	}
+	return ""
+}
+
+// IntelMatcher annotates events whose fields match a loaded indicator with an intel_matches list and, optionally,
+// outputs an intel.match event for each match.
+type IntelMatcher struct {
+	files          []*IntelFile
+	fields         []IntelField
+	eventTypes     []string
+	emitEvents     bool
+	reloadInterval time.Duration
+
+	// outputs an intel.match event; replaced in tests
+	output func(msg map[string]interface{}) error
+
+	evaluated     int64
+	matchedEvents int64
+}
+
+// NewIntelMatcher loads every file; a file that cannot be loaded at startup is a fatal error.
+func NewIntelMatcher(files []*IntelFile, fields []IntelField, eventTypes []string, emitEvents bool,
+	reloadInterval time.Duration) (*IntelMatcher, error) {
+	for _, f := range files {
+		if err := f.load(); err != nil {
+			return nil, fmt.Errorf("could not load intel file %s: %s", f.Name, err)
+		}
+		log.Infof("Loaded %d indicators from intel file %s (%s)", f.statistics().Indicators, f.Name, f.File)
+	}
+	return &IntelMatcher{
+		files:          files,
+		fields:         fields,
+		eventTypes:     eventTypes,
+		emitEvents:     emitEvents,
+		reloadInterval: reloadInterval,
+		output:         outputMessage,
+	}, nil
+}
+
+func (m *IntelMatcher) Name() string {
+	return "intel"
+}
+
+func (m *IntelMatcher) Process(msg map[string]interface{}) bool {
+	if msg["type"] == intelMatchType || !matchAnyRoutingKey(m.eventTypes, msg) {
+		return true
+	}
+	atomic.AddInt64(&m.evaluated, 1)
+
+	var matches []interface{}
+	for _, field := range m.fields {
+		v, ok := getFieldPath(msg, field.Field)
+		if !ok {
+			continue
+		}
+		value, ok := v.(string)
+		if !ok || value == "" {
+			continue
+		}
+		for _, f := range m.files {
+			if indicator := f.lookup(field.Type, value); indicator != nil {
+				atomic.AddInt64(&f.matches, 1)
+				matches = append(matches, map[string]interface{}{
+					"field":       field.Field,
+					"indicator":   indicator.Value,
+					"type":        indicator.Type,
+					"source":      indicator.Source,
+					"confidence":  indicator.Confidence,
+					"tags":        indicator.Tags,
+					"description": indicator.Description,
+				})
+			}
+		}
+	}
+	if len(matches) == 0 {
+		return true
+	}
+	atomic.AddInt64(&m.matchedEvents, 1)
+
+	if m.emitEvents {
+		source := deepcopy.Iface(msg).(map[string]interface{})
+		for _, match := range matches {
+			if err := m.output(intelMatchEvent(match.(map[string]interface{}), source)); err != nil {
+				log.Errorf("Could not output an intel match event: %s", err)
+			}
+		}
+	}
+
+	existing, _ := msg["intel_matches"].([]interface{})
+	msg["intel_matches"] = append(existing, matches...)
+	return true
+}
+
+func intelMatchEvent(match, source map[string]interface{}) map[string]interface{} {
+	event := map[string]interface{}{
+		"type":       intelMatchType,
+		"event_type": source["type"],
+		"match_time": time.Now().Unix(),
+		"event":      source,
+	}
+	for k, v := range match {
+		if k == "type" {
+			k = "indicator_type"
+		}
+		event[k] = v
+	}
+	for _, field := range []string{"timestamp", "sensor_id", "computer_name", "process_guid"} {
+		if v, ok := source[field]; ok {
+			event[field] = v
+		}
+	}
+	return event
+}
+
+func (m *IntelMatcher) Statistics() interface{} {
+	stats := IntelStatistics{
+		Evaluated:     atomic.LoadInt64(&m.evaluated),
+		MatchedEvents: atomic.LoadInt64(&m.matchedEvents),
+		Files:         make(map[string]IntelFileStatistics, len(m.files)),
+	}
+	for _, f := range m.files {
+		stats.Files[f.Name] = f.statistics()
+	}
+	return stats
+}
+
+// Start reloads each file when it changes, checked every reload interval, and every file on SIGHUP.
+func (m *IntelMatcher) Start() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		ticker := time.NewTicker(m.reloadInterval)
+		defer ticker.Stop()
+		defer signal.Stop(hup)
+
+		for {
+			select {
+			case <-ticker.C:
+				for _, f := range m.files {
+					if f.changed() {
+						m.reload(f)
+					}
+				}
+			case <-hup:
+				log.Info("Received SIGHUP, reloading intel files.")
+				for _, f := range m.files {
+					m.reload(f)
+				}
+			case <-shutdownRequested:
+				return
+			}
+		}
+	}()
+}
+
+func (m *IntelMatcher) reload(f *IntelFile) {
+	if err := f.load(); err != nil {
+		log.Errorf("Could not reload intel file %s; keeping the previous indicators: %s", f.Name, err)
+		return
+	}
+	log.Infof("Reloaded %d indicators from intel file %s (%s)", f.statistics().Indicators, f.Name, f.File)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseIntelIndicators(t *testing.T) {
+	for _, test := range []struct {
+		desc     string
+		format   string
+		data     string
+		expected []*Indicator
+	}{
+		{
+			desc:   "CSV with a header row",
+			format: "csv",
+			data: `# exported hourly
+indicator,type,source,confidence,tags,description
+203.0.113.7,ip,internal-ir,90,c2;apt,Beacon server
+198.51.100.0/24,,internal-ir,,,
+evil.example.com,,,,,
+5746BD7E255DD6A8AFA06F7C42C1BA41,,,,,
+C:\Users\Public\stage2.exe,,,,,
+`,
+			expected: []*Indicator{
+				{Value: "203.0.113.7", Type: "ip", Source: "internal-ir", Confidence: 90, Tags: []string{"c2", "apt"},
+					Description: "Beacon server"},
+				{Value: "198.51.100.0/24", Type: "ip", Source: "internal-ir"},
+				{Value: "evil.example.com", Type: "domain"},
+				{Value: "5746BD7E255DD6A8AFA06F7C42C1BA41", Type: "md5"},
+				{Value: `C:\Users\Public\stage2.exe`, Type: "path"},
+			},
+		},
+		{
+			desc:   "JSON array",
+			format: "json",
+			data: `[{"value": "evil.example.com", "source": "vendor", "confidence": 50, "tags": ["phishing"]},
+				{"indicator": "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", "tags": "a;b"}]`,
+			expected: []*Indicator{
+				{Value: "evil.example.com", Type: "domain", Source: "vendor", Confidence: 50,
+					Tags: []string{"phishing"}},
+				{Value: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", Type: "sha256",
+					Tags: []string{"a", "b"}},
+			},
+		},
+		{
+			desc:   "JSON lines",
+			format: "json",
+			data:   "{\"value\": \"203.0.113.7\"}\n{\"value\": \"mimikatz.exe\", \"type\": \"path\"}\n",
+			expected: []*Indicator{
+				{Value: "203.0.113.7", Type: "ip"},
+				{Value: "mimikatz.exe", Type: "path"},
+			},
+		},
+		{
+			desc:   "STIX bundle",
+			format: "stix",
+			data: `{"type": "bundle", "id": "bundle--1", "objects": [
+				{"type": "identity", "name": "Internal CTI"},
+				{"type": "indicator", "name": "Loader", "confidence": 75, "labels": ["malicious-activity"],
+				 "pattern": "[file:hashes.'SHA-256' = 'e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855'] OR [file:hashes.MD5 = '5746bd7e255dd6a8afa06f7c42c1ba41']"},
+				{"type": "indicator", "name": "C2", "pattern": "[ipv4-addr:value = '203.0.113.7'] AND [domain-name:value = 'c2.example.net']"},
+				{"type": "indicator", "name": "Exfil URL", "pattern": "[url:value = 'https://example.org/x']"}
+			]}`,
+			expected: []*Indicator{
+				{Value: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", Type: "sha256",
+					Confidence: 75, Tags: []string{"malicious-activity"}, Description: "Loader"},
+				{Value: "5746bd7e255dd6a8afa06f7c42c1ba41", Type: "md5", Confidence: 75,
+					Tags: []string{"malicious-activity"}, Description: "Loader"},
+				{Value: "203.0.113.7", Type: "ip", Description: "C2"},
+				{Value: "c2.example.net", Type: "domain", Description: "C2"},
+			},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			indicators, err := parseIntelIndicators([]byte(test.data), test.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.expected, indicators); diff != "" {
+				t.Errorf("indicators mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	for _, data := range []string{
+		"value,type\n1.2.3.4,url\n",
+		"type,source\nip,x\n",
+	} {
+		if _, err := parseIntelIndicators([]byte(data), "csv"); err == nil {
+			t.Errorf("expected an error for %q", data)
+		}
+	}
+}
+
+func TestIntelMatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "intel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ir := &IntelFile{Name: "internal-ir", File: filepath.Join(dir, "ir.csv"), Confidence: 80, Tags: []string{"ir"}}
+	if err := ioutil.WriteFile(ir.File, []byte(`value,type
+203.0.113.7,
+198.51.100.0/24,
+example.com,
+mimikatz.exe,path
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var emitted []map[string]interface{}
+	m, err := NewIntelMatcher([]*IntelFile{ir}, defaultIntelFields, []string{"ingress.event.#"}, true, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.output = func(msg map[string]interface{}) error {
+		emitted = append(emitted, msg)
+		return nil
+	}
+
+	for _, test := range []struct {
+		msg     map[string]interface{}
+		matches []string
+	}{
+		{map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "203.0.113.7",
+			"domain": "www.Example.com"}, []string{"203.0.113.7", "example.com"}},
+		{map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "198.51.100.99"},
+			[]string{"198.51.100.0/24"}},
+		{map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "192.0.2.1",
+			"domain": "notexample.com"}, nil},
+		{map[string]interface{}{"type": "ingress.event.procstart", "path": `C:\Temp\Mimikatz.exe`},
+			[]string{"mimikatz.exe"}},
+		{map[string]interface{}{"type": "watchlist.hit.process", "path": `C:\Temp\mimikatz.exe`}, nil},
+	} {
+		m.Process(test.msg)
+		var matches []string
+		list, _ := test.msg["intel_matches"].([]interface{})
+		for _, match := range list {
+			matches = append(matches, match.(map[string]interface{})["indicator"].(string))
+		}
+		if diff := cmp.Diff(test.matches, matches); diff != "" {
+			t.Errorf("%v: matches mismatch (-want +got):\n%s", test.msg, diff)
+		}
+	}
+
+	if len(emitted) != 4 {
+		t.Fatalf("expected 4 intel.match events, got %d", len(emitted))
+	}
+	first := emitted[0]
+	delete(first, "match_time")
+	expected := map[string]interface{}{
+		"type":           intelMatchType,
+		"event_type":     "ingress.event.netconn",
+		"field":          "remote_ip",
+		"indicator":      "203.0.113.7",
+		"indicator_type": "ip",
+		"source":         "internal-ir",
+		"confidence":     80,
+		"tags":           []string{"ir"},
+		"description":    "",
+		"event": map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "203.0.113.7",
+			"domain": "www.Example.com"},
+	}
+	if diff := cmp.Diff(expected, first); diff != "" {
+		t.Errorf("intel.match event mismatch (-want +got):\n%s", diff)
+	}
+
+	// a modified file is reloaded; a broken one keeps the previous indicators
+	later := time.Now().Add(time.Minute)
+	ioutil.WriteFile(ir.File, []byte("value\n192.0.2.1\n"), 0644)
+	os.Chtimes(ir.File, later, later)
+	if !ir.changed() {
+		t.Fatal("expected the modified file to be detected")
+	}
+	m.reload(ir)
+	if ir.lookup("ip", "192.0.2.1") == nil || ir.lookup("ip", "203.0.113.7") != nil {
+		t.Error("reloaded indicators were not applied")
+	}
+
+	ioutil.WriteFile(ir.File, []byte("value,type\n192.0.2.2,url\n"), 0644)
+	os.Chtimes(ir.File, later.Add(time.Minute), later.Add(time.Minute))
+	m.reload(ir)
+	stats := m.Statistics().(IntelStatistics)
+	if stats.Files["internal-ir"].Indicators != 1 || stats.Files["internal-ir"].LastError == "" ||
+		ir.lookup("ip", "192.0.2.1") == nil {
+		t.Errorf("expected the previous indicators and an error to be kept, got %+v", stats)
+	}
+	if stats.Evaluated != 4 || stats.MatchedEvents != 3 {
+		t.Errorf("unexpected statistics %+v", stats)
+	}
+}
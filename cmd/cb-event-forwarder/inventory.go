@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"github.com/carbonblack/cb-event-forwarder/internal/deepcopy"
+	log "github.com/sirupsen/logrus"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// InventorySource is a Cb Response REST API endpoint that is polled for inventory.<kind> events.
+type InventorySource struct {
+	Kind  string
+	Route string
+	// List is true if the endpoint returns an array of objects with an "id", false if it returns a single object
+	List bool
+	// CompareFields are the fields compared in changes_only mode; fields such as check-in times that change on every
+	// poll are left out. All fields are compared if empty.
+	CompareFields []string
+}
+
+var inventorySources = []InventorySource{
+	{
+		Kind:  "sensor",
+		Route: "api/v1/sensor",
+		List:  true,
+		CompareFields: []string{"status", "uninstall", "uninstalled", "group_id", "computer_name",
+			"computer_dns_name", "os_environment_display_string", "build_version_string", "network_adapters",
+			"network_isolation_enabled", "is_isolating"},
+	},
+	{
+		Kind:          "feed",
+		Route:         "api/v1/feed",
+		List:          true,
+		CompareFields: []string{"name", "display_name", "enabled", "feed_url", "alerting_enabled", "tech_data"},
+	},
+	{
+		Kind:  "watchlist",
+		Route: "api/v1/watchlist",
+		List:  true,
+		CompareFields: []string{"name", "search_query", "index_type", "enabled", "alliance_id",
+			"readonly"},
+	},
+	{
+		Kind:  "info",
+		Route: "api/info",
+	},
+	{
+		Kind:  "license",
+		Route: "api/v1/license",
+	},
+}
+
+type InventoryStatistics struct {
+	Interval      float64   `json:"interval"`
+	Items         int       `json:"items"`
+	EventsEmitted int64     `json:"events_emitted"`
+	LastPoll      time.Time `json:"last_poll"`
+	LastError     string    `json:"last_error"`
+	LastErrorTime time.Time `json:"last_error_time"`
+}
+
+// InventoryPoller periodically retrieves one InventorySource and outputs it as inventory.<kind> events, either as a
+// full snapshot of every item or, in changes_only mode, only for items that were added, removed or modified since
+// the previous poll.
+type InventoryPoller struct {
+	source      InventorySource
+	interval    time.Duration
+	changesOnly bool
+
+	// retrieves a route from the Cb Response REST API; replaced in tests
+	get func(route string) ([]byte, error)
+	// outputs a synthetic event; replaced in tests
+	output func(msg map[string]interface{}) error
+
+	sync.RWMutex
+	previous      map[string]map[string]interface{}
+	lastPoll      time.Time
+	lastError     string
+	lastErrorTime time.Time
+
+	eventsEmitted int64
+}
+
+func NewInventoryPoller(source InventorySource, interval time.Duration, changesOnly bool) *InventoryPoller {
+	return &InventoryPoller{
+		source:      source,
+		interval:    interval,
+		changesOnly: changesOnly,
+		get:         GetCb,
+		output:      outputMessage,
+	}
+}
+
+// Start polls immediately and then every interval until shutdown is requested.
+func (p *InventoryPoller) Start() {
+	log.Infof("Emitting inventory.%s events every %s", p.source.Kind, p.interval)
+
+	go func() {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+
+		for {
+			if err := p.Poll(); err != nil {
+				log.Errorf("Could not retrieve %s inventory from the Cb Response Server: %s", p.source.Kind, err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-shutdownRequested:
+				return
+			}
+		}
+	}()
+}
+
+// Poll retrieves the source and outputs inventory events for it.
+func (p *InventoryPoller) Poll() error {
+	current, err := p.fetch()
+	if err != nil {
+		p.Lock()
+		p.lastError = err.Error()
+		p.lastErrorTime = time.Now()
+		p.Unlock()
+		return err
+	}
+
+	now := time.Now()
+
+	p.Lock()
+	previous := p.previous
+	p.previous = current
+	p.lastPoll = now
+	p.Unlock()
+
+	var events []map[string]interface{}
+	if p.changesOnly {
+		// the first poll has nothing to compare with, so it is output as a snapshot
+		if previous == nil {
+			events = p.snapshot(current)
+		} else {
+			events = p.changes(previous, current)
+		}
+	} else {
+		events = p.snapshot(current)
+	}
+
+	for _, event := range events {
+		event["type"] = "inventory." + p.source.Kind
+		event["inventory_time"] = now.Unix()
+		if err := p.output(event); err != nil {
+			return err
+		}
+		atomic.AddInt64(&p.eventsEmitted, 1)
+	}
+
+	return nil
+}
+
+// fetch returns the items of the source keyed by id. A single object source has one item with an empty key.
+func (p *InventoryPoller) fetch() (map[string]map[string]interface{}, error) {
+	body, err := p.get(p.source.Route)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make(map[string]map[string]interface{})
+
+	if !p.source.List {
+		var item map[string]interface{}
+		if err := decodeAPIResponse(body, &item); err != nil {
+			return nil, err
+		}
+		items[""] = item
+		return items, nil
+	}
+
+	var itemList []map[string]interface{}
+	if err := decodeAPIResponse(body, &itemList); err != nil {
+		return nil, err
+	}
+	for _, item := range itemList {
+		id, ok := item["id"]
+		if !ok {
+			continue
+		}
+		items[fmt.Sprint(id)] = item
+	}
+	return items, nil
+}
+
+func sortedInventoryKeys(items map[string]map[string]interface{}) []string {
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// copyInventoryItem returns a deep copy of item, so that the later stages changing the event do not change the
+// copy kept for comparison with the next poll.
+func copyInventoryItem(item map[string]interface{}) map[string]interface{} {
+	return deepcopy.Iface(item).(map[string]interface{})
+}
+
+func (p *InventoryPoller) snapshot(current map[string]map[string]interface{}) []map[string]interface{} {
+	events := make([]map[string]interface{}, 0, len(current))
+	for _, key := range sortedInventoryKeys(current) {
+		events = append(events, copyInventoryItem(current[key]))
+	}
+	return events
+}
+
+// changedFields returns the compared fields whose values differ between the two versions of an item.
+func (p *InventoryPoller) changedFields(before, after map[string]interface{}) []string {
+	fields := p.source.CompareFields
+	if len(fields) == 0 {
+		seen := make(map[string]bool)
+		for k := range before {
+			seen[k] = true
+		}
+		for k := range after {
+			seen[k] = true
+		}
+		for k := range seen {
+			fields = append(fields, k)
+		}
+		sort.Strings(fields)
+	}
+
+	var changed []string
+	for _, field := range fields {
+		if !reflect.DeepEqual(before[field], after[field]) {
+			changed = append(changed, field)
+		}
+	}
+	return changed
+}
+
+// changes returns an event for each item that was added, removed or modified. The change field is "added",
+// "removed" or "modified"; for sensors whose status changed it is the new status instead, for example "offline" or
+// "uninstalled". Modified items list the fields that changed in changed_fields and their former values in
+// previous_values.
+func (p *InventoryPoller) changes(previous, current map[string]map[string]interface{}) []map[string]interface{} {
+	var events []map[string]interface{}
+
+	for _, key := range sortedInventoryKeys(current) {
+		item := current[key]
+		before, existed := previous[key]
+		if !existed {
+			event := copyInventoryItem(item)
+			event["change"] = "added"
+			events = append(events, event)
+			continue
+		}
+
+		changed := p.changedFields(before, item)
+		if len(changed) == 0 {
+			continue
+		}
+
+		event := copyInventoryItem(item)
+		event["change"] = "modified"
+		previousValues := make(map[string]interface{}, len(changed))
+		for _, field := range changed {
+			previousValues[field] = before[field]
+			if status, ok := item["status"].(string); ok && field == "status" && p.source.Kind == "sensor" {
+				event["change"] = strings.Replace(strings.ToLower(status), " ", "_", -1)
+			}
+		}
+		event["changed_fields"] = changed
+		event["previous_values"] = previousValues
+		events = append(events, event)
+	}
+
+	for _, key := range sortedInventoryKeys(previous) {
+		if _, exists := current[key]; !exists {
+			event := copyInventoryItem(previous[key])
+			event["change"] = "removed"
+			events = append(events, event)
+		}
+	}
+
+	return events
+}
+
+func (p *InventoryPoller) Statistics() interface{} {
+	p.RLock()
+	defer p.RUnlock()
+
+	return InventoryStatistics{
+		Interval:      p.interval.Seconds(),
+		Items:         len(p.previous),
+		EventsEmitted: atomic.LoadInt64(&p.eventsEmitted),
+		LastPoll:      p.lastPoll,
+		LastError:     p.lastError,
+		LastErrorTime: p.lastErrorTime,
+	}
+}
+
+// startInventory starts a poller for each inventory source with a configured interval.
+func startInventory() map[string]*InventoryPoller {
+	pollers := make(map[string]*InventoryPoller)
+	for _, source := range inventorySources {
+		interval, ok := config.InventoryIntervals[source.Kind]
+		if !ok {
+			continue
+		}
+		poller := NewInventoryPoller(source, interval, config.InventoryChangesOnly)
+		poller.Start()
+		pollers[source.Kind] = poller
+	}
+	return pollers
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const testInventorySensors = `[
+	{"id": 1, "computer_name": "WIN-ACME-01", "status": "Online", "uninstalled": null,
+	 "last_checkin_time": "2018-03-01 17:00:00.000000-05:00"},
+	{"id": 2, "computer_name": "WIN-ACME-02", "status": "Online", "uninstalled": null,
+	 "last_checkin_time": "2018-03-01 17:00:00.000000-05:00"}
+]`
+
+func TestInventoryPoller(t *testing.T) {
+	for _, test := range []struct {
+		desc        string
+		source      InventorySource
+		changesOnly bool
+		polls       []string
+		expected    []map[string]interface{}
+	}{
+		{
+			desc:   "Snapshot outputs every sensor",
+			source: inventorySources[0],
+			polls:  []string{testInventorySensors, testInventorySensors},
+			expected: []map[string]interface{}{
+				{"type": "inventory.sensor", "id": json.Number("1"), "computer_name": "WIN-ACME-01",
+					"status": "Online", "uninstalled": nil, "last_checkin_time": "2018-03-01 17:00:00.000000-05:00"},
+				{"type": "inventory.sensor", "id": json.Number("2"), "computer_name": "WIN-ACME-02",
+					"status": "Online", "uninstalled": nil, "last_checkin_time": "2018-03-01 17:00:00.000000-05:00"},
+			},
+		},
+		{
+			desc:        "First poll of changes only is a snapshot",
+			source:      inventorySources[0],
+			changesOnly: true,
+			polls:       []string{`[{"id": 1, "status": "Online"}]`},
+			expected: []map[string]interface{}{
+				{"type": "inventory.sensor", "id": json.Number("1"), "status": "Online"},
+			},
+		},
+		{
+			desc:        "Unchanged sensors are not output",
+			source:      inventorySources[0],
+			changesOnly: true,
+			polls: []string{
+				testInventorySensors,
+				`[
+					{"id": 1, "computer_name": "WIN-ACME-01", "status": "Online", "uninstalled": null,
+					 "last_checkin_time": "2018-03-01 17:05:00.000000-05:00"},
+					{"id": 2, "computer_name": "WIN-ACME-02", "status": "Online", "uninstalled": null,
+					 "last_checkin_time": "2018-03-01 17:05:00.000000-05:00"}
+				]`,
+			},
+		},
+		{
+			desc:        "Sensor changes",
+			source:      inventorySources[0],
+			changesOnly: true,
+			polls: []string{
+				testInventorySensors,
+				`[
+					{"id": 1, "computer_name": "WIN-ACME-01", "status": "Offline", "uninstalled": null},
+					{"id": 3, "computer_name": "WIN-ACME-03", "status": "Online", "uninstalled": null}
+				]`,
+			},
+			expected: []map[string]interface{}{
+				{"type": "inventory.sensor", "id": json.Number("1"), "computer_name": "WIN-ACME-01",
+					"status": "Offline", "uninstalled": nil, "change": "offline",
+					"changed_fields": []string{"status"}, "previous_values": map[string]interface{}{"status": "Online"}},
+				{"type": "inventory.sensor", "id": json.Number("3"), "computer_name": "WIN-ACME-03",
+					"status": "Online", "uninstalled": nil, "change": "added"},
+				{"type": "inventory.sensor", "id": json.Number("2"), "computer_name": "WIN-ACME-02",
+					"status": "Online", "uninstalled": nil, "last_checkin_time": "2018-03-01 17:00:00.000000-05:00",
+					"change": "removed"},
+			},
+		},
+		{
+			desc:        "Uninstalled sensor",
+			source:      inventorySources[0],
+			changesOnly: true,
+			polls: []string{
+				`[{"id": 1, "status": "Online", "uninstalled": null}]`,
+				`[{"id": 1, "status": "Uninstalled", "uninstalled": true}]`,
+			},
+			expected: []map[string]interface{}{
+				{"type": "inventory.sensor", "id": json.Number("1"), "status": "Uninstalled", "uninstalled": true,
+					"change": "uninstalled", "changed_fields": []string{"status", "uninstalled"},
+					"previous_values": map[string]interface{}{"status": "Online", "uninstalled": nil}},
+			},
+		},
+		{
+			desc:        "Modified feed",
+			source:      inventorySources[1],
+			changesOnly: true,
+			polls: []string{
+				`[{"id": 7, "name": "abusech", "enabled": true}]`,
+				`[{"id": 7, "name": "abusech", "enabled": false}]`,
+			},
+			expected: []map[string]interface{}{
+				{"type": "inventory.feed", "id": json.Number("7"), "name": "abusech", "enabled": false,
+					"change": "modified", "changed_fields": []string{"enabled"},
+					"previous_values": map[string]interface{}{"enabled": true}},
+			},
+		},
+		{
+			desc:        "Server information compares every field",
+			source:      inventorySources[3],
+			changesOnly: true,
+			polls: []string{
+				`{"version": "6.2.1.180130.1213", "cblr_enabled": true}`,
+				`{"version": "6.2.2.180315.1519", "cblr_enabled": true}`,
+			},
+			expected: []map[string]interface{}{
+				{"type": "inventory.info", "version": "6.2.2.180315.1519", "cblr_enabled": true,
+					"change": "modified", "changed_fields": []string{"version"},
+					"previous_values": map[string]interface{}{"version": "6.2.1.180130.1213"}},
+			},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			var output []map[string]interface{}
+
+			p := NewInventoryPoller(test.source, time.Hour, test.changesOnly)
+			p.output = func(msg map[string]interface{}) error {
+				if _, ok := msg["inventory_time"].(int64); !ok {
+					t.Errorf("expected inventory_time in %v", msg)
+				}
+				delete(msg, "inventory_time")
+				output = append(output, msg)
+				return nil
+			}
+
+			for _, body := range test.polls {
+				output = nil
+				p.get = func(route string) ([]byte, error) {
+					if route != test.source.Route {
+						t.Errorf("expected a request for %s, got %s", test.source.Route, route)
+					}
+					return []byte(body), nil
+				}
+				if err := p.Poll(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if diff := cmp.Diff(test.expected, output); diff != "" {
+				t.Errorf("events of the last poll mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestInventoryPollerKeepsItsOwnCopy(t *testing.T) {
+	body := `{"version": "6.2.1.180130.1213", "license": {"expires": "2030-01-01"}}`
+	var output []map[string]interface{}
+
+	p := NewInventoryPoller(inventorySources[3], time.Hour, true)
+	p.get = func(route string) ([]byte, error) { return []byte(body), nil }
+	p.output = func(msg map[string]interface{}) error {
+		// a later stage masking a nested field
+		msg["license"].(map[string]interface{})["expires"] = "redacted"
+		output = append(output, msg)
+		return nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := p.Poll(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(output) != 1 {
+		t.Errorf("expected only the first poll to be output, got %v", output)
+	}
+}
@@ -257,68 +257,77 @@ func ProcessJSONMessage(msg map[string]interface{}, routingKey string) ([]map[st
 }
 
 /*
- * Used to perform postprocessing on messages.  For exmaple, for feed hits we need to grab the report_title.
- * To do this we must query the Cb Response Server's REST API to get the report_title.  NOTE: In order to do this
- * functionality we need the Cb Response Server URL and API Token set within the config.
+ * Returns the feed_id and report_id to look up in order to post process this message.  Both feed hits and alerts
+ * carry the report in report_id; watchlist alerts have a feed_id of -1 and are resolved by the watchlist enrichment
+ * stage instead.  ok is false for any other message, or if the ids are missing or of an unexpected type.
  */
-func PostprocessJSONMessage(msg map[string]interface{}) map[string]interface{} {
+func reportLookupIDs(msg map[string]interface{}) (feedID int, reportID string, ok bool) {
+	messageType, isString := msg["type"].(string)
+	if !isString {
+		return
+	}
 
-	if val, ok := msg["type"]; ok {
-		messageType := val.(string)
+	if !strings.HasPrefix(messageType, "feed.") && !strings.HasPrefix(messageType, "alert.") {
+		return
+	}
 
-		var reportIDString string
+	rawFeedID, feedIDPresent := msg["feed_id"]
+	rawReportID, reportIDPresent := msg["report_id"]
 
-		if strings.HasPrefix(messageType, "feed.") {
-			reportIDString = "report_id"
-		} else if strings.HasPrefix(messageType, "alert.") {
-			reportIDString = "watchlist_id"
-		} else {
-			return msg
-		}
+	/*
+	 * First make sure these fields are present
+	 */
+	if !feedIDPresent || !reportIDPresent {
+		return
+	}
 
-		feedID, feedIDPresent := msg["feed_id"]
-		reportID, reportIDPresent := msg[reportIDString]
-
-		/*
-		 * First make sure these fields are present
-		 */
-		if feedIDPresent && reportIDPresent {
-			/*
-			 * feedID should be of type json.Number which is typed as a string
-			 * reportID should be of type string as well
-			 */
-			if reflect.TypeOf(feedID).Kind() == reflect.String &&
-				reflect.TypeOf(reportID).Kind() == reflect.String {
-				iFeedID, err := feedID.(json.Number).Int64()
-				if err == nil && iFeedID != -1 {
-					/*
-					 * Get the report_title for this feed hit
-					 */
-					reportTitle, reportScore, reportLink, err := GetReport(int(iFeedID), reportID.(string))
-					log.Debugf("Report title = %s , Score = %d, link = %s", reportTitle, reportScore, reportLink)
-					if err == nil {
-						/*
-						 * Finally save the report_title into this message
-						 */
-						msg["report_title"] = reportTitle
-						msg["report_score"] = reportScore
-						msg["report_link"] = reportLink
-						/*
-							log.Infof("report title for id %s:%s == %s\n",
-								feedID.(json.Number).String(),
-								reportID.(string),
-								reportTitle)
-						*/
-					}
+	/*
+	 * feedID is a json.Number in feed hits but a string in alerts
+	 * reportID should be of type string
+	 */
+	iFeedID, feedIDIsNumber := intFromEvent(rawFeedID)
+	reportID, reportIDIsString := rawReportID.(string)
+	if !feedIDIsNumber || !reportIDIsString {
+		log.Debug("Feed Id was an unexpected type")
+		return
+	}
 
-				} else {
-					log.Debug("Unable to convert feed_id to int64 from json.Number")
-				}
+	if iFeedID == -1 {
+		return
+	}
 
-			} else {
-				log.Debug("Feed Id was an unexpected type")
-			}
-		}
+	return iFeedID, reportID, true
+}
+
+/*
+ * Saves the report_title, report_score and report_link retrieved from the Cb Response Server into this message
+ */
+func addReportDetails(msg map[string]interface{}, reportTitle string, reportScore int, reportLink string) {
+	msg["report_title"] = reportTitle
+	msg["report_score"] = reportScore
+	msg["report_link"] = reportLink
+}
+
+/*
+ * Used to perform postprocessing on messages.  For exmaple, for feed hits we need to grab the report_title.
+ * To do this we must query the Cb Response Server's REST API to get the report_title.  NOTE: In order to do this
+ * functionality we need the Cb Response Server URL and API Token set within the config.
+ *
+ * This queries the API synchronously; the message workers hand messages to the PostprocessPool instead.
+ */
+func PostprocessJSONMessage(msg map[string]interface{}) map[string]interface{} {
+	feedID, reportID, ok := reportLookupIDs(msg)
+	if !ok {
+		return msg
+	}
+
+	/*
+	 * Get the report_title for this feed hit
+	 */
+	reportTitle, reportScore, reportLink, err := GetReport(feedID, reportID)
+	log.Debugf("Report title = %s , Score = %d, link = %s", reportTitle, reportScore, reportLink)
+	if err == nil {
+		addReportDetails(msg, reportTitle, reportScore, reportLink)
 	}
 	return msg
 }
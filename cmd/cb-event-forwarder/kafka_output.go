@@ -22,6 +22,10 @@ type KafkaOutput struct {
 	droppedEventCount int64
 	eventSentCount    int64
 
+	// when a message was last delivered, and when delivery or the connection to the brokers last failed
+	lastDeliveryTime time.Time
+	lastErrorTime    time.Time
+
 	sync.RWMutex
 }
 
@@ -60,10 +64,11 @@ func (o *KafkaOutput) Initialize(unused string) error {
 	return nil
 }
 
-func (o *KafkaOutput) Go(messages <-chan string, errorChan chan<- error) error {
+func (o *KafkaOutput) Go(messages <-chan string, errorChan chan<- error, done chan<- struct{}) error {
 	go func() {
 		refreshTicker := time.NewTicker(1 * time.Second)
 		defer refreshTicker.Stop()
+		defer close(done)
 		defer o.producer.Close()
 
 		hup := make(chan os.Signal, 1)
@@ -73,7 +78,11 @@ func (o *KafkaOutput) Go(messages <-chan string, errorChan chan<- error) error {
 
 		for {
 			select {
-			case message := <-messages:
+			case message, ok := <-messages:
+				if !ok {
+					o.flush()
+					return
+				}
 				var parsedMsg map[string]interface{}
 				json.Unmarshal([]byte(message), &parsedMsg)
 				if o.topic != "" {
@@ -89,15 +98,24 @@ func (o *KafkaOutput) Go(messages <-chan string, errorChan chan<- error) error {
 					}
 				 }
 			case e := <-o.producer.Events():
-				m := e.(*kafka.Message)
-				if m.TopicPartition.Error != nil {
-					log.Debugf("Delivery failed: %v\n", m.TopicPartition.Error)
-					atomic.AddInt64(&o.droppedEventCount, 1)
-					errorChan <- m.TopicPartition.Error
-				} else {
-					log.Debugf("Delivered message to topic %s [%d] at offset %v\n",
-						*m.TopicPartition.Topic, m.TopicPartition.Partition, m.TopicPartition.Offset)
-					atomic.AddInt64(&o.eventSentCount, 1)
+				switch m := e.(type) {
+				case *kafka.Message:
+					if m.TopicPartition.Error != nil {
+						log.Debugf("Delivery failed: %v\n", m.TopicPartition.Error)
+						atomic.AddInt64(&o.droppedEventCount, 1)
+						o.recordError()
+						errorChan <- m.TopicPartition.Error
+					} else {
+						log.Debugf("Delivered message to topic %s [%d] at offset %v\n",
+							*m.TopicPartition.Topic, m.TopicPartition.Partition, m.TopicPartition.Offset)
+						atomic.AddInt64(&o.eventSentCount, 1)
+						o.recordDelivery()
+						recordOutput()
+					}
+				case kafka.Error:
+					// client level errors, such as all brokers being down
+					log.Errorf("Kafka error: %s", m)
+					o.recordError()
 				}
 			}
 		}
@@ -106,6 +124,42 @@ func (o *KafkaOutput) Go(messages <-chan string, errorChan chan<- error) error {
 	return nil
 }
 
+// flush waits for messages still queued in the producer to be delivered, bounded by the time left before the
+// shutdown deadline.
+func (o *KafkaOutput) flush() {
+	log.Infof("Flushing %d queued messages to Kafka", o.producer.Len())
+	remaining := o.producer.Flush(int(shutdownTimeRemaining() / time.Millisecond))
+	if remaining > 0 {
+		log.Errorf("%d messages were not delivered to Kafka before shutdown", remaining)
+		atomic.AddInt64(&o.droppedEventCount, int64(remaining))
+	}
+}
+
+func (o *KafkaOutput) recordDelivery() {
+	o.Lock()
+	o.lastDeliveryTime = time.Now()
+	o.Unlock()
+}
+
+func (o *KafkaOutput) recordError() {
+	o.Lock()
+	o.lastErrorTime = time.Now()
+	o.Unlock()
+}
+
+// Connected reports false when the most recent delivery failed, or the brokers have reported an error since.
+func (o *KafkaOutput) Connected() bool {
+	o.RLock()
+	defer o.RUnlock()
+
+	return !o.lastErrorTime.After(o.lastDeliveryTime)
+}
+
+// Backlog returns the number of messages waiting to be delivered by the producer.
+func (o *KafkaOutput) Backlog() int {
+	return o.producer.Len()
+}
+
 func (o *KafkaOutput) Statistics() interface{} {
 	o.RLock()
 	defer o.RUnlock()
@@ -17,10 +17,12 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"runtime"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -49,9 +51,19 @@ type Status struct {
 	LastConnectError string
 	ErrorTime        time.Time
 
+	// unix nanosecond timestamps of the last event received and written by the output handler, updated atomically
+	lastInputTime  int64
+	lastOutputTime int64
+
+	// guards the connection fields above
 	sync.RWMutex
 }
 
+// recordOutput is called by the output handlers once an event has been written to their destination.
+func recordOutput() {
+	atomic.StoreInt64(&status.lastOutputTime, time.Now().UnixNano())
+}
+
 var status Status
 
 var (
@@ -70,6 +82,9 @@ func init() {
 	status.OutputEventRate = expvar.NewFloat("output_event_rate")
 	expvar.Publish("connection_status",
 		expvar.Func(func() interface{} {
+			status.RLock()
+			defer status.RUnlock()
+
 			res := make(map[string]interface{}, 0)
 			res["last_connect_time"] = status.LastConnectTime
 			res["last_error_text"] = status.LastConnectError
@@ -106,14 +121,40 @@ type Consumer struct {
 	tag     string
 }
 
+// Go starts the output loop. When messages is closed, the handler writes out any events still buffered,
+// releases its destination and then closes done.
 type OutputHandler interface {
 	Initialize(string) error
-	Go(messages <-chan string, errorChan chan<- error) error
+	Go(messages <-chan string, errorChan chan<- error, done chan<- struct{}) error
 	String() string
 	Statistics() interface{}
 	Key() string
 }
 
+// OutputHealth is optionally implemented by output handlers that can report whether they are currently able to
+// deliver events to their destination. It is consulted by the /readyz endpoint.
+type OutputHealth interface {
+	Connected() bool
+	Backlog() int
+}
+
+var outputHandler OutputHandler
+
+// postprocessor enriches feed hits and alerts through the Cb Response REST API; nil unless api_token is set
+var postprocessor *PostprocessPool
+
+// inputs started from the [file_input:<name>] sections, by name
+var fileInputs = make(map[string]*FileInput)
+
+// binaryExporter stores binaries announced by binarystore.file.added events; nil unless [binary_export] is configured
+var binaryExporter *BinaryExporter
+
+// deduplicator drops repeated events; nil unless [dedup:<name>] sections are configured
+var deduplicator *Deduplicator
+
+// netconnAggregator summarizes netconn events into flows; nil unless [netconn_aggregation] is enabled
+var netconnAggregator *NetconnAggregator
+
 /*
  * worker
  */
@@ -156,6 +197,7 @@ func reportBundleDetails(routingKey string, body []byte, headers amqp.Table) {
 
 func processMessage(body []byte, routingKey, contentType string, headers amqp.Table, exchangeName string) {
 	status.InputEventCount.Add(1)
+	atomic.StoreInt64(&status.lastInputTime, time.Now().UnixNano())
 
 	var err error
 	var msgs []map[string]interface{}
@@ -207,11 +249,13 @@ func processMessage(body []byte, routingKey, contentType string, headers amqp.Ta
 	}
 
 	for _, msg := range msgs {
+		if binaryExporter != nil && isBinaryStoreFileAdded(msg) {
+			binaryExporter.Submit(msg)
+			continue
+		}
+
 		if config.PerformFeedPostprocessing {
-			go func(msg map[string]interface{}) {
-				outputMsg := PostprocessJSONMessage(msg)
-				outputMessage(outputMsg)
-			}(msg)
+			postprocessor.Submit(msg)
 		} else {
 			err = outputMessage(msg)
 			if err != nil {
@@ -222,6 +266,12 @@ func processMessage(body []byte, routingKey, contentType string, headers amqp.Ta
 }
 
 func outputMessage(msg map[string]interface{}) error {
+	return outputMessageThrough(eventStages, msg)
+}
+
+// outputMessageThrough is outputMessage applying only stages; stages that emit events of their own use it so that
+// those events are not processed again by the stages they have already been through.
+func outputMessageThrough(stages []EventStage, msg map[string]interface{}) error {
 	var err error
 
 	//
@@ -229,6 +279,10 @@ func outputMessage(msg map[string]interface{}) error {
 	//
 	msg["cb_server"] = config.ServerName
 
+	if !applyEventStages(stages, msg) {
+		return nil
+	}
+
 	// Remove keys that have been configured to be removed
 	for _, v := range config.RemoveFromOutput {
 		delete(msg, v)
@@ -248,8 +302,10 @@ func outputMessage(msg map[string]interface{}) error {
 	}
 
 	if len(outmsg) > 0 && err == nil {
+		if err := publishResult(outmsg); err != nil {
+			return err
+		}
 		status.OutputEventCount.Add(1)
-		results <- string(outmsg)
 	} else {
 		return err
 	}
@@ -271,59 +327,22 @@ func worker(deliveries <-chan amqp.Delivery) {
 	log.Info("Worker exiting")
 }
 
-func logFileProcessingLoop() <-chan error {
-
-	errChan := make(chan error)
-
-	spawnTailer := func(fName string, label string) {
-
-		log.Debugf("Spawn tailer: %s", fName)
-
-		_, deliveries, err := NewFileConsumer(fName)
-
-		if err != nil {
-			status.LastConnectError = err.Error()
-			status.ErrorTime = time.Now()
-			errChan <- err
-		}
-
-		for delivery := range deliveries {
-			log.Debugf("Trying to deliver log message %s", delivery)
-			msgMap := make(map[string]interface{})
-			msgMap["message"] = strings.TrimSuffix(delivery, "\n")
-			msgMap["type"] = label
-			outputMessage(msgMap)
-		}
-
-	}
-
-	/* maps audit log labels to event types
-	AUDIT_TYPES = {
-	    "cb-audit-isolation": Audit_Log_Isolation,
-	    "cb-audit-banning": Audit_Log_Banning,
-	    "cb-audit-live-response": Audit_Log_Liveresponse,
-	    "cb-audit-useractivity": Audit_Log_Useractivity
-	}
-	*/
-	go spawnTailer("/var/log/cb/audit/live-response.log", "audit.log.liveresponse")
-	go spawnTailer("/var/log/cb/audit/banning.log", "audit.log.banning")
-	go spawnTailer("/var/log/cb/audit/isolation.log", "audit.log.isolation")
-	go spawnTailer("/var/log/cb/audit/useractivity.log", "audit.log.useractivity")
-	return errChan
-}
-
 func messageProcessingLoop(uri, queueName, consumerTag string) error {
 	connectionError := make(chan *amqp.Error, 1)
 
 	c, deliveries, err := NewConsumer(uri, queueName, consumerTag, config.UseRawSensorExchange, config.EventTypes)
 	if err != nil {
+		status.Lock()
 		status.LastConnectError = err.Error()
 		status.ErrorTime = time.Now()
+		status.Unlock()
 		return err
 	}
 
+	status.Lock()
 	status.LastConnectTime = time.Now()
 	status.IsConnected = true
+	status.Unlock()
 
 	c.conn.NotifyClose(connectionError)
 
@@ -347,10 +366,26 @@ func messageProcessingLoop(uri, queueName, consumerTag string) error {
 				wg.Wait()
 				os.Exit(1)
 			}
+		case <-shutdownRequested:
+			log.Infof("Cancelling AMQP consumer %s", consumerTag)
+			if err := c.Cancel(); err != nil {
+				log.Errorf("Could not cancel consumer %s: %s", consumerTag, err)
+			}
+			log.Info("Waiting for all workers to finish processing in-flight messages")
+			wg.Wait()
+			log.Info("All workers have exited")
+
+			status.Lock()
+			status.IsConnected = false
+			status.Unlock()
+			c.conn.Close()
+			return errShutdown
 		case closeError := <-connectionError:
+			status.Lock()
 			status.IsConnected = false
 			status.LastConnectError = closeError.Error()
 			status.ErrorTime = time.Now()
+			status.Unlock()
 
 			log.Errorf("Connection closed: %s", closeError.Error())
 			log.Info("Waiting for all workers to exit")
@@ -370,8 +405,6 @@ func messageProcessingLoop(uri, queueName, consumerTag string) error {
 func startOutputs() error {
 	// Configure the specific output.
 	// Valid options are: 'udp', 'tcp', 'file', 's3', 'syslog' ,"http",'splunk'
-	var outputHandler OutputHandler
-
 	parameters := config.OutputParameters
 
 	switch config.OutputType {
@@ -432,10 +465,14 @@ func startOutputs() error {
 	}))
 
 	log.Infof("Initialized output: %s\n", outputHandler.String())
-	return outputHandler.Go(results, outputErrors)
+	return outputHandler.Go(results, outputErrors, outputDone)
 }
 
 func main() {
+	if flag.NArg() > 0 && flag.Arg(0) == "verify-chain" {
+		os.Exit(runVerifyChain(flag.Args()[1:], os.Stdout))
+	}
+
 	hostname, err := os.Hostname()
 	if err != nil {
 		log.Fatal(err)
@@ -451,6 +488,12 @@ func main() {
 	}
 
 	if config.PerformFeedPostprocessing {
+		cbAPI, err = newCbAPIClientFromConfig()
+		if err != nil {
+			log.Fatal("Could not create Cb API client: " + err.Error())
+		}
+		expvar.Publish("cb_api", expvar.Func(cbAPI.Statistics))
+
 		apiVersion, err := GetCbVersion()
 		if err != nil {
 			log.Fatal("Could not get cb version: " + err.Error())
@@ -495,6 +538,32 @@ func main() {
 		log.Fatalf("Could not startOutputs: %s", err)
 	}
 
+	if config.PerformFeedPostprocessing {
+		postprocessor = NewPostprocessPool(config.PostprocessWorkers, config.PostprocessQueueSize,
+			config.PostprocessTimeout)
+		postprocessor.Start()
+		expvar.Publish("postprocessing", expvar.Func(postprocessor.Statistics))
+	}
+
+	if config.BinaryExport {
+		store, err := newBinaryStore(config.BinaryExportDestination)
+		if err != nil {
+			log.Fatalf("Could not open binary export destination: %s", err)
+		}
+		binaryExporter = NewBinaryExporter(store, config.BinaryExportWorkers, config.BinaryExportQueueSize,
+			config.BinaryExportMaxSize, config.BinaryExportRetries, config.BinaryExportTimeout)
+		binaryExporter.Start()
+		expvar.Publish("binary_export", expvar.Func(binaryExporter.Statistics))
+	}
+
+	if err := startEventStages(); err != nil {
+		log.Fatalf("Could not start event processing stages: %s", err)
+	}
+
+	for kind, poller := range startInventory() {
+		expvar.Publish("inventory_"+kind, expvar.Func(poller.Statistics))
+	}
+
 	dirs := [...]string{
 		"/usr/share/cb/integrations/event-forwarder/content",
 		"./static",
@@ -551,6 +620,9 @@ func main() {
 		})
 	}
 
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+
 	go http.ListenAndServe(fmt.Sprintf(":%d", config.HTTPServerPort), nil)
 
 	numConsumers := 1
@@ -564,37 +636,73 @@ func main() {
 		queueName = config.AMQPQueueName
 	}
 
+	consumerLoops.Add(numConsumers)
 	for i := 0; i < numConsumers; i++ {
 		go func(consumerNumber int) {
+			defer consumerLoops.Done()
+
 			log.Infof("Starting AMQP loop %d to %s on queue %s", consumerNumber, config.AMQPURL(), queueName)
 			for {
 				err := messageProcessingLoop(config.AMQPURL(), queueName, fmt.Sprintf("go-event-consumer-%d", consumerNumber))
+				if err == errShutdown {
+					log.Infof("AMQP loop %d stopped for shutdown", consumerNumber)
+					return
+				}
 				log.Infof("AMQP loop %d exited: %s. Sleeping for 30 seconds then retrying.", consumerNumber, err)
-				time.Sleep(30 * time.Second)
-			}
-		}(i)
-	}
-
-	if config.AuditLog == true {
-		log.Info("starting log file processing loop")
-		go func() {
-			errChan := logFileProcessingLoop()
-			for {
 				select {
-				case err := <-errChan:
-					log.Infof("%v", err)
+				case <-time.After(30 * time.Second):
+				case <-shutdownRequested:
+					return
 				}
 			}
-		}()
+		}(i)
+	}
 
+	if config.AuditLog {
+		var err error
+		auditLogInput, err = newAuditLogInput(config.AuditLogFiles, config.AuditLogCheckpointFile)
+		if err != nil {
+			log.Fatalf("Could not start audit log processing: %s", err)
+		}
+		auditLogInput.Start()
+		expvar.Publish("audit_log", expvar.Func(auditLogInput.Statistics))
 	} else {
-		log.Info("Not starting file processing loop")
+		log.Info("Not starting audit log processing")
 	}
 
-	for {
-		time.Sleep(30 * time.Second)
-		status.OutputEventRate.Set(float64(status.OutputEventCount.Value()) / float64(time.Now().Sub(status.StartTime)))
+	for _, c := range config.FileInputs {
+		input, err := NewFileInput([]FileInputConfig{c}, c.CheckpointFile)
+		if err != nil {
+			log.Fatalf("Could not start file input %s: %s", c.Name, err)
+		}
+		input.Start()
+		fileInputs[c.Name] = input
+	}
+	if len(fileInputs) > 0 {
+		expvar.Publish("file_input", expvar.Func(func() interface{} {
+			stats := make(map[string]interface{})
+			for name, input := range fileInputs {
+				stats[name] = input.Statistics()
+			}
+			return stats
+		}))
 	}
 
-	log.Info("cb-event-forwarder exiting")
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+
+	rateTicker := time.NewTicker(30 * time.Second)
+	defer rateTicker.Stop()
+
+	for {
+		select {
+		case <-rateTicker.C:
+			status.OutputEventRate.Set(float64(status.OutputEventCount.Value()) / float64(time.Now().Sub(status.StartTime)))
+		case sig := <-term:
+			log.Infof("Received %s", sig)
+			shutdown()
+			log.Info("cb-event-forwarder exiting")
+			os.Exit(0)
+		}
+	}
 }
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var maskMethods = map[string]bool{"hmac": true, "redact": true, "regex": true, "truncate": true}
+
+// the shortest HMAC key accepted in a masking key file
+const minMaskKeyLength = 16
+
+// MaskRule is one [mask:<name>] section: a masking method applied to a list of fields.
+type MaskRule struct {
+	Name   string
+	Fields []string
+	// hmac, redact, regex or truncate
+	Method string
+	// the regular expression whose matches are replaced, for the regex method
+	Pattern string
+	// the replacement for redacted values or regex matches; regex replacements may refer to groups, as in ${1}
+	Replacement string
+	// the number of characters kept by the truncate method
+	Length int
+	// lower case values before pseudonymizing them, so that CORP\JDoe and corp\jdoe get the same pseudonym
+	IgnoreCase bool
+	EventTypes []string
+	// output types the rule applies to; every output if empty
+	Outputs []string
+
+	re     *regexp.Regexp
+	masked map[string]*int64
+}
+
+// appliesTo reports whether the rule is used with the given output type.
+func (r *MaskRule) appliesTo(outputType string) bool {
+	if len(r.Outputs) == 0 {
+		return true
+	}
+	for _, o := range r.Outputs {
+		if o == outputType {
+			return true
+		}
+	}
+	return false
+}
+
+// MaskKeys are the HMAC keys used for pseudonymization, read from a file of <key id>:<secret> lines. The active key
+// is the one named by Active, or the last one in the file, so a key is rotated by appending a new one. The file is
+// reloaded when it changes; pseudonyms are prefixed with the id of the key that made them.
+type MaskKeys struct {
+	File   string
+	Active string
+
+	sync.RWMutex
+	activeID  string
+	key       []byte
+	modTime   time.Time
+	loadedAt  time.Time
+	lastErr   string
+	rotations int64
+}
+
+type MaskRuleStatistics struct {
+	Method string           `json:"method"`
+	Masked map[string]int64 `json:"masked"`
+}
+
+type MaskingStatistics struct {
+	Evaluated    int64                         `json:"evaluated"`
+	MaskedEvents int64                         `json:"masked_events"`
+	Rules        map[string]MaskRuleStatistics `json:"rules"`
+	ActiveKey    string                        `json:"active_key,omitempty"`
+	KeyRotations int64                         `json:"key_rotations"`
+	KeysLoaded   time.Time                     `json:"keys_loaded,omitempty"`
+	KeysError    string                        `json:"keys_error,omitempty"`
+}
+
+// parseMaskKeys parses a key file, returning the ids of the keys in order.
+func parseMaskKeys(data []byte) ([]string, map[string][]byte, error) {
+	var ids []string
+	keys := make(map[string][]byte)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, nil, fmt.Errorf("line %d: expected <key id>:<secret>", line)
+		}
+		id, secret := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if len(secret) < minMaskKeyLength {
+			return nil, nil, fmt.Errorf("line %d: the secret for key %s is shorter than %d characters", line, id,
+				minMaskKeyLength)
+		}
+		if _, ok := keys[id]; ok {
+			return nil, nil, fmt.Errorf("line %d: duplicate key id %s", line, id)
+		}
+		ids = append(ids, id)
+		keys[id] = []byte(secret)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil, errors.New("no keys in the file")
+	}
+	return ids, keys, nil
+}
+
+// load reads the key file and switches to its active key. If it cannot be loaded, the previous key stays in use.
+func (k *MaskKeys) load() error {
+	info, err := os.Stat(k.File)
+	if err != nil {
+		k.Lock()
+		k.lastErr = err.Error()
+		k.Unlock()
+		return err
+	}
+
+	var ids []string
+	var keys map[string][]byte
+	data, err := ioutil.ReadFile(k.File)
+	if err == nil {
+		ids, keys, err = parseMaskKeys(data)
+	}
+	active := k.Active
+	if err == nil {
+		if active == "" {
+			active = ids[len(ids)-1]
+		} else if _, ok := keys[active]; !ok {
+			err = fmt.Errorf("the active key %s is not in the file", active)
+		}
+	}
+
+	k.Lock()
+	defer k.Unlock()
+	k.modTime = info.ModTime()
+	if err != nil {
+		k.lastErr = err.Error()
+		return err
+	}
+	if k.activeID != "" && (k.activeID != active || !hmac.Equal(k.key, keys[active])) {
+		k.rotations++
+		log.Infof("Rotated the masking key from %s to %s", k.activeID, active)
+	}
+	k.activeID = active
+	k.key = keys[active]
+	k.loadedAt = time.Now()
+	k.lastErr = ""
+	return nil
+}
+
+// changed reports whether the key file has been modified since it was last loaded.
+func (k *MaskKeys) changed() bool {
+	info, err := os.Stat(k.File)
+	if err != nil {
+		return false
+	}
+	k.RLock()
+	defer k.RUnlock()
+	return !info.ModTime().Equal(k.modTime)
+}
+
+// pseudonym returns <key id>:<the first 128 bits of HMAC-SHA256(key, value), in hex>. The same value always gets
+// the same pseudonym while the key is unchanged, so events can still be correlated.
+func (k *MaskKeys) pseudonym(value string) string {
+	k.RLock()
+	id, key := k.activeID, k.key
+	k.RUnlock()
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return id + ":" + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// The Masker pseudonymizes, redacts, partially masks or truncates fields before events are output, according to
+// the [mask:<name>] rules that apply to the configured output. Fields are also masked in the copy of the original
+// event that detection and intel match events carry in their event field.
+type Masker struct {
+	rules          []*MaskRule
+	keys           *MaskKeys
+	reloadInterval time.Duration
+
+	evaluated    int64
+	maskedEvents int64
+}
+
+// NewMasker returns a Masker with the rules that apply to outputType. keys may be nil if no rule uses the hmac
+// method; otherwise they are loaded, and a key file that cannot be loaded is an error.
+func NewMasker(rules []*MaskRule, outputType string, keys *MaskKeys, reloadInterval time.Duration) (*Masker,
+	error) {
+	m := &Masker{reloadInterval: reloadInterval}
+	for _, rule := range rules {
+		if !rule.appliesTo(outputType) {
+			continue
+		}
+		if rule.Method == "hmac" && keys == nil {
+			return nil, fmt.Errorf("mask rule %s uses the hmac method, but no key_file is configured", rule.Name)
+		}
+		rule.masked = make(map[string]*int64, len(rule.Fields))
+		for _, field := range rule.Fields {
+			rule.masked[field] = new(int64)
+		}
+		m.rules = append(m.rules, rule)
+	}
+
+	if keys != nil {
+		if err := keys.load(); err != nil {
+			return nil, fmt.Errorf("could not load masking keys from %s: %s", keys.File, err)
+		}
+		m.keys = keys
+	}
+	return m, nil
+}
+
+func (m *Masker) Name() string {
+	return "masking"
+}
+
+// matchesType reports whether the rule applies to data from events of the given type.
+func (r *MaskRule) matchesType(eventType string) bool {
+	if len(r.EventTypes) == 0 {
+		return true
+	}
+	for _, pattern := range r.EventTypes {
+		if matchRoutingKey(pattern, eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+// maskSourceType returns the type of the events whose data msg carries: netconn summaries are copies of netconn
+// events, and dedup rollups carry the key fields of the events they suppressed, whose type is in event_type.
+func maskSourceType(msg map[string]interface{}) string {
+	eventType, _ := msg["type"].(string)
+	switch eventType {
+	case netconnSummaryType:
+		return "ingress.event.netconn"
+	case dedupRollupType:
+		if sourceType, ok := msg["event_type"].(string); ok {
+			return sourceType
+		}
+	}
+	return eventType
+}
+
+func (m *Masker) Process(msg map[string]interface{}) bool {
+	atomic.AddInt64(&m.evaluated, 1)
+
+	// rules are matched against the type of the data they mask: the event itself, the copy of the original event
+	// in detection and intel match events, or the key of a dedup rollup
+	eventType, _ := msg["type"].(string)
+	sourceType := maskSourceType(msg)
+	embedded, _ := msg["event"].(map[string]interface{})
+	embeddedType, _ := embedded["type"].(string)
+	var dedupKey map[string]interface{}
+	if eventType == dedupRollupType {
+		dedupKey, _ = msg["dedup_key"].(map[string]interface{})
+	}
+
+	masked := false
+	for _, rule := range m.rules {
+		matchesEvent := rule.matchesType(eventType) || rule.matchesType(sourceType)
+		matchesEmbedded := embedded != nil && rule.matchesType(embeddedType)
+		matchesKey := dedupKey != nil && rule.matchesType(sourceType)
+		if !matchesEvent && !matchesEmbedded && !matchesKey {
+			continue
+		}
+		for _, field := range rule.Fields {
+			n := 0
+			if matchesEvent {
+				n += m.maskField(rule, msg, field)
+			}
+			if matchesEmbedded {
+				n += m.maskField(rule, embedded, field)
+			}
+			if matchesKey {
+				n += m.maskField(rule, dedupKey, field)
+			}
+			if n > 0 {
+				atomic.AddInt64(rule.masked[field], int64(n))
+				masked = true
+			}
+		}
+	}
+
+	if masked {
+		atomic.AddInt64(&m.maskedEvents, 1)
+	}
+	return true
+}
+
+// maskField masks the value of field in msg, returning the number of values masked.
+func (m *Masker) maskField(rule *MaskRule, msg map[string]interface{}, field string) int {
+	value, ok := getFieldPath(msg, field)
+	if !ok || value == nil {
+		return 0
+	}
+	masked, n := m.maskValue(rule, value)
+	if n > 0 {
+		setFieldPath(msg, field, masked)
+	}
+	return n
+}
+
+// maskValue masks a single value, or each element of a list, returning the number of values that were changed.
+// Objects are only replaced by the redact method.
+func (m *Masker) maskValue(rule *MaskRule, value interface{}) (interface{}, int) {
+	switch v := value.(type) {
+	case []interface{}:
+		masked := make([]interface{}, len(v))
+		total := 0
+		for i, element := range v {
+			var n int
+			masked[i], n = m.maskValue(rule, element)
+			total += n
+		}
+		return masked, total
+	case map[string]interface{}:
+		if rule.Method == "redact" {
+			return rule.Replacement, 1
+		}
+		return value, 0
+	case string:
+		return m.maskString(rule, v)
+	default:
+		masked, n := m.maskString(rule, fmt.Sprint(v))
+		if n == 0 {
+			return value, 0
+		}
+		return masked, n
+	}
+}
+
+// maskString masks s, returning 1 if it was changed and 0 if the rule left it as it was, as when a regex does not
+// match or a value is already shorter than the truncation length.
+func (m *Masker) maskString(rule *MaskRule, s string) (string, int) {
+	switch rule.Method {
+	case "hmac":
+		if rule.IgnoreCase {
+			s = strings.ToLower(s)
+		}
+		return m.keys.pseudonym(s), 1
+	case "redact":
+		return rule.Replacement, 1
+	case "regex":
+		if masked := rule.re.ReplaceAllString(s, rule.Replacement); masked != s {
+			return masked, 1
+		}
+	case "truncate":
+		if runes := []rune(s); len(runes) > rule.Length {
+			return string(runes[:rule.Length]), 1
+		}
+	}
+	return s, 0
+}
+
+func (m *Masker) Statistics() interface{} {
+	stats := MaskingStatistics{
+		Evaluated:    atomic.LoadInt64(&m.evaluated),
+		MaskedEvents: atomic.LoadInt64(&m.maskedEvents),
+		Rules:        make(map[string]MaskRuleStatistics, len(m.rules)),
+	}
+	for _, rule := range m.rules {
+		ruleStats := MaskRuleStatistics{Method: rule.Method, Masked: make(map[string]int64, len(rule.masked))}
+		for field, n := range rule.masked {
+			ruleStats.Masked[field] = atomic.LoadInt64(n)
+		}
+		stats.Rules[rule.Name] = ruleStats
+	}
+	if m.keys != nil {
+		m.keys.RLock()
+		stats.ActiveKey = m.keys.activeID
+		stats.KeyRotations = m.keys.rotations
+		stats.KeysLoaded = m.keys.loadedAt
+		stats.KeysError = m.keys.lastErr
+		m.keys.RUnlock()
+	}
+	return stats
+}
+
+// Start checks the key file for changes every reload interval, and reloads it on SIGHUP.
+func (m *Masker) Start() {
+	if m.keys == nil {
+		return
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		ticker := time.NewTicker(m.reloadInterval)
+		defer ticker.Stop()
+		defer signal.Stop(hup)
+
+		for {
+			select {
+			case <-ticker.C:
+				if m.keys.changed() {
+					m.reloadKeys()
+				}
+			case <-hup:
+				log.Info("Received SIGHUP, reloading masking keys.")
+				m.reloadKeys()
+			case <-shutdownRequested:
+				return
+			}
+		}
+	}()
+}
+
+func (m *Masker) reloadKeys() {
+	if err := m.keys.load(); err != nil {
+		log.Errorf("Could not reload masking keys from %s; keeping the previous key: %s", m.keys.File, err)
+	}
+}
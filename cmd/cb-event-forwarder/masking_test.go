@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/vaughan0/go-ini"
+)
+
+func testPseudonym(id, secret, value string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(value))
+	return id + ":" + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func TestMasker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "masking")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "keys")
+	if err := ioutil.WriteFile(keyFile, []byte("# EU pseudonymization keys\n2024q1:first-secret-0123456789\n"),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rules := []*MaskRule{
+		{Name: "identities", Fields: []string{"username", "computer_name"}, Method: "hmac", IgnoreCase: true},
+		{Name: "passwords", Fields: []string{"command_line"}, Method: "regex",
+			Pattern: `(?i)(/p(?:assword)?[:= ]+)\S+`, Replacement: "${1}****",
+			re: regexp.MustCompile(`(?i)(/p(?:assword)?[:= ]+)\S+`)},
+		{Name: "adapters", Fields: []string{"network_adapters"}, Method: "redact", Replacement: "[REDACTED]",
+			EventTypes: []string{"ingress.event.procstart"}},
+		{Name: "cmdline-length", Fields: []string{"command_line"}, Method: "truncate", Length: 39},
+		{Name: "s3-only", Fields: []string{"path"}, Method: "redact", Replacement: "x", Outputs: []string{"s3"}},
+	}
+
+	m, err := NewMasker(rules, "file", &MaskKeys{File: keyFile}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jdoe := testPseudonym("2024q1", "first-secret-0123456789", `corp\jdoe`)
+	host := testPseudonym("2024q1", "first-secret-0123456789", "wks-0042")
+	for _, test := range []struct {
+		msg      map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			msg: map[string]interface{}{"type": "ingress.event.procstart", "username": `CORP\JDoe`,
+				"computer_name": "WKS-0042", "path": `C:\Windows\System32\net.exe`,
+				"command_line":     `net use \\fs01\share /user:jdoe /p:Hunter2! /persistent:no`,
+				"network_adapters": []interface{}{map[string]interface{}{"ip": "10.0.0.5"}}},
+			expected: map[string]interface{}{"type": "ingress.event.procstart", "username": jdoe,
+				"computer_name": host, "path": `C:\Windows\System32\net.exe`,
+				"command_line":     `net use \\fs01\share /user:jdoe /p:****`,
+				"network_adapters": []interface{}{"[REDACTED]"}},
+		},
+		{
+			// the same identity gets the same pseudonym, including in the copy of the event
+			msg: map[string]interface{}{"type": "detection.sigma", "sensor_id": int32(3),
+				"event": map[string]interface{}{"username": `corp\jdoe`, "computer_name": "wks-0042",
+					"network_adapters": "10.0.0.5"}},
+			expected: map[string]interface{}{"type": "detection.sigma", "sensor_id": int32(3),
+				"event": map[string]interface{}{"username": jdoe, "computer_name": host,
+					"network_adapters": "10.0.0.5"}},
+		},
+		{
+			msg:      map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "203.0.113.7"},
+			expected: map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "203.0.113.7"},
+		},
+	} {
+		if !m.Process(test.msg) {
+			t.Error("masking should never drop events")
+		}
+		if diff := cmp.Diff(test.expected, test.msg); diff != "" {
+			t.Errorf("event mismatch (-want +got):\n%s", diff)
+		}
+	}
+
+	// appending a key rotates to it
+	if err := ioutil.WriteFile(keyFile, []byte("2024q1:first-secret-0123456789\n2024q2:second-secret-0123456789\n"),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(keyFile, later, later)
+	if !m.keys.changed() {
+		t.Fatal("expected the modified key file to be detected")
+	}
+	m.reloadKeys()
+
+	msg := map[string]interface{}{"type": "ingress.event.procstart", "username": `corp\jdoe`}
+	m.Process(msg)
+	if expected := testPseudonym("2024q2", "second-secret-0123456789", `corp\jdoe`); msg["username"] != expected {
+		t.Errorf("expected %s after rotating the key, got %s", expected, msg["username"])
+	}
+
+	// a key file with a short secret is rejected, keeping the current key
+	ioutil.WriteFile(keyFile, []byte("2024q3:short\n"), 0644)
+	m.reloadKeys()
+
+	stats := m.Statistics().(MaskingStatistics)
+	expected := MaskingStatistics{
+		Evaluated:    4,
+		MaskedEvents: 3,
+		Rules: map[string]MaskRuleStatistics{
+			"identities":     {Method: "hmac", Masked: map[string]int64{"username": 3, "computer_name": 2}},
+			"passwords":      {Method: "regex", Masked: map[string]int64{"command_line": 1}},
+			"adapters":       {Method: "redact", Masked: map[string]int64{"network_adapters": 1}},
+			"cmdline-length": {Method: "truncate", Masked: map[string]int64{"command_line": 1}},
+		},
+		ActiveKey:    "2024q2",
+		KeyRotations: 1,
+		KeysLoaded:   stats.KeysLoaded,
+		KeysError:    "line 1: the secret for key 2024q3 is shorter than 16 characters",
+	}
+	if diff := cmp.Diff(expected, stats); diff != "" {
+		t.Errorf("statistics mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, err := NewMasker(rules[:1], "file", nil, time.Minute); err == nil {
+		t.Error("expected an error for an hmac rule without keys")
+	}
+}
+
+func TestMaskerDerivedEvents(t *testing.T) {
+	rules := []*MaskRule{
+		{Name: "netconn-ips", Fields: []string{"remote_ip"}, Method: "redact", Replacement: "x",
+			EventTypes: []string{"ingress.event.netconn"}},
+		{Name: "paths", Fields: []string{"path"}, Method: "regex", Pattern: `(?i)\\users\\[^\\]+`,
+			Replacement: `\users\*`, re: regexp.MustCompile(`(?i)\\users\\[^\\]+`)},
+	}
+	m, err := NewMasker(rules, "file", nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		desc     string
+		msg      map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			desc:     "netconn summaries are masked as netconn events",
+			msg:      map[string]interface{}{"type": netconnSummaryType, "remote_ip": "203.0.113.7", "count": 3},
+			expected: map[string]interface{}{"type": netconnSummaryType, "remote_ip": "x", "count": 3},
+		},
+		{
+			desc: "the copy of the original event is matched on its own type",
+			msg: map[string]interface{}{"type": "intel.match", "remote_ip": "203.0.113.7",
+				"event": map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "203.0.113.7"}},
+			expected: map[string]interface{}{"type": "intel.match", "remote_ip": "203.0.113.7",
+				"event": map[string]interface{}{"type": "ingress.event.netconn", "remote_ip": "x"}},
+		},
+		{
+			desc: "dedup rollup keys are matched on the type of the suppressed events",
+			msg: map[string]interface{}{"type": dedupRollupType, "event_type": "ingress.event.netconn",
+				"dedup_key": map[string]interface{}{"remote_ip": "203.0.113.7", "sensor_id": int32(3)}},
+			expected: map[string]interface{}{"type": dedupRollupType, "event_type": "ingress.event.netconn",
+				"dedup_key": map[string]interface{}{"remote_ip": "x", "sensor_id": int32(3)}},
+		},
+		{
+			desc:     "values a rule leaves unchanged are not counted",
+			msg:      map[string]interface{}{"type": "ingress.event.filemod", "path": `C:\Windows\notepad.exe`},
+			expected: map[string]interface{}{"type": "ingress.event.filemod", "path": `C:\Windows\notepad.exe`},
+		},
+		{
+			msg:      map[string]interface{}{"type": "ingress.event.filemod", "path": `C:\Users\jdoe\x.txt`},
+			expected: map[string]interface{}{"type": "ingress.event.filemod", "path": `C:\users\*\x.txt`},
+		},
+	} {
+		m.Process(test.msg)
+		if diff := cmp.Diff(test.expected, test.msg); diff != "" {
+			t.Errorf("%s: event mismatch (-want +got):\n%s", test.desc, diff)
+		}
+	}
+
+	stats := m.Statistics().(MaskingStatistics)
+	if stats.MaskedEvents != 4 || stats.Rules["netconn-ips"].Masked["remote_ip"] != 3 ||
+		stats.Rules["paths"].Masked["path"] != 1 {
+		t.Errorf("unexpected statistics %+v", stats)
+	}
+}
+
+func TestParseMaskConfigurationErrors(t *testing.T) {
+	for _, section := range []ini.Section{
+		{"method": "redact"},
+		{"fields": "username", "method": "encrypt"},
+		{"fields": "command_line", "method": "regex"},
+		{"fields": "command_line", "method": "regex", "pattern": "("},
+		{"fields": "command_line", "method": "truncate", "length": "0"},
+		{"fields": "username", "method": "hmac"},
+		{"fields": "username", "method": "redact", "outputs": "carrier-pigeon"},
+	} {
+		config := &Configuration{}
+		errs := &ConfigurationError{Empty: true}
+		parseMaskConfiguration(&ini.File{"mask:test": section}, config, errs)
+		if errs.Empty {
+			t.Errorf("expected an error for %v", section)
+		}
+	}
+}
@@ -98,6 +98,17 @@ func (o *NetOutput) closeAndScheduleReconnection() {
 	log.Infof("Lost connection to %s. Will try to reconnect at %s.", o.netConn, o.reconnectTime)
 }
 
+func (o *NetOutput) close() {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.connected {
+		log.Infof("Closing connection to %s", o.netConn)
+		o.outputSocket.Close()
+		o.connected = false
+	}
+}
+
 func (o *NetOutput) Key() string {
 	o.RLock()
 	defer o.RUnlock()
@@ -125,6 +136,17 @@ func (o *NetOutput) Statistics() interface{} {
 	}
 }
 
+func (o *NetOutput) Connected() bool {
+	o.RLock()
+	defer o.RUnlock()
+
+	return o.connected
+}
+
+func (o *NetOutput) Backlog() int {
+	return 0
+}
+
 func (o *NetOutput) output(m string) error {
 	if o.addNewline {
 		m = m + "\r\n"
@@ -139,11 +161,13 @@ func (o *NetOutput) output(m string) error {
 	_, err := o.outputSocket.Write([]byte(m))
 	if err != nil {
 		o.closeAndScheduleReconnection()
+	} else {
+		recordOutput()
 	}
 	return err
 }
 
-func (o *NetOutput) Go(messages <-chan string, errorChan chan<- error) error {
+func (o *NetOutput) Go(messages <-chan string, errorChan chan<- error, done chan<- struct{}) error {
 	if o.outputSocket == nil {
 		return errors.New("Output socket not open")
 	}
@@ -155,11 +179,16 @@ func (o *NetOutput) Go(messages <-chan string, errorChan chan<- error) error {
 		hup := make(chan os.Signal, 1)
 		signal.Notify(hup, syscall.SIGHUP)
 
+		defer close(done)
 		defer signal.Stop(hup)
 
 		for {
 			select {
-			case message := <-messages:
+			case message, ok := <-messages:
+				if !ok {
+					o.close()
+					return
+				}
 				if err := o.output(message); err != nil {
 					errorChan <- err
 				}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// type of the flow summary events emitted in place of aggregated netconn events
+const netconnSummaryType = "netconn.summary"
+
+// fields that identify a flow; netconn events with the same values are aggregated into one summary
+var netconnFlowFields = []string{"process_guid", "remote_ip", "remote_port", "protocol", "direction"}
+
+// fields of a single connection that are summarized rather than copied into the summary event
+var netconnPerConnectionFields = []string{"timestamp", "local_port", "port", "ipv4"}
+
+type netconnFlow struct {
+	// the first event of the flow, without its per-connection fields
+	summary        map[string]interface{}
+	started        time.Time
+	count          int64
+	firstTimestamp float64
+	lastTimestamp  float64
+	localPorts     map[int]bool
+}
+
+type netconnDestination struct {
+	since time.Time
+	count int
+}
+
+type NetconnAggregatorStatistics struct {
+	Window          float64 `json:"window"`
+	Flows           int     `json:"flows"`
+	Destinations    int     `json:"destinations"`
+	Aggregated      int64   `json:"aggregated"`
+	Summaries       int64   `json:"summaries"`
+	RarePassthrough int64   `json:"rare_passthrough"`
+	Overflow        int64   `json:"overflow"`
+}
+
+// NetconnAggregator replaces ingress.event.netconn events with one netconn.summary event per flow and window. A
+// flow is the connections of one process to one remote IP and port with the same protocol and direction.
+type NetconnAggregator struct {
+	window time.Duration
+	// flows tracked at once; connections starting new flows beyond this are output unaggregated
+	maxFlows int
+	// connections to remote IPs seen fewer than rareThreshold times within rareWindow are output unaggregated;
+	// disabled if rareThreshold is 0. At most maxFlows destinations are counted.
+	rareThreshold int
+	rareWindow    time.Duration
+
+	// current time; replaced in tests
+	now func() time.Time
+	// outputs a summary event; replaced in tests
+	output func(msg map[string]interface{}) error
+
+	sync.Mutex
+	flows        map[string]*netconnFlow
+	destinations map[string]*netconnDestination
+
+	aggregated      int64
+	summaries       int64
+	rarePassthrough int64
+	overflow        int64
+}
+
+func NewNetconnAggregator(window time.Duration, maxFlows, rareThreshold int,
+	rareWindow time.Duration) *NetconnAggregator {
+	a := &NetconnAggregator{
+		window:        window,
+		maxFlows:      maxFlows,
+		rareThreshold: rareThreshold,
+		rareWindow:    rareWindow,
+		now:           time.Now,
+		flows:         make(map[string]*netconnFlow),
+		destinations:  make(map[string]*netconnDestination),
+	}
+	// summaries are built from events that have been through the stages before this one already
+	a.output = func(msg map[string]interface{}) error {
+		return outputMessageThrough(stagesAfter(a), msg)
+	}
+	return a
+}
+
+func (a *NetconnAggregator) Name() string {
+	return "netconn_aggregation"
+}
+
+func (a *NetconnAggregator) Process(msg map[string]interface{}) bool {
+	if msg["type"] != "ingress.event.netconn" {
+		return true
+	}
+	now := a.now()
+
+	a.Lock()
+	if a.rare(msg, now) {
+		a.Unlock()
+		atomic.AddInt64(&a.rarePassthrough, 1)
+		return true
+	}
+
+	key, _ := dedupKey(netconnFlowFields, msg)
+	flow, ok := a.flows[key]
+	var expired *netconnFlow
+	if ok && now.Sub(flow.started) >= a.window {
+		expired, ok = flow, false
+	}
+	if !ok {
+		if expired == nil && len(a.flows) >= a.maxFlows {
+			a.Unlock()
+			atomic.AddInt64(&a.overflow, 1)
+			return true
+		}
+		flow = newNetconnFlow(msg, now)
+		a.flows[key] = flow
+	}
+	flow.add(msg, now)
+	a.Unlock()
+
+	atomic.AddInt64(&a.aggregated, 1)
+	if expired != nil {
+		a.emit(expired)
+	}
+	return false
+}
+
+// rare records a connection to the remote IP of msg and reports whether that destination is rare. The caller holds
+// the lock.
+func (a *NetconnAggregator) rare(msg map[string]interface{}, now time.Time) bool {
+	if a.rareThreshold == 0 {
+		return false
+	}
+	ip, ok := msg["remote_ip"].(string)
+	if !ok || ip == "" {
+		return false
+	}
+
+	destination, ok := a.destinations[ip]
+	if !ok && len(a.destinations) >= a.maxFlows {
+		// too many destinations to tell which are rare
+		return false
+	}
+	if !ok || now.Sub(destination.since) >= a.rareWindow {
+		destination = &netconnDestination{since: now}
+		a.destinations[ip] = destination
+	}
+	destination.count++
+	return destination.count < a.rareThreshold
+}
+
+func newNetconnFlow(msg map[string]interface{}, now time.Time) *netconnFlow {
+	summary := make(map[string]interface{}, len(msg))
+	for k, v := range msg {
+		summary[k] = v
+	}
+	for _, field := range netconnPerConnectionFields {
+		delete(summary, field)
+	}
+	return &netconnFlow{summary: summary, started: now, localPorts: make(map[int]bool)}
+}
+
+func (f *netconnFlow) add(msg map[string]interface{}, now time.Time) {
+	timestamp, ok := msg["timestamp"].(float64)
+	if !ok {
+		timestamp = unixSecondsFloat(now)
+	}
+	if f.count == 0 || timestamp < f.firstTimestamp {
+		f.firstTimestamp = timestamp
+	}
+	if f.count == 0 || timestamp > f.lastTimestamp {
+		f.lastTimestamp = timestamp
+	}
+	if port, ok := intFromEvent(msg["local_port"]); ok {
+		f.localPorts[port] = true
+	}
+	f.count++
+}
+
+// Start emits the summaries of flows whose window has closed, and forgets expired destinations, periodically until
+// shutdown is requested.
+func (a *NetconnAggregator) Start() {
+	interval := a.window / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				a.sweep(false)
+			case <-shutdownRequested:
+				return
+			}
+		}
+	}()
+}
+
+// Stop emits the summaries of every open flow. It is called during shutdown, once no more events are being
+// processed.
+func (a *NetconnAggregator) Stop() {
+	a.sweep(true)
+}
+
+func (a *NetconnAggregator) sweep(all bool) {
+	now := a.now()
+	var expired []*netconnFlow
+
+	a.Lock()
+	for key, flow := range a.flows {
+		if all || now.Sub(flow.started) >= a.window {
+			expired = append(expired, flow)
+			delete(a.flows, key)
+		}
+	}
+	for ip, destination := range a.destinations {
+		if now.Sub(destination.since) >= a.rareWindow {
+			delete(a.destinations, ip)
+		}
+	}
+	a.Unlock()
+
+	for _, flow := range expired {
+		a.emit(flow)
+	}
+}
+
+func (a *NetconnAggregator) emit(flow *netconnFlow) {
+	if err := a.output(a.summarize(flow)); err != nil {
+		log.Errorf("Could not output a netconn summary: %s", err)
+		return
+	}
+	atomic.AddInt64(&a.summaries, 1)
+}
+
+func (a *NetconnAggregator) summarize(flow *netconnFlow) map[string]interface{} {
+	msg := flow.summary
+	localPorts := make([]int, 0, len(flow.localPorts))
+	for port := range flow.localPorts {
+		localPorts = append(localPorts, port)
+	}
+	sort.Ints(localPorts)
+
+	msg["type"] = netconnSummaryType
+	msg["timestamp"] = flow.firstTimestamp
+	msg["count"] = flow.count
+	msg["first_timestamp"] = flow.firstTimestamp
+	msg["last_timestamp"] = flow.lastTimestamp
+	msg["local_ports"] = localPorts
+	msg["window"] = a.window.Seconds()
+	return msg
+}
+
+func (a *NetconnAggregator) Statistics() interface{} {
+	a.Lock()
+	flows, destinations := len(a.flows), len(a.destinations)
+	a.Unlock()
+
+	return NetconnAggregatorStatistics{
+		Window:          a.window.Seconds(),
+		Flows:           flows,
+		Destinations:    destinations,
+		Aggregated:      atomic.LoadInt64(&a.aggregated),
+		Summaries:       atomic.LoadInt64(&a.summaries),
+		RarePassthrough: atomic.LoadInt64(&a.rarePassthrough),
+		Overflow:        atomic.LoadInt64(&a.overflow),
+	}
+}
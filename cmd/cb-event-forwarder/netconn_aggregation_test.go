@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func testNetconnEvent(timestamp float64, remoteIP string, localPort uint16) map[string]interface{} {
+	return map[string]interface{}{
+		"type":          "ingress.event.netconn",
+		"event_type":    "netconn",
+		"timestamp":     timestamp,
+		"sensor_id":     int32(12),
+		"computer_name": "WIN-DESKTOP",
+		"process_guid":  "00000012-0000-0a5c-01d2-7a1b2c3d4e5f",
+		"domain":        "",
+		"remote_ip":     remoteIP,
+		"remote_port":   uint16(443),
+		"local_ip":      "10.0.0.5",
+		"local_port":    localPort,
+		"protocol":      int32(6),
+		"direction":     "outbound",
+	}
+}
+
+func TestNetconnAggregator(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	var summaries []map[string]interface{}
+
+	a := NewNetconnAggregator(time.Minute, 2, 0, time.Hour)
+	a.now = func() time.Time { return now }
+	a.output = func(msg map[string]interface{}) error {
+		summaries = append(summaries, msg)
+		return nil
+	}
+
+	steps := []struct {
+		advance  time.Duration
+		msg      map[string]interface{}
+		expected bool
+	}{
+		{0, testNetconnEvent(1499999990.5, "93.184.216.34", 50001), false},
+		{time.Second, testNetconnEvent(1499999991.25, "93.184.216.34", 50002), false},
+		{time.Second, testNetconnEvent(1499999989, "93.184.216.34", 50001), false},
+		{0, testNetconnEvent(1499999992, "151.101.1.69", 50003), false},
+		// too many flows: output unaggregated
+		{0, testNetconnEvent(1499999992, "140.82.112.3", 50004), true},
+		{0, map[string]interface{}{"type": "ingress.event.procstart"}, true},
+	}
+	for i, step := range steps {
+		now = now.Add(step.advance)
+		if got := a.Process(step.msg); got != step.expected {
+			t.Errorf("step %d: Process(%v) = %t, expected %t", i, step.msg, got, step.expected)
+		}
+	}
+
+	// the first flow started at 1500000000 and the second at 1500000002
+	now = time.Unix(1500000061, 0)
+	a.sweep(false)
+
+	expected := []map[string]interface{}{
+		{
+			"type":            netconnSummaryType,
+			"event_type":      "netconn",
+			"timestamp":       1499999989.0,
+			"sensor_id":       int32(12),
+			"computer_name":   "WIN-DESKTOP",
+			"process_guid":    "00000012-0000-0a5c-01d2-7a1b2c3d4e5f",
+			"domain":          "",
+			"remote_ip":       "93.184.216.34",
+			"remote_port":     uint16(443),
+			"local_ip":        "10.0.0.5",
+			"protocol":        int32(6),
+			"direction":       "outbound",
+			"count":           int64(3),
+			"first_timestamp": 1499999989.0,
+			"last_timestamp":  1499999991.25,
+			"local_ports":     []int{50001, 50002},
+			"window":          float64(60),
+		},
+	}
+	if diff := cmp.Diff(expected, summaries); diff != "" {
+		t.Errorf("summaries mismatch (-want +got):\n%s", diff)
+	}
+
+	a.Stop()
+	if len(summaries) != 2 || summaries[1]["remote_ip"] != "151.101.1.69" || summaries[1]["count"] != int64(1) {
+		t.Errorf("expected the remaining flow to be summarized on Stop, got %v", summaries)
+	}
+
+	expectedStats := NetconnAggregatorStatistics{Window: 60, Aggregated: 4, Summaries: 2, Overflow: 1}
+	if diff := cmp.Diff(expectedStats, a.Statistics()); diff != "" {
+		t.Errorf("statistics mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestNetconnAggregatorRareDestinations(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	var summaries []map[string]interface{}
+
+	a := NewNetconnAggregator(time.Minute, 100, 3, time.Hour)
+	a.now = func() time.Time { return now }
+	a.output = func(msg map[string]interface{}) error {
+		summaries = append(summaries, msg)
+		return nil
+	}
+
+	// the first two connections to a destination are rare and output as they are; later ones are aggregated, and
+	// a flow still open when its window closes is summarized when the next connection arrives
+	for i, test := range []struct {
+		advance  time.Duration
+		remoteIP string
+		expected bool
+	}{
+		{0, "198.51.100.7", true},
+		{0, "198.51.100.7", true},
+		{0, "198.51.100.7", false},
+		{0, "203.0.113.9", true},
+		{0, "198.51.100.7", false},
+		{2 * time.Minute, "198.51.100.7", false},
+		// the destination counts reset after rare_destination_window
+		{time.Hour, "198.51.100.7", true},
+	} {
+		now = now.Add(test.advance)
+		if got := a.Process(testNetconnEvent(1500000000, test.remoteIP, 50000)); got != test.expected {
+			t.Errorf("step %d: connection to %s: got %t, expected %t", i, test.remoteIP, got, test.expected)
+		}
+	}
+
+	if len(summaries) != 1 || summaries[0]["count"] != int64(2) {
+		t.Errorf("expected one summary of two connections, got %v", summaries)
+	}
+	stats := a.Statistics().(NetconnAggregatorStatistics)
+	if stats.RarePassthrough != 4 || stats.Aggregated != 3 {
+		t.Errorf("unexpected statistics %+v", stats)
+	}
+}
+
+func TestNetconnSummarySkipsEarlierStages(t *testing.T) {
+	savedConfig, savedStages, savedResults := config, eventStages, results
+	defer func() {
+		config, eventStages, results = savedConfig, savedStages, savedResults
+	}()
+	config.OutputFormat = JSONOutputFormat
+	results = make(chan string, 10)
+
+	dir, err := ioutil.TempDir("", "netconn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// neither the rule nor the intel file are limited to netconn events, so both would match the summary again
+	if err := ioutil.WriteFile(filepath.Join(dir, "rule.yml"), []byte(`title: Known C2
+id: 1a2b3c4d-0101
+level: high
+logsource:
+    product: windows
+detection:
+    selection:
+        remote_ip: 203.0.113.7
+    condition: selection
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	intelFile := &IntelFile{Name: "internal-ir", File: filepath.Join(dir, "ir.csv")}
+	if err := ioutil.WriteFile(intelFile.File, []byte("value\n203.0.113.7\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var detections, intelMatches int
+	sigma := NewSigmaEngine(dir, "low", true)
+	sigma.output = func(msg map[string]interface{}) error {
+		detections++
+		return nil
+	}
+	if err := sigma.Load(); err != nil {
+		t.Fatal(err)
+	}
+	intel, err := NewIntelMatcher([]*IntelFile{intelFile}, defaultIntelFields, nil, true, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intel.output = func(msg map[string]interface{}) error {
+		intelMatches++
+		return nil
+	}
+	a := NewNetconnAggregator(time.Minute, 100, 0, time.Hour)
+	eventStages = []EventStage{sigma, intel, a}
+
+	if err := outputMessage(testNetconnEvent(1499999990.5, "203.0.113.7", 50001)); err != nil {
+		t.Fatal(err)
+	}
+	a.Stop()
+
+	if detections != 1 || intelMatches != 1 {
+		t.Errorf("expected 1 detection and 1 intel match, got %d and %d", detections, intelMatches)
+	}
+	if len(results) != 1 {
+		t.Fatalf("expected only the summary to be output, got %d events", len(results))
+	}
+	var summary map[string]interface{}
+	if err := json.Unmarshal([]byte(<-results), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary["type"] != netconnSummaryType {
+		t.Errorf("expected a summary, got %v", summary)
+	}
+	if sigmaMatches, _ := summary["sigma_matches"].([]interface{}); len(sigmaMatches) != 1 {
+		t.Errorf("expected the Sigma match of the first event only, got %v", summary["sigma_matches"])
+	}
+	if matches, _ := summary["intel_matches"].([]interface{}); len(matches) != 1 {
+		t.Errorf("expected the intel match of the first event only, got %v", summary["intel_matches"])
+	}
+}
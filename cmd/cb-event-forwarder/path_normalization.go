@@ -0,0 +1,393 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// limits on what the PathNormalizer learns from events
+const (
+	maxLearnedVolumeSensors = 100000
+	maxLearnedUsers         = 100000
+)
+
+// names of the well-known service account SIDs, used when a registry path is under one of their hives
+var wellKnownSIDs = map[string]string{
+	"S-1-5-18": `NT AUTHORITY\SYSTEM`,
+	"S-1-5-19": `NT AUTHORITY\LOCAL SERVICE`,
+	"S-1-5-20": `NT AUTHORITY\NETWORK SERVICE`,
+}
+
+type PathNormalizationStatistics struct {
+	Evaluated           int64 `json:"evaluated"`
+	DevicePaths         int64 `json:"device_paths"`
+	UnmappedDevicePaths int64 `json:"unmapped_device_paths"`
+	RegistryPaths       int64 `json:"registry_paths"`
+	LearnedVolumes      int   `json:"learned_volumes"`
+	LearnedUsers        int   `json:"learned_users"`
+}
+
+// The PathNormalizer rewrites native Windows paths in raw events into the forms analysts expect. Device paths such
+// as \Device\HarddiskVolume2\Windows\explorer.exe become C:\Windows\explorer.exe, and registry paths such as
+// \registry\machine\software become HKLM\software. The original value of each rewritten field is kept in
+// <field>_original. It also adds file_name, file_extension and directory, derived from path, and process_name.
+//
+// Volumes are mapped to drive letters by the configured volume map, and by mappings learned per sensor from events
+// that carry the same file in both forms, such as a procstart whose path is a device path and whose process_path
+// has a drive letter. SIDs in registry paths are resolved to user names learned from the uid and username of
+// process events.
+type PathNormalizer struct {
+	fields       []string
+	eventTypes   []string
+	volumes      map[string]string
+	learnVolumes bool
+	systemRoot   string
+
+	sync.RWMutex
+	// device (lower case) to drive letter, by sensor id
+	learnedVolumes map[int]map[string]string
+	// user name by SID (upper case)
+	learnedUsers map[string]string
+
+	evaluated           int64
+	devicePaths         int64
+	unmappedDevicePaths int64
+	registryPaths       int64
+}
+
+// NewPathNormalizer returns a PathNormalizer for the given fields. volumes maps devices, such as
+// \Device\HarddiskVolume2, to drive letters such as C:.
+func NewPathNormalizer(fields, eventTypes []string, volumes map[string]string, learnVolumes bool,
+	systemRoot string) *PathNormalizer {
+	lowerVolumes := make(map[string]string, len(volumes))
+	for device, drive := range volumes {
+		lowerVolumes[strings.ToLower(strings.TrimSuffix(device, `\`))] = strings.ToUpper(drive)
+	}
+	return &PathNormalizer{
+		fields:         fields,
+		eventTypes:     eventTypes,
+		volumes:        lowerVolumes,
+		learnVolumes:   learnVolumes,
+		systemRoot:     strings.TrimSuffix(systemRoot, `\`),
+		learnedVolumes: make(map[int]map[string]string),
+		learnedUsers:   make(map[string]string),
+	}
+}
+
+func (n *PathNormalizer) Name() string {
+	return "path_normalization"
+}
+
+func (n *PathNormalizer) Process(msg map[string]interface{}) bool {
+	if !matchAnyRoutingKey(n.eventTypes, msg) {
+		return true
+	}
+	atomic.AddInt64(&n.evaluated, 1)
+
+	sensorID, hasSensor := intFromEvent(msg["sensor_id"])
+	if hasSensor && n.learnVolumes {
+		n.learnVolumesFrom(sensorID, msg)
+	}
+	n.learnUser(msg)
+
+	for _, field := range n.fields {
+		value, ok := msg[field].(string)
+		if !ok || value == "" {
+			continue
+		}
+
+		normalized := value
+		if strings.HasPrefix(strings.ToLower(value), `\registry\`) {
+			var sid string
+			normalized, sid = normalizeRegistryPath(value)
+			atomic.AddInt64(&n.registryPaths, 1)
+			if sid != "" {
+				if _, ok := msg["registry_user_sid"]; !ok {
+					msg["registry_user_sid"] = sid
+					if user := n.userFor(sid); user != "" {
+						msg["registry_user"] = user
+					}
+				}
+			}
+		} else if isNativePath(value) {
+			var mapped bool
+			normalized, mapped = n.normalizeDevicePath(sensorID, hasSensor, value)
+			if mapped {
+				atomic.AddInt64(&n.devicePaths, 1)
+			} else {
+				atomic.AddInt64(&n.unmappedDevicePaths, 1)
+			}
+		}
+
+		if normalized != value {
+			msg[field+"_original"] = value
+			msg[field] = normalized
+		}
+	}
+
+	n.addDerivedFields(msg)
+	return true
+}
+
+// isNativePath reports whether p is an NT object manager path rather than a Win32 path.
+func isNativePath(p string) bool {
+	lower := strings.ToLower(p)
+	return strings.HasPrefix(lower, `\device\`) || strings.HasPrefix(lower, `\??\`) ||
+		strings.HasPrefix(lower, `\\?\`) || strings.HasPrefix(lower, `\systemroot\`)
+}
+
+// splitDevicePath splits a path such as \Device\HarddiskVolume2\Windows into the device, in lower case, and the rest
+// of the path.
+func splitDevicePath(p string) (device, rest string, ok bool) {
+	const prefix = `\device\`
+	if !strings.HasPrefix(strings.ToLower(p), prefix) {
+		return "", "", false
+	}
+	i := strings.Index(p[len(prefix):], `\`)
+	if i < 0 {
+		return strings.ToLower(p), "", true
+	}
+	i += len(prefix)
+	return strings.ToLower(p[:i]), p[i:], true
+}
+
+// splitDrivePath splits a path such as C:\Windows into the upper case drive letter and the rest of the path.
+func splitDrivePath(p string) (drive, rest string, ok bool) {
+	if len(p) < 3 || p[1] != ':' || p[2] != '\\' {
+		return "", "", false
+	}
+	c := p[0] | 0x20
+	if c < 'a' || c > 'z' {
+		return "", "", false
+	}
+	return strings.ToUpper(p[:2]), p[2:], true
+}
+
+// stripNativePrefix removes the \??\ or \\?\ prefix of a path such as \??\C:\Windows.
+func stripNativePrefix(p string) string {
+	lower := strings.ToLower(p)
+	for _, prefix := range []string{`\??\`, `\\?\`} {
+		if strings.HasPrefix(lower, prefix) {
+			if strings.HasPrefix(lower[len(prefix):], `unc\`) {
+				return `\\` + p[len(prefix)+len(`unc\`):]
+			}
+			return p[len(prefix):]
+		}
+	}
+	return p
+}
+
+// normalizeDevicePath returns p with its device mapped to a drive letter or UNC path, reporting whether it could be.
+func (n *PathNormalizer) normalizeDevicePath(sensorID int, hasSensor bool, p string) (string, bool) {
+	p = stripNativePrefix(p)
+	lower := strings.ToLower(p)
+
+	switch {
+	case strings.HasPrefix(lower, `\systemroot\`):
+		return n.systemRoot + p[len(`\systemroot`):], n.systemRoot != ""
+	case strings.HasPrefix(lower, `\device\mup\`):
+		return `\\` + p[len(`\device\mup\`):], true
+	case strings.HasPrefix(lower, `\device\lanmanredirector\`):
+		return `\\` + p[len(`\device\lanmanredirector\`):], true
+	}
+
+	device, rest, ok := splitDevicePath(p)
+	if !ok {
+		// \??\C:\... with the prefix removed
+		return p, true
+	}
+
+	if hasSensor {
+		n.RLock()
+		drive, ok := n.learnedVolumes[sensorID][device]
+		n.RUnlock()
+		if ok {
+			return drive + rest, true
+		}
+	}
+	if drive, ok := n.volumes[device]; ok {
+		return drive + rest, true
+	}
+	return p, false
+}
+
+// learnVolumesFrom learns the drive letter of a volume from an event with the same file as a device path in one
+// field and a drive letter path in another.
+func (n *PathNormalizer) learnVolumesFrom(sensorID int, msg map[string]interface{}) {
+	var devices, drives [][2]string
+	for _, field := range n.fields {
+		value, ok := msg[field].(string)
+		if !ok {
+			continue
+		}
+		value = stripNativePrefix(value)
+		if device, rest, ok := splitDevicePath(value); ok && len(rest) > 1 {
+			devices = append(devices, [2]string{device, rest})
+		} else if drive, rest, ok := splitDrivePath(value); ok && len(rest) > 1 {
+			drives = append(drives, [2]string{drive, rest})
+		}
+	}
+
+	for _, device := range devices {
+		for _, drive := range drives {
+			if strings.EqualFold(device[1], drive[1]) {
+				n.learnVolume(sensorID, device[0], drive[0])
+			}
+		}
+	}
+}
+
+func (n *PathNormalizer) learnVolume(sensorID int, device, drive string) {
+	n.RLock()
+	known := n.learnedVolumes[sensorID][device] == drive
+	n.RUnlock()
+	if known {
+		return
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	volumes, ok := n.learnedVolumes[sensorID]
+	if !ok {
+		if len(n.learnedVolumes) >= maxLearnedVolumeSensors {
+			return
+		}
+		volumes = make(map[string]string)
+		n.learnedVolumes[sensorID] = volumes
+	}
+	volumes[device] = drive
+}
+
+// learnUser records the user name of the SID in the uid of a process event.
+func (n *PathNormalizer) learnUser(msg map[string]interface{}) {
+	sid, ok := msg["uid"].(string)
+	if !ok || !strings.HasPrefix(strings.ToUpper(sid), "S-1-") {
+		return
+	}
+	user, ok := msg["username"].(string)
+	if !ok || user == "" {
+		return
+	}
+	sid = strings.ToUpper(sid)
+
+	n.RLock()
+	known := n.learnedUsers[sid] == user
+	n.RUnlock()
+	if known {
+		return
+	}
+
+	n.Lock()
+	if _, ok := n.learnedUsers[sid]; ok || len(n.learnedUsers) < maxLearnedUsers {
+		n.learnedUsers[sid] = user
+	}
+	n.Unlock()
+}
+
+func (n *PathNormalizer) userFor(sid string) string {
+	if user, ok := wellKnownSIDs[sid]; ok {
+		return user
+	}
+	n.RLock()
+	defer n.RUnlock()
+	return n.learnedUsers[sid]
+}
+
+// normalizeRegistryPath replaces the \registry\machine and \registry\user roots of a registry path with HKLM and HKU.
+// For a key under a user's hive, it also returns the user's SID.
+func normalizeRegistryPath(p string) (string, string) {
+	lower := strings.ToLower(p)
+	switch {
+	case lower == `\registry\machine` || strings.HasPrefix(lower, `\registry\machine\`):
+		return "HKLM" + p[len(`\registry\machine`):], ""
+	case lower == `\registry\user`:
+		return "HKU", ""
+	case strings.HasPrefix(lower, `\registry\user\`):
+		rest := p[len(`\registry\user\`):]
+		hive := rest
+		if i := strings.Index(rest, `\`); i >= 0 {
+			hive = rest[:i]
+		}
+		sid := strings.ToUpper(hive)
+		if strings.HasSuffix(sid, "_CLASSES") {
+			sid = strings.TrimSuffix(sid, "_CLASSES")
+			rest = sid + "_Classes" + rest[len(hive):]
+		} else {
+			rest = sid + rest[len(hive):]
+		}
+		if !strings.HasPrefix(sid, "S-1-") {
+			sid = ""
+		}
+		return `HKU\` + rest, sid
+	}
+	return p, ""
+}
+
+// addDerivedFields adds file_name, file_extension and directory from path, unless it is a registry path, and
+// process_name from process_path, or from path for process events. Fields already in the event are kept.
+func (n *PathNormalizer) addDerivedFields(msg map[string]interface{}) {
+	setDefault := func(field, value string) {
+		if _, ok := msg[field]; !ok && value != "" {
+			msg[field] = value
+		}
+	}
+
+	eventType, _ := msg["type"].(string)
+	path, _ := msg["path"].(string)
+	if path != "" && !isRegistryPath(path) && eventType != "ingress.event.regmod" {
+		directory, name := splitWindowsPath(path)
+		setDefault("file_name", name)
+		setDefault("directory", directory)
+		if i := strings.LastIndex(name, "."); i > 0 && i < len(name)-1 {
+			setDefault("file_extension", strings.ToLower(name[i+1:]))
+		}
+	}
+
+	if processPath, ok := msg["process_path"].(string); ok && processPath != "" {
+		_, name := splitWindowsPath(processPath)
+		setDefault("process_name", name)
+	} else if eventType == "ingress.event.procstart" || eventType == "ingress.event.procend" ||
+		eventType == "ingress.event.process" {
+		_, name := splitWindowsPath(path)
+		setDefault("process_name", name)
+	}
+}
+
+func isRegistryPath(p string) bool {
+	lower := strings.ToLower(p)
+	return strings.HasPrefix(lower, `\registry\`) || strings.HasPrefix(p, `HKLM\`) || strings.HasPrefix(p, `HKU\`)
+}
+
+// splitWindowsPath splits a path on its last separator, which may be a backslash or a forward slash. The directory
+// of a file in the root of a drive keeps its trailing separator, as in C:\.
+func splitWindowsPath(p string) (directory, name string) {
+	i := strings.LastIndexAny(p, `\/`)
+	if i < 0 {
+		return "", p
+	}
+	directory = p[:i]
+	if directory == "" || (len(directory) == 2 && directory[1] == ':') {
+		directory = p[:i+1]
+	}
+	return directory, p[i+1:]
+}
+
+func (n *PathNormalizer) Statistics() interface{} {
+	n.RLock()
+	learnedVolumes := 0
+	for _, volumes := range n.learnedVolumes {
+		learnedVolumes += len(volumes)
+	}
+	learnedUsers := len(n.learnedUsers)
+	n.RUnlock()
+
+	return PathNormalizationStatistics{
+		Evaluated:           atomic.LoadInt64(&n.evaluated),
+		DevicePaths:         atomic.LoadInt64(&n.devicePaths),
+		UnmappedDevicePaths: atomic.LoadInt64(&n.unmappedDevicePaths),
+		RegistryPaths:       atomic.LoadInt64(&n.registryPaths),
+		LearnedVolumes:      learnedVolumes,
+		LearnedUsers:        learnedUsers,
+	}
+}
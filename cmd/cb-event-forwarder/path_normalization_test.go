@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPathNormalizer(t *testing.T) {
+	n := NewPathNormalizer([]string{"path", "process_path", "parent_path"}, []string{"ingress.event.#"},
+		map[string]string{`\Device\HarddiskVolume3`: "d:"}, true, `C:\Windows`)
+
+	for _, test := range []struct {
+		desc     string
+		msg      map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			desc: "procstart learns the volume and the user",
+			msg: map[string]interface{}{"type": "ingress.event.procstart", "sensor_id": int32(7),
+				"path":         `\device\harddiskvolume2\windows\system32\svchost.exe`,
+				"process_path": `c:\windows\system32\svchost.exe`, "parent_path": `\SystemRoot\System32\smss.exe`,
+				"uid": "s-1-5-21-1004336348-1177238915-682003330-1001", "username": `CORP\jdoe`},
+			expected: map[string]interface{}{"type": "ingress.event.procstart", "sensor_id": int32(7),
+				"path":                 `C:\windows\system32\svchost.exe`,
+				"path_original":        `\device\harddiskvolume2\windows\system32\svchost.exe`,
+				"process_path":         `c:\windows\system32\svchost.exe`,
+				"parent_path":          `C:\Windows\System32\smss.exe`,
+				"parent_path_original": `\SystemRoot\System32\smss.exe`,
+				"uid":                  "s-1-5-21-1004336348-1177238915-682003330-1001", "username": `CORP\jdoe`,
+				"file_name": "svchost.exe", "file_extension": "exe", "directory": `C:\windows\system32`,
+				"process_name": "svchost.exe"},
+		},
+		{
+			desc: "filemod on the learned volume",
+			msg: map[string]interface{}{"type": "ingress.event.filemod", "sensor_id": int32(7),
+				"path":         `\device\harddiskvolume2\users\jdoe\appdata\local\temp\Stage2.PS1`,
+				"process_path": `c:\windows\system32\windowspowershell\v1.0\powershell.exe`},
+			expected: map[string]interface{}{"type": "ingress.event.filemod", "sensor_id": int32(7),
+				"path":          `C:\users\jdoe\appdata\local\temp\Stage2.PS1`,
+				"path_original": `\device\harddiskvolume2\users\jdoe\appdata\local\temp\Stage2.PS1`,
+				"process_path":  `c:\windows\system32\windowspowershell\v1.0\powershell.exe`,
+				"file_name":     "Stage2.PS1", "file_extension": "ps1", "directory": `C:\users\jdoe\appdata\local\temp`,
+				"process_name": "powershell.exe"},
+		},
+		{
+			desc: "volumes are learned per sensor; other volumes use the configured map",
+			msg: map[string]interface{}{"type": "ingress.event.moduleload", "sensor_id": int32(8),
+				"path": `\device\harddiskvolume2\x.dll`},
+			expected: map[string]interface{}{"type": "ingress.event.moduleload", "sensor_id": int32(8),
+				"path": `\device\harddiskvolume2\x.dll`, "file_name": "x.dll", "file_extension": "dll",
+				"directory": `\device\harddiskvolume2`},
+		},
+		{
+			desc: "configured volume, and a UNC path",
+			msg: map[string]interface{}{"type": "ingress.event.filemod", "sensor_id": int32(8),
+				"path": `\Device\HarddiskVolume3\data`, "process_path": `\Device\Mup\fs01\tools\copy.exe`},
+			expected: map[string]interface{}{"type": "ingress.event.filemod", "sensor_id": int32(8),
+				"path": `D:\data`, "path_original": `\Device\HarddiskVolume3\data`,
+				"process_path": `\\fs01\tools\copy.exe`, "process_path_original": `\Device\Mup\fs01\tools\copy.exe`,
+				"file_name": "data", "directory": `D:\`, "process_name": "copy.exe"},
+		},
+		{
+			desc: "registry key under a user hive",
+			msg: map[string]interface{}{"type": "ingress.event.regmod", "sensor_id": int32(7),
+				"path": `\registry\user\s-1-5-21-1004336348-1177238915-682003330-1001\software\microsoft\windows\currentversion\run\updater`},
+			expected: map[string]interface{}{"type": "ingress.event.regmod", "sensor_id": int32(7),
+				"path":              `HKU\S-1-5-21-1004336348-1177238915-682003330-1001\software\microsoft\windows\currentversion\run\updater`,
+				"path_original":     `\registry\user\s-1-5-21-1004336348-1177238915-682003330-1001\software\microsoft\windows\currentversion\run\updater`,
+				"registry_user_sid": "S-1-5-21-1004336348-1177238915-682003330-1001",
+				"registry_user":     `CORP\jdoe`},
+		},
+		{
+			desc: "registry keys under the classes hive of a service account, and the machine hive",
+			msg: map[string]interface{}{"type": "ingress.event.regmod",
+				"path": `\registry\user\S-1-5-18_CLASSES\clsid\{0}`, "parent_path": `\registry\machine\system`},
+			expected: map[string]interface{}{"type": "ingress.event.regmod",
+				"path": `HKU\S-1-5-18_Classes\clsid\{0}`, "path_original": `\registry\user\S-1-5-18_CLASSES\clsid\{0}`,
+				"parent_path": `HKLM\system`, "parent_path_original": `\registry\machine\system`,
+				"registry_user_sid": "S-1-5-18", "registry_user": `NT AUTHORITY\SYSTEM`},
+		},
+		{
+			desc: "derived fields already in the event are kept",
+			msg: map[string]interface{}{"type": "ingress.event.childproc", "path": `\??\C:\Tools\x`,
+				"process_name": "cmd.exe"},
+			expected: map[string]interface{}{"type": "ingress.event.childproc", "path": `C:\Tools\x`,
+				"path_original": `\??\C:\Tools\x`, "process_name": "cmd.exe", "file_name": "x",
+				"directory": `C:\Tools`},
+		},
+		{
+			desc:     "other event types are left alone",
+			msg:      map[string]interface{}{"type": "watchlist.hit.process", "path": `\device\harddiskvolume3\x`},
+			expected: map[string]interface{}{"type": "watchlist.hit.process", "path": `\device\harddiskvolume3\x`},
+		},
+	} {
+		n.Process(test.msg)
+		if diff := cmp.Diff(test.expected, test.msg); diff != "" {
+			t.Errorf("%s: event mismatch (-want +got):\n%s", test.desc, diff)
+		}
+	}
+
+	expected := PathNormalizationStatistics{Evaluated: 7, DevicePaths: 6, UnmappedDevicePaths: 1, RegistryPaths: 3,
+		LearnedVolumes: 1, LearnedUsers: 1}
+	if diff := cmp.Diff(expected, n.Statistics()); diff != "" {
+		t.Errorf("statistics mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// returned for lookups that are not started because every worker already has a query outstanding
+var errTooManyLookups = errors.New("too many report lookups in progress")
+
+type reportLookupResult struct {
+	report *ThreatReport
+	err    error
+}
+
+// reportLookup is a single in-flight query to the Cb Response Server. Workers that need the same
+// "<feed_id>|<report_id>" while the query is outstanding wait on done instead of issuing their own request.
+type reportLookup struct {
+	done   chan struct{}
+	result reportLookupResult
+}
+
+type PostprocessStatistics struct {
+	QueueDepth     int     `json:"queue_depth"`
+	QueueSize      int     `json:"queue_size"`
+	Workers        int     `json:"workers"`
+	Enriched       int64   `json:"enriched"`
+	Unenriched     int64   `json:"unenriched"`
+	CacheHits      int64   `json:"cache_hits"`
+	Coalesced      int64   `json:"coalesced"`
+	APIRequests    int64   `json:"api_requests"`
+	APIErrors      int64   `json:"api_errors"`
+	Timeouts       int64   `json:"timeouts"`
+	SkippedLookups int64   `json:"skipped_lookups"`
+	APILatencyLast float64 `json:"api_latency_last_ms"`
+	APILatencyAvg  float64 `json:"api_latency_avg_ms"`
+	APILatencyMax  float64 `json:"api_latency_max_ms"`
+}
+
+// PostprocessPool enriches feed hits and alerts with report details from the Cb Response REST API using a fixed
+// number of workers reading from a bounded queue. Submit blocks when the queue is full, which in turn slows
+// consumption from the message bus rather than piling up goroutines while the Cb server is slow. Lookups that time
+// out keep running in the background, but no more than one per worker: once that many are outstanding, events for
+// other reports are sent without report details until one of them finishes.
+//
+// With more than one worker, events are not necessarily output in the order they were received.
+type PostprocessPool struct {
+	workers int
+	timeout time.Duration
+	queue   chan map[string]interface{}
+	wg      sync.WaitGroup
+
+	// queries the Cb Response Server for a report; replaced in tests
+	fetchReport func(feedID int, reportID string) (*ThreatReport, error)
+	// hands the (possibly enriched) message on to the output; replaced in tests
+	output func(msg map[string]interface{}) error
+
+	inflightLock sync.Mutex
+	inflight     map[string]*reportLookup
+	// holds a token for each query to the Cb Response Server that has not returned yet
+	fetchSlots chan struct{}
+
+	enriched       int64
+	unenriched     int64
+	cacheHits      int64
+	coalesced      int64
+	apiRequests    int64
+	apiErrors      int64
+	timeouts       int64
+	skippedLookups int64
+	apiLatencyLast int64
+	apiLatencyMax  int64
+	apiLatencySum  int64
+}
+
+func NewPostprocessPool(workers, queueSize int, timeout time.Duration) *PostprocessPool {
+	return &PostprocessPool{
+		workers:     workers,
+		timeout:     timeout,
+		queue:       make(chan map[string]interface{}, queueSize),
+		fetchReport: getThreatReport,
+		output:      outputMessage,
+		inflight:    make(map[string]*reportLookup),
+		fetchSlots:  make(chan struct{}, workers),
+	}
+}
+
+func (p *PostprocessPool) Start() {
+	log.Infof("Starting %d feed post-processing workers (queue size %d, API timeout %s)",
+		p.workers, cap(p.queue), p.timeout)
+
+	p.wg.Add(p.workers)
+	for i := 0; i < p.workers; i++ {
+		go p.worker()
+	}
+}
+
+// Submit queues a message for post-processing, blocking while the queue is full.
+func (p *PostprocessPool) Submit(msg map[string]interface{}) {
+	p.queue <- msg
+}
+
+// Stop waits for all queued messages to be post-processed and output. No messages may be submitted after Stop
+// is called.
+func (p *PostprocessPool) Stop() {
+	close(p.queue)
+	p.wg.Wait()
+}
+
+func (p *PostprocessPool) worker() {
+	defer p.wg.Done()
+
+	for msg := range p.queue {
+		if err := p.output(p.postprocess(msg)); err != nil {
+			log.Errorf("Error outputting post-processed message: %s", err)
+		}
+	}
+}
+
+// postprocess adds report_title, report_score and report_link to feed hits and alerts. If the report cannot be
+// retrieved within the configured timeout the message is returned unenriched; the lookup keeps running in the
+// background so that the result is cached for later messages.
+func (p *PostprocessPool) postprocess(msg map[string]interface{}) map[string]interface{} {
+	feedID, reportID, ok := reportLookupIDs(msg)
+	if !ok {
+		return msg
+	}
+
+	key := reportCacheKey(feedID, reportID)
+	if report, ok := GetCachedReport(key); ok {
+		atomic.AddInt64(&p.cacheHits, 1)
+		atomic.AddInt64(&p.enriched, 1)
+		addReportDetails(msg, report.Title, report.Score, report.Link)
+		return msg
+	}
+
+	lookup := p.lookup(key, feedID, reportID)
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	select {
+	case <-lookup.done:
+		if lookup.result.err != nil {
+			log.Debugf("Could not retrieve report %s: %s", key, lookup.result.err)
+			atomic.AddInt64(&p.unenriched, 1)
+			return msg
+		}
+		report := lookup.result.report
+		log.Debugf("Report title = %s , Score = %d, link = %s", report.Title, report.Score, report.Link)
+		addReportDetails(msg, report.Title, report.Score, report.Link)
+		atomic.AddInt64(&p.enriched, 1)
+	case <-timer.C:
+		log.Debugf("Timed out after %s retrieving report %s; sending event without report details", p.timeout, key)
+		atomic.AddInt64(&p.timeouts, 1)
+		atomic.AddInt64(&p.unenriched, 1)
+	}
+
+	return msg
+}
+
+// lookup returns the in-flight query for key, starting one if none is outstanding. If too many queries are
+// outstanding already, the lookup returned has failed with errTooManyLookups.
+func (p *PostprocessPool) lookup(key string, feedID int, reportID string) *reportLookup {
+	p.inflightLock.Lock()
+	defer p.inflightLock.Unlock()
+
+	if l, ok := p.inflight[key]; ok {
+		atomic.AddInt64(&p.coalesced, 1)
+		return l
+	}
+
+	l := &reportLookup{done: make(chan struct{})}
+	select {
+	case p.fetchSlots <- struct{}{}:
+	default:
+		atomic.AddInt64(&p.skippedLookups, 1)
+		l.result = reportLookupResult{err: errTooManyLookups}
+		close(l.done)
+		return l
+	}
+	p.inflight[key] = l
+
+	go func() {
+		defer func() { <-p.fetchSlots }()
+
+		start := time.Now()
+		report, err := p.fetchReport(feedID, reportID)
+		p.recordLatency(time.Since(start))
+
+		atomic.AddInt64(&p.apiRequests, 1)
+		if err != nil {
+			atomic.AddInt64(&p.apiErrors, 1)
+		}
+
+		l.result = reportLookupResult{report: report, err: err}
+
+		p.inflightLock.Lock()
+		delete(p.inflight, key)
+		p.inflightLock.Unlock()
+
+		close(l.done)
+	}()
+
+	return l
+}
+
+func (p *PostprocessPool) recordLatency(latency time.Duration) {
+	atomic.StoreInt64(&p.apiLatencyLast, int64(latency))
+	atomic.AddInt64(&p.apiLatencySum, int64(latency))
+	for {
+		max := atomic.LoadInt64(&p.apiLatencyMax)
+		if int64(latency) <= max || atomic.CompareAndSwapInt64(&p.apiLatencyMax, max, int64(latency)) {
+			return
+		}
+	}
+}
+
+func (p *PostprocessPool) Statistics() interface{} {
+	toMillis := func(ns int64) float64 {
+		return float64(ns) / float64(time.Millisecond)
+	}
+
+	stats := PostprocessStatistics{
+		QueueDepth:     len(p.queue),
+		QueueSize:      cap(p.queue),
+		Workers:        p.workers,
+		Enriched:       atomic.LoadInt64(&p.enriched),
+		Unenriched:     atomic.LoadInt64(&p.unenriched),
+		CacheHits:      atomic.LoadInt64(&p.cacheHits),
+		Coalesced:      atomic.LoadInt64(&p.coalesced),
+		APIRequests:    atomic.LoadInt64(&p.apiRequests),
+		APIErrors:      atomic.LoadInt64(&p.apiErrors),
+		Timeouts:       atomic.LoadInt64(&p.timeouts),
+		SkippedLookups: atomic.LoadInt64(&p.skippedLookups),
+		APILatencyLast: toMillis(atomic.LoadInt64(&p.apiLatencyLast)),
+		APILatencyMax:  toMillis(atomic.LoadInt64(&p.apiLatencyMax)),
+	}
+	if stats.APIRequests > 0 {
+		stats.APILatencyAvg = toMillis(atomic.LoadInt64(&p.apiLatencySum)) / float64(stats.APIRequests)
+	}
+	return stats
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPostprocessPool(t *testing.T) {
+	for _, test := range []struct {
+		desc                string
+		messages            []map[string]interface{}
+		fetchDelay          time.Duration
+		fetchErr            error
+		expectedFetches     int
+		expectedEnriched    int64
+		expectedUnenriched  int64
+		expectedReportTitle interface{}
+	}{
+		{
+			desc: "Identical feed hits are coalesced into one API request",
+			messages: []map[string]interface{}{
+				{"type": "feed.ingress.hit.process", "feed_id": json.Number("7"), "report_id": "coalesce"},
+				{"type": "feed.ingress.hit.process", "feed_id": json.Number("7"), "report_id": "coalesce"},
+				{"type": "feed.ingress.hit.process", "feed_id": json.Number("7"), "report_id": "coalesce"},
+			},
+			fetchDelay:          50 * time.Millisecond,
+			expectedFetches:     1,
+			expectedEnriched:    3,
+			expectedReportTitle: "report coalesce",
+		},
+		{
+			desc: "Slow API sends the event unenriched",
+			messages: []map[string]interface{}{
+				{"type": "feed.ingress.hit.binary", "feed_id": json.Number("8"), "report_id": "slow"},
+			},
+			fetchDelay:         time.Second,
+			expectedFetches:    1,
+			expectedUnenriched: 1,
+		},
+		{
+			desc: "API error sends the event unenriched",
+			messages: []map[string]interface{}{
+				{"type": "feed.ingress.hit.binary", "feed_id": json.Number("9"), "report_id": "broken"},
+			},
+			fetchErr:           errors.New("Cb Response Server returned a 500 status code"),
+			expectedFetches:    1,
+			expectedUnenriched: 1,
+		},
+		{
+			desc: "Other event types are not looked up",
+			messages: []map[string]interface{}{
+				{"type": "ingress.event.process", "process_guid": "guid"},
+			},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			var lock sync.Mutex
+			var fetches int
+			var output []map[string]interface{}
+
+			p := NewPostprocessPool(len(test.messages), len(test.messages), 200*time.Millisecond)
+			p.fetchReport = func(feedID int, reportID string) (*ThreatReport, error) {
+				lock.Lock()
+				fetches++
+				lock.Unlock()
+				time.Sleep(test.fetchDelay)
+				if test.fetchErr != nil {
+					return nil, test.fetchErr
+				}
+				return &ThreatReport{FeedID: feedID, Title: "report " + reportID, Score: 50}, nil
+			}
+			p.output = func(msg map[string]interface{}) error {
+				lock.Lock()
+				output = append(output, msg)
+				lock.Unlock()
+				return nil
+			}
+
+			p.Start()
+			for _, msg := range test.messages {
+				p.Submit(msg)
+			}
+			p.Stop()
+
+			if len(output) != len(test.messages) {
+				t.Fatalf("expected %d messages to be output, got %d", len(test.messages), len(output))
+			}
+			lock.Lock()
+			if fetches != test.expectedFetches {
+				t.Errorf("expected %d API requests, got %d", test.expectedFetches, fetches)
+			}
+			lock.Unlock()
+
+			stats := p.Statistics().(PostprocessStatistics)
+			if stats.Enriched != test.expectedEnriched || stats.Unenriched != test.expectedUnenriched {
+				t.Errorf("expected %d enriched and %d unenriched, got %d and %d", test.expectedEnriched,
+					test.expectedUnenriched, stats.Enriched, stats.Unenriched)
+			}
+
+			for _, msg := range output {
+				if diff := cmp.Diff(test.expectedReportTitle, msg["report_title"]); diff != "" {
+					t.Errorf("report_title mismatch (-want +got):\n%s", diff)
+				}
+			}
+		})
+	}
+}
+
+func TestPostprocessPoolLimitsOutstandingLookups(t *testing.T) {
+	release := make(chan struct{})
+	var lock sync.Mutex
+	var fetches int
+
+	p := NewPostprocessPool(2, 10, 20*time.Millisecond)
+	p.fetchReport = func(feedID int, reportID string) (*ThreatReport, error) {
+		lock.Lock()
+		fetches++
+		lock.Unlock()
+		<-release
+		return &ThreatReport{FeedID: feedID, Title: "report " + reportID}, nil
+	}
+	p.output = func(msg map[string]interface{}) error { return nil }
+
+	// every lookup times out; only the first two reach the server, one per worker
+	p.Start()
+	for _, reportID := range []string{"a", "b", "c", "d", "e"} {
+		p.Submit(map[string]interface{}{"type": "feed.ingress.hit.process", "feed_id": json.Number("10"),
+			"report_id": reportID})
+	}
+	p.Stop()
+	close(release)
+
+	lock.Lock()
+	defer lock.Unlock()
+	stats := p.Statistics().(PostprocessStatistics)
+	if fetches != 2 || stats.SkippedLookups != 3 || stats.Unenriched != 5 {
+		t.Errorf("expected 2 API requests and 3 skipped lookups, got %d and %+v", fetches, stats)
+	}
+}
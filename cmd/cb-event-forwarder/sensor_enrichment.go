@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/carbonblack/cb-event-forwarder/internal/deepcopy"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type SensorEnrichmentStatistics struct {
+	Sensors         int       `json:"sensors"`
+	LastRefresh     time.Time `json:"last_refresh"`
+	LastError       string    `json:"last_error"`
+	LastErrorTime   time.Time `json:"last_error_time"`
+	RefreshFailures int64     `json:"refresh_failures"`
+	EnrichedEvents  int64     `json:"enriched_events"`
+	UnknownSensors  int64     `json:"unknown_sensors"`
+}
+
+// SensorEnricher adds details about the sensor that reported an event, taken from a snapshot of /api/v1/sensor
+// that is refreshed in the background. If a refresh fails, the previous snapshot keeps being used.
+type SensorEnricher struct {
+	fields   []string
+	interval time.Duration
+
+	// retrieves a route from the Cb Response REST API; replaced in tests
+	get func(route string) ([]byte, error)
+
+	sync.RWMutex
+	sensors       map[int]map[string]interface{}
+	lastRefresh   time.Time
+	lastError     string
+	lastErrorTime time.Time
+
+	refreshFailures int64
+	enrichedEvents  int64
+	unknownSensors  int64
+}
+
+func NewSensorEnricher(fields []string, interval time.Duration) *SensorEnricher {
+	return &SensorEnricher{
+		fields:   fields,
+		interval: interval,
+		get:      GetCb,
+		sensors:  make(map[int]map[string]interface{}),
+	}
+}
+
+func (e *SensorEnricher) Name() string {
+	return "sensor_enrichment"
+}
+
+// Start loads the initial snapshot and refreshes it every interval. A failure to load the initial snapshot is
+// logged but not fatal; events are sent without sensor details until a refresh succeeds.
+func (e *SensorEnricher) Start() {
+	startPeriodicRefresh("sensor details", e.interval, e.Refresh, e.LastRefresh)
+}
+
+func decodeAPIResponse(body []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// Refresh replaces the snapshot with the current sensor list. The sensor_group field is resolved from the sensor's
+// group_id using /api/group.
+func (e *SensorEnricher) Refresh() error {
+	err := e.refresh()
+	if err != nil {
+		atomic.AddInt64(&e.refreshFailures, 1)
+		e.Lock()
+		e.lastError = err.Error()
+		e.lastErrorTime = time.Now()
+		e.Unlock()
+	}
+	return err
+}
+
+func (e *SensorEnricher) refresh() error {
+	body, err := e.get("api/v1/sensor")
+	if err != nil {
+		return err
+	}
+	var sensorList []map[string]interface{}
+	if err := decodeAPIResponse(body, &sensorList); err != nil {
+		return err
+	}
+
+	body, err = e.get("api/group")
+	if err != nil {
+		return err
+	}
+	var groupList []map[string]interface{}
+	if err := decodeAPIResponse(body, &groupList); err != nil {
+		return err
+	}
+
+	groups := make(map[int]interface{}, len(groupList))
+	for _, group := range groupList {
+		if id, ok := intFromEvent(group["id"]); ok {
+			groups[id] = group["name"]
+		}
+	}
+
+	sensors := make(map[int]map[string]interface{}, len(sensorList))
+	for _, sensor := range sensorList {
+		id, ok := intFromEvent(sensor["id"])
+		if !ok {
+			continue
+		}
+		if groupID, ok := intFromEvent(sensor["group_id"]); ok {
+			if name, ok := groups[groupID]; ok {
+				sensor["sensor_group"] = name
+			}
+		}
+		sensors[id] = sensor
+	}
+
+	e.Lock()
+	e.sensors = sensors
+	e.lastRefresh = time.Now()
+	e.Unlock()
+
+	log.Debugf("Loaded details for %d sensors", len(sensors))
+	return nil
+}
+
+func (e *SensorEnricher) LastRefresh() time.Time {
+	e.RLock()
+	defer e.RUnlock()
+	return e.lastRefresh
+}
+
+// Process copies the configured sensor fields into the event. Fields already present in the event are not
+// overwritten.
+func (e *SensorEnricher) Process(msg map[string]interface{}) bool {
+	sensorID, ok := intFromEvent(msg["sensor_id"])
+	if !ok {
+		return true
+	}
+
+	e.RLock()
+	sensor, ok := e.sensors[sensorID]
+	e.RUnlock()
+
+	if !ok {
+		atomic.AddInt64(&e.unknownSensors, 1)
+		return true
+	}
+
+	for _, field := range e.fields {
+		if _, present := msg[field]; present {
+			continue
+		}
+		if val, ok := sensor[field]; ok && val != nil {
+			// later stages change events in place, so nested values must not be shared with the snapshot
+			msg[field] = deepcopy.Iface(val)
+		}
+	}
+	atomic.AddInt64(&e.enrichedEvents, 1)
+
+	return true
+}
+
+func (e *SensorEnricher) Statistics() interface{} {
+	e.RLock()
+	defer e.RUnlock()
+
+	return SensorEnrichmentStatistics{
+		Sensors:         len(e.sensors),
+		LastRefresh:     e.lastRefresh,
+		LastError:       e.lastError,
+		LastErrorTime:   e.lastErrorTime,
+		RefreshFailures: atomic.LoadInt64(&e.refreshFailures),
+		EnrichedEvents:  atomic.LoadInt64(&e.enrichedEvents),
+		UnknownSensors:  atomic.LoadInt64(&e.unknownSensors),
+	}
+}
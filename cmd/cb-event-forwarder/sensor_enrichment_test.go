@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const testSensorList = `[
+	{"id": 1, "group_id": 2, "computer_name": "WIN-A", "os_environment_display_string": "Windows 10 Enterprise",
+	 "build_version_string": "6.2.2.10003", "network_adapters": "10.0.0.5,000c29aabbcc|"},
+	{"id": 7, "group_id": 9, "computer_name": "WIN-B", "os_environment_display_string": "Windows Server 2016",
+	 "build_version_string": "6.2.2.10003", "network_adapters": "10.0.0.7,000c29ddeeff|"}
+]`
+
+const testGroupList = `[{"id": 2, "name": "Workstations"}, {"id": 3, "name": "Servers"}]`
+
+func newTestSensorEnricher(fields []string) *SensorEnricher {
+	e := NewSensorEnricher(fields, time.Minute)
+	e.get = func(route string) ([]byte, error) {
+		switch route {
+		case "api/v1/sensor":
+			return []byte(testSensorList), nil
+		case "api/group":
+			return []byte(testGroupList), nil
+		}
+		return nil, errors.New("unexpected route " + route)
+	}
+	return e
+}
+
+func TestSensorEnricherProcess(t *testing.T) {
+	for _, test := range []struct {
+		desc     string
+		fields   []string
+		msg      map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			desc:   "JSON event",
+			fields: []string{"sensor_group", "os_environment_display_string", "network_adapters"},
+			msg:    map[string]interface{}{"type": "alert.watchlist.hit.query.process", "sensor_id": json.Number("1")},
+			expected: map[string]interface{}{
+				"type":                          "alert.watchlist.hit.query.process",
+				"sensor_id":                     json.Number("1"),
+				"sensor_group":                  "Workstations",
+				"os_environment_display_string": "Windows 10 Enterprise",
+				"network_adapters":              "10.0.0.5,000c29aabbcc|",
+			},
+		},
+		{
+			desc:   "Protobuf event",
+			fields: []string{"build_version_string"},
+			msg:    map[string]interface{}{"type": "ingress.event.procstart", "sensor_id": int32(1)},
+			expected: map[string]interface{}{
+				"type":                 "ingress.event.procstart",
+				"sensor_id":            int32(1),
+				"build_version_string": "6.2.2.10003",
+			},
+		},
+		{
+			desc:   "Sensor in a group that no longer exists",
+			fields: []string{"sensor_group", "computer_name"},
+			msg:    map[string]interface{}{"sensor_id": json.Number("7")},
+			expected: map[string]interface{}{
+				"sensor_id":     json.Number("7"),
+				"computer_name": "WIN-B",
+			},
+		},
+		{
+			desc:   "Existing fields are not overwritten",
+			fields: []string{"computer_name"},
+			msg:    map[string]interface{}{"sensor_id": json.Number("1"), "computer_name": "from-event"},
+			expected: map[string]interface{}{
+				"sensor_id":     json.Number("1"),
+				"computer_name": "from-event",
+			},
+		},
+		{
+			desc:     "Unknown sensor",
+			fields:   []string{"sensor_group"},
+			msg:      map[string]interface{}{"sensor_id": json.Number("42")},
+			expected: map[string]interface{}{"sensor_id": json.Number("42")},
+		},
+		{
+			desc:     "Event without a sensor",
+			fields:   []string{"sensor_group"},
+			msg:      map[string]interface{}{"type": "audit.log.banning"},
+			expected: map[string]interface{}{"type": "audit.log.banning"},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			e := newTestSensorEnricher(test.fields)
+			if err := e.Refresh(); err != nil {
+				t.Fatal(err)
+			}
+
+			if !e.Process(test.msg) {
+				t.Errorf("expected event to be kept")
+			}
+			if diff := cmp.Diff(test.expected, test.msg); diff != "" {
+				t.Errorf("event mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSensorEnricherKeepsSnapshotWhenAPIIsDown(t *testing.T) {
+	e := newTestSensorEnricher([]string{"sensor_group"})
+	if err := e.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	e.get = func(route string) ([]byte, error) {
+		return nil, &CbAPIError{StatusCode: 503}
+	}
+	if err := e.Refresh(); err == nil {
+		t.Fatal("expected refresh to fail")
+	}
+
+	msg := map[string]interface{}{"sensor_id": json.Number("1")}
+	e.Process(msg)
+	if msg["sensor_group"] != "Workstations" {
+		t.Errorf("expected sensor_group from the previous snapshot, got %v", msg["sensor_group"])
+	}
+
+	stats := e.Statistics().(SensorEnrichmentStatistics)
+	if stats.RefreshFailures != 1 || stats.Sensors != 2 {
+		t.Errorf("unexpected statistics: %+v", stats)
+	}
+}
+
+func TestSensorEnricherKeepsItsOwnCopy(t *testing.T) {
+	e := NewSensorEnricher([]string{"network_adapters"}, time.Minute)
+	e.get = func(route string) ([]byte, error) {
+		if route == "api/v1/sensor" {
+			return []byte(`[{"id": 1, "group_id": 2, "network_adapters": [{"ip": "10.0.0.5"}]}]`), nil
+		}
+		return []byte(testGroupList), nil
+	}
+	if err := e.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a later stage masking a nested field of the first event
+	first := map[string]interface{}{"sensor_id": json.Number("1")}
+	e.Process(first)
+	first["network_adapters"].([]interface{})[0].(map[string]interface{})["ip"] = "redacted"
+
+	second := map[string]interface{}{"sensor_id": json.Number("1")}
+	e.Process(second)
+	expected := []interface{}{map[string]interface{}{"ip": "10.0.0.5"}}
+	if diff := cmp.Diff(expected, second["network_adapters"]); diff != "" {
+		t.Errorf("network_adapters mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errShutdown = errors.New("shutdown requested")
+
+var (
+	// closed when SIGTERM/SIGINT is received; AMQP consumer loops stop consuming once this is closed
+	shutdownRequested = make(chan struct{})
+
+	// tracks the AMQP consumer loops started from main()
+	consumerLoops sync.WaitGroup
+
+	// closed by the output handler once it has flushed and closed its destination
+	outputDone = make(chan struct{})
+
+	// guards results against sends after it has been closed during shutdown
+	resultsLock   sync.RWMutex
+	resultsClosed bool
+
+	// when shutdown gives up and exits, as Unix nanoseconds; zero until shutdown begins
+	shutdownDeadline int64
+)
+
+// time kept back from the shutdown deadline for the output to finish closing
+const shutdownDeadlineMargin = time.Second
+
+// shutdownTimeRemaining returns how long an output may still spend flushing before shutdown gives up, or the full
+// shutdown timeout if no shutdown is in progress.
+func shutdownTimeRemaining() time.Duration {
+	deadline := atomic.LoadInt64(&shutdownDeadline)
+	if deadline == 0 {
+		return config.ShutdownTimeout
+	}
+	remaining := time.Until(time.Unix(0, deadline)) - shutdownDeadlineMargin
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// publishResult hands an encoded event to the output handler. Once shutdown has closed the results channel,
+// events are rejected with an error rather than sent on a closed channel.
+func publishResult(msg string) error {
+	resultsLock.RLock()
+	defer resultsLock.RUnlock()
+
+	if resultsClosed {
+		return errShutdown
+	}
+	results <- msg
+	return nil
+}
+
+func closeResults() {
+	resultsLock.Lock()
+	defer resultsLock.Unlock()
+
+	if !resultsClosed {
+		resultsClosed = true
+		close(results)
+	}
+}
+
+// shutdown performs an orderly shutdown: stop consuming from the message bus, let the workers and any outstanding
+// feed post-processing finish, then close the results channel so the output drains, flushes and closes. If this
+// takes longer than the configured shutdown_timeout, the process exits with a non-zero status.
+func shutdown() {
+	log.Infof("Shutting down; waiting up to %s for in-flight events to be output", config.ShutdownTimeout)
+
+	atomic.StoreInt64(&shutdownDeadline, time.Now().Add(config.ShutdownTimeout).UnixNano())
+	deadline := time.AfterFunc(config.ShutdownTimeout, func() {
+		log.Errorf("Shutdown did not complete within %s; exiting with events still in flight", config.ShutdownTimeout)
+		os.Exit(1)
+	})
+	defer deadline.Stop()
+
+	close(shutdownRequested)
+
+	// the consumer loops stop reading output errors once they begin draining; keep logging them here so the
+	// output never blocks while events are still being flushed
+	go func() {
+		for outputError := range outputErrors {
+			log.Errorf("ERROR during output: %s", outputError.Error())
+		}
+	}()
+
+	consumerLoops.Wait()
+	log.Info("All AMQP consumers have stopped")
+
+	if auditLogInput != nil {
+		auditLogInput.Stop()
+		log.Info("Audit log tailing has stopped")
+	}
+	for name, input := range fileInputs {
+		input.Stop()
+		log.Infof("File input %s has stopped", name)
+	}
+
+	if postprocessor != nil {
+		postprocessor.Stop()
+		log.Info("Feed post-processing has finished")
+	}
+
+	if binaryExporter != nil {
+		binaryExporter.Stop()
+		log.Info("Binary exports have finished")
+	}
+
+	if deduplicator != nil {
+		deduplicator.Stop()
+		log.Info("Pending dedup rollups have been output")
+	}
+
+	if netconnAggregator != nil {
+		netconnAggregator.Stop()
+		log.Info("Open netconn flows have been summarized")
+	}
+
+	closeResults()
+	<-outputDone
+	log.Info("Output has been flushed and closed")
+}
@@ -0,0 +1,949 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/carbonblack/cb-event-forwarder/internal/deepcopy"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// type of the events emitted for rule matches
+const sigmaDetectionType = "detection.sigma"
+
+// sigmaLevels orders the Sigma rule levels, for min_level
+var sigmaLevels = map[string]int{"informational": 0, "low": 1, "medium": 2, "high": 3, "critical": 4}
+
+// sigmaCategoryEventTypes maps the Sigma logsource categories that have an equivalent in the raw sensor events to
+// their event types. Rules for other categories are not loaded.
+var sigmaCategoryEventTypes = map[string][]string{
+	"process_creation":   {"ingress.event.procstart"},
+	"network_connection": {"ingress.event.netconn"},
+	"registry_event":     {"ingress.event.regmod"},
+	"registry_add":       {"ingress.event.regmod"},
+	"registry_set":       {"ingress.event.regmod"},
+	"registry_delete":    {"ingress.event.regmod"},
+	"file_event":         {"ingress.event.filemod"},
+	"file_change":        {"ingress.event.filemod"},
+	"file_delete":        {"ingress.event.filemod"},
+	"image_load":         {"ingress.event.moduleload"},
+}
+
+// event types matched by rules without a logsource category, which are written for any raw sensor event but not for
+// events such as detections, summaries or feed hits
+var sigmaUncategorizedEventTypes = []string{"ingress.event.#"}
+
+// sigmaFieldMappings maps Sigma field names, which follow Sysmon, to the fields written by WriteProcessMessage,
+// WriteNetconn2Message, WriteRegmodMessage, WriteFilemodMessage and the process header of every raw event. Fields
+// that are not mapped are looked up by their own name, so rules may also use the forwarder's field names.
+var sigmaFieldMappings = map[string]map[string]string{
+	"": {
+		"Image":        "process_path",
+		"ProcessId":    "pid",
+		"ProcessGuid":  "process_guid",
+		"md5":          "md5",
+		"sha256":       "sha256",
+		"Computer":     "computer_name",
+		"ComputerName": "computer_name",
+	},
+	"process_creation": {
+		"Image":             "path",
+		"CommandLine":       "command_line",
+		"ParentImage":       "parent_path",
+		"ParentProcessId":   "parent_pid",
+		"ParentProcessGuid": "parent_process_guid",
+		"User":              "username",
+	},
+	"network_connection": {
+		"DestinationIp":       "remote_ip",
+		"DestinationPort":     "remote_port",
+		"DestinationHostname": "domain",
+		"SourceIp":            "local_ip",
+		"SourcePort":          "local_port",
+		"Initiated":           "direction",
+		"Protocol":            "protocol",
+	},
+	"registry": {
+		"TargetObject": "path",
+		"EventType":    "action",
+	},
+	"file": {
+		"TargetFilename": "path",
+	},
+	"image_load": {
+		"ImageLoaded": "path",
+	},
+}
+
+// sigmaValueMappings maps Sigma values to the values of the forwarder's fields, by forwarder field name.
+var sigmaValueMappings = map[string]map[string]string{
+	"direction": {"true": "outbound", "false": "inbound"},
+	"protocol":  {"tcp": "6", "udp": "17", "icmp": "1"},
+	"action": {"setvalue": "writeval", "createkey": "createkey", "deletekey": "delkey",
+		"deletevalue": "delval"},
+}
+
+// sigmaFieldMapping returns the mappings that apply to rules of a logsource category.
+func sigmaFieldMapping(category string) map[string]string {
+	switch {
+	case strings.HasPrefix(category, "registry_"):
+		category = "registry"
+	case strings.HasPrefix(category, "file_"):
+		category = "file"
+	}
+	return sigmaFieldMappings[category]
+}
+
+// SigmaRule is a Sigma detection rule, compiled for the forwarder's event fields.
+type SigmaRule struct {
+	ID          string
+	Title       string
+	Level       string
+	Status      string
+	Description string
+	Tags        []string
+	File        string
+
+	eventTypes []string
+	condition  sigmaCondition
+	matches    int64
+}
+
+type sigmaRuleDocument struct {
+	Title       string                 `yaml:"title"`
+	ID          string                 `yaml:"id"`
+	Status      string                 `yaml:"status"`
+	Description string                 `yaml:"description"`
+	Level       string                 `yaml:"level"`
+	Tags        []string               `yaml:"tags"`
+	Logsource   map[string]string      `yaml:"logsource"`
+	Detection   map[string]interface{} `yaml:"detection"`
+}
+
+// parseSigmaRules compiles the rules in a YAML file. A file may hold several rule documents; documents without a
+// detection section are skipped.
+func parseSigmaRules(data []byte, file string) ([]*SigmaRule, error) {
+	var rules []*SigmaRule
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc sigmaRuleDocument
+		err := decoder.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if doc.Detection == nil {
+			continue
+		}
+
+		rule, err := compileSigmaRule(doc, file)
+		if err != nil {
+			name := doc.Title
+			if name == "" {
+				name = file
+			}
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func compileSigmaRule(doc sigmaRuleDocument, file string) (*SigmaRule, error) {
+	rule := &SigmaRule{
+		ID:          doc.ID,
+		Title:       doc.Title,
+		Level:       strings.ToLower(doc.Level),
+		Status:      doc.Status,
+		Description: doc.Description,
+		Tags:        doc.Tags,
+		File:        file,
+	}
+	if rule.ID == "" {
+		rule.ID = rule.Title
+	}
+
+	category := doc.Logsource["category"]
+	if category != "" {
+		eventTypes, ok := sigmaCategoryEventTypes[category]
+		if !ok {
+			return nil, fmt.Errorf("unsupported logsource category %s", category)
+		}
+		rule.eventTypes = eventTypes
+	} else if doc.Logsource["service"] != "" {
+		return nil, fmt.Errorf("unsupported logsource service %s", doc.Logsource["service"])
+	} else {
+		rule.eventTypes = sigmaUncategorizedEventTypes
+	}
+
+	selections := make(map[string]sigmaCondition)
+	var conditions []string
+	for name, value := range doc.Detection {
+		switch name {
+		case "condition":
+			switch c := value.(type) {
+			case string:
+				conditions = []string{c}
+			case []interface{}:
+				for _, element := range c {
+					conditions = append(conditions, fmt.Sprint(element))
+				}
+			default:
+				return nil, errors.New("condition must be a string or a list")
+			}
+		case "timeframe":
+			return nil, errors.New("timeframe is not supported")
+		default:
+			selection, err := compileSigmaSelection(value, category)
+			if err != nil {
+				return nil, fmt.Errorf("selection %s: %s", name, err)
+			}
+			selections[name] = selection
+		}
+	}
+	if len(conditions) == 0 {
+		return nil, errors.New("detection has no condition")
+	}
+
+	var alternatives sigmaOr
+	for _, condition := range conditions {
+		c, err := parseSigmaCondition(condition, selections)
+		if err != nil {
+			return nil, fmt.Errorf("condition %q: %s", condition, err)
+		}
+		alternatives = append(alternatives, c)
+	}
+	if len(alternatives) == 1 {
+		rule.condition = alternatives[0]
+	} else {
+		rule.condition = alternatives
+	}
+	return rule, nil
+}
+
+// sigmaCondition is a compiled selection or condition.
+type sigmaCondition interface {
+	match(msg map[string]interface{}) bool
+}
+
+type sigmaAnd []sigmaCondition
+
+func (c sigmaAnd) match(msg map[string]interface{}) bool {
+	for _, element := range c {
+		if !element.match(msg) {
+			return false
+		}
+	}
+	return true
+}
+
+type sigmaOr []sigmaCondition
+
+func (c sigmaOr) match(msg map[string]interface{}) bool {
+	for _, element := range c {
+		if element.match(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+type sigmaNot struct {
+	condition sigmaCondition
+}
+
+func (c sigmaNot) match(msg map[string]interface{}) bool {
+	return !c.condition.match(msg)
+}
+
+// sigmaFieldCondition matches one field against a list of values: any of them, or all of them with |all.
+type sigmaFieldCondition struct {
+	field  string
+	all    bool
+	values []func(string) bool
+	// set by |exists and by a null value: whether the field must be present
+	exists *bool
+}
+
+func (c *sigmaFieldCondition) match(msg map[string]interface{}) bool {
+	v, ok := getFieldPath(msg, c.field)
+	strs := sigmaStrings(v)
+	if ok && len(strs) == 0 {
+		ok = false
+	}
+	if c.exists != nil {
+		return ok == *c.exists
+	}
+	if !ok {
+		return false
+	}
+
+	for _, value := range c.values {
+		matched := false
+		for _, s := range strs {
+			if value(s) {
+				matched = true
+				break
+			}
+		}
+		if matched && !c.all {
+			return true
+		}
+		if !matched && c.all {
+			return false
+		}
+	}
+	return c.all
+}
+
+// sigmaKeywords matches events with any string value matching one of the keywords.
+type sigmaKeywords []func(string) bool
+
+func (c sigmaKeywords) match(msg map[string]interface{}) bool {
+	for _, v := range msg {
+		for _, s := range sigmaStrings(v) {
+			for _, keyword := range c {
+				if keyword(s) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// sigmaStrings returns a field value as the strings rule values are matched against; a list matches if any of its
+// elements does.
+func sigmaStrings(v interface{}) []string {
+	switch value := v.(type) {
+	case nil:
+		return nil
+	case string:
+		if value == "" {
+			return nil
+		}
+		return []string{value}
+	case []interface{}:
+		var strs []string
+		for _, element := range value {
+			strs = append(strs, sigmaStrings(element)...)
+		}
+		return strs
+	case []string:
+		return value
+	case map[string]interface{}:
+		return nil
+	}
+	return []string{fmt.Sprint(v)}
+}
+
+func compileSigmaSelection(value interface{}, category string) (sigmaCondition, error) {
+	switch selection := value.(type) {
+	case map[interface{}]interface{}:
+		keys := make([]string, 0, len(selection))
+		for k := range selection {
+			keys = append(keys, fmt.Sprint(k))
+		}
+		sort.Strings(keys)
+
+		var and sigmaAnd
+		for _, key := range keys {
+			c, err := compileSigmaField(key, selection[key], category)
+			if err != nil {
+				return nil, err
+			}
+			and = append(and, c)
+		}
+		return and, nil
+	case []interface{}:
+		if len(selection) == 0 {
+			return nil, errors.New("empty selection")
+		}
+		if _, ok := selection[0].(map[interface{}]interface{}); ok {
+			var or sigmaOr
+			for _, element := range selection {
+				c, err := compileSigmaSelection(element, category)
+				if err != nil {
+					return nil, err
+				}
+				or = append(or, c)
+			}
+			return or, nil
+		}
+
+		var keywords sigmaKeywords
+		for _, element := range selection {
+			matchers, err := compileSigmaValue(element, []string{"contains"}, nil)
+			if err != nil {
+				return nil, err
+			}
+			keywords = append(keywords, matchers...)
+		}
+		return keywords, nil
+	case string, int, float64:
+		return compileSigmaSelection([]interface{}{selection}, category)
+	}
+	return nil, fmt.Errorf("unsupported selection %v", value)
+}
+
+func compileSigmaField(key string, value interface{}, category string) (sigmaCondition, error) {
+	parts := strings.Split(key, "|")
+	field, modifiers := parts[0], parts[1:]
+
+	if mapped, ok := sigmaFieldMapping(category)[field]; ok {
+		field = mapped
+	} else if mapped, ok := sigmaFieldMappings[""][field]; ok {
+		field = mapped
+	}
+	c := &sigmaFieldCondition{field: field}
+
+	var valueModifiers []string
+	for _, modifier := range modifiers {
+		switch modifier {
+		case "all":
+			c.all = true
+		case "exists":
+			exists, ok := value.(bool)
+			if !ok {
+				return nil, fmt.Errorf("%s: exists takes true or false", key)
+			}
+			c.exists = &exists
+			return c, nil
+		default:
+			valueModifiers = append(valueModifiers, modifier)
+		}
+	}
+
+	values, ok := value.([]interface{})
+	if !ok {
+		values = []interface{}{value}
+	}
+	for _, v := range values {
+		if v == nil {
+			exists := false
+			c.exists = &exists
+			return c, nil
+		}
+		matchers, err := compileSigmaValue(v, valueModifiers, sigmaValueMappings[field])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err)
+		}
+		c.values = append(c.values, matchers...)
+	}
+	return c, nil
+}
+
+// compileSigmaValue returns the matchers for one value of a field, applying its modifiers. Some modifiers, such as
+// windash and base64offset, expand one value into several alternatives.
+func compileSigmaValue(value interface{}, modifiers []string, valueMapping map[string]string) ([]func(string) bool,
+	error) {
+	s := fmt.Sprint(value)
+	if mapped, ok := valueMapping[strings.ToLower(s)]; ok {
+		s = mapped
+	}
+
+	mode := "equal"
+	cased := false
+	alternatives := []string{s}
+	for _, modifier := range modifiers {
+		switch modifier {
+		case "contains", "startswith", "endswith":
+			mode = modifier
+		case "cased":
+			cased = true
+		case "windash":
+			var expanded []string
+			for _, a := range alternatives {
+				expanded = append(expanded, a)
+				if strings.Contains(a, "-") {
+					expanded = append(expanded, strings.Replace(a, "-", "/", -1))
+				}
+			}
+			alternatives = expanded
+		case "base64":
+			for i, a := range alternatives {
+				alternatives[i] = base64.StdEncoding.EncodeToString([]byte(a))
+			}
+			cased = true
+		case "base64offset":
+			var expanded []string
+			for _, a := range alternatives {
+				expanded = append(expanded, base64Offsets(a)...)
+			}
+			alternatives = expanded
+			cased = true
+		case "re":
+			re, err := regexp.Compile(s)
+			if err != nil {
+				return nil, err
+			}
+			return []func(string) bool{re.MatchString}, nil
+		case "cidr":
+			network, err := parseCIDROrIP(s)
+			if err != nil {
+				return nil, err
+			}
+			return []func(string) bool{func(v string) bool {
+				ip := net.ParseIP(v)
+				return ip != nil && network.Contains(ip)
+			}}, nil
+		case "gt", "gte", "lt", "lte":
+			return []func(string) bool{compileSigmaNumeric(modifier, s)}, nil
+		default:
+			return nil, fmt.Errorf("unsupported modifier %s", modifier)
+		}
+	}
+
+	matchers := make([]func(string) bool, 0, len(alternatives))
+	for _, a := range alternatives {
+		matcher, err := compileSigmaString(a, mode, cased)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, matcher)
+	}
+	return matchers, nil
+}
+
+func compileSigmaNumeric(modifier, s string) func(string) bool {
+	limit, err := strconv.ParseFloat(s, 64)
+	return func(v string) bool {
+		f, parseErr := strconv.ParseFloat(v, 64)
+		if err != nil || parseErr != nil {
+			return false
+		}
+		switch modifier {
+		case "gt":
+			return f > limit
+		case "gte":
+			return f >= limit
+		case "lt":
+			return f < limit
+		}
+		return f <= limit
+	}
+}
+
+// base64Offsets returns the three base64 encodings of s as it would appear at each offset within a longer encoded
+// string, without the characters that depend on the surrounding text.
+func base64Offsets(s string) []string {
+	start := []int{0, 2, 3}
+	var offsets []string
+	for i := 0; i < 3; i++ {
+		encoded := base64.StdEncoding.EncodeToString([]byte(strings.Repeat(" ", i) + s))
+		end := len(encoded)
+		switch (len(s) + i) % 3 {
+		case 1:
+			end -= 3
+		case 2:
+			end -= 2
+		}
+		if start[i] < end {
+			offsets = append(offsets, encoded[start[i]:end])
+		}
+	}
+	return offsets
+}
+
+// compileSigmaString matches a Sigma string value: * and ? are wildcards unless escaped with a backslash, and
+// matching ignores case unless cased is set.
+func compileSigmaString(s, mode string, cased bool) (func(string) bool, error) {
+	var literal strings.Builder
+	var pattern strings.Builder
+	wildcards := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && (s[i+1] == '*' || s[i+1] == '?' || s[i+1] == '\\'):
+			i++
+			literal.WriteByte(s[i])
+			pattern.WriteString(regexp.QuoteMeta(string(s[i])))
+		case c == '*':
+			wildcards = true
+			pattern.WriteString(".*")
+		case c == '?':
+			wildcards = true
+			pattern.WriteString(".")
+		default:
+			literal.WriteByte(c)
+			pattern.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	if wildcards {
+		expr := pattern.String()
+		switch mode {
+		case "contains":
+			expr = ".*" + expr + ".*"
+		case "startswith":
+			expr = expr + ".*"
+		case "endswith":
+			expr = ".*" + expr
+		}
+		expr = "(?s)^" + expr + "$"
+		if !cased {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+
+	want := literal.String()
+	normalize := func(v string) string { return v }
+	if !cased {
+		want = strings.ToLower(want)
+		normalize = strings.ToLower
+	}
+	switch mode {
+	case "contains":
+		return func(v string) bool { return strings.Contains(normalize(v), want) }, nil
+	case "startswith":
+		return func(v string) bool { return strings.HasPrefix(normalize(v), want) }, nil
+	case "endswith":
+		return func(v string) bool { return strings.HasSuffix(normalize(v), want) }, nil
+	}
+	return func(v string) bool { return normalize(v) == want }, nil
+}
+
+// parseSigmaCondition parses a Sigma condition: selection names combined with and, or, not and parentheses, and
+// "1 of" or "all of" a selection name pattern or "them". Aggregations after a | are not supported.
+func parseSigmaCondition(condition string, selections map[string]sigmaCondition) (sigmaCondition, error) {
+	if strings.Contains(condition, "|") {
+		return nil, errors.New("aggregations are not supported")
+	}
+	p := &sigmaConditionParser{
+		tokens:     strings.Fields(strings.NewReplacer("(", " ( ", ")", " ) ").Replace(condition)),
+		selections: selections,
+	}
+	c, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return c, nil
+}
+
+type sigmaConditionParser struct {
+	tokens     []string
+	pos        int
+	selections map[string]sigmaCondition
+}
+
+func (p *sigmaConditionParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *sigmaConditionParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *sigmaConditionParser) parseOr() (sigmaCondition, error) {
+	c, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	or := sigmaOr{c}
+	for strings.ToLower(p.peek()) == "or" {
+		p.next()
+		c, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		or = append(or, c)
+	}
+	if len(or) == 1 {
+		return or[0], nil
+	}
+	return or, nil
+}
+
+func (p *sigmaConditionParser) parseAnd() (sigmaCondition, error) {
+	c, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	and := sigmaAnd{c}
+	for strings.ToLower(p.peek()) == "and" {
+		p.next()
+		c, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, c)
+	}
+	if len(and) == 1 {
+		return and[0], nil
+	}
+	return and, nil
+}
+
+func (p *sigmaConditionParser) parseNot() (sigmaCondition, error) {
+	if strings.ToLower(p.peek()) == "not" {
+		p.next()
+		c, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return sigmaNot{c}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *sigmaConditionParser) parsePrimary() (sigmaCondition, error) {
+	token := p.next()
+	switch lower := strings.ToLower(token); {
+	case token == "":
+		return nil, errors.New("unexpected end of condition")
+	case token == "(":
+		c, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, errors.New("missing )")
+		}
+		return c, nil
+	case (lower == "1" || lower == "any" || lower == "all") && strings.ToLower(p.peek()) == "of":
+		p.next()
+		pattern := p.next()
+		if pattern == "" {
+			return nil, errors.New("missing selection after of")
+		}
+		var names []string
+		for name := range p.selections {
+			if matched, _ := path.Match(pattern, name); matched || pattern == "them" {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("no selections match %s", pattern)
+		}
+		sort.Strings(names)
+		conditions := make([]sigmaCondition, len(names))
+		for i, name := range names {
+			conditions[i] = p.selections[name]
+		}
+		if lower == "all" {
+			return sigmaAnd(conditions), nil
+		}
+		return sigmaOr(conditions), nil
+	}
+
+	c, ok := p.selections[token]
+	if !ok {
+		return nil, fmt.Errorf("unknown selection %s", token)
+	}
+	return c, nil
+}
+
+type SigmaRuleStatistics struct {
+	Title   string `json:"title"`
+	Level   string `json:"level"`
+	Matches int64  `json:"matches"`
+}
+
+type SigmaStatistics struct {
+	RulesLoaded  int                            `json:"rules_loaded"`
+	RulesSkipped int                            `json:"rules_skipped"`
+	LastLoaded   time.Time                      `json:"last_loaded"`
+	Evaluated    int64                          `json:"evaluated"`
+	Detections   int64                          `json:"detections"`
+	Rules        map[string]SigmaRuleStatistics `json:"rules"`
+}
+
+// SigmaEngine evaluates Sigma rules against every event and outputs a detection.sigma event for each match.
+type SigmaEngine struct {
+	dir       string
+	minLevel  string
+	tagEvents bool
+
+	// outputs a detection event; replaced in tests
+	output func(msg map[string]interface{}) error
+
+	sync.RWMutex
+	rules        []*SigmaRule
+	rulesSkipped int
+	lastLoaded   time.Time
+
+	evaluated  int64
+	detections int64
+}
+
+func NewSigmaEngine(dir, minLevel string, tagEvents bool) *SigmaEngine {
+	return &SigmaEngine{dir: dir, minLevel: minLevel, tagEvents: tagEvents, output: outputMessage}
+}
+
+// Load compiles the rules in every .yml and .yaml file under the rules directory and replaces the current rules.
+// Rules that cannot be compiled, or are below the minimum level, are skipped with a warning.
+func (e *SigmaEngine) Load() error {
+	var rules []*SigmaRule
+	skipped := 0
+
+	err := filepath.Walk(e.dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || (filepath.Ext(file) != ".yml" && filepath.Ext(file) != ".yaml") {
+			return nil
+		}
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		fileRules, err := parseSigmaRules(data, file)
+		if err != nil {
+			log.Warnf("Skipping Sigma rule file %s: %s", file, err)
+			skipped++
+			return nil
+		}
+		for _, rule := range fileRules {
+			if sigmaLevels[rule.Level] < sigmaLevels[e.minLevel] {
+				skipped++
+				continue
+			}
+			rules = append(rules, rule)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	e.Lock()
+	e.rules, e.rulesSkipped, e.lastLoaded = rules, skipped, time.Now()
+	e.Unlock()
+	log.Infof("Loaded %d Sigma rules from %s; skipped %d", len(rules), e.dir, skipped)
+	return nil
+}
+
+// Start reloads the rules on SIGHUP until shutdown is requested.
+func (e *SigmaEngine) Start() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+				log.Info("Received SIGHUP, reloading Sigma rules.")
+				if err := e.Load(); err != nil {
+					log.Errorf("Could not reload Sigma rules; keeping the previous rules: %s", err)
+				}
+			case <-shutdownRequested:
+				return
+			}
+		}
+	}()
+}
+
+func (e *SigmaEngine) Name() string {
+	return "sigma"
+}
+
+func (e *SigmaEngine) Process(msg map[string]interface{}) bool {
+	if msg["type"] == sigmaDetectionType {
+		return true
+	}
+	atomic.AddInt64(&e.evaluated, 1)
+
+	var matched []*SigmaRule
+	e.RLock()
+	for _, rule := range e.rules {
+		if matchAnyRoutingKey(rule.eventTypes, msg) && rule.condition.match(msg) {
+			matched = append(matched, rule)
+		}
+	}
+	e.RUnlock()
+	if len(matched) == 0 {
+		return true
+	}
+
+	source := deepcopy.Iface(msg).(map[string]interface{})
+	for _, rule := range matched {
+		atomic.AddInt64(&rule.matches, 1)
+		atomic.AddInt64(&e.detections, 1)
+		if err := e.output(sigmaDetection(rule, source)); err != nil {
+			log.Errorf("Could not output the detection for Sigma rule %s: %s", rule.Title, err)
+		}
+	}
+
+	if e.tagEvents {
+		tags, _ := msg["sigma_matches"].([]interface{})
+		for _, rule := range matched {
+			tags = append(tags, map[string]interface{}{"id": rule.ID, "title": rule.Title, "level": rule.Level})
+		}
+		msg["sigma_matches"] = tags
+	}
+	return true
+}
+
+func sigmaDetection(rule *SigmaRule, source map[string]interface{}) map[string]interface{} {
+	detection := map[string]interface{}{
+		"type":             sigmaDetectionType,
+		"rule_id":          rule.ID,
+		"rule_title":       rule.Title,
+		"rule_level":       rule.Level,
+		"rule_status":      rule.Status,
+		"rule_description": rule.Description,
+		"rule_tags":        rule.Tags,
+		"event_type":       source["type"],
+		"detection_time":   time.Now().Unix(),
+		"event":            source,
+	}
+	for _, field := range []string{"timestamp", "sensor_id", "computer_name", "process_guid"} {
+		if v, ok := source[field]; ok {
+			detection[field] = v
+		}
+	}
+	return detection
+}
+
+func (e *SigmaEngine) Statistics() interface{} {
+	e.RLock()
+	defer e.RUnlock()
+
+	stats := SigmaStatistics{
+		RulesLoaded:  len(e.rules),
+		RulesSkipped: e.rulesSkipped,
+		LastLoaded:   e.lastLoaded,
+		Evaluated:    atomic.LoadInt64(&e.evaluated),
+		Detections:   atomic.LoadInt64(&e.detections),
+		Rules:        make(map[string]SigmaRuleStatistics, len(e.rules)),
+	}
+	for _, rule := range e.rules {
+		stats.Rules[rule.ID] = SigmaRuleStatistics{Title: rule.Title, Level: rule.Level,
+			Matches: atomic.LoadInt64(&rule.matches)}
+	}
+	return stats
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const testSigmaRules = `title: Encoded PowerShell
+id: 1a2b3c4d-0001
+level: high
+logsource:
+    category: process_creation
+    product: windows
+detection:
+    selection_image:
+        Image|endswith: '\powershell.exe'
+    selection_flags:
+        CommandLine|contains:
+            - ' -enc '
+            - ' -EncodedCommand '
+    filter:
+        ParentImage|startswith: 'C:\Program Files\Management\'
+    condition: all of selection_* and not filter
+---
+title: Outbound SMB
+id: 1a2b3c4d-0002
+level: medium
+logsource:
+    category: network_connection
+detection:
+    selection:
+        Initiated: 'true'
+        Protocol: tcp
+        DestinationPort:
+            - 139
+            - 445
+    filter_internal:
+        DestinationIp|cidr:
+            - 10.0.0.0/8
+            - 192.168.0.0/16
+    condition: selection and not filter_internal
+---
+title: Run key persistence
+id: 1a2b3c4d-0003
+level: medium
+logsource:
+    category: registry_event
+detection:
+    selection:
+        EventType: SetValue
+        TargetObject|contains|all:
+            - '\software\'
+            - '\currentversion\run'
+    condition: selection
+---
+title: Dropped script
+id: 1a2b3c4d-0004
+level: low
+logsource:
+    category: file_event
+detection:
+    selection:
+        TargetFilename|re: '(?i)\\temp\\[^\\]+\.(ps1|vbs)$'
+    keywords:
+        - mimikatz
+    condition: 1 of them
+`
+
+func TestSigmaRules(t *testing.T) {
+	rules, err := parseSigmaRules([]byte(testSigmaRules), "test.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		desc     string
+		msg      map[string]interface{}
+		expected []string
+	}{
+		{
+			desc: "encoded powershell",
+			msg: map[string]interface{}{"type": "ingress.event.procstart",
+				"path":         `C:\Windows\System32\WindowsPowerShell\v1.0\PowerShell.exe`,
+				"command_line": `powershell.exe -NoP -enc SQBFAFgA`, "parent_path": `C:\Windows\explorer.exe`},
+			expected: []string{"1a2b3c4d-0001"},
+		},
+		{
+			desc: "encoded powershell from the management agent",
+			msg: map[string]interface{}{"type": "ingress.event.procstart",
+				"path":         `C:\Windows\System32\WindowsPowerShell\v1.0\powershell.exe`,
+				"command_line": `powershell.exe -enc SQBFAFgA`, "parent_path": `c:\program files\management\agent.exe`},
+		},
+		{
+			desc: "powershell without encoded commands",
+			msg: map[string]interface{}{"type": "ingress.event.procstart",
+				"path": `C:\Windows\System32\WindowsPowerShell\v1.0\powershell.exe`, "command_line": `powershell.exe`},
+		},
+		{
+			desc: "process rule on a different event type",
+			msg: map[string]interface{}{"type": "ingress.event.procend",
+				"path":         `C:\Windows\System32\WindowsPowerShell\v1.0\powershell.exe`,
+				"command_line": `powershell.exe -enc SQBFAFgA`},
+		},
+		{
+			desc: "outbound smb",
+			msg: map[string]interface{}{"type": "ingress.event.netconn", "direction": "outbound",
+				"protocol": int32(6), "remote_ip": "203.0.113.7", "remote_port": uint16(445)},
+			expected: []string{"1a2b3c4d-0002"},
+		},
+		{
+			desc: "internal smb",
+			msg: map[string]interface{}{"type": "ingress.event.netconn", "direction": "outbound",
+				"protocol": int32(6), "remote_ip": "10.1.1.1", "remote_port": uint16(445)},
+		},
+		{
+			desc: "inbound smb",
+			msg: map[string]interface{}{"type": "ingress.event.netconn", "direction": "inbound",
+				"protocol": int32(6), "remote_ip": "203.0.113.7", "remote_port": uint16(445)},
+		},
+		{
+			desc: "run key",
+			msg: map[string]interface{}{"type": "ingress.event.regmod", "action": "writeval",
+				"path": `\registry\machine\SOFTWARE\Microsoft\Windows\CurrentVersion\Run\updater`},
+			expected: []string{"1a2b3c4d-0003"},
+		},
+		{
+			desc: "run key deleted",
+			msg: map[string]interface{}{"type": "ingress.event.regmod", "action": "delval",
+				"path": `\registry\machine\SOFTWARE\Microsoft\Windows\CurrentVersion\Run\updater`},
+		},
+		{
+			desc: "script in temp",
+			msg: map[string]interface{}{"type": "ingress.event.filemod",
+				"path": `C:\Users\jdoe\AppData\Local\Temp\stage2.PS1`},
+			expected: []string{"1a2b3c4d-0004"},
+		},
+		{
+			desc: "keyword in any field",
+			msg: map[string]interface{}{"type": "ingress.event.filemod", "path": `C:\tools\readme.txt`,
+				"process_path": `C:\tools\Mimikatz.exe`},
+			expected: []string{"1a2b3c4d-0004"},
+		},
+	} {
+		var matched []string
+		for _, rule := range rules {
+			if matchAnyRoutingKey(rule.eventTypes, test.msg) && rule.condition.match(test.msg) {
+				matched = append(matched, rule.ID)
+			}
+		}
+		if diff := cmp.Diff(test.expected, matched); diff != "" {
+			t.Errorf("%s: matched rules mismatch (-want +got):\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestSigmaRuleWithoutCategory(t *testing.T) {
+	rules, err := parseSigmaRules([]byte(`title: Honeypot activity
+id: 1a2b3c4d-0101
+logsource:
+    product: windows
+detection:
+    selection:
+        ComputerName: WIN-HONEYPOT
+    condition: selection
+`), "test.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		eventType string
+		expected  bool
+	}{
+		{"ingress.event.procstart", true},
+		{"ingress.event.netconn", true},
+		{"detection.sigma", false},
+		{"netconn.summary", false},
+		{"watchlist.hit.process", false},
+	} {
+		msg := map[string]interface{}{"type": test.eventType, "computer_name": "WIN-HONEYPOT"}
+		matched := matchAnyRoutingKey(rules[0].eventTypes, msg) && rules[0].condition.match(msg)
+		if matched != test.expected {
+			t.Errorf("%s: expected match to be %t", test.eventType, test.expected)
+		}
+	}
+}
+
+func TestSigmaValueModifiers(t *testing.T) {
+	for _, test := range []struct {
+		value     string
+		modifiers []string
+		input     string
+		expected  bool
+	}{
+		{`C:\Windows\\*\cmd.exe`, nil, `c:\windows\system32\CMD.EXE`, true},
+		{`C:\Windows\\*\cmd.exe`, nil, `c:\windows\system32\cmd.exe.bak`, false},
+		{`cmd?exe`, []string{"contains"}, `run cmd.exe now`, true},
+		{`\*literal`, []string{"startswith"}, `*literal star`, true},
+		{`\*literal`, []string{"startswith"}, `a literal star`, false},
+		{`Admin`, []string{"cased"}, `admin`, false},
+		{` -nop `, []string{"windash", "contains"}, `powershell /nop -c`, true},
+		{`Invoke-Mimikatz`, []string{"base64"}, `SW52b2tlLU1pbWlrYXR6`, true},
+		{`http://`, []string{"base64offset", "contains"}, `aWV4IChodHRwOi8v`, true},
+		{`1024`, []string{"gt"}, `49152`, true},
+		{`1024`, []string{"lte"}, `49152`, false},
+		{`fd00::/8`, []string{"cidr"}, `fd12::1`, true},
+	} {
+		matchers, err := compileSigmaValue(test.value, test.modifiers, nil)
+		if err != nil {
+			t.Errorf("%s|%v: %s", test.value, test.modifiers, err)
+			continue
+		}
+		got := false
+		for _, m := range matchers {
+			got = got || m(test.input)
+		}
+		if got != test.expected {
+			t.Errorf("%s|%v matching %q: got %t, expected %t", test.value, test.modifiers, test.input, got,
+				test.expected)
+		}
+	}
+}
+
+func TestSigmaRuleErrors(t *testing.T) {
+	for _, rule := range []string{
+		"title: x\nlogsource: {category: dns_query}\ndetection: {selection: {query: x}, condition: selection}\n",
+		"title: x\nlogsource: {service: security}\ndetection: {selection: {EventID: 4625}, condition: selection}\n",
+		"title: x\ndetection: {selection: {a: x}, condition: selection | count() > 5}\n",
+		"title: x\ndetection: {selection: {a: x}, condition: selection and missing}\n",
+		"title: x\ndetection: {selection: {a|frobnicate: x}, condition: selection}\n",
+		"title: x\ndetection: {selection: {a: x}, condition: (selection}\n",
+		"title: x\ndetection: {selection: {a: x}}\n",
+	} {
+		if _, err := parseSigmaRules([]byte(rule), "test.yml"); err == nil {
+			t.Errorf("expected an error for %s", rule)
+		}
+	}
+}
+
+func TestSigmaEngine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sigma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, "windows"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string]string{
+		"windows/rules.yml": testSigmaRules,
+		"broken.yaml":       "title: broken\ndetection: {selection: {a: x}, condition: nope}\n",
+		"README.md":         "not a rule",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var detections []map[string]interface{}
+	e := NewSigmaEngine(dir, "medium", true)
+	e.output = func(msg map[string]interface{}) error {
+		detections = append(detections, msg)
+		return nil
+	}
+	if err := e.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := map[string]interface{}{"type": "ingress.event.netconn", "sensor_id": int32(12),
+		"process_guid": "00000012-0000-0a5c-01d2-7a1b2c3d4e5f", "direction": "outbound", "protocol": int32(6),
+		"remote_ip": "203.0.113.7", "remote_port": uint16(139)}
+	if !e.Process(msg) {
+		t.Error("events with detections should still be output")
+	}
+	e.Process(map[string]interface{}{"type": "ingress.event.filemod", "path": `C:\Temp\x.ps1`})
+
+	if len(detections) != 1 {
+		t.Fatalf("expected one detection, got %v", detections)
+	}
+	detection := detections[0]
+	delete(detection, "detection_time")
+	expected := map[string]interface{}{
+		"type":             sigmaDetectionType,
+		"rule_id":          "1a2b3c4d-0002",
+		"rule_title":       "Outbound SMB",
+		"rule_level":       "medium",
+		"rule_status":      "",
+		"rule_description": "",
+		"rule_tags":        []string(nil),
+		"event_type":       "ingress.event.netconn",
+		"sensor_id":        int32(12),
+		"process_guid":     "00000012-0000-0a5c-01d2-7a1b2c3d4e5f",
+		"event": map[string]interface{}{"type": "ingress.event.netconn", "sensor_id": int32(12),
+			"process_guid": "00000012-0000-0a5c-01d2-7a1b2c3d4e5f", "direction": "outbound",
+			"protocol": int32(6), "remote_ip": "203.0.113.7", "remote_port": uint16(139)},
+	}
+	if diff := cmp.Diff(expected, detection); diff != "" {
+		t.Errorf("detection mismatch (-want +got):\n%s", diff)
+	}
+
+	expectedTags := []interface{}{map[string]interface{}{"id": "1a2b3c4d-0002", "title": "Outbound SMB",
+		"level": "medium"}}
+	if diff := cmp.Diff(expectedTags, msg["sigma_matches"]); diff != "" {
+		t.Errorf("tags mismatch (-want +got):\n%s", diff)
+	}
+
+	stats := e.Statistics().(SigmaStatistics)
+	// the low level rule is below min_level and the broken file is skipped
+	if stats.RulesLoaded != 3 || stats.RulesSkipped != 2 || stats.Evaluated != 2 || stats.Detections != 1 ||
+		stats.Rules["1a2b3c4d-0002"].Matches != 1 {
+		t.Errorf("unexpected statistics %+v", stats)
+	}
+}
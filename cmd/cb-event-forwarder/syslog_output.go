@@ -90,6 +90,17 @@ func (o *SyslogOutput) Statistics() interface{} {
 	}
 }
 
+func (o *SyslogOutput) Connected() bool {
+	o.RLock()
+	defer o.RUnlock()
+
+	return o.connected
+}
+
+func (o *SyslogOutput) Backlog() int {
+	return 0
+}
+
 func (o *SyslogOutput) markConnected() {
 	o.connectTime = time.Now()
 	log.Infof("Connected to %s at %s.", o.hostnamePort, o.connectTime)
@@ -115,6 +126,17 @@ func (o *SyslogOutput) closeAndScheduleReconnection() {
 	log.Infof("Lost connection to %s. Will try to reconnect at %s.", o.hostnamePort, o.reconnectTime)
 }
 
+func (o *SyslogOutput) close() {
+	o.Lock()
+	defer o.Unlock()
+
+	if o.connected {
+		log.Infof("Closing connection to %s", o.hostnamePort)
+		o.outputSocket.Close()
+		o.connected = false
+	}
+}
+
 func (o *SyslogOutput) output(m string) error {
 	if !o.connected {
 		// drop this event on the floor...
@@ -126,12 +148,14 @@ func (o *SyslogOutput) output(m string) error {
 	if err != nil {
 		o.closeAndScheduleReconnection()
 		atomic.AddInt64(&o.droppedEventCount, 1)
+	} else {
+		recordOutput()
 	}
 
 	return err
 }
 
-func (o *SyslogOutput) Go(messages <-chan string, errorChan chan<- error) error {
+func (o *SyslogOutput) Go(messages <-chan string, errorChan chan<- error, done chan<- struct{}) error {
 	if o.outputSocket == nil {
 		return errors.New("Output socket not open")
 	}
@@ -143,11 +167,16 @@ func (o *SyslogOutput) Go(messages <-chan string, errorChan chan<- error) error
 		hup := make(chan os.Signal, 1)
 		signal.Notify(hup, syscall.SIGHUP)
 
+		defer close(done)
 		defer signal.Stop(hup)
 
 		for {
 			select {
-			case message := <-messages:
+			case message, ok := <-messages:
+				if !ok {
+					o.close()
+					return
+				}
 				if err := o.output(message); err != nil {
 					errorChan <- err
 				}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/carbonblack/cb-event-forwarder/internal/deepcopy"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+var transformActions = map[string]bool{
+	"rename":  true,
+	"copy":    true,
+	"drop":    true,
+	"add":     true,
+	"convert": true,
+	"flatten": true,
+}
+
+var transformTypes = map[string]bool{"string": true, "int": true, "float": true, "bool": true}
+
+// TransformField is one field a transform step acts on. Arg is the new name for rename and copy, the value for add
+// and the type for convert; drop and flatten take no argument.
+type TransformField struct {
+	Field string
+	Arg   string
+}
+
+// TransformStep is one [transform:<n>] section: a single action applied to the events whose type matches one of
+// EventTypes, or to every event if it is empty.
+type TransformStep struct {
+	Name       string
+	Action     string
+	EventTypes []string
+	Fields     []TransformField
+	// joins the keys of flattened fields; defaults to "."
+	Separator string
+
+	applied int64
+	errors  int64
+}
+
+type TransformStepStatistics struct {
+	Action  string `json:"action"`
+	Applied int64  `json:"applied"`
+	Errors  int64  `json:"errors"`
+}
+
+// Transformer applies the transform steps, in order, to every event just before it is encoded.
+type Transformer struct {
+	steps []*TransformStep
+}
+
+func NewTransformer(steps []*TransformStep) *Transformer {
+	return &Transformer{steps: steps}
+}
+
+func (t *Transformer) Name() string {
+	return "transform"
+}
+
+func (t *Transformer) Process(msg map[string]interface{}) bool {
+	for _, step := range t.steps {
+		if matchAnyRoutingKey(step.EventTypes, msg) {
+			step.apply(msg)
+		}
+	}
+	return true
+}
+
+func (t *Transformer) Statistics() interface{} {
+	stats := make(map[string]TransformStepStatistics, len(t.steps))
+	for _, step := range t.steps {
+		stats[step.Name] = TransformStepStatistics{
+			Action:  step.Action,
+			Applied: atomic.LoadInt64(&step.applied),
+			Errors:  atomic.LoadInt64(&step.errors),
+		}
+	}
+	return stats
+}
+
+func (s *TransformStep) apply(msg map[string]interface{}) {
+	atomic.AddInt64(&s.applied, 1)
+
+	if s.Action == "flatten" && len(s.Fields) == 0 {
+		keys := make([]string, 0, len(msg))
+		for k := range msg {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s.flatten(msg, k)
+		}
+		return
+	}
+
+	for _, f := range s.Fields {
+		switch s.Action {
+		case "rename":
+			if v, ok := getFieldPath(msg, f.Field); ok {
+				deleteFieldPath(msg, f.Field)
+				s.set(msg, f.Arg, v)
+			}
+		case "copy":
+			if v, ok := getFieldPath(msg, f.Field); ok {
+				s.set(msg, f.Arg, deepcopy.Iface(v))
+			}
+		case "drop":
+			deleteFieldPath(msg, f.Field)
+		case "add":
+			s.set(msg, f.Field, f.Arg)
+		case "convert":
+			if v, ok := getFieldPath(msg, f.Field); ok {
+				converted, err := convertField(v, f.Arg)
+				if err != nil {
+					atomic.AddInt64(&s.errors, 1)
+					continue
+				}
+				s.set(msg, f.Field, converted)
+			}
+		case "flatten":
+			s.flatten(msg, f.Field)
+		}
+	}
+}
+
+func (s *TransformStep) set(msg map[string]interface{}, field string, v interface{}) {
+	if !setFieldPath(msg, field, v) {
+		atomic.AddInt64(&s.errors, 1)
+	}
+}
+
+// flatten replaces a nested object or array with top-level keys joining the path to each value, such as
+// docs.0.md5.
+func (s *TransformStep) flatten(msg map[string]interface{}, field string) {
+	v, ok := getFieldPath(msg, field)
+	if !ok {
+		return
+	}
+	switch v.(type) {
+	case map[string]interface{}, []interface{}, []map[string]interface{}:
+	default:
+		return
+	}
+
+	separator := s.Separator
+	if separator == "" {
+		separator = "."
+	}
+	deleteFieldPath(msg, field)
+	flattenInto(msg, field, v, separator)
+}
+
+func flattenInto(msg map[string]interface{}, prefix string, v interface{}, separator string) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, child := range value {
+			flattenInto(msg, prefix+separator+k, child, separator)
+		}
+	case []interface{}:
+		for i, child := range value {
+			flattenInto(msg, prefix+separator+strconv.Itoa(i), child, separator)
+		}
+	case []map[string]interface{}:
+		for i, child := range value {
+			flattenInto(msg, prefix+separator+strconv.Itoa(i), child, separator)
+		}
+	default:
+		msg[prefix] = v
+	}
+}
+
+func convertField(v interface{}, toType string) (interface{}, error) {
+	switch toType {
+	case "string":
+		switch value := v.(type) {
+		case string:
+			return value, nil
+		case json.Number:
+			return value.String(), nil
+		case map[string]interface{}, []interface{}, []map[string]interface{}:
+			b, err := json.Marshal(value)
+			return string(b), err
+		}
+		return fmt.Sprint(v), nil
+	case "int":
+		if b, ok := v.(bool); ok {
+			if b {
+				return 1, nil
+			}
+			return 0, nil
+		}
+		if s, ok := v.(string); ok {
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				return int(f), nil
+			}
+		}
+		if n, ok := v.(json.Number); ok {
+			if f, err := n.Float64(); err == nil {
+				return int(f), nil
+			}
+		}
+		if i, ok := intFromEvent(v); ok {
+			return i, nil
+		}
+	case "float":
+		switch value := v.(type) {
+		case json.Number:
+			return value.Float64()
+		case string:
+			return strconv.ParseFloat(value, 64)
+		case float32:
+			return float64(value), nil
+		case float64:
+			return value, nil
+		}
+		if i, ok := intFromEvent(v); ok {
+			return float64(i), nil
+		}
+	case "bool":
+		switch value := v.(type) {
+		case bool:
+			return value, nil
+		case string:
+			return strconv.ParseBool(value)
+		}
+		if i, ok := intFromEvent(v); ok {
+			return i != 0, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot convert %v to %s", v, toType)
+}
+
+// A field path names a top-level key or, with dots, a value nested in objects and arrays, such as
+// docs.0.highlights. A top-level key that itself contains dots is matched before looking inside nested values.
+
+func getFieldPath(msg map[string]interface{}, path string) (interface{}, bool) {
+	if v, ok := msg[path]; ok {
+		return v, true
+	}
+
+	var current interface{} = msg
+	for _, part := range strings.Split(path, ".") {
+		next, ok := fieldPathChild(current, part)
+		if !ok {
+			return nil, false
+		}
+		current = next
+	}
+	return current, true
+}
+
+func fieldPathChild(v interface{}, part string) (interface{}, bool) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		child, ok := value[part]
+		return child, ok
+	case []interface{}:
+		i, err := strconv.Atoi(part)
+		if err != nil || i < 0 || i >= len(value) {
+			return nil, false
+		}
+		return value[i], true
+	case []map[string]interface{}:
+		i, err := strconv.Atoi(part)
+		if err != nil || i < 0 || i >= len(value) {
+			return nil, false
+		}
+		return value[i], true
+	}
+	return nil, false
+}
+
+func deleteFieldPath(msg map[string]interface{}, path string) {
+	if _, ok := msg[path]; ok {
+		delete(msg, path)
+		return
+	}
+
+	i := strings.LastIndex(path, ".")
+	if i < 0 {
+		return
+	}
+	parent, ok := getFieldPath(msg, path[:i])
+	if !ok {
+		return
+	}
+	if m, ok := parent.(map[string]interface{}); ok {
+		delete(m, path[i+1:])
+	}
+}
+
+// setFieldPath sets the value at path, creating objects for missing parts of the path. It returns false if the path
+// runs through a value that is not an object.
+func setFieldPath(msg map[string]interface{}, path string, v interface{}) bool {
+	if _, ok := msg[path]; ok || !strings.Contains(path, ".") {
+		msg[path] = v
+		return true
+	}
+
+	parts := strings.Split(path, ".")
+	var current interface{} = msg
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := fieldPathChild(current, part)
+		if !ok {
+			m, isMap := current.(map[string]interface{})
+			if !isMap {
+				return false
+			}
+			child = make(map[string]interface{})
+			m[part] = child
+		}
+		current = child
+	}
+
+	m, ok := current.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	m[parts[len(parts)-1]] = v
+	return true
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func testTransformEvent() map[string]interface{} {
+	return map[string]interface{}{
+		"type":         "watchlist.hit.process",
+		"process_name": "cmd.exe",
+		"sensor_id":    json.Number("12"),
+		"docs": []interface{}{
+			map[string]interface{}{"md5": "A1", "highlights": []interface{}{"PREPREPREcmd.exePOSTPOSTPOST"}},
+		},
+		"process": map[string]interface{}{"pid": json.Number("2140"), "user": "SYSTEM"},
+	}
+}
+
+func TestTransformer(t *testing.T) {
+	for _, test := range []struct {
+		desc     string
+		steps    []*TransformStep
+		msg      map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			desc: "Rename, drop nested, add and copy in order",
+			steps: []*TransformStep{
+				{Action: "rename", Fields: []TransformField{{"process_name", "process.name"}}},
+				{Action: "drop", Fields: []TransformField{{"docs.0.highlights", ""}}},
+				{Action: "add", Fields: []TransformField{{"environment", "production"}, {"observer.dc", "us-east-1"}}},
+				{Action: "copy", Fields: []TransformField{{"process", "host_process"}}},
+			},
+			msg: testTransformEvent(),
+			expected: map[string]interface{}{
+				"type":      "watchlist.hit.process",
+				"sensor_id": json.Number("12"),
+				"docs":      []interface{}{map[string]interface{}{"md5": "A1"}},
+				"process": map[string]interface{}{"pid": json.Number("2140"), "user": "SYSTEM",
+					"name": "cmd.exe"},
+				"host_process": map[string]interface{}{"pid": json.Number("2140"), "user": "SYSTEM",
+					"name": "cmd.exe"},
+				"environment": "production",
+				"observer":    map[string]interface{}{"dc": "us-east-1"},
+			},
+		},
+		{
+			desc: "Flatten everything",
+			steps: []*TransformStep{
+				{Action: "flatten"},
+			},
+			msg: testTransformEvent(),
+			expected: map[string]interface{}{
+				"type":                "watchlist.hit.process",
+				"process_name":        "cmd.exe",
+				"sensor_id":           json.Number("12"),
+				"docs.0.md5":          "A1",
+				"docs.0.highlights.0": "PREPREPREcmd.exePOSTPOSTPOST",
+				"process.pid":         json.Number("2140"),
+				"process.user":        "SYSTEM",
+			},
+		},
+		{
+			desc: "Flatten one field with a separator",
+			steps: []*TransformStep{
+				{Action: "flatten", Fields: []TransformField{{"process", ""}}, Separator: "_"},
+			},
+			msg: map[string]interface{}{
+				"type":    "ingress.event.procstart",
+				"process": map[string]interface{}{"pid": json.Number("2140")},
+				"docs":    []interface{}{"x"},
+			},
+			expected: map[string]interface{}{
+				"type":        "ingress.event.procstart",
+				"process_pid": json.Number("2140"),
+				"docs":        []interface{}{"x"},
+			},
+		},
+		{
+			desc: "Convert types",
+			steps: []*TransformStep{
+				{Action: "convert", Fields: []TransformField{
+					{"sensor_id", "string"},
+					{"process.pid", "int"},
+					{"score", "float"},
+					{"enabled", "bool"},
+					{"process", "string"},
+					{"not_a_number", "int"},
+				}},
+			},
+			msg: map[string]interface{}{
+				"sensor_id":    json.Number("12"),
+				"process":      map[string]interface{}{"pid": "2140"},
+				"score":        json.Number("75"),
+				"enabled":      "true",
+				"not_a_number": "n/a",
+			},
+			expected: map[string]interface{}{
+				"sensor_id":    "12",
+				"process":      `{"pid":2140}`,
+				"score":        float64(75),
+				"enabled":      true,
+				"not_a_number": "n/a",
+			},
+		},
+		{
+			desc: "Steps are scoped by routing key pattern",
+			steps: []*TransformStep{
+				{Action: "add", EventTypes: []string{"feed.#"}, Fields: []TransformField{{"feed", "yes"}}},
+				{Action: "add", EventTypes: []string{"watchlist.*"}, Fields: []TransformField{{"one_word", "yes"}}},
+				{Action: "add", EventTypes: []string{"watchlist.*.process"}, Fields: []TransformField{{"proc", "yes"}}},
+				{Action: "add", EventTypes: []string{"#"}, Fields: []TransformField{{"all", "yes"}}},
+			},
+			msg: map[string]interface{}{"type": "watchlist.hit.process"},
+			expected: map[string]interface{}{
+				"type": "watchlist.hit.process",
+				"proc": "yes",
+				"all":  "yes",
+			},
+		},
+		{
+			desc: "Missing fields are left alone",
+			steps: []*TransformStep{
+				{Action: "rename", Fields: []TransformField{{"md5", "file_hash"}}},
+				{Action: "drop", Fields: []TransformField{{"docs.3.md5", ""}, {"process_name.x", ""}}},
+				{Action: "add", Fields: []TransformField{{"process_name.x", "cannot nest in a string"}}},
+			},
+			msg: map[string]interface{}{"type": "ingress.event.procstart", "process_name": "cmd.exe"},
+			expected: map[string]interface{}{
+				"type":         "ingress.event.procstart",
+				"process_name": "cmd.exe",
+			},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			NewTransformer(test.steps).Process(test.msg)
+			if diff := cmp.Diff(test.expected, test.msg); diff != "" {
+				t.Errorf("event mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMatchRoutingKey(t *testing.T) {
+	for _, test := range []struct {
+		pattern  string
+		key      string
+		expected bool
+	}{
+		{"watchlist.#", "watchlist.hit.process", true},
+		{"watchlist.#", "watchlist", true},
+		{"watchlist.*", "watchlist.hit.process", false},
+		{"watchlist.*", "watchlist.storage", true},
+		{"*.hit.#", "feed.hit.process", true},
+		{"*.hit.#", "alert.watchlist.hit.query.process", false},
+		{"#.process", "watchlist.hit.process", true},
+		{"ingress.event.procstart", "ingress.event.procstart", true},
+		{"ingress.event.procstart", "ingress.event.procend", false},
+	} {
+		if got := matchRoutingKey(test.pattern, test.key); got != test.expected {
+			t.Errorf("matchRoutingKey(%q, %q) = %t, expected %t", test.pattern, test.key, got, test.expected)
+		}
+	}
+}
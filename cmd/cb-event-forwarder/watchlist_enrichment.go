@@ -0,0 +1,162 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Watchlist holds the fields of /api/v1/watchlist that are added to events.
+type Watchlist struct {
+	ID          interface{} `json:"id"`
+	Name        string      `json:"name"`
+	SearchQuery string      `json:"search_query"`
+	IndexType   string      `json:"index_type"`
+}
+
+type WatchlistEnrichmentStatistics struct {
+	Watchlists        int       `json:"watchlists"`
+	LastRefresh       time.Time `json:"last_refresh"`
+	LastError         string    `json:"last_error"`
+	LastErrorTime     time.Time `json:"last_error_time"`
+	RefreshFailures   int64     `json:"refresh_failures"`
+	EnrichedEvents    int64     `json:"enriched_events"`
+	UnknownWatchlists int64     `json:"unknown_watchlists"`
+}
+
+// WatchlistEnricher adds the name, query and index type of the watchlist that fired to watchlist hits and alerts,
+// taken from a snapshot of /api/v1/watchlist that is refreshed in the background.
+type WatchlistEnricher struct {
+	interval time.Duration
+
+	// retrieves a route from the Cb Response REST API; replaced in tests
+	get func(route string) ([]byte, error)
+
+	sync.RWMutex
+	watchlists    map[int]*Watchlist
+	lastRefresh   time.Time
+	lastError     string
+	lastErrorTime time.Time
+
+	refreshFailures   int64
+	enrichedEvents    int64
+	unknownWatchlists int64
+}
+
+func NewWatchlistEnricher(interval time.Duration) *WatchlistEnricher {
+	return &WatchlistEnricher{
+		interval:   interval,
+		get:        GetCb,
+		watchlists: make(map[int]*Watchlist),
+	}
+}
+
+func (e *WatchlistEnricher) Name() string {
+	return "watchlist_enrichment"
+}
+
+func (e *WatchlistEnricher) Start() {
+	startPeriodicRefresh("watchlists", e.interval, e.Refresh, e.LastRefresh)
+}
+
+// Refresh replaces the snapshot with the current list of watchlists.
+func (e *WatchlistEnricher) Refresh() error {
+	err := e.refresh()
+	if err != nil {
+		atomic.AddInt64(&e.refreshFailures, 1)
+		e.Lock()
+		e.lastError = err.Error()
+		e.lastErrorTime = time.Now()
+		e.Unlock()
+	}
+	return err
+}
+
+func (e *WatchlistEnricher) refresh() error {
+	body, err := e.get("api/v1/watchlist")
+	if err != nil {
+		return err
+	}
+	var watchlistList []*Watchlist
+	if err := decodeAPIResponse(body, &watchlistList); err != nil {
+		return err
+	}
+
+	watchlists := make(map[int]*Watchlist, len(watchlistList))
+	for _, watchlist := range watchlistList {
+		if id, ok := intFromEvent(watchlist.ID); ok {
+			watchlist.SearchQuery = watchlistQuery(watchlist.SearchQuery)
+			watchlists[id] = watchlist
+		}
+	}
+
+	e.Lock()
+	e.watchlists = watchlists
+	e.lastRefresh = time.Now()
+	e.Unlock()
+
+	log.Debugf("Loaded %d watchlists", len(watchlists))
+	return nil
+}
+
+// watchlistQuery returns the query from a watchlist's search_query, which is stored URL encoded along with other
+// search parameters, for example "q=process_name%3Acmd.exe&cb.urlver=1".
+func watchlistQuery(searchQuery string) string {
+	values, err := url.ParseQuery(searchQuery)
+	if err != nil || values.Get("q") == "" {
+		return searchQuery
+	}
+	return values.Get("q")
+}
+
+func (e *WatchlistEnricher) LastRefresh() time.Time {
+	e.RLock()
+	defer e.RUnlock()
+	return e.lastRefresh
+}
+
+// Process adds watchlist_name, watchlist_query and watchlist_index_type to events carrying a watchlist_id. A
+// watchlist_name already present in the event is kept.
+func (e *WatchlistEnricher) Process(msg map[string]interface{}) bool {
+	watchlistID, ok := intFromEvent(msg["watchlist_id"])
+	if !ok {
+		return true
+	}
+
+	e.RLock()
+	watchlist, ok := e.watchlists[watchlistID]
+	e.RUnlock()
+
+	if !ok {
+		atomic.AddInt64(&e.unknownWatchlists, 1)
+		return true
+	}
+
+	// only strings are copied into the event, so later stages changing it cannot change the snapshot; fields with
+	// nested values would need to be copied with deepcopy.Iface, as the sensor enricher does
+	if _, present := msg["watchlist_name"]; !present {
+		msg["watchlist_name"] = watchlist.Name
+	}
+	msg["watchlist_query"] = watchlist.SearchQuery
+	msg["watchlist_index_type"] = watchlist.IndexType
+	atomic.AddInt64(&e.enrichedEvents, 1)
+
+	return true
+}
+
+func (e *WatchlistEnricher) Statistics() interface{} {
+	e.RLock()
+	defer e.RUnlock()
+
+	return WatchlistEnrichmentStatistics{
+		Watchlists:        len(e.watchlists),
+		LastRefresh:       e.lastRefresh,
+		LastError:         e.lastError,
+		LastErrorTime:     e.lastErrorTime,
+		RefreshFailures:   atomic.LoadInt64(&e.refreshFailures),
+		EnrichedEvents:    atomic.LoadInt64(&e.enrichedEvents),
+		UnknownWatchlists: atomic.LoadInt64(&e.unknownWatchlists),
+	}
+}
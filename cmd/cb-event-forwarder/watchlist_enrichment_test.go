@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const testWatchlistList = `[
+	{"id": "2", "name": "Non-System Filemods to system32", "index_type": "events",
+	 "search_query": "q=filemod%3Asystem32%20-process_name%3Asvchost.exe&cb.urlver=1"},
+	{"id": "2812", "name": "google", "index_type": "modules", "search_query": "q=company_name%3Agoogle&cb.urlver=1"}
+]`
+
+func TestWatchlistEnricherProcess(t *testing.T) {
+	for _, test := range []struct {
+		desc     string
+		msg      map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			desc: "Watchlist hit",
+			msg: map[string]interface{}{
+				"type":           "watchlist.hit.process",
+				"watchlist_id":   json.Number("2"),
+				"watchlist_name": "Non-System Filemods to system32",
+			},
+			expected: map[string]interface{}{
+				"type":                 "watchlist.hit.process",
+				"watchlist_id":         json.Number("2"),
+				"watchlist_name":       "Non-System Filemods to system32",
+				"watchlist_query":      "filemod:system32 -process_name:svchost.exe",
+				"watchlist_index_type": "events",
+			},
+		},
+		{
+			desc: "Alert with the watchlist id as a string",
+			msg: map[string]interface{}{
+				"type":         "alert.watchlist.hit.query.binary",
+				"watchlist_id": "2812",
+				"feed_id":      "-1",
+			},
+			expected: map[string]interface{}{
+				"type":                 "alert.watchlist.hit.query.binary",
+				"watchlist_id":         "2812",
+				"feed_id":              "-1",
+				"watchlist_name":       "google",
+				"watchlist_query":      "company_name:google",
+				"watchlist_index_type": "modules",
+			},
+		},
+		{
+			desc:     "Unknown watchlist",
+			msg:      map[string]interface{}{"type": "watchlist.hit.binary", "watchlist_id": json.Number("4")},
+			expected: map[string]interface{}{"type": "watchlist.hit.binary", "watchlist_id": json.Number("4")},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			e := NewWatchlistEnricher(time.Minute)
+			e.get = func(route string) ([]byte, error) {
+				return []byte(testWatchlistList), nil
+			}
+			if err := e.Refresh(); err != nil {
+				t.Fatal(err)
+			}
+
+			e.Process(test.msg)
+			if diff := cmp.Diff(test.expected, test.msg); diff != "" {
+				t.Errorf("event mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestWatchlistEnricherKeepsItsOwnCopy(t *testing.T) {
+	e := NewWatchlistEnricher(time.Minute)
+	e.get = func(route string) ([]byte, error) {
+		return []byte(testWatchlistList), nil
+	}
+	if err := e.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	// later stages changing the first event in place
+	first := map[string]interface{}{"type": "watchlist.hit.process", "watchlist_id": json.Number("2812")}
+	e.Process(first)
+	first["watchlist_name"] = "redacted"
+	first["watchlist_query"] = "redacted"
+
+	second := map[string]interface{}{"type": "watchlist.hit.process", "watchlist_id": json.Number("2812")}
+	e.Process(second)
+	if second["watchlist_name"] != "google" || second["watchlist_query"] != "company_name:google" {
+		t.Errorf("expected the snapshot to be unchanged, got %v", second)
+	}
+}
+
+func TestReportLookupIDs(t *testing.T) {
+	for _, test := range []struct {
+		desc             string
+		msg              map[string]interface{}
+		expectedFeedID   int
+		expectedReportID string
+		expectedOK       bool
+	}{
+		{
+			desc: "Feed hit",
+			msg: map[string]interface{}{"type": "feed.ingress.hit.binary", "feed_id": json.Number("33"),
+				"report_id": "Binary_449571D58547F434FAF544F2BAF2FA4C"},
+			expectedFeedID:   33,
+			expectedReportID: "Binary_449571D58547F434FAF544F2BAF2FA4C",
+			expectedOK:       true,
+		},
+		{
+			desc: "Feed alert",
+			msg: map[string]interface{}{"type": "alert.watchlist.hit.ingress.process", "feed_id": "24",
+				"report_id": "report-1", "watchlist_id": "11"},
+			expectedFeedID:   24,
+			expectedReportID: "report-1",
+			expectedOK:       true,
+		},
+		{
+			desc: "Watchlist alert is not looked up as a report",
+			msg: map[string]interface{}{"type": "alert.watchlist.hit.query.binary", "feed_id": "-1",
+				"watchlist_id": "2812"},
+		},
+		{
+			desc: "Watchlist hit",
+			msg:  map[string]interface{}{"type": "watchlist.hit.process", "watchlist_id": json.Number("2")},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			feedID, reportID, ok := reportLookupIDs(test.msg)
+			if feedID != test.expectedFeedID || reportID != test.expectedReportID || ok != test.expectedOK {
+				t.Errorf("expected (%d, %q, %t), got (%d, %q, %t)", test.expectedFeedID, test.expectedReportID,
+					test.expectedOK, feedID, reportID, ok)
+			}
+		})
+	}
+}
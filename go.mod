@@ -1,6 +1,7 @@
 module github.com/carbonblack/cb-event-forwarder
 
 require (
+	filippo.io/age v1.2.1
 	github.com/RackSec/srslog v0.0.0-20180514150917-1f7cff998e92
 	github.com/aws/aws-sdk-go v1.13.49
 	github.com/confluentinc/confluent-kafka-go v0.11.4
@@ -8,21 +9,19 @@ require (
 	github.com/go-ini/ini v1.36.0
 	github.com/golang/protobuf v1.2.0
 	github.com/golang/snappy v0.0.0-20170215233205-553a64147049
-	github.com/gregjones/httpcache v0.0.0-20181110185634-c63ab54fda8f
-	github.com/hpcloud/tail v1.0.0
 	github.com/jmespath/go-jmespath v0.0.0-20160202185014-0b12d6b521d8
+	github.com/oschwald/maxminddb-golang v1.12.0
 	github.com/pierrec/lz4 v0.0.0-20171218195038-2fcda4cb7018
 	github.com/pierrec/xxHash v0.1.1
 	github.com/rcrowley/go-metrics v0.0.0-20180125231941-8732c616f529
 	github.com/sirupsen/logrus v1.0.5
 	github.com/streadway/amqp v0.0.0-20180315184602-8e4aba63da9f
 	github.com/vaughan0/go-ini v0.0.0-20130923145212-a98ad7ee00ec
-	golang.org/x/crypto v0.0.0-20180322175230-88942b9c40a4
-	golang.org/x/net v0.0.0-20181207154023-610586996380 // indirect
+	golang.org/x/crypto v0.24.0
+	golang.org/x/net v0.0.0-20181207154023-610586996380
 	golang.org/x/oauth2 v0.0.0-20181203162652-d668ce993890
-	golang.org/x/sys v0.0.0-20180329131831-378d26f46672
-	gopkg.in/fsnotify.v1 v1.4.7 // indirect
+	golang.org/x/sys v0.21.0
 	gopkg.in/h2non/filetype.v1 v1.0.5
-	gopkg.in/tomb.v1 v1.0.0-20141024135613-dd632973f1e7
+	gopkg.in/yaml.v2 v2.4.0
 	zvelo.io/ttlru v1.0.2
 )